@@ -0,0 +1,64 @@
+package main
+
+import (
+	"strings"
+)
+
+// ItemACL grants access to an item beyond its owner. Entries are principal IDs
+// ("key:…", "jwt:…"), groups ("group:<name>") or "*" for everyone in the tenant.
+// An item with an ACL is private to its owner, administrators and the entries
+// listed; write access implies read access. Items without an ACL are open to
+// every caller whose scopes allow the operation.
+type ItemACL struct {
+	Read  []string `json:"read,omitempty"`
+	Write []string `json:"write,omitempty"`
+}
+
+// validate checks that every entry is a principal ID, a group or "*".
+func (acl *ItemACL) validate() error {
+	if acl == nil {
+		return nil
+	}
+	for _, entry := range append(append([]string{}, acl.Read...), acl.Write...) {
+		prefix, name, ok := strings.Cut(entry, ":")
+		if entry == "*" || (ok && name != "" && (prefix == "group" || prefix == "key" || prefix == "jwt")) {
+			continue
+		}
+		return &inputError{"acl entries must be \"*\", \"group:<name>\" or a principal ID such as \"key:<id>\" or \"jwt:<subject>\""}
+	}
+	return nil
+}
+
+// canUse reports whether the principal may perform an operation needing scope
+// on item under the item's owner and ACL.
+func (p *Principal) canUse(scope string, item *Item) bool {
+	if item.ACL == nil || p.Allows(ScopeAdmin) || p.owns(item) {
+		return true
+	}
+	entries := item.ACL.Write
+	if scope == ScopeRead {
+		entries = append(append([]string{}, item.ACL.Read...), item.ACL.Write...)
+	}
+	for _, entry := range entries {
+		if p.matches(entry) {
+			return true
+		}
+	}
+	return false
+}
+
+// owns reports whether the principal created item.
+func (p *Principal) owns(item *Item) bool {
+	return item.Owner != "" && item.Owner == p.ID
+}
+
+// matches reports whether an ACL entry names the principal or one of its groups.
+func (p *Principal) matches(entry string) bool {
+	if entry == "*" || entry == p.ID {
+		return true
+	}
+	if group, ok := strings.CutPrefix(entry, "group:"); ok {
+		return containsString(p.Groups, group)
+	}
+	return false
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// TestItemACLs checks that items record their owner and that ACLs restrict
+// reads, writes, listings and ACL changes to the identities and groups granted.
+func TestItemACLs(t *testing.T) {
+	owner := newKey(t, testAPIKey, `{"name":"owner","scopes":["read","write","delete"]}`)
+	editor := newKey(t, testAPIKey, `{"name":"editor","scopes":["read","write","delete"],"groups":["editors"]}`)
+	outsider := newKey(t, testAPIKey, `{"name":"outsider","scopes":["read","write","delete"]}`)
+
+	if status, _ := call(t, owner.Secret, http.MethodPost, "/items", `{"type":"acl","data":{},"acl":{"read":["bob"]}}`); status != http.StatusBadRequest {
+		t.Errorf("malformed acl entry: expected 400, got %d", status)
+	}
+	status, b := call(t, owner.Secret, http.MethodPost, "/items", `{"type":"acl","data":{"v":1},"acl":{"write":["group:editors"]}}`)
+	if status != http.StatusCreated {
+		t.Fatalf("create private item: status %d %s", status, b)
+	}
+	var private Item
+	json.Unmarshal(b, &private)
+	if private.Owner != "key:"+owner.ID {
+		t.Errorf("expected owner key:%s, got %q", owner.ID, private.Owner)
+	}
+	_, b = call(t, owner.Secret, http.MethodPost, "/items", `{"type":"acl","data":{"v":1}}`)
+	var open Item
+	json.Unmarshal(b, &open)
+
+	if status, _ := call(t, outsider.Secret, http.MethodGet, "/items/"+private.ID, ""); status != http.StatusForbidden {
+		t.Errorf("outsider reading private item: expected 403, got %d", status)
+	}
+	if status, _ := call(t, outsider.Secret, http.MethodGet, "/items/"+open.ID, ""); status != http.StatusOK {
+		t.Errorf("outsider reading item without acl: expected 200, got %d", status)
+	}
+	_, b = call(t, outsider.Secret, http.MethodGet, "/items?type=acl", "")
+	var listed []Item
+	json.Unmarshal(b, &listed)
+	if len(listed) != 1 || listed[0].ID != open.ID {
+		t.Errorf("outsider should list only the open item, got %+v", listed)
+	}
+	if status, _ := call(t, outsider.Secret, http.MethodDelete, "/items/"+private.ID, ""); status != http.StatusForbidden {
+		t.Errorf("outsider deleting private item: expected 403, got %d", status)
+	}
+
+	if status, b := call(t, editor.Secret, http.MethodPut, "/items/"+private.ID, `{"type":"acl","data":{"v":2}}`); status != http.StatusOK {
+		t.Errorf("group editor updating: status %d %s", status, b)
+	}
+	status, b = call(t, editor.Secret, http.MethodPut, "/items/"+private.ID, `{"type":"acl","data":{"v":3},"acl":{"read":["*"]}}`)
+	if status != http.StatusForbidden || !strings.Contains(string(b), "only the owner") {
+		t.Errorf("editor changing acl: got %d %s", status, b)
+	}
+	if status, _ := call(t, owner.Secret, http.MethodPut, "/items/"+private.ID, `{"type":"acl","data":{"v":3},"acl":{"read":["*"]}}`); status != http.StatusOK {
+		t.Errorf("owner changing acl: expected 200, got %d", status)
+	}
+	if status, _ := call(t, outsider.Secret, http.MethodGet, "/items/"+private.ID, ""); status != http.StatusOK {
+		t.Errorf("outsider reading item shared with everyone: expected 200, got %d", status)
+	}
+	if status, _ := call(t, outsider.Secret, http.MethodPut, "/items/"+private.ID, `{"type":"acl","data":{}}`); status != http.StatusForbidden {
+		t.Errorf("outsider writing read-shared item: expected 403, got %d", status)
+	}
+	if status, _ := call(t, testAPIKey, http.MethodGet, "/items/"+private.ID, ""); status != http.StatusOK {
+		t.Errorf("admin reading private item: expected 200, got %d", status)
+	}
+
+	for _, id := range []string{private.ID, open.ID} {
+		call(t, testAPIKey, http.MethodDelete, "/items/"+id, "")
+	}
+}
+
+// TestAuthorizeWithoutPrincipal checks that handlers reached without
+// authentication refuse the request instead of skipping the checks.
+func TestAuthorizeWithoutPrincipal(t *testing.T) {
+	item := &Item{ID: "a", Type: "note", ACL: &ItemACL{Read: []string{"key:other"}}}
+	if err := authorize(testCtx, ScopeRead, nil); !errors.Is(err, ErrForbidden) {
+		t.Errorf("expected a request without a caller to be forbidden, got %v", err)
+	}
+	if err := authorize(withPrincipal(testCtx, systemPrincipal), ScopeDelete, item); err != nil {
+		t.Errorf("expected the system principal to be allowed, got %v", err)
+	}
+}
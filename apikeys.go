@@ -0,0 +1,465 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// apiKeyPrefix starts every generated key secret: gck_<key id>_<random>.
+const apiKeyPrefix = "gck_"
+
+// keyInvalidationChannel is the Redis pub/sub channel carrying the IDs of
+// keys whose record changed, so that every replica drops its cached lookups.
+const keyInvalidationChannel = "apikeys:invalidate"
+
+// APIKey is the stored record of an API key. Only a salted hash of the secret is kept.
+type APIKey struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Tenant     string     `json:"tenant,omitempty"`
+	Scopes     []string   `json:"scopes"`
+	Types      []string   `json:"types,omitempty"`
+	Tags       []string   `json:"tags,omitempty"`
+	Groups     []string   `json:"groups,omitempty"`
+	RateLimit  int        `json:"rateLimit,omitempty"`
+	Salt       string     `json:"salt,omitempty"`
+	Hash       string     `json:"hash,omitempty"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	ExpiresAt  *time.Time `json:"expiresAt,omitempty"`
+	RevokedAt  *time.Time `json:"revokedAt,omitempty"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+}
+
+// CreateKeyRequest is the payload for creating an API key. Types and Tags
+// optionally limit the key to items of those types or carrying those tags.
+// Groups are matched by "group:<name>" entries in item ACLs. RateLimit, in
+// requests per minute, overrides the server's limits for the key.
+// Tenant defaults to the caller's tenant; only system administrators may pick another.
+type CreateKeyRequest struct {
+	Name      string     `json:"name"`
+	Tenant    string     `json:"tenant"`
+	Scopes    []string   `json:"scopes"`
+	Types     []string   `json:"types"`
+	Tags      []string   `json:"tags"`
+	Groups    []string   `json:"groups"`
+	RateLimit int        `json:"rateLimit"`
+	ExpiresAt *time.Time `json:"expiresAt"`
+}
+
+// validate checks the fields of a create request that do not depend on the caller.
+func (req *CreateKeyRequest) validate() error {
+	if strings.TrimSpace(req.Name) == "" {
+		return &inputError{"name is required"}
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		return &inputError{"expiresAt must be in the future"}
+	}
+	if req.RateLimit < 0 {
+		return &inputError{"rateLimit must not be negative"}
+	}
+	if len(req.Scopes) == 0 {
+		return &inputError{"scopes is required"}
+	}
+	for _, scope := range req.Scopes {
+		if !validScope(scope) {
+			return &inputError{fmt.Sprintf("unknown scope: %q", scope)}
+		}
+	}
+	return nil
+}
+
+// CreateKeyResponse returns the key record together with its secret, which is never shown again.
+type CreateKeyResponse struct {
+	*APIKey
+	Secret string `json:"secret"`
+}
+
+// Active reports whether the key may authenticate at time now.
+func (k *APIKey) Active(now time.Time) bool {
+	return k.RevokedAt == nil && (k.ExpiresAt == nil || now.Before(*k.ExpiresAt))
+}
+
+// EffectiveScopes returns the key's scopes. Keys created before scopes existed
+// keep the read, write and delete access they always had.
+func (k *APIKey) EffectiveScopes() []string {
+	if len(k.Scopes) == 0 {
+		return []string{ScopeRead, ScopeWrite, ScopeDelete}
+	}
+	return k.Scopes
+}
+
+// redacted returns a copy of k without its salt and hash.
+func (k *APIKey) redacted() *APIKey {
+	c := *k
+	c.Salt, c.Hash = "", ""
+	return &c
+}
+
+// KeyStore persists API keys in Redis.
+type KeyStore struct {
+	client redis.UniversalClient
+}
+
+// NewKeyStore creates a new KeyStore.
+func NewKeyStore(client redis.UniversalClient) *KeyStore {
+	return &KeyStore{client: client}
+}
+
+// CreateKey generates a new key from req and returns its record and secret.
+func (s *KeyStore) CreateKey(ctx context.Context, req CreateKeyRequest) (*APIKey, string, error) {
+	idBytes := make([]byte, 6)
+	if _, err := rand.Read(idBytes); err != nil {
+		return nil, "", err
+	}
+	key := &APIKey{
+		ID:        hex.EncodeToString(idBytes),
+		Name:      req.Name,
+		Tenant:    req.Tenant,
+		Scopes:    req.Scopes,
+		Types:     req.Types,
+		Tags:      req.Tags,
+		Groups:    req.Groups,
+		RateLimit: req.RateLimit,
+		CreatedAt: time.Now().UTC(),
+		ExpiresAt: req.ExpiresAt,
+	}
+	secret, err := s.setSecret(key)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := s.saveKey(ctx, key); err != nil {
+		return nil, "", err
+	}
+	return key, secret, nil
+}
+
+// RotateKey replaces the secret of an active key, invalidating the old one.
+func (s *KeyStore) RotateKey(ctx context.Context, id string) (*APIKey, string, error) {
+	key, err := s.GetKey(ctx, id)
+	if err != nil {
+		return nil, "", err
+	}
+	if !key.Active(time.Now()) {
+		return nil, "", &inputError{"cannot rotate a revoked or expired key"}
+	}
+	secret, err := s.setSecret(key)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := s.saveKey(ctx, key); err != nil {
+		return nil, "", err
+	}
+	return key, secret, nil
+}
+
+// RevokeKey marks a key as revoked. The record is kept for the audit trail.
+func (s *KeyStore) RevokeKey(ctx context.Context, id string) error {
+	key, err := s.GetKey(ctx, id)
+	if err != nil {
+		return err
+	}
+	if key.RevokedAt == nil {
+		now := time.Now().UTC()
+		key.RevokedAt = &now
+	}
+	return s.saveKey(ctx, key)
+}
+
+// GetKey retrieves a key record by ID.
+func (s *KeyStore) GetKey(ctx context.Context, id string) (*APIKey, error) {
+	pipe := s.client.Pipeline()
+	get := pipe.Get(ctx, fmt.Sprintf("apikey:%s", id))
+	lastUsed := pipe.HGet(ctx, "apikeys:lastused", id)
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, err
+	}
+	data, err := get.Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	var key APIKey
+	if err := json.Unmarshal([]byte(data), &key); err != nil {
+		return nil, err
+	}
+	if ms, err := lastUsed.Int64(); err == nil {
+		t := time.UnixMilli(ms).UTC()
+		key.LastUsedAt = &t
+	}
+	return &key, nil
+}
+
+// ListKeys returns all key records.
+func (s *KeyStore) ListKeys(ctx context.Context) ([]*APIKey, error) {
+	ids, err := s.client.SMembers(ctx, "apikeys").Result()
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]*APIKey, 0, len(ids))
+	for _, id := range ids {
+		key, err := s.GetKey(ctx, id)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// Verify resolves a presented secret to its active key record.
+func (s *KeyStore) Verify(ctx context.Context, secret string) (*APIKey, error) {
+	id, ok := keyIDFromSecret(secret)
+	if !ok {
+		return nil, ErrInvalidCredentials
+	}
+	key, err := s.GetKey(ctx, id)
+	if err == ErrNotFound {
+		return nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal([]byte(hashSecret(key.Salt, secret)), []byte(key.Hash)) || !key.Active(time.Now()) {
+		return nil, ErrInvalidCredentials
+	}
+	return key, nil
+}
+
+// TouchKey records that the key was just used.
+func (s *KeyStore) TouchKey(ctx context.Context, id string, at time.Time) error {
+	return s.client.HSet(ctx, "apikeys:lastused", id, at.UnixMilli()).Err()
+}
+
+// setSecret generates a new secret for key and stores its salted hash on the record.
+func (s *KeyStore) setSecret(key *APIKey) (string, error) {
+	buf := make([]byte, 48)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	salt, random := buf[:16], buf[16:]
+	secret := apiKeyPrefix + key.ID + "_" + base64.RawURLEncoding.EncodeToString(random)
+	key.Salt = hex.EncodeToString(salt)
+	key.Hash = hashSecret(key.Salt, secret)
+	return secret, nil
+}
+
+func (s *KeyStore) saveKey(ctx context.Context, key *APIKey) error {
+	stored := *key
+	stored.LastUsedAt = nil // tracked separately so authentication doesn't rewrite the record
+	data, err := json.Marshal(&stored)
+	if err != nil {
+		return err
+	}
+	pipe := s.client.Pipeline()
+	pipe.Set(ctx, fmt.Sprintf("apikey:%s", key.ID), data, 0)
+	pipe.SAdd(ctx, "apikeys", key.ID)
+	pipe.Publish(ctx, keyInvalidationChannel, key.ID)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// hashSecret returns the hex HMAC-SHA256 of secret keyed with the hex salt.
+// Secrets are long random strings, so a fast keyed hash is sufficient.
+func hashSecret(salt, secret string) string {
+	mac := hmac.New(sha256.New, []byte(salt))
+	mac.Write([]byte(secret))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// keyIDFromSecret extracts the key ID from a gck_<id>_<random> secret.
+func keyIDFromSecret(secret string) (string, bool) {
+	rest, ok := strings.CutPrefix(secret, apiKeyPrefix)
+	if !ok {
+		return "", false
+	}
+	id, random, ok := strings.Cut(rest, "_")
+	if !ok || id == "" || random == "" {
+		return "", false
+	}
+	return id, true
+}
+
+// KeyHandler serves the admin endpoints for managing API keys. Tenant
+// administrators only see and manage the keys of their own tenant.
+type KeyHandler struct {
+	store   *KeyStore
+	tenants *TenantStore
+	auth    *Authenticator
+	logger  *slog.Logger
+}
+
+// NewKeyHandler creates a KeyHandler; auth's cache is invalidated on revoke and rotate.
+func NewKeyHandler(store *KeyStore, tenants *TenantStore, auth *Authenticator, logger *slog.Logger) *KeyHandler {
+	return &KeyHandler{store: store, tenants: tenants, auth: auth, logger: logger}
+}
+
+// visibleKey loads a key, reporting keys of other tenants as not found
+// unless the caller administers the default tenant.
+func (h *KeyHandler) visibleKey(ctx context.Context, id string) (*APIKey, error) {
+	key, err := h.store.GetKey(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if t := tenantFrom(ctx); t != "" && key.Tenant != t {
+		return nil, ErrNotFound
+	}
+	return key, nil
+}
+
+// keysHandler routes requests without ID: GET for list, POST for create.
+func (h *KeyHandler) keysHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		h.handleListKeys(w, r)
+	case http.MethodPost:
+		h.handleCreateKey(w, r)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// keyHandler routes /keys/{id} (GET, DELETE) and /keys/{id}/rotate (POST).
+func (h *KeyHandler) keyHandler(w http.ResponseWriter, r *http.Request) {
+	id, sub, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/keys/"), "/")
+	if id == "" {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	switch {
+	case sub == "" && r.Method == http.MethodGet:
+		h.handleGetKey(w, r, id)
+	case sub == "" && r.Method == http.MethodDelete:
+		h.handleRevokeKey(w, r, id)
+	case sub == "":
+		w.Header().Set("Allow", "GET, DELETE")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	case sub != "rotate":
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+	case r.Method != http.MethodPost:
+		w.Header().Set("Allow", "POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	default:
+		h.handleRotateKey(w, r, id)
+	}
+}
+
+// handleCreateKey processes POST /keys.
+func (h *KeyHandler) handleCreateKey(w http.ResponseWriter, r *http.Request) {
+	var req CreateKeyRequest
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request payload: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := ensureSingleJSON(dec); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := req.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if caller := tenantFrom(r.Context()); caller != "" {
+		if req.Tenant != "" && req.Tenant != caller {
+			http.Error(w, "api keys can only be created in your own tenant", http.StatusForbidden)
+			return
+		}
+		req.Tenant = caller
+	}
+	if ok, err := h.tenants.Exists(r.Context(), req.Tenant); err != nil || !ok {
+		if err == nil {
+			err = &inputError{fmt.Sprintf("unknown tenant: %q", req.Tenant)}
+		}
+		writeError(w, r, h.logger, err, "error checking tenant")
+		return
+	}
+
+	key, secret, err := h.store.CreateKey(r.Context(), req)
+	if err != nil {
+		writeError(w, r, h.logger, err, "error creating api key")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", fmt.Sprintf("/keys/%s", key.ID))
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(CreateKeyResponse{APIKey: key.redacted(), Secret: secret})
+}
+
+// handleGetKey processes GET /keys/{id}.
+func (h *KeyHandler) handleGetKey(w http.ResponseWriter, r *http.Request, id string) {
+	key, err := h.visibleKey(r.Context(), id)
+	if err != nil {
+		writeError(w, r, h.logger, err, "error getting api key")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(key.redacted())
+}
+
+// handleListKeys processes GET /keys.
+func (h *KeyHandler) handleListKeys(w http.ResponseWriter, r *http.Request) {
+	keys, err := h.store.ListKeys(r.Context())
+	if err != nil {
+		writeError(w, r, h.logger, err, "error listing api keys")
+		return
+	}
+	visible := make([]*APIKey, 0, len(keys))
+	for _, key := range keys {
+		if t := tenantFrom(r.Context()); t == "" || key.Tenant == t {
+			visible = append(visible, key.redacted())
+		}
+	}
+	keys = visible
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(keys)
+}
+
+// handleRevokeKey processes DELETE /keys/{id}.
+func (h *KeyHandler) handleRevokeKey(w http.ResponseWriter, r *http.Request, id string) {
+	if _, err := h.visibleKey(r.Context(), id); err != nil {
+		writeError(w, r, h.logger, err, "error getting api key")
+		return
+	}
+	if err := h.store.RevokeKey(r.Context(), id); err != nil {
+		writeError(w, r, h.logger, err, "error revoking api key")
+		return
+	}
+	h.auth.Invalidate(id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleRotateKey processes POST /keys/{id}/rotate.
+func (h *KeyHandler) handleRotateKey(w http.ResponseWriter, r *http.Request, id string) {
+	if _, err := h.visibleKey(r.Context(), id); err != nil {
+		writeError(w, r, h.logger, err, "error getting api key")
+		return
+	}
+	key, secret, err := h.store.RotateKey(r.Context(), id)
+	if err != nil {
+		writeError(w, r, h.logger, err, "error rotating api key")
+		return
+	}
+	h.auth.Invalidate(id)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(CreateKeyResponse{APIKey: key.redacted(), Secret: secret})
+}
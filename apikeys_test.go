@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestAPIKeyManagement creates, uses, rotates and revokes a stored API key.
+func TestAPIKeyManagement(t *testing.T) {
+	admin := &http.Client{Transport: &authTransport{token: testAPIKey, base: http.DefaultTransport}}
+	statusWith := func(token, method, path string) int {
+		t.Helper()
+		req, _ := http.NewRequest(method, testServerURL+path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	resp, err := admin.Post(testServerURL+"/keys", "application/json", bytes.NewReader([]byte(`{"name":"ci","scopes":["read"]}`)))
+	if err != nil {
+		t.Fatalf("POST /keys: %v", err)
+	}
+	if resp.StatusCode != http.StatusCreated {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("POST /keys status %d: %s", resp.StatusCode, body)
+	}
+	var created CreateKeyResponse
+	json.NewDecoder(resp.Body).Decode(&created)
+	resp.Body.Close()
+	if !strings.HasPrefix(created.Secret, apiKeyPrefix+created.ID+"_") || created.Hash != "" {
+		t.Fatalf("unexpected create response: %+v", created)
+	}
+
+	if got := statusWith(created.Secret, http.MethodGet, "/items"); got != http.StatusOK {
+		t.Errorf("GET /items with stored key: status %d", got)
+	}
+	if got := statusWith(created.Secret, http.MethodGet, "/keys"); got != http.StatusForbidden {
+		t.Errorf("GET /keys with non-admin key: expected 403, got %d", got)
+	}
+
+	resp, _ = admin.Get(testServerURL + "/keys/" + created.ID)
+	raw, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	var fetched APIKey
+	json.Unmarshal(raw, &fetched)
+	if fetched.LastUsedAt == nil || bytes.Contains(raw, []byte(`"hash"`)) || bytes.Contains(raw, []byte(`"salt"`)) {
+		t.Errorf("unexpected key record: %s", raw)
+	}
+
+	resp, _ = admin.Post(testServerURL+"/keys/"+created.ID+"/rotate", "application/json", nil)
+	var rotated CreateKeyResponse
+	json.NewDecoder(resp.Body).Decode(&rotated)
+	resp.Body.Close()
+	if rotated.Secret == "" || rotated.Secret == created.Secret {
+		t.Fatalf("rotate did not issue a new secret: %+v", rotated)
+	}
+	if got := statusWith(created.Secret, http.MethodGet, "/items"); got != http.StatusUnauthorized {
+		t.Errorf("old secret after rotate: expected 401, got %d", got)
+	}
+	if got := statusWith(rotated.Secret, http.MethodGet, "/items"); got != http.StatusOK {
+		t.Errorf("new secret after rotate: status %d", got)
+	}
+
+	if got := statusWith(testAPIKey, http.MethodDelete, "/keys/"+created.ID); got != http.StatusNoContent {
+		t.Errorf("DELETE /keys/%s: status %d", created.ID, got)
+	}
+	if got := statusWith(rotated.Secret, http.MethodGet, "/items"); got != http.StatusUnauthorized {
+		t.Errorf("revoked key: expected 401, got %d", got)
+	}
+	if got := statusWith("gck_"+created.ID+"_forged", http.MethodGet, "/items"); got != http.StatusUnauthorized {
+		t.Errorf("forged key: expected 401, got %d", got)
+	}
+}
+
+// TestAPIKeyScopes checks that scopes and type limits are enforced with 403s,
+// that lists are restricted, and that scopes reach the audit trail.
+func TestAPIKeyScopes(t *testing.T) {
+	if got, _ := call(t, testAPIKey, http.MethodPost, "/keys", `{"name":"x","scopes":["superuser"]}`); got != http.StatusBadRequest {
+		t.Errorf("unknown scope: expected 400, got %d", got)
+	}
+
+	reader := newKey(t, testAPIKey, `{"name":"reader","scopes":["read"]}`).Secret
+	writer := newKey(t, testAPIKey, `{"name":"writer","scopes":["read","write"],"types":["scoped"]}`).Secret
+
+	if got, body := call(t, reader, http.MethodPost, "/items", `{"type":"scoped","data":{}}`); got != http.StatusForbidden || !strings.Contains(string(body), `"write" scope`) {
+		t.Errorf("create with read-only key: got %d %q", got, body)
+	}
+	if got, body := call(t, writer, http.MethodPost, "/items", `{"type":"other","data":{}}`); got != http.StatusForbidden || !strings.Contains(string(body), "limited to item types scoped") {
+		t.Errorf("create outside type limit: got %d %q", got, body)
+	}
+	got, body := call(t, writer, http.MethodPost, "/items", `{"type":"scoped","data":{}}`)
+	if got != http.StatusCreated {
+		t.Fatalf("create within limits: got %d %q", got, body)
+	}
+	var scoped Item
+	json.Unmarshal(body, &scoped)
+	_, body = call(t, testAPIKey, http.MethodPost, "/items", `{"type":"other","data":{}}`)
+	var other Item
+	json.Unmarshal(body, &other)
+
+	if got, _ := call(t, writer, http.MethodGet, "/items/"+other.ID, ""); got != http.StatusForbidden {
+		t.Errorf("read outside type limit: expected 403, got %d", got)
+	}
+	_, body = call(t, writer, http.MethodGet, "/items", "")
+	var listed []Item
+	json.Unmarshal(body, &listed)
+	for _, it := range listed {
+		if it.Type != "scoped" {
+			t.Errorf("list leaked item of type %q", it.Type)
+		}
+	}
+	if got, _ := call(t, writer, http.MethodDelete, "/items/"+scoped.ID, ""); got != http.StatusForbidden {
+		t.Errorf("delete without delete scope: expected 403, got %d", got)
+	}
+	if got, _ := call(t, writer, http.MethodGet, "/audit", ""); got != http.StatusForbidden {
+		t.Errorf("audit without admin scope: expected 403, got %d", got)
+	}
+
+	_, body = call(t, testAPIKey, http.MethodGet, "/audit?itemId="+scoped.ID, "")
+	var entries []AuditEntry
+	json.Unmarshal(body, &entries)
+	if len(entries) != 1 || strings.Join(entries[0].Scopes, ",") != "read,write" {
+		t.Errorf("expected audit entry with writer scopes, got %+v", entries)
+	}
+
+	for _, id := range []string{scoped.ID, other.ID} {
+		call(t, testAPIKey, http.MethodDelete, "/items/"+id, "")
+	}
+}
+
+// TestKeyRevocationReachesReplicas checks that a key revoked through one
+// replica stops being accepted by another that has it cached.
+func TestKeyRevocationReachesReplicas(t *testing.T) {
+	keys := NewKeyStore(redisClient)
+	replica := NewAuthenticator(nil, keys, newTestLogger())
+	replica.CacheTTL = time.Hour
+	ctx, cancel := context.WithCancel(testCtx)
+	defer cancel()
+	if err := replica.Start(ctx); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	key, secret, err := keys.CreateKey(testCtx, CreateKeyRequest{Name: "replicated", Scopes: []string{ScopeRead}})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if _, err := replica.Authenticate(testCtx, secret); err != nil {
+		t.Fatalf("authenticate: %v", err)
+	}
+	if err := keys.RevokeKey(testCtx, key.ID); err != nil {
+		t.Fatalf("revoke: %v", err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for _, err = replica.Authenticate(testCtx, secret); err == nil && time.Now().Before(deadline); _, err = replica.Authenticate(testCtx, secret) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("expected the revoked key to be rejected by the other replica, got %v", err)
+	}
+}
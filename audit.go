@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// auditStreamKey is the append-only Redis stream holding a tenant's audit
+// entries. Each entry is also added, under the same ID, to the streams of its
+// item and of its actor, which answer queries filtered by either.
+const (
+	auditStreamKey      = "audit"
+	auditItemStreamKey  = "audit:item:%s"
+	auditActorStreamKey = "audit:actor:%s"
+)
+
+// Audit actions recorded for item mutations.
+const (
+	AuditCreate = "create"
+	AuditUpdate = "update"
+	AuditDelete = "delete"
+)
+
+// AuditEntry records who changed an item, when, from where and how.
+type AuditEntry struct {
+	ID        string        `json:"id"`
+	Time      time.Time     `json:"time"`
+	Action    string        `json:"action"`
+	Actor     string        `json:"actor"`
+	Scopes    []string      `json:"scopes,omitempty"`
+	ItemID    string        `json:"itemId"`
+	ItemType  string        `json:"itemType"`
+	Changes   []AuditChange `json:"changes"`
+	ClientIP  string        `json:"clientIp,omitempty"`
+	RequestID string        `json:"requestId,omitempty"`
+}
+
+// AuditChange is the value at one path of an item before and after a mutation.
+// Paths are "type", "tags", "acl" and dotted paths below "data".
+type AuditChange struct {
+	Path string          `json:"path"`
+	From json.RawMessage `json:"from,omitempty"`
+	To   json.RawMessage `json:"to,omitempty"`
+}
+
+// AuditQuery filters audit entries; zero fields match everything.
+type AuditQuery struct {
+	ItemID string
+	Actor  string
+	Since  time.Time
+	Limit  int
+}
+
+// AuditLog appends an entry for every item mutation and answers queries over them.
+type AuditLog struct {
+	client redis.UniversalClient
+	logger *slog.Logger
+
+	// Encrypted lists the data paths stored encrypted by item type. Changes
+	// to them are recorded without their values.
+	Encrypted typeFields
+}
+
+// NewAuditLog creates an AuditLog.
+func NewAuditLog(client redis.UniversalClient, logger *slog.Logger) *AuditLog {
+	return &AuditLog{client: client, logger: logger}
+}
+
+// ItemChanged records ev with the actor and request metadata found in ctx.
+func (a *AuditLog) ItemChanged(ctx context.Context, ev ChangeEvent) {
+	entry := AuditEntry{
+		Time:      ev.Time,
+		Actor:     actorFrom(ctx),
+		ItemID:    ev.ItemID,
+		ItemType:  ev.Subject().Type,
+		Changes:   diffItems(ev.Before, ev.Item),
+		ClientIP:  requestInfoFrom(ctx).ClientIP,
+		RequestID: requestInfoFrom(ctx).ID,
+	}
+	if p := principalFrom(ctx); p != nil {
+		entry.Scopes = p.Scopes
+	}
+	a.redact(ev, entry.Changes)
+	switch ev.Event {
+	case EventItemCreated:
+		entry.Action = AuditCreate
+	case EventItemUpdated:
+		entry.Action = AuditUpdate
+	case EventItemDeleted:
+		entry.Action = AuditDelete
+	}
+	if err := a.Append(context.WithoutCancel(ctx), &entry); err != nil {
+		a.logger.ErrorContext(ctx, "error writing audit entry", "action", entry.Action, "item_id", entry.ItemID, "error", err)
+	}
+}
+
+// redact replaces the values at encrypted paths in changes by "<encrypted>".
+func (a *AuditLog) redact(ev ChangeEvent, changes []AuditChange) {
+	types := []string{ev.Subject().Type}
+	if ev.Before != nil && ev.Before.Type != types[0] {
+		types = append(types, ev.Before.Type)
+	}
+	for i, c := range changes {
+		path, ok := strings.CutPrefix(c.Path, "data")
+		if !ok || (path != "" && path[0] != '.') {
+			continue
+		}
+		path = strings.TrimPrefix(path, ".")
+		for _, typ := range types {
+			changes[i].From = maskEncrypted(a.Encrypted[typ], path, changes[i].From)
+			changes[i].To = maskEncrypted(a.Encrypted[typ], path, changes[i].To)
+		}
+	}
+}
+
+// maskEncrypted returns value, found at path below an item's data, with
+// whatever it holds of the encrypted paths replaced by "<encrypted>".
+func maskEncrypted(encrypted []string, path string, value json.RawMessage) json.RawMessage {
+	masked := json.RawMessage(`"<encrypted>"`)
+	if value == nil {
+		return nil
+	}
+	for _, p := range encrypted {
+		switch {
+		case p == "*" || p == path || strings.HasPrefix(path, p+"."):
+			return masked
+		case path == "" || strings.HasPrefix(p, path+"."):
+			rel := strings.TrimPrefix(strings.TrimPrefix(p, path), ".")
+			value, _, _ = replaceAt(value, splitPath(rel), func(json.RawMessage) (json.RawMessage, error) { return masked, nil })
+		}
+	}
+	return value
+}
+
+// appendAuditScript adds ARGV[1] to the stream KEYS[1], then under the same
+// ID to the index streams in the other KEYS, and returns the ID. An index
+// stream already past the ID, as when an interrupted migration runs again,
+// is left as it is.
+var appendAuditScript = redis.NewScript(`
+local id = ARGV[2]
+if id == "*" then
+  id = redis.call("XADD", KEYS[1], "*", "entry", ARGV[1])
+end
+for i = 2, #KEYS do
+  redis.pcall("XADD", KEYS[i], id, "entry", ARGV[1])
+end
+return id
+`)
+
+// Append adds entry to the log and sets its ID.
+func (a *AuditLog) Append(ctx context.Context, entry *AuditEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	id, err := appendAuditScript.Run(ctx, a.client, auditKeys(ctx, entry), data, "*").Text()
+	if err != nil {
+		return err
+	}
+	entry.ID = id
+	return nil
+}
+
+// auditKeys returns the stream holding entry followed by its index streams.
+func auditKeys(ctx context.Context, entry *AuditEntry) []string {
+	keys := []string{tenantKey(ctx, auditStreamKey), tenantKey(ctx, auditItemStreamKey, entry.ItemID)}
+	if entry.Actor != "" {
+		keys = append(keys, tenantKey(ctx, auditActorStreamKey, entry.Actor))
+	}
+	return keys
+}
+
+// Query returns matching entries in chronological order, up to q.Limit. It
+// reads the stream of q.ItemID, else that of q.Actor, so its cost does not
+// grow with the rest of the history.
+func (a *AuditLog) Query(ctx context.Context, q AuditQuery) ([]*AuditEntry, error) {
+	const batch = 500
+	start := "-"
+	if !q.Since.IsZero() {
+		start = strconv.FormatInt(q.Since.UnixMilli(), 10)
+	}
+	stream := tenantKey(ctx, auditStreamKey)
+	switch {
+	case q.ItemID != "":
+		stream = tenantKey(ctx, auditItemStreamKey, q.ItemID)
+	case q.Actor != "":
+		stream = tenantKey(ctx, auditActorStreamKey, q.Actor)
+	}
+	entries := []*AuditEntry{}
+	for {
+		msgs, err := a.client.XRangeN(ctx, stream, start, "+", batch).Result()
+		if err != nil {
+			return nil, err
+		}
+		for _, msg := range msgs {
+			raw, _ := msg.Values["entry"].(string)
+			var entry AuditEntry
+			if err := json.Unmarshal([]byte(raw), &entry); err != nil {
+				return nil, err
+			}
+			entry.ID = msg.ID
+			if (q.ItemID != "" && entry.ItemID != q.ItemID) || (q.Actor != "" && entry.Actor != q.Actor) {
+				continue
+			}
+			entries = append(entries, &entry)
+			if q.Limit > 0 && len(entries) >= q.Limit {
+				return entries, nil
+			}
+		}
+		if len(msgs) < batch {
+			return entries, nil
+		}
+		start = "(" + msgs[len(msgs)-1].ID
+	}
+}
+
+// handleQuery processes GET /audit?itemId=&actor=&since=&limit=.
+func (a *AuditLog) handleQuery(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	params := r.URL.Query()
+	q := AuditQuery{ItemID: params.Get("itemId"), Actor: params.Get("actor"), Limit: 100}
+	if since := params.Get("since"); since != "" {
+		t, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			http.Error(w, "since must be an RFC 3339 timestamp", http.StatusBadRequest)
+			return
+		}
+		q.Since = t
+	}
+	if limit := params.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > 1000 {
+			http.Error(w, "limit must be between 1 and 1000", http.StatusBadRequest)
+			return
+		}
+		q.Limit = n
+	}
+
+	entries, err := a.Query(r.Context(), q)
+	if isOutage(err) {
+		writeUnavailable(w, err)
+		return
+	}
+	if err != nil {
+		a.logger.ErrorContext(r.Context(), "error querying audit log", "error", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+// diffItems lists the paths whose values differ between before and after.
+// Either side may be nil for creates and deletes.
+func diffItems(before, after *Item) []AuditChange {
+	side := func(it *Item) map[string]interface{} {
+		if it == nil {
+			return map[string]interface{}{}
+		}
+		var data interface{}
+		json.Unmarshal(it.Data, &data)
+		var tags, acl interface{}
+		if len(it.Tags) > 0 {
+			raw, _ := json.Marshal(it.Tags)
+			json.Unmarshal(raw, &tags)
+		}
+		if it.ACL != nil {
+			raw, _ := json.Marshal(it.ACL)
+			json.Unmarshal(raw, &acl)
+		}
+		return map[string]interface{}{"type": it.Type, "tags": tags, "acl": acl, "data": data}
+	}
+	changes := []AuditChange{}
+	diffValues("", side(before), side(after), &changes)
+	return changes
+}
+
+// diffValues appends a change for every leaf that differs, descending into objects.
+func diffValues(path string, from, to interface{}, changes *[]AuditChange) {
+	fromObj, fromIsObj := from.(map[string]interface{})
+	toObj, toIsObj := to.(map[string]interface{})
+	if fromIsObj && toIsObj {
+		keys := make([]string, 0, len(fromObj)+len(toObj))
+		for k := range fromObj {
+			keys = append(keys, k)
+		}
+		for k := range toObj {
+			if _, ok := fromObj[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			p := k
+			if path != "" {
+				p = path + "." + k
+			}
+			diffValues(p, fromObj[k], toObj[k], changes)
+		}
+		return
+	}
+	if reflect.DeepEqual(from, to) {
+		return
+	}
+	change := AuditChange{Path: path}
+	if from != nil {
+		change.From, _ = json.Marshal(from)
+	}
+	if to != nil {
+		change.To, _ = json.Marshal(to)
+	}
+	*changes = append(*changes, change)
+}
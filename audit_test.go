@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// TestAuditIntegration mutates an item and checks the audit trail recorded for it.
+func TestAuditIntegration(t *testing.T) {
+	client := &http.Client{Transport: &authTransport{token: testAPIKey, base: http.DefaultTransport}}
+	do := func(method, path, body, requestID string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(method, testServerURL+path, bytes.NewReader([]byte(body)))
+		if err != nil {
+			t.Fatalf("creating %s %s: %v", method, path, err)
+		}
+		req.Header.Set("X-Request-ID", requestID)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		if got := resp.Header.Get("X-Request-ID"); got != requestID {
+			t.Errorf("expected X-Request-ID %q echoed, got %q", requestID, got)
+		}
+		return resp
+	}
+
+	resp := do(http.MethodPost, "/items", `{"type":"audited","tags":["a"],"data":{"price":10,"name":"x"}}`, "req-create")
+	var item Item
+	json.NewDecoder(resp.Body).Decode(&item)
+	resp.Body.Close()
+	do(http.MethodPut, "/items/"+item.ID, `{"type":"audited","tags":["a","b"],"data":{"price":12,"name":"x"}}`, "req-update").Body.Close()
+	do(http.MethodDelete, "/items/"+item.ID, "", "req-delete").Body.Close()
+
+	query := func(params url.Values) []AuditEntry {
+		t.Helper()
+		resp, err := client.Get(testServerURL + "/audit?" + params.Encode())
+		if err != nil {
+			t.Fatalf("GET /audit: %v", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("GET /audit status %d", resp.StatusCode)
+		}
+		var entries []AuditEntry
+		json.NewDecoder(resp.Body).Decode(&entries)
+		return entries
+	}
+
+	entries := query(url.Values{"itemId": {item.ID}, "actor": {keyIdentity(testAPIKey)}})
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 audit entries, got %d: %+v", len(entries), entries)
+	}
+	for i, want := range []struct{ action, requestID string }{
+		{AuditCreate, "req-create"},
+		{AuditUpdate, "req-update"},
+		{AuditDelete, "req-delete"},
+	} {
+		e := entries[i]
+		if e.Action != want.action || e.RequestID != want.requestID || e.ItemType != "audited" || e.ClientIP == "" {
+			t.Errorf("entry %d: unexpected %+v", i, e)
+		}
+	}
+
+	var paths []string
+	for _, c := range entries[1].Changes {
+		paths = append(paths, c.Path)
+	}
+	if len(paths) != 2 || paths[0] != "data.price" || paths[1] != "tags" {
+		t.Errorf("unexpected update diff paths: %v", paths)
+	}
+	if string(entries[1].Changes[0].From) != "10" || string(entries[1].Changes[0].To) != "12" {
+		t.Errorf("unexpected price change: %+v", entries[1].Changes[0])
+	}
+
+	if got := query(url.Values{"itemId": {item.ID}, "actor": {"key:someone-else"}}); len(got) != 0 {
+		t.Errorf("expected no entries for other actor, got %d", len(got))
+	}
+	future := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	if got := query(url.Values{"itemId": {item.ID}, "since": {future}}); len(got) != 0 {
+		t.Errorf("expected no entries since %s, got %d", future, len(got))
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// keyTouchInterval throttles how often a key's last-used timestamp is written.
+const keyTouchInterval = time.Minute
+
+// Authenticator resolves bearer tokens to principals. Bootstrap keys from
+// API_KEYS are accepted as administrators, JWTs are checked by JWT when set,
+// and all other keys are verified against the KeyStore, with successful
+// lookups cached in process for CacheTTL.
+type Authenticator struct {
+	bootstrap map[string]struct{}
+	keys      *KeyStore
+	logger    *slog.Logger
+
+	CacheTTL time.Duration
+	JWT      *JWTValidator
+	// Tenants, when set, rejects JWTs naming an unregistered tenant.
+	Tenants *TenantStore
+
+	mu    sync.Mutex
+	cache map[[sha256.Size]byte]*cachedKey
+}
+
+type cachedKey struct {
+	principal *Principal
+	expires   time.Time
+	touched   time.Time
+}
+
+// NewAuthenticator creates an Authenticator accepting bootstrap keys and keys stored in keys.
+func NewAuthenticator(bootstrap map[string]struct{}, keys *KeyStore, logger *slog.Logger) *Authenticator {
+	return &Authenticator{
+		bootstrap: bootstrap,
+		keys:      keys,
+		logger:    logger,
+		CacheTTL:  30 * time.Second,
+		cache:     make(map[[sha256.Size]byte]*cachedKey),
+	}
+}
+
+// Authenticate returns the principal for token, or an error matching ErrInvalidCredentials.
+func (a *Authenticator) Authenticate(ctx context.Context, token string) (*Principal, error) {
+	if _, ok := a.bootstrap[token]; ok {
+		return &Principal{ID: keyIdentity(token), Scopes: []string{ScopeAdmin}}, nil
+	}
+	if a.JWT != nil && looksLikeJWT(token) {
+		p, err := a.JWT.Validate(ctx, token)
+		if err != nil || a.Tenants == nil {
+			return p, err
+		}
+		ok, err := a.Tenants.Exists(ctx, p.Tenant)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, fmt.Errorf("%w: unknown tenant %q", ErrInvalidCredentials, p.Tenant)
+		}
+		return p, nil
+	}
+
+	now := time.Now()
+	sum := sha256.Sum256([]byte(token))
+	a.mu.Lock()
+	entry, ok := a.cache[sum]
+	if ok && now.After(entry.expires) {
+		delete(a.cache, sum)
+		ok = false
+	}
+	touch := ok && now.Sub(entry.touched) > keyTouchInterval
+	if touch {
+		entry.touched = now
+	}
+	a.mu.Unlock()
+	if ok {
+		if touch {
+			a.touch(ctx, entry.principal.KeyID, now)
+		}
+		return entry.principal, nil
+	}
+
+	key, err := a.keys.Verify(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	p := &Principal{
+		ID:        "key:" + key.ID,
+		Tenant:    key.Tenant,
+		KeyID:     key.ID,
+		Name:      key.Name,
+		Scopes:    key.EffectiveScopes(),
+		Types:     key.Types,
+		Tags:      key.Tags,
+		Groups:    key.Groups,
+		RateLimit: key.RateLimit,
+	}
+	expires := now.Add(a.CacheTTL)
+	if key.ExpiresAt != nil && key.ExpiresAt.Before(expires) {
+		expires = *key.ExpiresAt
+	}
+	a.mu.Lock()
+	a.cache[sum] = &cachedKey{principal: p, expires: expires, touched: now}
+	a.mu.Unlock()
+	a.touch(ctx, key.ID, now)
+	return p, nil
+}
+
+// Start subscribes to the key changes saved by every replica, dropping their
+// cached lookups as they arrive. The cache is emptied whenever the
+// subscription is re-established, as messages may have been missed.
+func (a *Authenticator) Start(ctx context.Context) error {
+	if a.keys == nil {
+		return nil
+	}
+	ps := a.keys.client.Subscribe(ctx, keyInvalidationChannel)
+	if _, err := ps.Receive(ctx); err != nil {
+		ps.Close()
+		return err
+	}
+	a.purge()
+	go func() {
+		defer ps.Close()
+		ch := ps.ChannelWithSubscriptions(ctx, 100)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg, ok := <-ch:
+				if !ok {
+					return
+				}
+				switch msg := msg.(type) {
+				case *redis.Message:
+					a.Invalidate(msg.Payload)
+				case *redis.Subscription:
+					a.purge()
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// purge drops every cached lookup.
+func (a *Authenticator) purge() {
+	a.mu.Lock()
+	clear(a.cache)
+	a.mu.Unlock()
+}
+
+// Invalidate drops cached lookups for a key so revocation and rotation apply
+// immediately on this replica; other replicas follow when Start receives the
+// change, or within CacheTTL if they are not subscribed.
+func (a *Authenticator) Invalidate(keyID string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for sum, entry := range a.cache {
+		if entry.principal.KeyID == keyID {
+			delete(a.cache, sum)
+		}
+	}
+}
+
+func (a *Authenticator) touch(ctx context.Context, keyID string, at time.Time) {
+	if err := a.keys.TouchKey(context.WithoutCancel(ctx), keyID, at); err != nil {
+		a.logger.ErrorContext(ctx, "error recording use of api key", "key_id", keyID, "error", err)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// maxBatchOperations bounds the operations of one POST /batch.
+const maxBatchOperations = 100
+
+// batchHandler processes POST /batch. The operations run in order, each as
+// its own write: a failed operation does not undo or stop the others, and
+// its result carries the status the single-item request would have failed
+// with. The response is 200 whenever the batch itself was valid.
+func (h *Handler) batchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	var req BatchRequest
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request payload: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := ensureSingleJSON(dec); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.Operations) == 0 || len(req.Operations) > maxBatchOperations {
+		http.Error(w, fmt.Sprintf("a batch must have between 1 and %d operations", maxBatchOperations), http.StatusBadRequest)
+		return
+	}
+
+	resp := BatchResponse{Results: make([]BatchResult, len(req.Operations))}
+	for i, op := range req.Operations {
+		resp.Results[i] = h.runBatchOperation(r.Context(), op)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// runBatchOperation executes op and returns its result.
+func (h *Handler) runBatchOperation(ctx context.Context, op BatchOperation) BatchResult {
+	if op.Op != "create" && op.ID == "" {
+		return BatchResult{Status: http.StatusBadRequest, Error: "id is required"}
+	}
+	var (
+		item   *Item
+		err    error
+		status = http.StatusOK
+	)
+	switch op.Op {
+	case "create":
+		item, err = h.createItem(ctx, CreateItemRequest{Type: op.Type, Tags: op.Tags, Data: op.Data, ACL: op.ACL})
+		status = http.StatusCreated
+	case "update":
+		item, err = h.updateItem(ctx, op.ID, op.IfMatch, UpdateItemRequest{Type: op.Type, Tags: op.Tags, Data: op.Data, ACL: op.ACL})
+	case "patch":
+		item, err = h.patchItem(ctx, op.ID, op.IfMatch, PatchItemRequest{Type: op.Type, Tags: op.Tags, Data: op.Data, ACL: op.ACL})
+	case "delete":
+		err = h.deleteItem(ctx, op.ID, op.IfMatch)
+		status = http.StatusNoContent
+	default:
+		return BatchResult{Status: http.StatusBadRequest, Error: "unknown op: " + op.Op}
+	}
+	if err != nil {
+		return h.batchError(ctx, err)
+	}
+	if item == nil {
+		return BatchResult{Status: status}
+	}
+	return BatchResult{Status: status, Item: item, ETag: itemETag(item)}
+}
+
+// batchError maps a failed operation to its result, mirroring Handler.writeError.
+func (h *Handler) batchError(ctx context.Context, err error) BatchResult {
+	switch {
+	case errors.Is(err, ErrInvalidInput):
+		return BatchResult{Status: http.StatusBadRequest, Error: err.Error()}
+	case errors.Is(err, ErrForbidden):
+		return BatchResult{Status: http.StatusForbidden, Error: err.Error()}
+	case errors.Is(err, ErrNotFound):
+		return BatchResult{Status: http.StatusNotFound, Error: http.StatusText(http.StatusNotFound)}
+	case errors.Is(err, ErrPreconditionFailed):
+		return BatchResult{Status: http.StatusPreconditionFailed, Error: err.Error()}
+	case isOutage(err):
+		return BatchResult{Status: http.StatusServiceUnavailable, Error: ErrUnavailable.Error()}
+	default:
+		h.logger.ErrorContext(ctx, "error running batch operation", "error", err)
+		return BatchResult{Status: http.StatusInternalServerError, Error: http.StatusText(http.StatusInternalServerError)}
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// TestBatch runs creates, patches and deletes in one request and checks that
+// failed operations are reported without stopping the rest.
+func TestBatch(t *testing.T) {
+	status, b := call(t, testAPIKey, http.MethodPost, "/batch", `{"operations":[
+		{"op":"create","type":"batch","tags":["x"],"data":{"n":1}},
+		{"op":"create","type":"","data":{}},
+		{"op":"patch","id":"missing","data":{"n":2}},
+		{"op":"frobnicate","id":"x"}
+	]}`)
+	if status != http.StatusOK {
+		t.Fatalf("POST /batch: status %d %s", status, b)
+	}
+	var resp BatchResponse
+	json.Unmarshal(b, &resp)
+	if len(resp.Results) != 4 {
+		t.Fatalf("expected 4 results, got %s", b)
+	}
+	for i, want := range []int{http.StatusCreated, http.StatusBadRequest, http.StatusNotFound, http.StatusBadRequest} {
+		if resp.Results[i].Status != want {
+			t.Errorf("operation %d: expected %d, got %+v", i, want, resp.Results[i])
+		}
+	}
+	created := resp.Results[0]
+	if created.Item == nil || created.ETag != itemETag(created.Item) {
+		t.Fatalf("expected the created item and its ETag, got %+v", created)
+	}
+
+	ops := fmt.Sprintf(`{"operations":[
+		{"op":"patch","id":%[1]q,"ifMatch":%[2]q,"data":{"m":2}},
+		{"op":"delete","id":%[1]q,"ifMatch":%[2]q},
+		{"op":"delete","id":%[1]q}
+	]}`, created.Item.ID, created.ETag)
+	_, b = call(t, testAPIKey, http.MethodPost, "/batch", ops)
+	resp = BatchResponse{}
+	json.Unmarshal(b, &resp)
+	if len(resp.Results) != 3 {
+		t.Fatalf("expected 3 results, got %s", b)
+	}
+	if r := resp.Results[0]; r.Status != http.StatusOK || string(r.Item.Data) != `{"m":2,"n":1}` {
+		t.Errorf("patch: got %+v", r)
+	}
+	if r := resp.Results[1]; r.Status != http.StatusPreconditionFailed {
+		t.Errorf("delete with the ETag from before the patch: expected 412, got %+v", r)
+	}
+	if r := resp.Results[2]; r.Status != http.StatusNoContent {
+		t.Errorf("unconditional delete: expected 204, got %+v", r)
+	}
+
+	if status, _ := call(t, testAPIKey, http.MethodPost, "/batch", `{"operations":[]}`); status != http.StatusBadRequest {
+		t.Errorf("empty batch: expected 400, got %d", status)
+	}
+	tooMany := `{"operations":[` + strings.Repeat(`{"op":"delete","id":"x"},`, maxBatchOperations) + `{"op":"delete","id":"x"}]}`
+	if status, _ := call(t, testAPIKey, http.MethodPost, "/batch", tooMany); status != http.StatusBadRequest {
+		t.Errorf("oversized batch: expected 400, got %d", status)
+	}
+}
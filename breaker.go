@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// CircuitBreaker is a go-redis hook that stops sending commands to Redis
+// once Threshold commands in a row failed to reach it. While open it fails
+// commands at once with ErrUnavailable; after Cooldown it lets one command
+// through as a probe, which closes the breaker on success and reopens it
+// on failure. Commands that fail to reach Redis are reported as
+// ErrUnavailable whether the breaker is open or not.
+type CircuitBreaker struct {
+	logger *slog.Logger
+
+	// Threshold is the number of consecutive failures that opens the breaker;
+	// zero disables it.
+	Threshold int
+	// Cooldown is how long the breaker stays open before probing Redis.
+	Cooldown time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time // zero while closed
+	probing   bool
+	opened    uint64
+	rejected  uint64
+}
+
+// NewCircuitBreaker creates a CircuitBreaker opening after 5 failures for 5 seconds.
+func NewCircuitBreaker(logger *slog.Logger) *CircuitBreaker {
+	return &CircuitBreaker{logger: logger, Threshold: 5, Cooldown: 5 * time.Second}
+}
+
+// allow returns an error if the breaker is open, letting a single probe
+// through once the cooldown has elapsed.
+func (b *CircuitBreaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.openUntil.IsZero() {
+		return nil
+	}
+	if wait := time.Until(b.openUntil); wait > 0 || b.probing {
+		b.rejected++
+		return &unavailableError{err: errors.New("circuit breaker is open"), retryAfter: max(wait, time.Second), rejected: true}
+	}
+	b.probing = true
+	return nil
+}
+
+// record notes the outcome of a command that was sent with ctx and returns
+// the error to report for it. A command that failed because its caller gave
+// up, by cancelling ctx or letting its deadline pass, says nothing about
+// Redis: it neither counts as a failure nor closes the breaker.
+func (b *CircuitBreaker) record(ctx context.Context, err error) error {
+	outage := isOutage(err)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if err != nil && (ctx.Err() != nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)) {
+		return err
+	}
+	if !outage {
+		if !b.openUntil.IsZero() {
+			b.logger.Info("redis is reachable again, closing the circuit breaker")
+		}
+		b.failures, b.openUntil = 0, time.Time{}
+		return err
+	}
+	b.failures++
+	if b.Threshold > 0 && (b.failures == b.Threshold || !b.openUntil.IsZero()) {
+		if b.openUntil.IsZero() {
+			b.opened++
+			b.logger.Warn("redis is unreachable, opening the circuit breaker", "failures", b.failures, "cooldown", b.Cooldown, "error", err)
+		}
+		b.openUntil = time.Now().Add(b.Cooldown)
+		return &unavailableError{err: err, retryAfter: b.Cooldown}
+	}
+	return &unavailableError{err: err, retryAfter: time.Second}
+}
+
+func (b *CircuitBreaker) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	return ctx, b.allow()
+}
+
+func (b *CircuitBreaker) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	if isRejected(cmd.Err()) {
+		return nil
+	}
+	return b.record(ctx, cmd.Err())
+}
+
+func (b *CircuitBreaker) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	return ctx, b.allow()
+}
+
+func (b *CircuitBreaker) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	var err error
+	for _, cmd := range cmds {
+		if isRejected(cmd.Err()) {
+			return nil
+		}
+		if err = cmd.Err(); isOutage(err) {
+			break
+		}
+	}
+	if err = b.record(ctx, err); isOutage(err) {
+		return err
+	}
+	return nil
+}
+
+var (
+	breakerOpenDesc = prometheus.NewDesc("gocrud_redis_breaker_open",
+		"1 while the Redis circuit breaker is open.", nil, nil)
+	breakerOpenedDesc = prometheus.NewDesc("gocrud_redis_breaker_opened_total",
+		"Times the Redis circuit breaker opened.", nil, nil)
+	breakerRejectedDesc = prometheus.NewDesc("gocrud_redis_breaker_rejected_total",
+		"Redis commands failed by the open circuit breaker without being sent.", nil, nil)
+)
+
+func (b *CircuitBreaker) Describe(ch chan<- *prometheus.Desc) {
+	ch <- breakerOpenDesc
+	ch <- breakerOpenedDesc
+	ch <- breakerRejectedDesc
+}
+
+func (b *CircuitBreaker) Collect(ch chan<- prometheus.Metric) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	open := 0.0
+	if !b.openUntil.IsZero() {
+		open = 1
+	}
+	ch <- prometheus.MustNewConstMetric(breakerOpenDesc, prometheus.GaugeValue, open)
+	ch <- prometheus.MustNewConstMetric(breakerOpenedDesc, prometheus.CounterValue, float64(b.opened))
+	ch <- prometheus.MustNewConstMetric(breakerRejectedDesc, prometheus.CounterValue, float64(b.rejected))
+}
+
+// isOutage reports whether err means Redis could not be reached or cannot
+// serve commands right now, as opposed to a missing key, a failed command or
+// a caller that gave up; context.DeadlineExceeded is a net.Error too.
+func isOutage(err error) bool {
+	if err == nil || err == redis.Nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var ue *unavailableError
+	if errors.As(err, &ue) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	msg := err.Error()
+	for _, prefix := range []string{"redis: connection pool timeout", "LOADING ", "MASTERDOWN ", "CLUSTERDOWN ", "TRYAGAIN ", "READONLY "} {
+		if strings.HasPrefix(msg, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// isRejected reports whether err is the open breaker refusing a command.
+func isRejected(err error) bool {
+	var ue *unavailableError
+	return errors.As(err, &ue) && ue.rejected
+}
+
+// retryRedis runs op, an idempotent operation, and retries it up to retries
+// times while it fails because Redis is unreachable. It waits a random time
+// up to backoff before the first retry, doubling the bound for each one. It
+// gives up at once when the breaker is open or ctx is done.
+func retryRedis(ctx context.Context, retries int, backoff time.Duration, op func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := op()
+		if err == nil || attempt >= retries || !isOutage(err) || isRejected(err) || backoff <= 0 {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(rand.N(backoff) + time.Millisecond):
+		}
+		backoff *= 2
+	}
+}
+
+// waitForRedis runs op, a startup step, until it succeeds or fails for a
+// reason other than Redis being unavailable. It waits up to 5 seconds
+// between attempts, or until the open breaker lets a probe through.
+func waitForRedis(ctx context.Context, logger *slog.Logger, step string, op func() error) error {
+	backoff := 100 * time.Millisecond
+	for {
+		err := op()
+		if !isOutage(err) {
+			return err
+		}
+		logger.Warn("waiting for redis", "step", step, "error", err)
+		wait := backoff
+		var ue *unavailableError
+		if errors.As(err, &ue) && ue.rejected {
+			wait = ue.retryAfter
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+		backoff = min(2*backoff, 5*time.Second)
+	}
+}
+
+// writeUnavailable answers 503 with Retry-After for an error for which
+// isOutage is true.
+func writeUnavailable(w http.ResponseWriter, err error) {
+	retryAfter := time.Second
+	var ue *unavailableError
+	if errors.As(err, &ue) {
+		retryAfter = ue.retryAfter
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(retryAfter)))
+	http.Error(w, ErrUnavailable.Error(), http.StatusServiceUnavailable)
+}
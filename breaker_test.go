@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	b := NewCircuitBreaker(newTestLogger())
+	b.Threshold, b.Cooldown = 2, 50*time.Millisecond
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+
+	if err := b.record(testCtx, refused); !errors.Is(err, ErrUnavailable) || isRejected(err) {
+		t.Fatalf("expected a failure to reach redis to be reported as unavailable, got %v", err)
+	}
+	if err := b.record(testCtx, redis.Nil); err != redis.Nil {
+		t.Fatalf("expected other errors to pass through, got %v", err)
+	}
+	b.record(testCtx, refused)
+	if err := b.allow(); err != nil {
+		t.Fatalf("expected the breaker to stay closed after a success, got %v", err)
+	}
+	b.record(testCtx, refused)
+	err := b.allow()
+	var ue *unavailableError
+	if !isRejected(err) || !errors.As(err, &ue) || ue.retryAfter <= 0 {
+		t.Fatalf("expected the breaker to open after 2 failures, got %v", err)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if err := b.allow(); err != nil {
+		t.Fatalf("expected a probe after the cooldown, got %v", err)
+	}
+	if err := b.allow(); !isRejected(err) {
+		t.Fatalf("expected a single probe at a time, got %v", err)
+	}
+	b.record(testCtx, refused)
+	if err := b.allow(); !isRejected(err) {
+		t.Fatalf("expected a failed probe to reopen the breaker, got %v", err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	b.allow()
+	b.record(testCtx, nil)
+	if err := b.allow(); err != nil {
+		t.Fatalf("expected a successful probe to close the breaker, got %v", err)
+	}
+	if b.opened != 1 || b.rejected != 3 {
+		t.Errorf("expected 1 opening and 3 rejections, got %d and %d", b.opened, b.rejected)
+	}
+
+	// callers giving up neither count as failures nor close the breaker
+	cancelled, cancel := context.WithCancel(testCtx)
+	cancel()
+	timedOut := &net.OpError{Op: "read", Net: "tcp", Err: errors.New("i/o timeout")}
+	for _, err := range []error{context.DeadlineExceeded, context.Canceled} {
+		if b.record(testCtx, err); isOutage(err) {
+			t.Errorf("expected %v not to be an outage", err)
+		}
+	}
+	b.record(cancelled, timedOut)
+	b.record(testCtx, refused)
+	if err := b.allow(); err != nil {
+		t.Fatalf("expected the breaker to stay closed, got %v", err)
+	}
+	b.record(testCtx, refused)
+	time.Sleep(60 * time.Millisecond)
+	b.allow()
+	b.record(cancelled, context.Canceled)
+	time.Sleep(60 * time.Millisecond)
+	if err := b.allow(); err != nil {
+		t.Fatalf("expected another probe after a cancelled one, got %v", err)
+	}
+	b.record(testCtx, refused)
+	if err := b.allow(); !isRejected(err) {
+		t.Fatalf("expected a cancelled probe to leave the breaker open, got %v", err)
+	}
+}
+
+func TestRetryRedis(t *testing.T) {
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	for _, tc := range []struct {
+		name  string
+		err   error
+		calls int
+	}{
+		{"outage", refused, 3},
+		{"missing key", redis.Nil, 1},
+		{"command error", errors.New("WRONGTYPE Operation against a key holding the wrong kind of value"), 1},
+		{"open breaker", &unavailableError{err: refused, rejected: true}, 1},
+	} {
+		calls := 0
+		err := retryRedis(testCtx, 2, time.Millisecond, func() error {
+			calls++
+			return tc.err
+		})
+		if err != tc.err || calls != tc.calls {
+			t.Errorf("%s: expected %d calls, got %d (%v)", tc.name, tc.calls, calls, err)
+		}
+	}
+}
+
+// TestRedisUnavailable checks that a store whose Redis is down answers 503
+// with Retry-After, and serves a cached item marked stale when allowed to.
+func TestRedisUnavailable(t *testing.T) {
+	client := redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1})
+	defer client.Close()
+	breaker := NewCircuitBreaker(newTestLogger())
+	breaker.Threshold = 1
+	client.AddHook(breaker)
+
+	store := NewRedisStore(client)
+	store.RetryBackoff = time.Millisecond
+	store.Cache = NewItemCache(client, newTestLogger(), 10, 1<<20, time.Millisecond)
+	key := tenantKey(testCtx, "item:%s", "down")
+	data, _ := json.Marshal(&Item{ID: "down", Type: "note", Data: json.RawMessage(`{}`)})
+	store.Cache.put(key, data, store.Cache.startFill(key))
+	time.Sleep(2 * time.Millisecond)
+	h := NewHandler(store, newTestLogger())
+
+	get := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/items/down", nil)
+		h.itemHandler(rec, req.WithContext(withPrincipal(req.Context(), systemPrincipal)))
+		return rec
+	}
+	rec := get()
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") != "5" {
+		t.Fatalf("expected 503 with Retry-After: 5, got %d %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	if breaker.opened != 1 {
+		t.Fatalf("expected the breaker to open")
+	}
+
+	store.StaleReads = true
+	rec = get()
+	if rec.Code != http.StatusOK || rec.Header().Get("Warning") == "" {
+		t.Fatalf("expected the cached item with a Warning, got %d %v", rec.Code, rec.Header())
+	}
+	rec = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/items/uncached", nil)
+	h.itemHandler(rec, req.WithContext(withPrincipal(req.Context(), systemPrincipal)))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 for an item that is not cached, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// cacheInvalidationChannel is the Redis pub/sub channel carrying the keys of
+// items written on any replica, each prefixed with the ID of the cache that
+// published it and a space.
+const cacheInvalidationChannel = "items:invalidate"
+
+// ItemCache is an in-process LRU cache of stored items, bounded by entry
+// count and by the total size of the cached JSON. Writes on any replica
+// evict the item everywhere through Redis pub/sub. Entries also expire a
+// maximum age after they were read from Redis, which bounds how long a stale
+// item can be served if an invalidation is lost. A nil *ItemCache caches
+// nothing.
+type ItemCache struct {
+	// id tells the invalidations published by this replica apart; it
+	// evicts the item itself when writing it
+	id         string
+	client     redis.UniversalClient
+	logger     *slog.Logger
+	maxEntries int
+	maxBytes   int
+	maxAge     time.Duration
+
+	mu      sync.Mutex
+	lru     *list.List // of *cacheEntry, most recently used first
+	entries map[string]*list.Element
+	bytes   int
+	// fills tracks the keys being read from Redis, so that a read that raced
+	// with a write to its key is not cached; epoch counts purges
+	fills map[string]*cacheFill
+	epoch uint64
+
+	hits, misses, stale, evictions, invalidations uint64
+}
+
+// cacheFill counts the reads of a key in flight and the writes to it since
+// the oldest of them started.
+type cacheFill struct {
+	readers int
+	writes  uint64
+}
+
+// fillToken is returned by startFill and passed to put.
+type fillToken struct {
+	writes, epoch uint64
+}
+
+type cacheEntry struct {
+	key    string
+	data   []byte
+	stored time.Time
+}
+
+// NewItemCache creates an ItemCache holding up to maxEntries items and
+// maxBytes of item JSON, each for at most maxAge. Call Start to receive
+// invalidations from other replicas.
+func NewItemCache(client redis.UniversalClient, logger *slog.Logger, maxEntries, maxBytes int, maxAge time.Duration) *ItemCache {
+	return &ItemCache{
+		id:         uuid.NewString(),
+		client:     client,
+		logger:     logger,
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		maxAge:     maxAge,
+		lru:        list.New(),
+		entries:    make(map[string]*list.Element),
+		fills:      make(map[string]*cacheFill),
+	}
+}
+
+// Start subscribes to invalidations and applies them until ctx is done. It
+// returns once the subscription is confirmed by Redis. Invalidations sent
+// while the subscription is down are lost, so the cache is emptied whenever
+// it is established.
+func (c *ItemCache) Start(ctx context.Context) error {
+	if c == nil {
+		return nil
+	}
+	ps := c.client.Subscribe(ctx, cacheInvalidationChannel)
+	if _, err := ps.Receive(ctx); err != nil {
+		ps.Close()
+		return err
+	}
+	c.purge()
+	go func() {
+		defer ps.Close()
+		ch := ps.ChannelWithSubscriptions(ctx, 100)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg, ok := <-ch:
+				if !ok {
+					return
+				}
+				switch msg := msg.(type) {
+				case *redis.Message:
+					if origin, key, ok := strings.Cut(msg.Payload, " "); ok && origin != c.id {
+						c.invalidate(key)
+					}
+				case *redis.Subscription:
+					c.logger.Warn("item cache subscription re-established, emptying the cache")
+					c.purge()
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// get returns the cached JSON of key, if it is fresh.
+func (c *ItemCache) get(key string) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok || time.Since(el.Value.(*cacheEntry).stored) > c.maxAge {
+		// expired entries are kept for getStale until evicted or replaced
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.lru.MoveToFront(el)
+	return el.Value.(*cacheEntry).data, true
+}
+
+// getStale returns the cached JSON of key however old it is. It is only used
+// while Redis is unavailable, when invalidations cannot arrive either.
+func (c *ItemCache) getStale(key string) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.stale++
+	return el.Value.(*cacheEntry).data, true
+}
+
+// startFill is called before reading key from Redis after a miss. The
+// returned token must be passed to put, even when the read fails.
+func (c *ItemCache) startFill(key string) fillToken {
+	if c == nil {
+		return fillToken{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f, ok := c.fills[key]
+	if !ok {
+		f = &cacheFill{}
+		c.fills[key] = f
+	}
+	f.readers++
+	return fillToken{writes: f.writes, epoch: c.epoch}
+}
+
+// put caches data read from Redis for key, unless key was written or the
+// cache purged since the read started: the data may then predate the write.
+// A nil data only ends the fill.
+func (c *ItemCache) put(key string, data []byte, token fillToken) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f := c.fills[key]
+	if f.readers--; f.readers == 0 {
+		delete(c.fills, key)
+	}
+	if data == nil || len(data) > c.maxBytes || f.writes != token.writes || c.epoch != token.epoch {
+		return
+	}
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, data: data, stored: time.Now()})
+	c.bytes += len(data)
+	for c.lru.Len() > c.maxEntries || c.bytes > c.maxBytes {
+		c.remove(c.lru.Back())
+		c.evictions++
+	}
+}
+
+// publish queues the invalidation of key on the other replicas in pipe.
+func (c *ItemCache) publish(ctx context.Context, pipe redis.Pipeliner, key string) {
+	if c != nil {
+		pipe.Publish(ctx, cacheInvalidationChannel, c.id+" "+key)
+	}
+}
+
+// invalidate evicts key after a write.
+func (c *ItemCache) invalidate(key string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.invalidations++
+	if f, ok := c.fills[key]; ok {
+		f.writes++
+	}
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+}
+
+// purge evicts every entry.
+func (c *ItemCache) purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.epoch++
+	c.lru.Init()
+	c.entries = make(map[string]*list.Element)
+	c.bytes = 0
+}
+
+func (c *ItemCache) remove(el *list.Element) {
+	e := c.lru.Remove(el).(*cacheEntry)
+	delete(c.entries, e.key)
+	c.bytes -= len(e.data)
+}
+
+var (
+	cacheRequestsDesc = prometheus.NewDesc("gocrud_item_cache_requests_total",
+		"Item cache lookups by result: hit, miss or stale.", []string{"result"}, nil)
+	cacheEvictionsDesc = prometheus.NewDesc("gocrud_item_cache_evictions_total",
+		"Items evicted from the cache to stay within its bounds.", nil, nil)
+	cacheInvalidationsDesc = prometheus.NewDesc("gocrud_item_cache_invalidations_total",
+		"Item writes received by the cache, from this and other replicas.", nil, nil)
+	cacheEntriesDesc = prometheus.NewDesc("gocrud_item_cache_entries",
+		"Items currently cached.", nil, nil)
+	cacheBytesDesc = prometheus.NewDesc("gocrud_item_cache_bytes",
+		"Size of the JSON of the items currently cached.", nil, nil)
+)
+
+func (c *ItemCache) Describe(ch chan<- *prometheus.Desc) {
+	ch <- cacheRequestsDesc
+	ch <- cacheEvictionsDesc
+	ch <- cacheInvalidationsDesc
+	ch <- cacheEntriesDesc
+	ch <- cacheBytesDesc
+}
+
+func (c *ItemCache) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch <- prometheus.MustNewConstMetric(cacheRequestsDesc, prometheus.CounterValue, float64(c.hits), "hit")
+	ch <- prometheus.MustNewConstMetric(cacheRequestsDesc, prometheus.CounterValue, float64(c.misses), "miss")
+	ch <- prometheus.MustNewConstMetric(cacheRequestsDesc, prometheus.CounterValue, float64(c.stale), "stale")
+	ch <- prometheus.MustNewConstMetric(cacheEvictionsDesc, prometheus.CounterValue, float64(c.evictions))
+	ch <- prometheus.MustNewConstMetric(cacheInvalidationsDesc, prometheus.CounterValue, float64(c.invalidations))
+	ch <- prometheus.MustNewConstMetric(cacheEntriesDesc, prometheus.GaugeValue, float64(c.lru.Len()))
+	ch <- prometheus.MustNewConstMetric(cacheBytesDesc, prometheus.GaugeValue, float64(c.bytes))
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// cacheStats returns a copy of c's counters.
+func cacheStats(c *ItemCache) (stats struct{ hits, invalidations uint64 }) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats.hits, stats.invalidations = c.hits, c.invalidations
+	return stats
+}
+
+func TestItemCacheBounds(t *testing.T) {
+	c := NewItemCache(nil, newTestLogger(), 3, 10, 50*time.Millisecond)
+	fill := func(key, data string) {
+		c.put(key, []byte(data), c.startFill(key))
+	}
+	fill("a", "aaaa")
+	fill("b", "bbbb")
+	c.get("a")
+	fill("c", "c")
+	fill("d", "d")
+	if _, ok := c.get("b"); ok {
+		t.Error("expected the least recently used entry to be evicted by count")
+	}
+	fill("e", "eeeeee")
+	if _, ok := c.get("a"); ok || c.bytes != 8 {
+		t.Errorf("expected entries to be evicted by size, holding %d bytes", c.bytes)
+	}
+	fill("big", "0123456789a")
+	if _, ok := c.get("big"); ok {
+		t.Error("expected an entry larger than the cache not to be cached")
+	}
+
+	token := c.startFill("f")
+	c.invalidate("f")
+	c.put("f", []byte("f"), token)
+	if _, ok := c.get("f"); ok || len(c.fills) != 0 {
+		t.Error("expected a read that raced with a write not to be cached")
+	}
+
+	if _, ok := c.get("e"); !ok {
+		t.Fatal("expected e to be cached")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if _, ok := c.get("e"); ok {
+		t.Error("expected entries to expire after the maximum age")
+	}
+	if err := testutil.CollectAndCompare(c, strings.NewReader(`
+# HELP gocrud_item_cache_requests_total Item cache lookups by result: hit, miss or stale.
+# TYPE gocrud_item_cache_requests_total counter
+gocrud_item_cache_requests_total{result="hit"} 2
+gocrud_item_cache_requests_total{result="miss"} 5
+gocrud_item_cache_requests_total{result="stale"} 0
+# HELP gocrud_item_cache_evictions_total Items evicted from the cache to stay within its bounds.
+# TYPE gocrud_item_cache_evictions_total counter
+gocrud_item_cache_evictions_total 2
+`), "gocrud_item_cache_requests_total", "gocrud_item_cache_evictions_total"); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestItemCacheInvalidation checks that a write through one replica's store
+// evicts the item from another replica's cache.
+func TestItemCacheInvalidation(t *testing.T) {
+	ctx, cancel := context.WithCancel(testCtx)
+	defer cancel()
+	replicas := make([]*RedisStore, 2)
+	for i := range replicas {
+		replicas[i] = NewRedisStore(redisClient)
+		replicas[i].Cache = NewItemCache(redisClient, newTestLogger(), 100, 1<<20, time.Minute)
+		if err := replicas[i].Cache.Start(ctx); err != nil {
+			t.Fatalf("start: %v", err)
+		}
+	}
+	a, b := replicas[0], replicas[1]
+
+	item := &Item{ID: "cached", Type: "note", Data: json.RawMessage(`{"v":1}`)}
+	if err := a.SaveItem(testCtx, item); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	defer a.DeleteItem(testCtx, "cached")
+	// wait for the save to reach the other replica so it can't evict the item below
+	for cacheStats(b.Cache).invalidations == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if n := cacheStats(a.Cache).invalidations; n != 1 {
+		t.Fatalf("expected the writing replica to skip its own invalidation, got %d", n)
+	}
+	for i := 0; i < 2; i++ {
+		if got, err := b.GetItem(testCtx, "cached"); err != nil || string(got.Data) != `{"v":1}` {
+			t.Fatalf("get: %+v, %v", got, err)
+		}
+	}
+	if hits := cacheStats(b.Cache).hits; hits != 1 {
+		t.Fatalf("expected the second read to hit the cache, got %d hits", hits)
+	}
+
+	item.Data = json.RawMessage(`{"v":2}`)
+	if err := a.SaveItem(testCtx, item); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		got, err := b.GetItem(testCtx, "cached")
+		if err != nil {
+			t.Fatalf("get: %v", err)
+		}
+		if string(got.Data) == `{"v":2}` {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the other replica kept serving the stale item")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	a.GetItem(testCtx, "cached")
+	if _, ok := a.Cache.get(tenantKey(testCtx, "item:%s", "cached")); !ok {
+		t.Fatal("expected the item to be cached")
+	}
+	if err := a.DeleteItem(testCtx, "cached"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if _, err := a.GetItem(testCtx, "cached"); err != ErrNotFound {
+		t.Fatalf("expected the deleting replica to miss at once, got %v", err)
+	}
+}
@@ -0,0 +1,385 @@
+// Package client is a typed Go client for the gocrud API.
+//
+//	c := client.New("http://localhost:9090", os.Getenv("GOCRUD_KEY"))
+//	item, err := c.Create(ctx, client.CreateItemRequest{Type: "task", Data: json.RawMessage(`{"title":"x"}`)})
+//	if errors.Is(err, client.ErrForbidden) { ... }
+//
+// Requests that fail with 429 or a 5xx status, or with a network error, are
+// retried with exponential backoff. Creates and batches carry a generated
+// Idempotency-Key, so retrying them never creates duplicates.
+//
+// Items carry the ETag of the version read; passing it as IfMatch makes an
+// update, patch or delete fail with ErrPreconditionFailed if the item has
+// changed since.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"iter"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Item is a stored item.
+type Item struct {
+	ID           string          `json:"id"`
+	Type         string          `json:"type"`
+	Tags         []string        `json:"tags"`
+	Data         json.RawMessage `json:"data"`
+	Owner        string          `json:"owner,omitempty"`
+	ACL          *ItemACL        `json:"acl,omitempty"`
+	CreatedAt    time.Time       `json:"createdAt"`
+	LastModified time.Time       `json:"lastModified"`
+	// ETag identifies this version of the item. It is set on items returned
+	// by Create, Get, Update, Patch and Batch.
+	ETag string `json:"-"`
+}
+
+// ItemACL restricts an item to its owner, administrators and the principal
+// IDs, "group:<name>" entries or "*" listed.
+type ItemACL struct {
+	Read  []string `json:"read,omitempty"`
+	Write []string `json:"write,omitempty"`
+}
+
+// CreateItemRequest is the payload for creating an item.
+type CreateItemRequest struct {
+	Type string          `json:"type"`
+	Tags []string        `json:"tags,omitempty"`
+	Data json.RawMessage `json:"data"`
+	ACL  *ItemACL        `json:"acl,omitempty"`
+}
+
+// UpdateItemRequest is the payload for replacing an item's type, tags and
+// data. ACL is left unchanged when nil. IfMatch, when set, is the ETag the
+// item must still have.
+type UpdateItemRequest struct {
+	Type    string          `json:"type"`
+	Tags    []string        `json:"tags,omitempty"`
+	Data    json.RawMessage `json:"data"`
+	ACL     *ItemACL        `json:"acl,omitempty"`
+	IfMatch string          `json:"-"`
+}
+
+// PatchItemRequest is the payload for changing part of an item. Type, ACL
+// and, while nil, Tags are left unchanged; Data is a JSON merge patch (RFC
+// 7386) of the item's data, in which null removes a member. IfMatch, when
+// set, is the ETag the item must still have.
+type PatchItemRequest struct {
+	Type    string          `json:"type,omitempty"`
+	Tags    []string        `json:"tags"`
+	Data    json.RawMessage `json:"data,omitempty"`
+	ACL     *ItemACL        `json:"acl,omitempty"`
+	IfMatch string          `json:"-"`
+}
+
+// BatchOperation is one write of a batch. Op is "create", "update", "patch"
+// or "delete"; ID names the item for all but create, and the other fields
+// are those of the matching request.
+type BatchOperation struct {
+	Op      string          `json:"op"`
+	ID      string          `json:"id,omitempty"`
+	IfMatch string          `json:"ifMatch,omitempty"`
+	Type    string          `json:"type,omitempty"`
+	Tags    []string        `json:"tags"`
+	Data    json.RawMessage `json:"data,omitempty"`
+	ACL     *ItemACL        `json:"acl,omitempty"`
+}
+
+// BatchResult is the outcome of one operation of a batch.
+type BatchResult struct {
+	// Status is the HTTP status the single-item request would have had.
+	Status int `json:"status"`
+	// Item is the item created, updated or patched.
+	Item *Item `json:"item,omitempty"`
+	// Err is set when the operation failed and matches the same sentinel
+	// errors as a failed single-item request.
+	Err error `json:"-"`
+}
+
+// ListOptions filters items by type and tags; empty fields match everything.
+// PageSize is how many items Items fetches per request, 100 if zero.
+type ListOptions struct {
+	Type     string
+	Tags     []string
+	PageSize int
+}
+
+// Client calls a gocrud server with a bearer token (API key or JWT).
+type Client struct {
+	baseURL string
+	token   string
+
+	// HTTPClient sends the requests. Defaults to a client with a 30s timeout.
+	HTTPClient *http.Client
+	// MaxRetries is how many times a failed request is retried.
+	MaxRetries int
+	// MinBackoff and MaxBackoff bound the delay before each retry, which
+	// doubles per attempt. A Retry-After header from the server takes precedence.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// New creates a Client for the server at baseURL with default retry settings.
+func New(baseURL, token string) *Client {
+	return &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		token:      token,
+		HTTPClient: &http.Client{Timeout: 30 * time.Second},
+		MaxRetries: 3,
+		MinBackoff: 100 * time.Millisecond,
+		MaxBackoff: 5 * time.Second,
+	}
+}
+
+// Create creates an item. Retries reuse one Idempotency-Key, so the item is
+// created at most once.
+func (c *Client) Create(ctx context.Context, req CreateItemRequest) (*Item, error) {
+	header := http.Header{"Idempotency-Key": {uuid.NewString()}}
+	return c.item(ctx, http.MethodPost, "/items", header, req)
+}
+
+// Get returns the item with id.
+func (c *Client) Get(ctx context.Context, id string) (*Item, error) {
+	return c.item(ctx, http.MethodGet, "/items/"+url.PathEscape(id), nil, nil)
+}
+
+// Update replaces the type, tags and data of the item with id.
+func (c *Client) Update(ctx context.Context, id string, req UpdateItemRequest) (*Item, error) {
+	return c.item(ctx, http.MethodPut, "/items/"+url.PathEscape(id), ifMatch(req.IfMatch), req)
+}
+
+// Patch changes the fields of the item with id that req sets.
+func (c *Client) Patch(ctx context.Context, id string, req PatchItemRequest) (*Item, error) {
+	return c.item(ctx, http.MethodPatch, "/items/"+url.PathEscape(id), ifMatch(req.IfMatch), req)
+}
+
+// Delete deletes the item with id.
+func (c *Client) Delete(ctx context.Context, id string) error {
+	return c.DeleteIf(ctx, id, "")
+}
+
+// DeleteIf deletes the item with id if it still has etag, or in any case if
+// etag is empty.
+func (c *Client) DeleteIf(ctx context.Context, id, etag string) error {
+	_, err := c.do(ctx, http.MethodDelete, "/items/"+url.PathEscape(id), nil, ifMatch(etag), nil, nil)
+	return err
+}
+
+// Batch runs ops in order in one request and returns their results in the
+// same order. Each operation succeeds or fails on its own; the error is only
+// set if the batch as a whole was refused. Retries reuse one
+// Idempotency-Key, so the operations run at most once.
+func (c *Client) Batch(ctx context.Context, ops []BatchOperation) ([]BatchResult, error) {
+	var resp struct {
+		Results []struct {
+			Status int    `json:"status"`
+			Item   *Item  `json:"item"`
+			ETag   string `json:"etag"`
+			Error  string `json:"error"`
+		} `json:"results"`
+	}
+	header := http.Header{"Idempotency-Key": {uuid.NewString()}}
+	body := struct {
+		Operations []BatchOperation `json:"operations"`
+	}{ops}
+	if _, err := c.do(ctx, http.MethodPost, "/batch", nil, header, body, &resp); err != nil {
+		return nil, err
+	}
+	results := make([]BatchResult, len(resp.Results))
+	for i, r := range resp.Results {
+		results[i] = BatchResult{Status: r.Status, Item: r.Item}
+		if r.Item != nil {
+			r.Item.ETag = r.ETag
+		}
+		if r.Status >= 300 {
+			results[i].Err = &Error{StatusCode: r.Status, Message: r.Error}
+		}
+	}
+	return results, nil
+}
+
+// List returns the items matching opts that the caller may read, in one
+// response.
+func (c *Client) List(ctx context.Context, opts ListOptions) ([]*Item, error) {
+	var items []*Item
+	if _, err := c.do(ctx, http.MethodGet, "/items", opts.query(), nil, nil, &items); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// Items iterates over the items matching opts in order of their IDs,
+// fetching them a page at a time, and stops after the first error.
+func (c *Client) Items(ctx context.Context, opts ListOptions) iter.Seq2[*Item, error] {
+	return func(yield func(*Item, error) bool) {
+		query := opts.query()
+		pageSize := opts.PageSize
+		if pageSize <= 0 {
+			pageSize = 100
+		}
+		query.Set("limit", strconv.Itoa(pageSize))
+		for path := "/items"; path != ""; {
+			var items []*Item
+			header, err := c.do(ctx, http.MethodGet, path, query, nil, nil, &items)
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+			for _, item := range items {
+				if !yield(item, nil) {
+					return
+				}
+			}
+			path, query = nextPage(header)
+		}
+	}
+}
+
+func (o ListOptions) query() url.Values {
+	query := url.Values{}
+	if o.Type != "" {
+		query.Set("type", o.Type)
+	}
+	for _, tag := range o.Tags {
+		query.Add("tag", tag)
+	}
+	return query
+}
+
+// nextPage returns the path and query of the page a listing response links
+// to with rel="next", or "" if it was the last page.
+func nextPage(header http.Header) (string, url.Values) {
+	for _, link := range header.Values("Link") {
+		target, params, ok := strings.Cut(link, ";")
+		if !ok || !strings.Contains(params, `rel="next"`) {
+			continue
+		}
+		u, err := url.Parse(strings.Trim(strings.TrimSpace(target), "<>"))
+		if err != nil {
+			continue
+		}
+		return u.Path, u.Query()
+	}
+	return "", nil
+}
+
+// item sends a request answered with an item and sets the item's ETag.
+func (c *Client) item(ctx context.Context, method, path string, header http.Header, body interface{}) (*Item, error) {
+	var item Item
+	respHeader, err := c.do(ctx, method, path, nil, header, body, &item)
+	if err != nil {
+		return nil, err
+	}
+	item.ETag = respHeader.Get("ETag")
+	return &item, nil
+}
+
+// ifMatch returns the If-Match header for etag, or nil if etag is empty.
+func ifMatch(etag string) http.Header {
+	if etag == "" {
+		return nil
+	}
+	return http.Header{"If-Match": {etag}}
+}
+
+// do sends a request, retrying failures, and decodes a successful JSON
+// response into out unless it is nil. It returns the response headers.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, header http.Header, body, out interface{}) (http.Header, error) {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return nil, err
+		}
+	}
+	u := c.baseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		req.Header.Set("Authorization", "Bearer "+c.token)
+		req.Header.Set("Accept", "application/json")
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+
+		resp, err := c.HTTPClient.Do(req)
+		if err != nil {
+			if ctx.Err() != nil || attempt >= c.MaxRetries {
+				return nil, err
+			}
+			if err := c.wait(ctx, attempt, 0); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			defer resp.Body.Close()
+			if out == nil || resp.StatusCode == http.StatusNoContent {
+				io.Copy(io.Discard, resp.Body)
+				return resp.Header, nil
+			}
+			if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+				return nil, fmt.Errorf("decoding %s %s response: %w", method, path, err)
+			}
+			return resp.Header, nil
+		}
+
+		apiErr := newError(resp)
+		if !apiErr.retryable() || attempt >= c.MaxRetries {
+			return nil, apiErr
+		}
+		if err := c.wait(ctx, attempt, apiErr.RetryAfter); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// wait sleeps before retry attempt+1: retryAfter if the server sent one,
+// otherwise an exponential backoff with jitter.
+func (c *Client) wait(ctx context.Context, attempt int, retryAfter time.Duration) error {
+	delay := retryAfter
+	if delay <= 0 {
+		delay = c.MinBackoff << attempt
+		if delay > c.MaxBackoff || delay <= 0 {
+			delay = c.MaxBackoff
+		}
+		delay = delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// parseRetryAfter reads a Retry-After header given in seconds.
+func parseRetryAfter(v string) time.Duration {
+	secs, err := strconv.Atoi(strings.TrimSpace(v))
+	if err != nil || secs < 0 {
+		return 0
+	}
+	return time.Duration(secs) * time.Second
+}
@@ -0,0 +1,113 @@
+package client_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gocrud/client"
+)
+
+// TestClientRetries checks that server errors and rate limits are retried
+// with the same idempotency key and that client errors are not.
+func TestClientRetries(t *testing.T) {
+	var calls atomic.Int32
+	keys := make(chan string, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys <- r.Header.Get("Idempotency-Key")
+		switch calls.Add(1) {
+		case 1:
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		case 2:
+			w.Header().Set("Retry-After", "0")
+			http.Error(w, "slow down", http.StatusTooManyRequests)
+		case 3:
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"id":"x","type":"t","data":{}}`))
+		default:
+			http.Error(w, "bad", http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+
+	c := client.New(srv.URL, "k")
+	c.MinBackoff, c.MaxBackoff = time.Millisecond, 5*time.Millisecond
+	item, err := c.Create(context.Background(), client.CreateItemRequest{Type: "t", Data: json.RawMessage(`{}`)})
+	if err != nil || item.ID != "x" || calls.Load() != 3 {
+		t.Fatalf("expected success on the third attempt, got %+v, %v after %d calls", item, err, calls.Load())
+	}
+	first := <-keys
+	if first == "" || <-keys != first || <-keys != first {
+		t.Fatal("expected every attempt to carry the same Idempotency-Key")
+	}
+
+	_, err = c.Get(context.Background(), "x")
+	var apiErr *client.Error
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadRequest || apiErr.Message != "bad" || calls.Load() != 4 {
+		t.Fatalf("expected a single 400 attempt, got %v after %d calls", err, calls.Load())
+	}
+}
+
+// TestClientPages checks that Items follows the Link header from page to
+// page and keeps the filters and page size on every request.
+func TestClientPages(t *testing.T) {
+	pages := map[string]string{
+		"":  `[{"id":"a"},{"id":"b"}]`,
+		"b": `[{"id":"c"}]`,
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("type") != "t" || q.Get("limit") != "2" {
+			http.Error(w, "lost the filter or page size: "+r.URL.RawQuery, http.StatusBadRequest)
+			return
+		}
+		if q.Get("cursor") == "" {
+			w.Header().Set("Link", `</items?cursor=b&limit=2&type=t>; rel="next"`)
+		}
+		w.Write([]byte(pages[q.Get("cursor")]))
+	}))
+	defer srv.Close()
+
+	var ids []string
+	for item, err := range client.New(srv.URL, "k").Items(context.Background(), client.ListOptions{Type: "t", PageSize: 2}) {
+		if err != nil {
+			t.Fatalf("items: %v", err)
+		}
+		ids = append(ids, item.ID)
+	}
+	if len(ids) != 3 || ids[0] != "a" || ids[2] != "c" {
+		t.Errorf("expected a, b, c across two pages, got %v", ids)
+	}
+}
+
+// TestClientBatch checks that failed batch operations come back as errors
+// matching the sentinel for their status.
+func TestClientBatch(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Idempotency-Key") == "" {
+			http.Error(w, "missing Idempotency-Key", http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`{"results":[{"status":201,"item":{"id":"a"},"etag":"\"1\""},{"status":412,"error":"item was modified"}]}`))
+	}))
+	defer srv.Close()
+
+	results, err := client.New(srv.URL, "k").Batch(context.Background(), []client.BatchOperation{
+		{Op: "create", Type: "t", Data: json.RawMessage(`{}`)},
+		{Op: "delete", ID: "b", IfMatch: `"0"`},
+	})
+	if err != nil || len(results) != 2 {
+		t.Fatalf("batch: %v, %v", results, err)
+	}
+	if results[0].Err != nil || results[0].Item.ETag != `"1"` {
+		t.Errorf("expected the created item with its ETag, got %+v", results[0])
+	}
+	if !errors.Is(results[1].Err, client.ErrPreconditionFailed) {
+		t.Errorf("expected ErrPreconditionFailed, got %v", results[1].Err)
+	}
+}
@@ -0,0 +1,103 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Errors matched by errors.Is against an *Error according to its status.
+var (
+	ErrInvalid      = errors.New("invalid request")
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrForbidden    = errors.New("forbidden")
+	ErrNotFound     = errors.New("not found")
+	ErrConflict     = errors.New("conflict")
+	ErrRateLimited  = errors.New("rate limited")
+	ErrUnavailable  = errors.New("server error")
+	// ErrPreconditionFailed matches a conditional write to an item that
+	// changed since the ETag given.
+	ErrPreconditionFailed = errors.New("precondition failed")
+	// ErrReadOnly and ErrMaintenance match requests refused by the service
+	// mode, which are not retried.
+	ErrReadOnly    = errors.New("service is read-only")
+	ErrMaintenance = errors.New("service is under maintenance")
+)
+
+// Error is a non-2xx response from the server.
+type Error struct {
+	StatusCode int
+	// Message is the response body, which explains 400 and 403 responses.
+	Message string
+	// RetryAfter is the delay the server asked for, if any.
+	RetryAfter time.Duration
+	// Mode is "read-only" or "maintenance" when the service mode refused
+	// the request; Message then holds the operator's explanation.
+	Mode string
+}
+
+func newError(resp *http.Response) *Error {
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+	e := &Error{
+		StatusCode: resp.StatusCode,
+		Message:    strings.TrimSpace(string(body)),
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+	}
+	if resp.Header.Get("Content-Type") == "application/problem+json" {
+		var problem struct {
+			Detail string `json:"detail"`
+			Mode   string `json:"mode"`
+		}
+		if json.Unmarshal(body, &problem) == nil {
+			e.Message, e.Mode = problem.Detail, problem.Mode
+		}
+	}
+	return e
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("gocrud: %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("gocrud: %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// Is matches the sentinel error for e's status code.
+func (e *Error) Is(target error) bool {
+	switch target {
+	case ErrInvalid:
+		return e.StatusCode == http.StatusBadRequest
+	case ErrUnauthorized:
+		return e.StatusCode == http.StatusUnauthorized
+	case ErrForbidden:
+		return e.StatusCode == http.StatusForbidden
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case ErrConflict:
+		return e.StatusCode == http.StatusConflict
+	case ErrPreconditionFailed:
+		return e.StatusCode == http.StatusPreconditionFailed
+	case ErrRateLimited:
+		return e.StatusCode == http.StatusTooManyRequests
+	case ErrUnavailable:
+		return e.StatusCode >= 500
+	case ErrReadOnly:
+		return e.Mode == "read-only"
+	case ErrMaintenance:
+		return e.Mode == "maintenance"
+	}
+	return false
+}
+
+// retryable reports whether the request may succeed if sent again: rate
+// limits, server errors other than a refusal by the service mode, and an
+// idempotent create that is still in progress.
+func (e *Error) retryable() bool {
+	return e.StatusCode == http.StatusTooManyRequests || (e.StatusCode >= 500 && e.Mode == "") ||
+		(e.StatusCode == http.StatusConflict && e.RetryAfter > 0)
+}
@@ -0,0 +1,88 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// Event is a change to an item matching a watch.
+type Event struct {
+	// Event is "item.created", "item.updated" or "item.deleted".
+	Event string `json:"event"`
+	Item  *Item  `json:"item"`
+}
+
+// Watcher streams item changes over the server's /ws endpoint.
+type Watcher struct {
+	conn *websocket.Conn
+	stop func() bool
+}
+
+// wsFrame is the subset of the server's WebSocket messages a Watcher reads and writes.
+type wsFrame struct {
+	Op           string   `json:"op"`
+	Subscription string   `json:"subscription,omitempty"`
+	Type         string   `json:"type,omitempty"`
+	Tags         []string `json:"tags,omitempty"`
+	Event        string   `json:"event,omitempty"`
+	Status       int      `json:"status,omitempty"`
+	Item         *Item    `json:"item,omitempty"`
+	Error        string   `json:"error,omitempty"`
+}
+
+// Watch subscribes to changes of items matching opts. The subscription is
+// confirmed before Watch returns; it ends when ctx is done or Close is called.
+func (c *Client) Watch(ctx context.Context, opts ListOptions) (*Watcher, error) {
+	u := "ws" + strings.TrimPrefix(c.baseURL, "http") + "/ws"
+	header := http.Header{"Authorization": {"Bearer " + c.token}}
+	conn, resp, err := websocket.DefaultDialer.DialContext(ctx, u, header)
+	if err != nil {
+		if resp != nil {
+			return nil, newError(resp)
+		}
+		return nil, err
+	}
+	w := &Watcher{conn: conn, stop: context.AfterFunc(ctx, func() { conn.Close() })}
+
+	if err := conn.WriteJSON(wsFrame{Op: "subscribe", Subscription: "watch", Type: opts.Type, Tags: opts.Tags}); err != nil {
+		w.Close()
+		return nil, err
+	}
+	var reply wsFrame
+	if err := conn.ReadJSON(&reply); err != nil {
+		w.Close()
+		return nil, err
+	}
+	if reply.Op == "error" {
+		w.Close()
+		return nil, &Error{StatusCode: reply.Status, Message: reply.Error}
+	}
+	return w, nil
+}
+
+// Next blocks until the next change arrives. It returns an error once the
+// connection is closed.
+func (w *Watcher) Next() (Event, error) {
+	for {
+		var frame wsFrame
+		if err := w.conn.ReadJSON(&frame); err != nil {
+			return Event{}, err
+		}
+		switch frame.Op {
+		case "event":
+			return Event{Event: frame.Event, Item: frame.Item}, nil
+		case "error":
+			return Event{}, fmt.Errorf("gocrud: watch: %s", frame.Error)
+		}
+	}
+}
+
+// Close ends the watch.
+func (w *Watcher) Close() error {
+	w.stop()
+	return w.conn.Close()
+}
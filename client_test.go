@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gocrud/client"
+)
+
+// TestClient drives the client package against the in-process server.
+func TestClient(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c := client.New(testServerURL, testAPIKey)
+
+	if _, err := client.New(testServerURL, "wrong-key").Get(ctx, "x"); !errors.Is(err, client.ErrUnauthorized) {
+		t.Fatalf("expected ErrUnauthorized with a bad key, got %v", err)
+	}
+	if _, err := c.Get(ctx, "no-such-item"); !errors.Is(err, client.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if _, err := c.Create(ctx, client.CreateItemRequest{Type: "", Data: json.RawMessage(`{}`)}); !errors.Is(err, client.ErrInvalid) {
+		t.Fatalf("expected ErrInvalid for a missing type, got %v", err)
+	}
+
+	w, err := c.Watch(ctx, client.ListOptions{Type: "sdknote"})
+	if err != nil {
+		t.Fatalf("watch: %v", err)
+	}
+	defer w.Close()
+
+	item, err := c.Create(ctx, client.CreateItemRequest{Type: "sdknote", Tags: []string{"a"}, Data: json.RawMessage(`{"n":1}`)})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	ev, err := w.Next()
+	if err != nil || ev.Event != "item.created" || ev.Item.ID != item.ID {
+		t.Fatalf("expected created event for %s, got %+v, %v", item.ID, ev, err)
+	}
+
+	got, err := c.Get(ctx, item.ID)
+	if err != nil || string(got.Data) != `{"n":1}` {
+		t.Fatalf("get: %+v, %v", got, err)
+	}
+	updated, err := c.Update(ctx, item.ID, client.UpdateItemRequest{Type: "sdknote", Tags: []string{"a", "b"}, Data: json.RawMessage(`{"n":2}`)})
+	if err != nil || string(updated.Data) != `{"n":2}` {
+		t.Fatalf("update: %+v, %v", updated, err)
+	}
+
+	if _, err := c.Update(ctx, item.ID, client.UpdateItemRequest{Type: "sdknote", Data: json.RawMessage(`{}`), IfMatch: got.ETag}); !errors.Is(err, client.ErrPreconditionFailed) {
+		t.Fatalf("expected ErrPreconditionFailed updating with a stale ETag, got %v", err)
+	}
+	patched, err := c.Patch(ctx, item.ID, client.PatchItemRequest{Data: json.RawMessage(`{"m":3}`), IfMatch: updated.ETag})
+	if err != nil || string(patched.Data) != `{"m":3,"n":2}` || len(patched.Tags) != 2 || patched.ETag == updated.ETag {
+		t.Fatalf("patch: %+v, %v", patched, err)
+	}
+
+	var ids []string
+	for it, err := range c.Items(ctx, client.ListOptions{Type: "sdknote", Tags: []string{"b"}, PageSize: 1}) {
+		if err != nil {
+			t.Fatalf("items: %v", err)
+		}
+		ids = append(ids, it.ID)
+	}
+	if len(ids) != 1 || ids[0] != item.ID {
+		t.Fatalf("expected only %s when filtering, got %v", item.ID, ids)
+	}
+
+	if err := c.DeleteIf(ctx, item.ID, updated.ETag); !errors.Is(err, client.ErrPreconditionFailed) {
+		t.Fatalf("expected ErrPreconditionFailed deleting with a stale ETag, got %v", err)
+	}
+	if err := c.DeleteIf(ctx, item.ID, patched.ETag); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if _, err := c.Get(ctx, item.ID); !errors.Is(err, client.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound after delete, got %v", err)
+	}
+}
+
+// TestClientReplayedCreate checks that a create retried after its response
+// was lost gets the stored response back, ETag included.
+func TestClientReplayedCreate(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	target, _ := url.Parse(testServerURL)
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	var lost atomic.Bool
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		if resp.Request.Method == http.MethodPost && lost.CompareAndSwap(false, true) {
+			return errors.New("response lost")
+		}
+		return nil
+	}
+	srv := httptest.NewServer(proxy)
+	defer srv.Close()
+	c := client.New(srv.URL, testAPIKey)
+	c.MinBackoff, c.MaxBackoff = time.Millisecond, 5*time.Millisecond
+
+	item, err := c.Create(ctx, client.CreateItemRequest{Type: "sdkreplay", Data: json.RawMessage(`{}`)})
+	if err != nil || !lost.Load() {
+		t.Fatalf("create: %+v, %v", item, err)
+	}
+	defer c.Delete(ctx, item.ID)
+	got, err := c.Get(ctx, item.ID)
+	if err != nil || item.ETag == "" || item.ETag != got.ETag {
+		t.Fatalf("expected the replayed create to carry ETag %q, got %q (%v)", got.ETag, item.ETag, err)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// keySlot returns the Redis Cluster hash slot of key: the CRC16 of its hash
+// tag, or of the whole key when it has none, modulo 16384.
+func keySlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	var crc uint16
+	for i := 0; i < len(key); i++ {
+		crc ^= uint16(key[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return int(crc % 16384)
+}
+
+// TestTenantKeysShareSlot checks that every key of a tenant hashes to the
+// same cluster slot, so multi-key commands on them are allowed.
+func TestTenantKeysShareSlot(t *testing.T) {
+	if keySlot("123456789") != 12739 || keySlot("{user1000}.following") != keySlot("{user1000}.followers") {
+		t.Fatal("keySlot does not match the Redis Cluster specification")
+	}
+	for _, tenant := range []string{"", "acme"} {
+		ctx := withTenant(testCtx, tenant)
+		want := keySlot(tenantKey(ctx, "items"))
+		for _, key := range []string{
+			tenantKey(ctx, "item:%s", "1"),
+			tenantKey(ctx, "items:type:%s", "note"),
+			tenantKey(ctx, "items:tag:%s", "urgent"),
+			tenantKey(ctx, "webhooks"),
+			tenantKey(ctx, "webhook:%s:deliveries", "w1"),
+			tenantKey(ctx, "webhook:%s:dead", "w1"),
+			tenantKey(ctx, auditStreamKey),
+			tenantKey(ctx, auditItemStreamKey, "1"),
+			tenantKey(ctx, auditActorStreamKey, "key:abc"),
+		} {
+			if got := keySlot(key); got != want {
+				t.Errorf("tenant %q: %s is in slot %d, expected %d", tenant, key, got, want)
+			}
+		}
+		if got, rest, ok := splitTenantKey(tenantKey(ctx, "items:type:note")); !ok || got != tenant || rest != "items:type:note" {
+			t.Errorf("splitTenantKey: got %q, %q, %v", got, rest, ok)
+		}
+	}
+}
+
+// TestCluster runs the store against a Redis Cluster. It needs the address
+// of one or more nodes in REDIS_CLUSTER_ADDRS and is skipped otherwise.
+func TestCluster(t *testing.T) {
+	addrs := os.Getenv("REDIS_CLUSTER_ADDRS")
+	if addrs == "" {
+		t.Skip("REDIS_CLUSTER_ADDRS is not set")
+	}
+	cfg := defaultConfig()
+	cfg.Redis.Mode = "cluster"
+	cfg.Redis.Addrs.Set(addrs)
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	client, err := connectRedis(testCtx, cfg)
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	defer client.Close()
+	if _, ok := client.(*redis.ClusterClient); !ok {
+		t.Fatalf("expected a cluster client, got %T", client)
+	}
+
+	tenants := NewTenantStore(client)
+	if err := tenants.CreateTenant(testCtx, &Tenant{ID: "clustertest", Name: "Cluster", CreatedAt: time.Now()}); err != nil {
+		t.Fatalf("create tenant: %v", err)
+	}
+	ctx := withTenant(testCtx, "clustertest")
+	store := NewRedisStore(client)
+	for _, item := range []*Item{
+		{ID: "a", Type: "task", Tags: []string{"x", "y"}, Data: json.RawMessage(`{}`)},
+		{ID: "b", Type: "task", Tags: []string{"x"}, Data: json.RawMessage(`{}`)},
+		{ID: "c", Type: "note", Tags: []string{"y"}, Data: json.RawMessage(`{}`)},
+	} {
+		if err := store.SaveItem(ctx, item); err != nil {
+			t.Fatalf("save: %v", err)
+		}
+	}
+	items, err := store.ListItems(ctx, "task", []string{"x", "y"})
+	if err != nil || len(items) != 1 || items[0].ID != "a" {
+		t.Fatalf("expected type and tag filters to intersect to item a, got %v, %v", items, err)
+	}
+	if err := store.DeleteItem(ctx, "b"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	client.SAdd(testCtx, tenantKey(ctx, "items:tag:stale"), "gone")
+	if n, err := store.Reindex(ctx); err != nil || n != 2 {
+		t.Fatalf("reindex: %d, %v", n, err)
+	}
+
+	webhooks := NewWebhookStore(client)
+	if err := webhooks.SaveWebhook(ctx, &Webhook{ID: "w1", URL: "http://example.com", Events: []string{"item.created"}}); err != nil {
+		t.Fatalf("save webhook: %v", err)
+	}
+	webhooks.LogDelivery(ctx, "w1", DeliveryRecord{})
+	if err := webhooks.DeleteWebhook(ctx, "w1"); err != nil {
+		t.Fatalf("delete webhook: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	NewHealth(client).handleStatus(rec, httptest.NewRequest("GET", "/status", nil))
+	var st Status
+	json.NewDecoder(rec.Body).Decode(&st)
+	if !st.Redis.OK || st.Redis.Mode != "cluster" {
+		t.Errorf("expected a healthy cluster in /status, got %+v", st.Redis)
+	}
+
+	if err := tenants.DeleteTenant(testCtx, "clustertest"); err != nil {
+		t.Fatalf("delete tenant: %v", err)
+	}
+	if keys, err := scanKeys(testCtx, client, tenantPrefix("clustertest")+"*"); err != nil || len(keys) != 0 {
+		t.Errorf("expected the tenant's keys to be removed, got %v, %v", keys, err)
+	}
+}
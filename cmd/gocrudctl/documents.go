@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gocrud/client"
+	"gopkg.in/yaml.v3"
+)
+
+// document is an item read from a file: the payload of a create request, as
+// in mockdata/, optionally with the ID of the item it updates. Exported items
+// have this shape too; their remaining fields are ignored.
+type document struct {
+	ID   string          `json:"id,omitempty"`
+	Type string          `json:"type"`
+	Tags []string        `json:"tags,omitempty"`
+	Data json.RawMessage `json:"data"`
+	ACL  *client.ItemACL `json:"acl,omitempty"`
+}
+
+// readDocuments reads the documents in path: a JSON or YAML file holding one
+// object or an array of them, "-" for stdin, or a directory whose .json, .yaml
+// and .yml files are read in name order.
+func readDocuments(path string) ([]document, error) {
+	if path == "" {
+		return nil, errors.New("-f is required")
+	}
+	if path == "-" {
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return nil, err
+		}
+		return parseDocuments("stdin", data)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	files := []string{path}
+	if info.IsDir() {
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		files = files[:0]
+		for _, e := range entries {
+			switch strings.ToLower(filepath.Ext(e.Name())) {
+			case ".json", ".yaml", ".yml":
+				if !e.IsDir() {
+					files = append(files, filepath.Join(path, e.Name()))
+				}
+			}
+		}
+		sort.Strings(files)
+	}
+	var docs []document
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		parsed, err := parseDocuments(f, data)
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, parsed...)
+	}
+	return docs, nil
+}
+
+// parseDocuments decodes one document or an array of them. Files named
+// .yaml or .yml are YAML; anything else is JSON if it looks like JSON, so the
+// data of JSON documents is kept verbatim, large numbers included.
+func parseDocuments(name string, data []byte) ([]document, error) {
+	js := bytes.TrimSpace(data)
+	ext := strings.ToLower(filepath.Ext(name))
+	looksJSON := len(js) > 0 && (js[0] == '{' || js[0] == '[')
+	if ext == ".yaml" || ext == ".yml" || ext != ".json" && !looksJSON {
+		var v interface{}
+		if err := yaml.Unmarshal(data, &v); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		// YAML decodes to JSON-compatible values, so re-encoding lets the JSON
+		// tags and json.RawMessage data apply to both formats.
+		var err error
+		if js, err = json.Marshal(v); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	var (
+		docs []document
+		err  error
+	)
+	if len(js) > 0 && js[0] == '[' {
+		err = json.Unmarshal(js, &docs)
+	} else {
+		docs = make([]document, 1)
+		err = json.Unmarshal(js, &docs[0])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	for i, d := range docs {
+		if d.Type == "" {
+			return nil, fmt.Errorf("%s: document %d has no type", name, i+1)
+		}
+	}
+	return docs, nil
+}
+
+// upsert updates the item named by d.ID if it exists, or creates a new one
+// when d has no ID or the item does not exist. The server assigns IDs, so a
+// created item's ID differs from d.ID.
+func upsert(ctx context.Context, c *client.Client, d document) (string, *client.Item, error) {
+	if d.ID != "" {
+		_, err := c.Get(ctx, d.ID)
+		if err == nil {
+			var item *client.Item
+			if item, err = c.Update(ctx, d.ID, client.UpdateItemRequest{Type: d.Type, Tags: d.Tags, Data: d.Data, ACL: d.ACL}); err == nil {
+				return "updated", item, nil
+			}
+		}
+		// an item deleted between the two requests is created as well
+		if !errors.Is(err, client.ErrNotFound) {
+			return "", nil, fmt.Errorf("updating %s: %w", d.ID, err)
+		}
+	}
+	item, err := c.Create(ctx, client.CreateItemRequest{Type: d.Type, Tags: d.Tags, Data: d.Data, ACL: d.ACL})
+	if err != nil {
+		return "", nil, fmt.Errorf("creating %s item: %w", d.Type, err)
+	}
+	return "created", item, nil
+}
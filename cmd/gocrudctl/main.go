@@ -0,0 +1,203 @@
+// Command gocrudctl is a command-line client for the gocrud API.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"gocrud/client"
+)
+
+const usage = `usage: gocrudctl <command> [flags] [args]
+
+commands:
+  get <id>...        print items
+  list               list items, filtered with --type and --tag
+  create -f <path>   create the items in a file or directory
+  apply -f <path>    update the items in a file or directory by id, creating those that do not exist
+  delete <id>...     delete items
+  export             write every item, filtered with --type and --tag, as a JSON array
+  import -f <path>   apply an export
+  watch              print changes to items, filtered with --type and --tag, until interrupted
+
+Every command takes --profile, --url and --key; commands that print items take
+-o table|json|yaml. Files may be JSON or YAML and hold one item or an array;
+-f - reads stdin. Profiles are read from $GOCRUDCTL_CONFIG or
+gocrud/gocrudctl.yaml in the user config directory.
+`
+
+// errUsage reports a command line that could not be parsed; usage has been printed.
+var errUsage = errors.New("invalid usage")
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := run(ctx, os.Args[1:], os.Stdout, os.Stderr); err != nil {
+		if errors.Is(err, errUsage) {
+			os.Exit(2)
+		}
+		fmt.Fprintln(os.Stderr, "gocrudctl:", err)
+		os.Exit(1)
+	}
+}
+
+// stringList is a repeatable string flag.
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// run executes the command in args, writing results to stdout.
+func run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	if len(args) == 0 || args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		fmt.Fprint(stderr, usage)
+		if len(args) == 0 {
+			return errUsage
+		}
+		return nil
+	}
+	name := args[0]
+	fs := flag.NewFlagSet("gocrudctl "+name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	profileName := fs.String("profile", "", "profile from the config file")
+	url := fs.String("url", "", "server base URL (overrides GOCRUD_URL and the profile)")
+	key := fs.String("key", "", "API key or JWT (overrides GOCRUD_KEY and the profile)")
+	format := formatTable
+	var typ, file string
+	var tags stringList
+	switch name {
+	case "get", "list", "create", "apply", "import", "watch":
+		fs.StringVar(&format, "o", formatTable, "output format: table, json or yaml")
+	}
+	switch name {
+	case "list", "export", "watch":
+		fs.StringVar(&typ, "type", "", "only items of this type")
+		fs.Var(&tags, "tag", "only items carrying this tag (repeatable)")
+	case "create", "apply", "import":
+		fs.StringVar(&file, "f", "", "file or directory to read, - for stdin")
+	case "get", "delete":
+	default:
+		fmt.Fprintf(stderr, "unknown command %q\n\n%s", name, usage)
+		return errUsage
+	}
+	if err := fs.Parse(args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return errUsage
+	}
+	if !validFormat(format) {
+		return fmt.Errorf("unknown output format %q", format)
+	}
+
+	path, err := configPath()
+	if err != nil {
+		return err
+	}
+	p, err := resolveProfile(path, *profileName, *url, *key, os.Getenv)
+	if err != nil {
+		return err
+	}
+	c := client.New(p.URL, p.Key)
+	opts := client.ListOptions{Type: typ, Tags: tags}
+
+	switch name {
+	case "get":
+		if fs.NArg() == 0 {
+			return errors.New("get: at least one item ID is required")
+		}
+		var items []*client.Item
+		for _, id := range fs.Args() {
+			item, err := c.Get(ctx, id)
+			if err != nil {
+				return fmt.Errorf("getting %s: %w", id, err)
+			}
+			items = append(items, item)
+		}
+		return printItems(stdout, format, items)
+	case "list":
+		items, err := c.List(ctx, opts)
+		if err != nil {
+			return err
+		}
+		return printItems(stdout, format, items)
+	case "create":
+		docs, err := readDocuments(file)
+		if err != nil {
+			return err
+		}
+		var items []*client.Item
+		for _, d := range docs {
+			d.ID = ""
+			_, item, err := upsert(ctx, c, d)
+			if err != nil {
+				return err
+			}
+			items = append(items, item)
+		}
+		return printItems(stdout, format, items)
+	case "apply", "import":
+		docs, err := readDocuments(file)
+		if err != nil {
+			return err
+		}
+		for _, d := range docs {
+			action, item, err := upsert(ctx, c, d)
+			if err != nil {
+				return err
+			}
+			if format == formatTable {
+				fmt.Fprintf(stdout, "%s %s\n", action, item.ID)
+			} else if err := printItems(stdout, format, []*client.Item{item}); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "delete":
+		if fs.NArg() == 0 {
+			return errors.New("delete: at least one item ID is required")
+		}
+		for _, id := range fs.Args() {
+			if err := c.Delete(ctx, id); err != nil {
+				return fmt.Errorf("deleting %s: %w", id, err)
+			}
+			fmt.Fprintf(stdout, "deleted %s\n", id)
+		}
+		return nil
+	case "export":
+		items, err := c.List(ctx, opts)
+		if err != nil {
+			return err
+		}
+		return printItems(stdout, formatJSON, items)
+	default: // watch
+		w, err := c.Watch(ctx, opts)
+		if err != nil {
+			return err
+		}
+		defer w.Close()
+		for {
+			ev, err := w.Next()
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				return err
+			}
+			if err := printEvent(stdout, format, ev); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gocrud/client"
+)
+
+func TestResolveProfile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gocrudctl.yaml")
+	os.WriteFile(path, []byte("current: prod\nprofiles:\n  prod: {url: 'https://prod', key: pk}\n  dev: {url: 'http://dev', key: dk}\n"), 0o600)
+	env := map[string]string{}
+	getenv := func(k string) string { return env[k] }
+
+	cases := []struct {
+		name, flagName, flagURL, flagKey string
+		env                              map[string]string
+		want                             profile
+	}{
+		{name: "current profile", want: profile{"https://prod", "pk"}},
+		{name: "named profile", flagName: "dev", want: profile{"http://dev", "dk"}},
+		{name: "profile from env", env: map[string]string{"GOCRUD_PROFILE": "dev"}, want: profile{"http://dev", "dk"}},
+		{name: "env overrides profile", env: map[string]string{"GOCRUD_KEY": "ek"}, want: profile{"https://prod", "ek"}},
+		{name: "flags override env", flagURL: "http://flag", env: map[string]string{"GOCRUD_URL": "http://env"}, want: profile{"http://flag", "pk"}},
+	}
+	for _, tc := range cases {
+		env = tc.env
+		got, err := resolveProfile(path, tc.flagName, tc.flagURL, tc.flagKey, getenv)
+		if err != nil || got != tc.want {
+			t.Errorf("%s: got %+v, %v; want %+v", tc.name, got, err, tc.want)
+		}
+	}
+
+	env = nil
+	if _, err := resolveProfile(path, "staging", "", "", getenv); err == nil {
+		t.Error("expected an error for an undefined profile")
+	}
+	got, err := resolveProfile(filepath.Join(t.TempDir(), "missing.yaml"), "", "", "", getenv)
+	if err != nil || got.URL != defaultURL {
+		t.Errorf("expected the default URL without a config file, got %+v, %v", got, err)
+	}
+}
+
+func TestReadDocuments(t *testing.T) {
+	docs, err := readDocuments(filepath.Join("..", "..", "mockdata"))
+	if err != nil {
+		t.Fatalf("reading mockdata: %v", err)
+	}
+	if len(docs) != 4 {
+		t.Fatalf("expected 4 documents from mockdata, got %d", len(docs))
+	}
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "a.yaml"), []byte("- id: x1\n  type: note\n  tags: [a]\n  data: {title: hi, n: 1}\n- type: note\n  data: {}\n"), 0o600)
+	os.WriteFile(filepath.Join(dir, "b.json"), []byte(`{"id":"x2","type":"note","data":{"n":12345678901234567890123},"createdAt":"2026-01-01T00:00:00Z"}`), 0o600)
+	os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("ignored"), 0o600)
+	docs, err = readDocuments(dir)
+	if err != nil {
+		t.Fatalf("reading directory: %v", err)
+	}
+	if len(docs) != 3 || docs[0].ID != "x1" || docs[1].ID != "" || docs[2].ID != "x2" {
+		t.Fatalf("unexpected documents: %+v", docs)
+	}
+	if string(docs[0].Data) != `{"n":1,"title":"hi"}` || string(docs[2].Data) != `{"n":12345678901234567890123}` {
+		t.Fatalf("unexpected data: %s, %s", docs[0].Data, docs[2].Data)
+	}
+
+	if _, err := parseDocuments("bad", []byte(`{"data":{}}`)); err == nil {
+		t.Error("expected an error for a document without a type")
+	}
+}
+
+func TestPrintItemsYAML(t *testing.T) {
+	var buf bytes.Buffer
+	items := []*client.Item{{ID: "1", Type: "note", Tags: []string{"a"}, Data: json.RawMessage(`{"zip":"01234","ok":"true"}`)}}
+	if err := printItems(&buf, formatYAML, items); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	// field order follows the API and strings that look like other types stay quoted
+	if !strings.HasPrefix(out, "- id: \"1\"\n  type: note\n") || !strings.Contains(out, `zip: "01234"`) || !strings.Contains(out, `ok: "true"`) {
+		t.Fatalf("unexpected YAML:\n%s", out)
+	}
+}
+
+// TestApply checks that apply updates the items it finds by ID and creates
+// those that do not exist.
+func TestApply(t *testing.T) {
+	var calls []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls = append(calls, r.Method+" "+r.URL.Path)
+		switch {
+		case r.Method == http.MethodPut && r.URL.Path == "/items/known":
+			w.Write([]byte(`{"id":"known","type":"note","data":{}}`))
+		case r.Method == http.MethodGet && r.URL.Path == "/items/known":
+			w.Write([]byte(`{"id":"known","type":"note","data":{}}`))
+		case r.Method == http.MethodGet:
+			http.NotFound(w, r)
+		case r.Method == http.MethodPost && r.URL.Path == "/items":
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"id":"new","type":"note","data":{}}`))
+		default:
+			http.Error(w, "unexpected", http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+
+	file := filepath.Join(t.TempDir(), "items.json")
+	os.WriteFile(file, []byte(`[{"id":"known","type":"note","data":{}},{"id":"gone","type":"note","data":{}},{"type":"note","data":{}}]`), 0o600)
+	t.Setenv("GOCRUDCTL_CONFIG", filepath.Join(t.TempDir(), "none.yaml"))
+
+	var out bytes.Buffer
+	if err := run(context.Background(), []string{"apply", "--url", srv.URL, "--key", "k", "-f", file}, &out, &out); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	if want := "updated known\ncreated new\ncreated new\n"; out.String() != want {
+		t.Fatalf("expected output %q, got %q", want, out.String())
+	}
+	want := []string{"GET /items/known", "PUT /items/known", "GET /items/gone", "POST /items", "POST /items"}
+	if strings.Join(calls, ",") != strings.Join(want, ",") {
+		t.Fatalf("expected calls %v, got %v", want, calls)
+	}
+}
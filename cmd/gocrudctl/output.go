@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"gocrud/client"
+	"gopkg.in/yaml.v3"
+)
+
+// Output formats selected with -o.
+const (
+	formatTable = "table"
+	formatJSON  = "json"
+	formatYAML  = "yaml"
+)
+
+func validFormat(f string) bool {
+	return f == formatTable || f == formatJSON || f == formatYAML
+}
+
+// printItems writes items as an aligned table, a JSON array or a YAML sequence.
+func printItems(w io.Writer, format string, items []*client.Item) error {
+	if items == nil {
+		items = []*client.Item{}
+	}
+	switch format {
+	case formatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(items)
+	case formatYAML:
+		return writeYAML(w, items)
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tTYPE\tTAGS\tLAST MODIFIED")
+	for _, item := range items {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", item.ID, item.Type, strings.Join(item.Tags, ","), item.LastModified.Format(time.RFC3339))
+	}
+	return tw.Flush()
+}
+
+// printEvent writes one watched change: a line per event for tables, a JSON
+// object per line or a YAML document.
+func printEvent(w io.Writer, format string, ev client.Event) error {
+	switch format {
+	case formatJSON:
+		return json.NewEncoder(w).Encode(ev)
+	case formatYAML:
+		if _, err := io.WriteString(w, "---\n"); err != nil {
+			return err
+		}
+		return writeYAML(w, ev)
+	}
+	_, err := fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", ev.Event, ev.Item.ID, ev.Item.Type, strings.Join(ev.Item.Tags, ","))
+	return err
+}
+
+// writeYAML renders v as YAML through its JSON encoding, so field names and
+// item data come out exactly as the API returns them, in the same order.
+func writeYAML(w io.Writer, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	var node yaml.Node
+	if err := yaml.Unmarshal(data, &node); err != nil {
+		return err
+	}
+	blockStyle(&node)
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(&node); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// blockStyle drops the flow and quoting styles the JSON input left on n.
+func blockStyle(n *yaml.Node) {
+	n.Style = 0
+	for _, c := range n.Content {
+		blockStyle(c)
+	}
+}
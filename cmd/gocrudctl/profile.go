@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+)
+
+// defaultURL is used when neither a flag, env var nor profile names a server.
+const defaultURL = "http://localhost:9090"
+
+// profile holds the connection settings for one server.
+type profile struct {
+	URL string `yaml:"url"`
+	Key string `yaml:"key"`
+}
+
+// profileFile is the gocrudctl configuration file:
+//
+//	current: prod
+//	profiles:
+//	  prod: {url: "https://gocrud.example.com", key: "..."}
+//	  local: {url: "http://localhost:9090", key: "dev-key"}
+type profileFile struct {
+	Current  string             `yaml:"current"`
+	Profiles map[string]profile `yaml:"profiles"`
+}
+
+// configPath returns GOCRUDCTL_CONFIG or gocrud/gocrudctl.yaml in the user's config directory.
+func configPath() (string, error) {
+	if p := os.Getenv("GOCRUDCTL_CONFIG"); p != "" {
+		return p, nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "gocrud", "gocrudctl.yaml"), nil
+}
+
+// resolveProfile works out the server to talk to. The --url and --key flags win
+// over GOCRUD_URL and GOCRUD_KEY, which win over the profile named by --profile,
+// GOCRUD_PROFILE or the file's current entry. A missing file is only an error
+// when a profile was asked for by name.
+func resolveProfile(path, name, flagURL, flagKey string, getenv func(string) string) (profile, error) {
+	if name == "" {
+		name = getenv("GOCRUD_PROFILE")
+	}
+	var file profileFile
+	data, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		if name != "" {
+			return profile{}, fmt.Errorf("profile %q: %s does not exist", name, path)
+		}
+	case err != nil:
+		return profile{}, err
+	default:
+		if err := yaml.Unmarshal(data, &file); err != nil {
+			return profile{}, fmt.Errorf("parsing %s: %w", path, err)
+		}
+	}
+
+	if name == "" {
+		name = file.Current
+	}
+	var p profile
+	if name != "" {
+		var ok bool
+		if p, ok = file.Profiles[name]; !ok {
+			return profile{}, fmt.Errorf("profile %q is not defined in %s", name, path)
+		}
+	}
+	for _, o := range []struct {
+		dst *string
+		val string
+	}{
+		{&p.URL, getenv("GOCRUD_URL")}, {&p.Key, getenv("GOCRUD_KEY")},
+		{&p.URL, flagURL}, {&p.Key, flagKey},
+	} {
+		if o.val != "" {
+			*o.dst = o.val
+		}
+	}
+	if p.URL == "" {
+		p.URL = defaultURL
+	}
+	return p, nil
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+	"github.com/klauspost/compress/zstd"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// valueZstd is the header byte of a compressed item value, which is followed
+// by the zstd-compressed value: plain or sealed. Plain values are the item
+// JSON itself, which always starts with '{', so values written before
+// compression was added need no header.
+const valueZstd byte = 0x01
+
+// rewriteLockKey keeps two runs of RewriteItems from overlapping. A run
+// extends the lock by rewriteLockTTL as it goes. It is the key of the
+// compression migration RewriteItems replaced, so that replicas still
+// running that one take the same lock during an upgrade.
+const (
+	rewriteLockKey = "compression:lock"
+	rewriteLockTTL = 10 * time.Minute
+)
+
+// The zstd encoder and decoder are safe for concurrent EncodeAll and
+// DecodeAll calls.
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault))
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+// ItemCodec turns items into the values stored in Redis and back. Items of
+// the types in Encrypt have the listed paths of their data encrypted with
+// keys from Keyring. Values of at least Threshold bytes are then compressed
+// with zstd, unless that does not make them smaller. Compressed and
+// encrypted values are read whatever the settings, as long as the keyring
+// has their key, so both can be turned off without rewriting the items. A
+// nil *ItemCodec stores items as plain JSON.
+type ItemCodec struct {
+	// Threshold is the size of value from which it is compressed; zero
+	// disables compression.
+	Threshold int
+	// Keyring holds the keys that encrypt item data; nil disables encryption.
+	Keyring *Keyring
+	// Encrypt lists, by item type, the paths in the data that are encrypted.
+	Encrypt typeFields
+
+	compressed, plain, bytesIn, bytesOut, sealed, rekeyed, migrated atomic.Uint64
+}
+
+// NewItemCodec creates an ItemCodec compressing values of at least threshold bytes.
+func NewItemCodec(threshold int) *ItemCodec {
+	return &ItemCodec{Threshold: threshold}
+}
+
+// valueInfo describes how a stored value was encoded.
+type valueInfo struct {
+	compressed bool
+	inner      []byte      // the value before compression
+	sealed     *sealedItem // nil unless the item is encrypted
+}
+
+// compress returns the value to store for inner, the plain or sealed item.
+func (c *ItemCodec) compress(inner []byte) []byte {
+	if c == nil || c.Threshold <= 0 || len(inner) < c.Threshold {
+		return inner
+	}
+	value := zstdEncoder.EncodeAll(inner, []byte{valueZstd})
+	if len(value) >= len(inner) {
+		return inner
+	}
+	return value
+}
+
+// encode returns the value to store for item in the tenant of ctx and
+// counts it.
+func (c *ItemCodec) encode(ctx context.Context, item *Item) ([]byte, error) {
+	inner, err := c.seal(ctx, item)
+	if err != nil {
+		return nil, err
+	}
+	value := c.compress(inner)
+	if c == nil {
+		return value, nil
+	}
+	if inner[0] == valueSealed {
+		c.sealed.Add(1)
+	}
+	if isCompressed(value) {
+		c.compressed.Add(1)
+		c.bytesIn.Add(uint64(len(inner)))
+		c.bytesOut.Add(uint64(len(value)))
+	} else {
+		c.plain.Add(1)
+	}
+	return value, nil
+}
+
+// decode returns the plain item JSON held in a value stored in the tenant
+// of ctx.
+func (c *ItemCodec) decode(ctx context.Context, value []byte) ([]byte, error) {
+	data, _, err := c.decodeValue(ctx, value)
+	return data, err
+}
+
+// decodeValue returns the plain item JSON held in a value stored in the
+// tenant of ctx and how the value was encoded.
+func (c *ItemCodec) decodeValue(ctx context.Context, value []byte) ([]byte, valueInfo, error) {
+	info := valueInfo{inner: value}
+	if isCompressed(value) {
+		inner, err := zstdDecoder.DecodeAll(value[1:], nil)
+		if err != nil {
+			return nil, info, fmt.Errorf("decompressing item: %w", err)
+		}
+		info.compressed, info.inner = true, inner
+	}
+	if len(info.inner) == 0 || info.inner[0] != valueSealed {
+		return info.inner, info, nil
+	}
+	data, sealed, err := c.open(ctx, info.inner)
+	info.sealed = sealed
+	return data, info, err
+}
+
+// rekey reports whether a value is encrypted with a key other than the
+// primary one, and should be encrypted again.
+func (c *ItemCodec) rekey(info valueInfo) bool {
+	return info.sealed != nil && info.sealed.KeyID != c.Keyring.Primary
+}
+
+// outdated reports whether the codec would store item other than in the
+// value described by info.
+func (c *ItemCodec) outdated(item *Item, info valueInfo) bool {
+	var paths []string
+	if info.sealed != nil {
+		paths = info.sealed.Paths
+	}
+	if c.rekey(info) || info.sealed != nil && info.sealed.Version != sealVersion || !slices.Equal(paths, c.sealPaths(item)) {
+		return true
+	}
+	return isCompressed(c.compress(info.inner)) != info.compressed
+}
+
+func isCompressed(value []byte) bool {
+	return len(value) > 0 && value[0] == valueZstd
+}
+
+var (
+	codecWrittenDesc = prometheus.NewDesc("gocrud_item_values_written_total",
+		"Item values written to Redis by encoding: zstd or json.", []string{"encoding"}, nil)
+	codecBytesInDesc = prometheus.NewDesc("gocrud_item_compression_input_bytes_total",
+		"Size of the item values that were stored compressed.", nil, nil)
+	codecBytesOutDesc = prometheus.NewDesc("gocrud_item_compression_output_bytes_total",
+		"Size of the compressed values stored for them.", nil, nil)
+	codecRatioDesc = prometheus.NewDesc("gocrud_item_compression_ratio",
+		"Compressed size over original size of the items compressed since the server started.", nil, nil)
+	codecSealedDesc = prometheus.NewDesc("gocrud_item_values_encrypted_total",
+		"Item values written to Redis with encrypted data.", nil, nil)
+	codecRekeyedDesc = prometheus.NewDesc("gocrud_item_values_rekeyed_total",
+		"Item values encrypted again with the primary key when read.", nil, nil)
+	codecMigratedDesc = prometheus.NewDesc("gocrud_item_values_migrated_total",
+		"Stored item values rewritten by RewriteItems.", nil, nil)
+)
+
+func (c *ItemCodec) Describe(ch chan<- *prometheus.Desc) {
+	ch <- codecWrittenDesc
+	ch <- codecBytesInDesc
+	ch <- codecBytesOutDesc
+	ch <- codecRatioDesc
+	ch <- codecSealedDesc
+	ch <- codecRekeyedDesc
+	ch <- codecMigratedDesc
+}
+
+func (c *ItemCodec) Collect(ch chan<- prometheus.Metric) {
+	in, out := c.bytesIn.Load(), c.bytesOut.Load()
+	ratio := 1.0
+	if in > 0 {
+		ratio = float64(out) / float64(in)
+	}
+	ch <- prometheus.MustNewConstMetric(codecWrittenDesc, prometheus.CounterValue, float64(c.compressed.Load()), "zstd")
+	ch <- prometheus.MustNewConstMetric(codecWrittenDesc, prometheus.CounterValue, float64(c.plain.Load()), "json")
+	ch <- prometheus.MustNewConstMetric(codecBytesInDesc, prometheus.CounterValue, float64(in))
+	ch <- prometheus.MustNewConstMetric(codecBytesOutDesc, prometheus.CounterValue, float64(out))
+	ch <- prometheus.MustNewConstMetric(codecRatioDesc, prometheus.GaugeValue, ratio)
+	ch <- prometheus.MustNewConstMetric(codecSealedDesc, prometheus.CounterValue, float64(c.sealed.Load()))
+	ch <- prometheus.MustNewConstMetric(codecRekeyedDesc, prometheus.CounterValue, float64(c.rekeyed.Load()))
+	ch <- prometheus.MustNewConstMetric(codecMigratedDesc, prometheus.CounterValue, float64(c.migrated.Load()))
+}
+
+// replaceValueScript sets KEYS[1] to ARGV[2] if it still holds ARGV[1], so
+// that a rewrite never overwrites an item written since it was read.
+var replaceValueScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+  redis.call("SET", KEYS[1], ARGV[2])
+  return 1
+end
+return 0
+`)
+
+// replaceValue stores item at key in place of value, unless the item was
+// written since value was read. The item is unchanged, so caches stay valid.
+func (s *RedisStore) replaceValue(ctx context.Context, key string, value []byte, item *Item) (bool, error) {
+	next, err := s.Codec.encode(ctx, item)
+	if err != nil {
+		return false, err
+	}
+	replaced, err := replaceValueScript.Run(ctx, s.client, []string{key}, value, next).Int()
+	return replaced == 1, err
+}
+
+// RewriteItems rewrites the stored items of every tenant that are not
+// encoded the way the codec would write them now: it compresses or
+// decompresses them to match the threshold, encrypts or decrypts the paths
+// configured for their type, and encrypts again those whose key is not the
+// primary one. It runs while the server is serving, stops with
+// errNotNormalMode once the service leaves normal mode, and returns the
+// number of items rewritten.
+func (s *RedisStore) RewriteItems(ctx context.Context) (_ int, err error) {
+	ctx, span := tracer.Start(ctx, "RedisStore.RewriteItems")
+	defer func() { endSpan(span, err) }()
+
+	if s.Modes.Current().Mode != ModeNormal {
+		return 0, errNotNormalMode
+	}
+	token := uuid.NewString()
+	ok, err := s.client.SetNX(ctx, rewriteLockKey, token, rewriteLockTTL).Result()
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, errRewriteRunning
+	}
+	// a run that outlived its lock must not release the next run's
+	defer releaseLockScript.Run(context.Background(), s.client, []string{rewriteLockKey}, token)
+
+	keys, err := scanKeys(ctx, s.client, "*}:item:*")
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for start := 0; start < len(keys); start += 500 {
+		if s.Modes.Current().Mode != ModeNormal {
+			return count, errNotNormalMode
+		}
+		held, err := holdLockScript.Run(ctx, s.client, []string{rewriteLockKey}, token, rewriteLockTTL.Milliseconds()).Int()
+		if err != nil {
+			return count, err
+		}
+		if held == 0 {
+			return count, errRewriteRunning
+		}
+		batch := keys[start:min(start+500, len(keys))]
+		cmds := make([]*redis.StringCmd, len(batch))
+		pipe := s.client.Pipeline()
+		for i, key := range batch {
+			cmds[i] = pipe.Get(ctx, key)
+		}
+		if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+			return count, err
+		}
+		for i, cmd := range cmds {
+			value, err := cmd.Bytes()
+			if err == redis.Nil {
+				continue // deleted since the scan
+			}
+			if err != nil {
+				return count, err
+			}
+			tenant, _, _ := splitTenantKey(batch[i])
+			ctx := withTenant(ctx, tenant)
+			data, info, err := s.Codec.decodeValue(ctx, value)
+			if err != nil {
+				return count, fmt.Errorf("%s: %w", batch[i], err)
+			}
+			item, err := decodeItem(data)
+			if err != nil {
+				return count, fmt.Errorf("%s: %w", batch[i], err)
+			}
+			if !s.Codec.outdated(item, info) {
+				continue
+			}
+			replaced, err := s.replaceValue(ctx, batch[i], value, item)
+			if err != nil {
+				return count, err
+			}
+			if replaced {
+				count++
+				if s.Codec != nil {
+					s.Codec.migrated.Add(1)
+				}
+			}
+		}
+	}
+	span.SetAttributes(attribute.Int("item.count", count))
+	return count, nil
+}
+
+// MigrateCompression is the name RewriteItems had before it also encrypted
+// items.
+//
+// Deprecated: use RewriteItems.
+func (s *RedisStore) MigrateCompression(ctx context.Context) (int, error) {
+	return s.RewriteItems(ctx)
+}
+
+// errRewriteRunning is returned by RewriteItems while another run holds the lock.
+var errRewriteRunning = errors.New("another rewrite of the stored items is running")
+
+// errNotNormalMode is returned by RewriteItems while the service is in
+// read-only or maintenance mode, when it must not write to Redis.
+var errNotNormalMode = errors.New("stored items are not rewritten while the service is in read-only or maintenance mode")
+
+// rewriteRetryInterval is how often rewriteItems checks whether the service
+// is back in normal mode.
+const rewriteRetryInterval = time.Minute
+
+// rewriteItems runs RewriteItems in the background of the server, logging
+// the outcome. Replicas starting together leave it to the first one. Outside
+// normal mode, it waits for the service to return to it.
+func rewriteItems(ctx context.Context, store *RedisStore, logger *slog.Logger) {
+	start := time.Now()
+	for waiting := false; ; waiting = true {
+		n, err := store.RewriteItems(ctx)
+		switch {
+		case errors.Is(err, errNotNormalMode):
+			if !waiting {
+				logger.Info("rewriting stored items once the service is back in normal mode", "mode", store.Modes.Current().Mode, "rewritten", n)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(rewriteRetryInterval):
+			}
+			continue
+		case errors.Is(err, errRewriteRunning):
+			logger.Info("stored items are being rewritten by another replica")
+		case err != nil:
+			logger.Error("error rewriting stored items", "error", err, "rewritten", n)
+		default:
+			logger.Info("stored items rewritten", "rewritten", n, "duration", time.Since(start))
+		}
+		return
+	}
+}
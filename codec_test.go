@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestItemCodec(t *testing.T) {
+	c := NewItemCodec(300)
+	small := &Item{ID: "a", Type: "note", Data: json.RawMessage(`{}`)}
+	large := &Item{ID: "b", Type: "task", Data: json.RawMessage(`{"checklist":"` + strings.Repeat("buy milk, ", 50) + `"}`)}
+	smallJSON, _ := json.Marshal(small)
+	largeJSON, _ := json.Marshal(large)
+	random := make([]byte, 400)
+	rand.Read(random)
+	random[0] = '{' // a stored value never starts with the compression marker
+
+	if v, err := c.encode(testCtx, small); err != nil || !bytes.Equal(v, smallJSON) {
+		t.Errorf("expected items under the threshold to be stored plain, got %q, %v", v, err)
+	}
+	v, err := c.encode(testCtx, large)
+	if err != nil || !isCompressed(v) || len(v) >= len(largeJSON) {
+		t.Fatalf("expected a large item to be compressed, got %d bytes, %v", len(v), err)
+	}
+	if v := c.compress(random); isCompressed(v) {
+		t.Error("expected a value that does not compress to be stored plain")
+	}
+	for i, codec := range []*ItemCodec{c, nil, NewItemCodec(0)} {
+		if data, err := codec.decode(testCtx, v); err != nil || !bytes.Equal(data, largeJSON) {
+			t.Errorf("codec %d: decode: %q, %v", i, data, err)
+		}
+		if data, err := codec.decode(testCtx, smallJSON); err != nil || !bytes.Equal(data, smallJSON) {
+			t.Errorf("expected plain values to be read as they are, got %q, %v", data, err)
+		}
+	}
+	if _, err := c.decode(testCtx, []byte{valueZstd, 'x'}); err == nil {
+		t.Error("expected a corrupt value to fail")
+	}
+	if v, _ := (*ItemCodec)(nil).encode(testCtx, large); !bytes.Equal(v, largeJSON) {
+		t.Error("expected a nil codec to compress nothing")
+	}
+
+	if err := testutil.CollectAndCompare(c, strings.NewReader(`
+# HELP gocrud_item_values_written_total Item values written to Redis by encoding: zstd or json.
+# TYPE gocrud_item_values_written_total counter
+gocrud_item_values_written_total{encoding="json"} 1
+gocrud_item_values_written_total{encoding="zstd"} 1
+`), "gocrud_item_values_written_total"); err != nil {
+		t.Error(err)
+	}
+	if ratio := float64(c.bytesOut.Load()) / float64(c.bytesIn.Load()); ratio >= 0.5 || testutil.CollectAndCount(c, "gocrud_item_compression_ratio") != 1 {
+		t.Errorf("expected a compression ratio under 0.5, got %v", ratio)
+	}
+}
+
+// TestRewriteItems compresses items stored before compression was
+// enabled and decompresses them again once it is disabled.
+func TestRewriteItems(t *testing.T) {
+	ctx := withTenant(testCtx, "")
+	plain := NewRedisStore(redisClient)
+	items := []*Item{
+		{ID: "zip-large", Type: "task", Tags: []string{"zip"}, Data: json.RawMessage(`{"checklist":"` + strings.Repeat("water the plants, ", 40) + `"}`)},
+		{ID: "zip-small", Type: "task", Tags: []string{"zip"}, Data: json.RawMessage(`{}`)},
+	}
+	for _, item := range items {
+		if err := plain.SaveItem(ctx, item); err != nil {
+			t.Fatalf("save: %v", err)
+		}
+		defer plain.DeleteItem(ctx, item.ID)
+	}
+	raw := func(id string) []byte {
+		t.Helper()
+		value, err := redisClient.Get(testCtx, tenantKey(ctx, "item:%s", id)).Bytes()
+		if err != nil {
+			t.Fatalf("get %s: %v", id, err)
+		}
+		return value
+	}
+	if isCompressed(raw("zip-large")) {
+		t.Fatal("expected the store without a codec to write plain values")
+	}
+
+	store := NewRedisStore(redisClient)
+	store.Codec = NewItemCodec(200)
+	if n, err := store.RewriteItems(testCtx); err != nil || n < 1 {
+		t.Fatalf("migrate: %d, %v", n, err)
+	}
+	if !isCompressed(raw("zip-large")) || isCompressed(raw("zip-small")) {
+		t.Fatal("expected only the large item to be compressed")
+	}
+	for _, s := range []*RedisStore{store, plain} {
+		got, err := s.GetItem(ctx, "zip-large")
+		if err != nil || string(got.Data) != string(items[0].Data) {
+			t.Fatalf("get: %+v, %v", got, err)
+		}
+		list, err := s.ListItems(ctx, "", []string{"zip"})
+		if err != nil || len(list) != 2 {
+			t.Fatalf("list: %d items, %v", len(list), err)
+		}
+	}
+	if n, err := store.RewriteItems(testCtx); err != nil || n != 0 {
+		t.Errorf("expected a second run to rewrite nothing, got %d, %v", n, err)
+	}
+
+	if n, _ := redisClient.Exists(testCtx, rewriteLockKey).Result(); n != 0 {
+		t.Error("expected a finished run to release its lock")
+	}
+	redisClient.Set(testCtx, rewriteLockKey, "held", 0)
+	if _, err := store.RewriteItems(testCtx); err != errRewriteRunning {
+		t.Errorf("expected the lock to keep a second migration from running, got %v", err)
+	}
+	if held, _ := redisClient.Get(testCtx, rewriteLockKey).Result(); held != "held" {
+		t.Errorf("expected the other run's lock to be kept, got %q", held)
+	}
+	redisClient.Del(testCtx, rewriteLockKey)
+
+	store.Codec.Threshold = 0
+	store.Modes = &ModeStore{}
+	store.Modes.current.Store(&ServiceMode{Mode: ModeReadOnly})
+	if n, err := store.RewriteItems(testCtx); err != errNotNormalMode || n != 0 || !isCompressed(raw("zip-large")) {
+		t.Fatalf("expected no rewrite in read-only mode, got %d, %v", n, err)
+	}
+	store.Modes.current.Store(&ServiceMode{Mode: ModeNormal})
+	if n, err := store.RewriteItems(testCtx); err != nil || n < 1 || isCompressed(raw("zip-large")) {
+		t.Fatalf("expected disabling compression to decompress the item, got %d, %v", n, err)
+	}
+}
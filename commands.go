@@ -0,0 +1,408 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// setupCommand loads the configuration of an administrative command and
+// connects to Redis. Its logs go to stderr so that stdout carries only output.
+func setupCommand(ctx context.Context, fs *flag.FlagSet, args []string) (*Config, *slog.Logger, redis.UniversalClient, error) {
+	cfg, err := loadConfig(fs, args, os.Getenv)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	logger, err := newLogger(os.Stderr, cfg.Log.Format, cfg.Log.Level)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	client, err := connectRedis(ctx, cfg)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return cfg, logger, client, nil
+}
+
+// newItemStore returns a RedisStore that stores items the way the server
+// configured by cfg does.
+func newItemStore(cfg *Config, client redis.UniversalClient) (*RedisStore, error) {
+	codec, err := cfg.itemCodec()
+	if err != nil {
+		return nil, err
+	}
+	store := NewRedisStore(client)
+	store.Codec = codec
+	return store, nil
+}
+
+// checkTenant fails unless tenant is the default tenant or a registered one.
+func checkTenant(ctx context.Context, client redis.UniversalClient, tenant string) error {
+	ok, err := NewTenantStore(client).Exists(ctx, tenant)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("unknown tenant %q", tenant)
+	}
+	return nil
+}
+
+// migrateCommand implements `gocrud migrate`.
+func migrateCommand(args []string) error {
+	ctx := context.Background()
+	_, logger, client, err := setupCommand(ctx, flag.NewFlagSet("gocrud migrate", flag.ContinueOnError), args)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	version, err := applyMigrations(ctx, client, migrations, logger)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("schema is at version %d\n", version)
+	return nil
+}
+
+// reindexCommand implements `gocrud reindex`.
+func reindexCommand(args []string) error {
+	ctx := context.Background()
+	fs := flag.NewFlagSet("gocrud reindex", flag.ContinueOnError)
+	tenant := fs.String("tenant", "*", `tenant to reindex, "" for the default tenant (default: every tenant)`)
+	cfg, _, client, err := setupCommand(ctx, fs, args)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	ids := []string{*tenant}
+	if *tenant == "*" {
+		tenants, err := NewTenantStore(client).ListTenants(ctx)
+		if err != nil {
+			return err
+		}
+		ids = []string{""}
+		for _, t := range tenants {
+			ids = append(ids, t.ID)
+		}
+		sort.Strings(ids[1:])
+	} else if err := checkTenant(ctx, client, *tenant); err != nil {
+		return err
+	}
+	store, err := newItemStore(cfg, client)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		n, err := store.Reindex(withTenant(ctx, id))
+		if err != nil {
+			return fmt.Errorf("reindexing tenant %q: %w", id, err)
+		}
+		fmt.Printf("reindexed %d items in tenant %q\n", n, id)
+	}
+	return nil
+}
+
+// exportCommand implements `gocrud export`.
+func exportCommand(args []string) error {
+	ctx := context.Background()
+	fs := flag.NewFlagSet("gocrud export", flag.ContinueOnError)
+	tenant := fs.String("tenant", "", "tenant to export")
+	output := fs.String("output", "-", "file to write, - for stdout")
+	cfg, _, client, err := setupCommand(ctx, fs, args)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	if err := checkTenant(ctx, client, *tenant); err != nil {
+		return err
+	}
+
+	w := io.Writer(os.Stdout)
+	if *output != "-" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	store, err := newItemStore(cfg, client)
+	if err != nil {
+		return err
+	}
+	n, err := exportItems(withTenant(ctx, *tenant), store, w)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "exported %d items\n", n)
+	return nil
+}
+
+// importCommand implements `gocrud import`.
+func importCommand(args []string) error {
+	ctx := context.Background()
+	fs := flag.NewFlagSet("gocrud import", flag.ContinueOnError)
+	tenant := fs.String("tenant", "", "tenant to import into")
+	file := fs.String("file", "-", "export to read, - for stdin")
+	cfg, _, client, err := setupCommand(ctx, fs, args)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	if err := checkTenant(ctx, client, *tenant); err != nil {
+		return err
+	}
+
+	r := io.Reader(os.Stdin)
+	if *file != "-" {
+		f, err := os.Open(*file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	store, err := newItemStore(cfg, client)
+	if err != nil {
+		return err
+	}
+	n, err := importItems(withTenant(ctx, *tenant), store, r)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("imported %d items\n", n)
+	return nil
+}
+
+// rewriteCommand implements `gocrud rewrite`, which rewrites the stored
+// items of every tenant to match the compression and encryption settings,
+// and encrypts again those encrypted with an old key. The server does the
+// same in the background when either is enabled; run it after disabling
+// them so that an older build can read every item again, or after a key
+// rotation before removing the old key.
+func rewriteCommand(args []string) error {
+	ctx := context.Background()
+	fs := flag.NewFlagSet("gocrud rewrite", flag.ContinueOnError)
+	cfg, logger, client, err := setupCommand(ctx, fs, args)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	store, err := newItemStore(cfg, client)
+	if err != nil {
+		return err
+	}
+	store.Modes = NewModeStore(client, logger)
+	if err := store.Modes.Start(ctx); err != nil {
+		return err
+	}
+	n, err := store.RewriteItems(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("rewrote %d items\n", n)
+	return nil
+}
+
+// exportItems writes every item of the tenant in ctx to w as a JSON array,
+// ordered by creation time, and returns how many there were.
+func exportItems(ctx context.Context, store *RedisStore, w io.Writer) (int, error) {
+	items, err := store.ListItems(ctx, "", nil)
+	if err != nil {
+		return 0, err
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if !items[i].CreatedAt.Equal(items[j].CreatedAt) {
+			return items[i].CreatedAt.Before(items[j].CreatedAt)
+		}
+		return items[i].ID < items[j].ID
+	})
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return len(items), enc.Encode(items)
+}
+
+// importItems saves the items in a JSON array written by exportItems into the
+// tenant in ctx, keeping their IDs, owners, ACLs and timestamps. Existing items
+// with the same IDs are replaced. Imports bypass the API, so they raise no
+// change events, webhooks or audit entries. Every item is checked before any
+// is saved.
+func importItems(ctx context.Context, store *RedisStore, r io.Reader) (int, error) {
+	var items []*Item
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&items); err != nil {
+		return 0, fmt.Errorf("invalid export: %w", err)
+	}
+	for i, item := range items {
+		if item == nil || item.ID == "" || item.Type == "" {
+			return 0, fmt.Errorf("invalid export: item %d has no id or type", i+1)
+		}
+		if item.ACL != nil {
+			if err := item.ACL.validate(); err != nil {
+				return 0, fmt.Errorf("invalid export: item %s: %w", item.ID, err)
+			}
+		}
+	}
+	for _, item := range items {
+		if err := store.SaveItem(ctx, item); err != nil {
+			return 0, fmt.Errorf("saving item %s: %w", item.ID, err)
+		}
+	}
+	return len(items), nil
+}
+
+// modeCommand implements `gocrud mode [normal|read-only|maintenance]`, which
+// prints the service mode after switching to the one given.
+func modeCommand(args []string) error {
+	ctx := context.Background()
+	fs := flag.NewFlagSet("gocrud mode", flag.ContinueOnError)
+	message := fs.String("message", "", "message shown to the callers whose requests are refused")
+	var mode string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		mode, args = args[0], args[1:]
+	}
+	_, logger, client, err := setupCommand(ctx, fs, args)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	modes := NewModeStore(client, logger)
+	if mode != "" {
+		m := &ServiceMode{Mode: mode, Message: *message, UpdatedAt: time.Now().UTC(), UpdatedBy: "cli"}
+		if err := modes.SetMode(ctx, m); err != nil {
+			return err
+		}
+	}
+	m, err := modes.GetMode(ctx)
+	if err != nil {
+		return err
+	}
+	out := json.NewEncoder(os.Stdout)
+	out.SetIndent("", "  ")
+	return out.Encode(m)
+}
+
+// keysCommand implements `gocrud keys create|list|rotate|revoke`, which
+// manage API keys without going through the API, e.g. to create the first
+// administrator.
+func keysCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: gocrud keys create|list|rotate|revoke [flags]")
+	}
+	ctx := context.Background()
+	fs := flag.NewFlagSet("gocrud keys "+args[0], flag.ContinueOnError)
+	out := json.NewEncoder(os.Stdout)
+	out.SetIndent("", "  ")
+
+	switch args[0] {
+	case "create":
+		var req CreateKeyRequest
+		var scopes, types, tags, groups commaList
+		var expiresIn Duration
+		fs.StringVar(&req.Name, "name", "", "name of the key")
+		fs.StringVar(&req.Tenant, "tenant", "", "tenant the key belongs to")
+		fs.Var(&scopes, "scopes", "comma-separated scopes: read, write, delete, admin")
+		fs.Var(&types, "types", "comma-separated item types the key is limited to")
+		fs.Var(&tags, "tags", "comma-separated item tags the key is limited to")
+		fs.Var(&groups, "groups", "comma-separated groups for item ACLs")
+		fs.IntVar(&req.RateLimit, "rate-limit", 0, "requests per minute, overriding the server's limits")
+		fs.Var(&expiresIn, "expires-in", "lifetime of the key, e.g. 720h (default: no expiry)")
+		_, _, client, err := setupCommand(ctx, fs, args[1:])
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+
+		req.Scopes, req.Types, req.Tags, req.Groups = scopes, types, tags, groups
+		if expiresIn > 0 {
+			at := time.Now().Add(time.Duration(expiresIn)).UTC()
+			req.ExpiresAt = &at
+		}
+		if err := req.validate(); err != nil {
+			return err
+		}
+		if err := checkTenant(ctx, client, req.Tenant); err != nil {
+			return err
+		}
+		key, secret, err := NewKeyStore(client).CreateKey(ctx, req)
+		if err != nil {
+			return err
+		}
+		return out.Encode(CreateKeyResponse{APIKey: key.redacted(), Secret: secret})
+	case "list":
+		_, _, client, err := setupCommand(ctx, fs, args[1:])
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+		keys, err := NewKeyStore(client).ListKeys(ctx)
+		if err != nil {
+			return err
+		}
+		redacted := make([]*APIKey, len(keys))
+		for i, k := range keys {
+			redacted[i] = k.redacted()
+		}
+		return out.Encode(redacted)
+	case "rotate":
+		_, _, client, err := setupCommand(ctx, fs, args[1:])
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+		if fs.NArg() != 1 {
+			return errors.New("usage: gocrud keys rotate [flags] <id>")
+		}
+		key, secret, err := NewKeyStore(client).RotateKey(ctx, fs.Arg(0))
+		if err != nil {
+			return fmt.Errorf("rotating %s: %w", fs.Arg(0), err)
+		}
+		return out.Encode(CreateKeyResponse{APIKey: key.redacted(), Secret: secret})
+	case "revoke":
+		_, _, client, err := setupCommand(ctx, fs, args[1:])
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+		if fs.NArg() == 0 {
+			return errors.New("usage: gocrud keys revoke [flags] <id>...")
+		}
+		keys := NewKeyStore(client)
+		for _, id := range fs.Args() {
+			if err := keys.RevokeKey(ctx, id); err != nil {
+				return fmt.Errorf("revoking %s: %w", id, err)
+			}
+			fmt.Printf("revoked %s\n", id)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown keys command %q", args[0])
+}
+
+// configCommand implements `gocrud config print`, which shows the effective
+// configuration with secrets redacted.
+func configCommand(args []string) error {
+	if len(args) == 0 || args[0] != "print" {
+		return errors.New("usage: gocrud config print [--format yaml|toml] [flags]")
+	}
+	fs := flag.NewFlagSet("gocrud config print", flag.ContinueOnError)
+	format := fs.String("format", "yaml", "output format: yaml or toml")
+	cfg, err := loadConfig(fs, args[1:], os.Getenv)
+	if err != nil {
+		return err
+	}
+	return writeConfig(os.Stdout, cfg.redacted(), *format)
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// TestExportImportReindex round-trips a tenant's items through export and
+// import and rebuilds their indexes.
+func TestExportImportReindex(t *testing.T) {
+	tenants := NewTenantStore(redisClient)
+	if err := tenants.CreateTenant(testCtx, &Tenant{ID: "cmdtest", Name: "Commands", CreatedAt: time.Now()}); err != nil {
+		t.Fatalf("create tenant: %v", err)
+	}
+	defer tenants.DeleteTenant(testCtx, "cmdtest")
+	ctx := withTenant(testCtx, "cmdtest")
+	store := NewRedisStore(redisClient)
+
+	created := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	for i, item := range []*Item{
+		{ID: "b", Type: "note", Tags: []string{"x"}, Data: json.RawMessage(`{"n":2}`), Owner: "key:1", CreatedAt: created.Add(time.Hour)},
+		{ID: "a", Type: "task", Tags: []string{"x", "y"}, Data: json.RawMessage(`{"n":1}`), ACL: &ItemACL{Read: []string{"*"}}, CreatedAt: created},
+	} {
+		item.LastModified = item.CreatedAt.Add(time.Duration(i) * time.Minute)
+		if err := store.SaveItem(ctx, item); err != nil {
+			t.Fatalf("save: %v", err)
+		}
+	}
+
+	var export bytes.Buffer
+	if n, err := exportItems(ctx, store, &export); err != nil || n != 2 {
+		t.Fatalf("export: %d, %v", n, err)
+	}
+	if strings.Index(export.String(), `"id": "a"`) > strings.Index(export.String(), `"id": "b"`) {
+		t.Fatalf("expected items in creation order:\n%s", export.String())
+	}
+
+	// wipe the tenant's items and indexes, then restore them from the export
+	for _, id := range []string{"a", "b"} {
+		if err := store.DeleteItem(ctx, id); err != nil {
+			t.Fatalf("delete: %v", err)
+		}
+	}
+	if n, err := importItems(ctx, store, bytes.NewReader(export.Bytes())); err != nil || n != 2 {
+		t.Fatalf("import: %d, %v", n, err)
+	}
+	a, err := store.GetItem(ctx, "a")
+	if err != nil || !a.CreatedAt.Equal(created) || a.ACL == nil || a.ACL.Read[0] != "*" {
+		t.Fatalf("expected item a restored with its timestamps and ACL, got %+v, %v", a, err)
+	}
+
+	// drop the indexes behind the store's back and rebuild them
+	redisClient.Del(testCtx, tenantKey(ctx, "items"), tenantKey(ctx, "items:tag:x"), tenantKey(ctx, "items:type:task"))
+	redisClient.SAdd(testCtx, tenantKey(ctx, "items:tag:stale"), "gone")
+	if n, err := store.Reindex(ctx); err != nil || n != 2 {
+		t.Fatalf("reindex: %d, %v", n, err)
+	}
+	tagged, err := store.ListItems(ctx, "task", []string{"x"})
+	if err != nil || len(tagged) != 1 || tagged[0].ID != "a" {
+		t.Fatalf("expected the rebuilt indexes to find item a, got %v, %v", tagged, err)
+	}
+	if n, _ := redisClient.Exists(testCtx, tenantKey(ctx, "items:tag:stale")).Result(); n != 0 {
+		t.Error("expected reindex to drop stale index entries")
+	}
+
+	for _, bad := range []string{`[{"id":"c"}]`, `[{"id":"c","type":"t","extra":1}]`, `{"id":"c"}`} {
+		if _, err := importItems(ctx, store, strings.NewReader(bad)); err == nil {
+			t.Errorf("expected import of %s to fail", bad)
+		}
+	}
+}
+
+func TestApplyMigrations(t *testing.T) {
+	defer redisClient.Del(testCtx, schemaVersionKey)
+	var applied []int
+	list := []migration{
+		{version: 1, description: "first", apply: func(ctx context.Context, _ redis.UniversalClient) error { applied = append(applied, 1); return nil }},
+		{version: 2, description: "second", apply: func(ctx context.Context, _ redis.UniversalClient) error { applied = append(applied, 2); return nil }},
+	}
+	if v, err := applyMigrations(testCtx, redisClient, list[:1], newTestLogger()); err != nil || v != 1 {
+		t.Fatalf("first run: version %d, %v", v, err)
+	}
+	if v, err := applyMigrations(testCtx, redisClient, list, newTestLogger()); err != nil || v != 2 {
+		t.Fatalf("second run: version %d, %v", v, err)
+	}
+	if len(applied) != 2 || applied[0] != 1 || applied[1] != 2 {
+		t.Fatalf("expected each migration to run once, got %v", applied)
+	}
+
+	redisClient.Set(testCtx, schemaLockKey, "held", time.Minute)
+	_, err := applyMigrations(testCtx, redisClient, list, newTestLogger())
+	redisClient.Del(testCtx, schemaLockKey)
+	if err == nil {
+		t.Fatal("expected an error while another migration holds the lock")
+	}
+
+	// a run whose lock expired leaves the lock of the run that took it over
+	redisClient.Del(testCtx, schemaVersionKey)
+	slow := []migration{{version: 1, description: "slow", apply: func(ctx context.Context, client redis.UniversalClient) error {
+		return client.Set(ctx, schemaLockKey, "next", time.Minute).Err()
+	}}}
+	if _, err := applyMigrations(testCtx, redisClient, slow, newTestLogger()); err != nil {
+		t.Fatalf("slow run: %v", err)
+	}
+	if held, _ := redisClient.Get(testCtx, schemaLockKey).Result(); held != "next" {
+		t.Errorf("expected the next run's lock to be kept, got %q", held)
+	}
+	redisClient.Del(testCtx, schemaLockKey)
+}
+
+func TestMigrateHashTags(t *testing.T) {
+	for key, want := range map[string]string{
+		"items":               "{default}:items",
+		"item:1":              "{default}:item:1",
+		"webhooks":            "{default}:webhooks",
+		"audit":               "{default}:audit",
+		"t:acme:items:tag:x":  "t:{acme}:items:tag:x",
+		"t:{acme}:items":      "",
+		"{default}:item:1":    "",
+		"webhooks:queue":      "",
+		"tenant:acme":         "",
+		"apikeys:lastused":    "",
+		"idempotency:k:abc":   "{default}:idempotency:k:abc",
+		"t:acme:ratelimit:k1": "t:{acme}:ratelimit:k1",
+	} {
+		if got, _ := hashTaggedKey(key); got != want {
+			t.Errorf("hashTaggedKey(%q) = %q, expected %q", key, got, want)
+		}
+	}
+
+	redisClient.Set(testCtx, "item:legacy", "{}", 0)
+	redisClient.SAdd(testCtx, "t:legacy:items:type:note", "n1")
+	redisClient.Set(testCtx, "t:legacy:idempotency:k:abc", "{}", time.Hour)
+	defer redisClient.Del(testCtx, "{default}:item:legacy", "t:{legacy}:items:type:note", "t:{legacy}:idempotency:k:abc")
+	if err := migrateHashTags(testCtx, redisClient); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	if v, err := redisClient.Get(testCtx, "{default}:item:legacy").Result(); err != nil || v != "{}" {
+		t.Errorf("expected the default tenant's item to move, got %q, %v", v, err)
+	}
+	if ok, err := redisClient.SIsMember(testCtx, "t:{legacy}:items:type:note", "n1").Result(); err != nil || !ok {
+		t.Errorf("expected the tenant's index to move, got %v, %v", ok, err)
+	}
+	if ttl, err := redisClient.TTL(testCtx, "t:{legacy}:idempotency:k:abc").Result(); err != nil || ttl <= 0 {
+		t.Errorf("expected the expiry to be kept, got %v, %v", ttl, err)
+	}
+	if n, _ := redisClient.Exists(testCtx, "item:legacy", "t:legacy:items:type:note").Result(); n != 0 {
+		t.Error("expected the legacy keys to be gone")
+	}
+}
+
+func TestMigrateAuditIndexes(t *testing.T) {
+	ctx := withTenant(testCtx, "legacy-audit")
+	defer func() {
+		keys, _ := scanKeys(testCtx, redisClient, tenantPrefix("legacy-audit")+"*")
+		redisClient.Del(testCtx, keys...)
+	}()
+	for i, actor := range []string{"key:a", "key:b", "key:a"} {
+		data, _ := json.Marshal(AuditEntry{Action: AuditUpdate, Actor: actor, ItemID: fmt.Sprintf("i%d", i%2)})
+		redisClient.XAdd(testCtx, &redis.XAddArgs{Stream: tenantKey(ctx, auditStreamKey), Values: map[string]interface{}{"entry": data}})
+	}
+	for range 2 {
+		if err := migrateAuditIndexes(testCtx, redisClient); err != nil {
+			t.Fatalf("migrate: %v", err)
+		}
+	}
+	audit := NewAuditLog(redisClient, newTestLogger())
+	for q, want := range map[AuditQuery]int{
+		{ItemID: "i0"}:                 2,
+		{Actor: "key:a"}:               2,
+		{Actor: "key:b"}:               1,
+		{ItemID: "i0", Actor: "key:b"}: 0,
+		{}:                             3,
+	} {
+		entries, err := audit.Query(ctx, q)
+		if err != nil || len(entries) != want {
+			t.Errorf("%+v: expected %d entries, got %d, %v", q, want, len(entries), err)
+		}
+	}
+}
+
+func TestCheckSchema(t *testing.T) {
+	defer redisClient.Del(testCtx, schemaVersionKey, "checkschema")
+	redisClient.Del(testCtx, schemaVersionKey)
+	redisClient.Set(testCtx, "checkschema", "data", 0)
+	if err := checkSchema(testCtx, redisClient); err == nil || !strings.Contains(err.Error(), "gocrud migrate") {
+		t.Fatalf("expected unversioned data to need a migration, got %v", err)
+	}
+	redisClient.Set(testCtx, schemaVersionKey, migrations[len(migrations)-1].version, 0)
+	if err := checkSchema(testCtx, redisClient); err != nil {
+		t.Fatalf("expected the current schema to pass, got %v", err)
+	}
+}
@@ -0,0 +1,710 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the server configuration. Each setting is taken from, in
+// increasing order of precedence, its default, the configuration file, its
+// environment variable and its command-line flag. Flags are named after the
+// setting's path in the file, e.g. --http.read_timeout.
+type Config struct {
+	Redis       RedisConfig       `yaml:"redis" toml:"redis"`
+	HTTP        HTTPConfig        `yaml:"http" toml:"http"`
+	Log         LogConfig         `yaml:"log" toml:"log"`
+	Auth        AuthConfig        `yaml:"auth" toml:"auth"`
+	RateLimit   RateLimitConfig   `yaml:"rate_limit" toml:"rate_limit"`
+	Cache       CacheConfig       `yaml:"cache" toml:"cache"`
+	Compression CompressionConfig `yaml:"compression" toml:"compression"`
+	Encryption  EncryptionConfig  `yaml:"encryption" toml:"encryption"`
+	Webhooks    WebhooksConfig    `yaml:"webhooks" toml:"webhooks"`
+	Tracing     TracingConfig     `yaml:"tracing" toml:"tracing"`
+}
+
+// RedisConfig locates the Redis server and tunes the connection pool. In
+// standalone mode URL and Addr are alternatives, and settings given alongside
+// URL override its parts. In sentinel and cluster mode Addrs lists the
+// sentinels or the cluster nodes to start from. Zero pool sizes and timeouts
+// keep the go-redis defaults; in cluster mode the pool settings apply to each
+// node.
+type RedisConfig struct {
+	Mode                 string         `yaml:"mode" toml:"mode"`
+	URL                  string         `yaml:"url" toml:"url"`
+	Addr                 string         `yaml:"addr" toml:"addr"`
+	Addrs                commaList      `yaml:"addrs" toml:"addrs"`
+	MasterName           string         `yaml:"master_name" toml:"master_name"`
+	SentinelUsername     string         `yaml:"sentinel_username" toml:"sentinel_username"`
+	SentinelPassword     string         `yaml:"sentinel_password" toml:"sentinel_password"`
+	SentinelPasswordFile string         `yaml:"sentinel_password_file" toml:"sentinel_password_file"`
+	Username             string         `yaml:"username" toml:"username"`
+	UsernameFile         string         `yaml:"username_file" toml:"username_file"`
+	Password             string         `yaml:"password" toml:"password"`
+	PasswordFile         string         `yaml:"password_file" toml:"password_file"`
+	DB                   int            `yaml:"db" toml:"db"`
+	TLS                  RedisTLSConfig `yaml:"tls" toml:"tls"`
+	PoolSize             int            `yaml:"pool_size" toml:"pool_size"`
+	MinIdleConns         int            `yaml:"min_idle_conns" toml:"min_idle_conns"`
+	DialTimeout          Duration       `yaml:"dial_timeout" toml:"dial_timeout"`
+	ReadTimeout          Duration       `yaml:"read_timeout" toml:"read_timeout"`
+	WriteTimeout         Duration       `yaml:"write_timeout" toml:"write_timeout"`
+	// Retries and RetryBackoff configure how reads are retried when Redis
+	// cannot be reached; writes are never retried.
+	Retries      int                `yaml:"retries" toml:"retries"`
+	RetryBackoff Duration           `yaml:"retry_backoff" toml:"retry_backoff"`
+	Breaker      RedisBreakerConfig `yaml:"breaker" toml:"breaker"`
+}
+
+// RedisBreakerConfig configures the CircuitBreaker; zero Failures disables it.
+type RedisBreakerConfig struct {
+	Failures int      `yaml:"failures" toml:"failures"`
+	Cooldown Duration `yaml:"cooldown" toml:"cooldown"`
+}
+
+// RedisTLSConfig enables TLS, which a rediss:// URL also does, and sets the
+// CA that verifies the server and the client certificate for mutual TLS.
+type RedisTLSConfig struct {
+	Enabled            bool   `yaml:"enabled" toml:"enabled"`
+	CAFile             string `yaml:"ca_file" toml:"ca_file"`
+	CertFile           string `yaml:"cert_file" toml:"cert_file"`
+	KeyFile            string `yaml:"key_file" toml:"key_file"`
+	ServerName         string `yaml:"server_name" toml:"server_name"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify" toml:"insecure_skip_verify"`
+}
+
+// HTTPConfig configures the listener and graceful shutdown.
+type HTTPConfig struct {
+	Addr         string   `yaml:"addr" toml:"addr"`
+	ReadTimeout  Duration `yaml:"read_timeout" toml:"read_timeout"`
+	WriteTimeout Duration `yaml:"write_timeout" toml:"write_timeout"`
+	IdleTimeout  Duration `yaml:"idle_timeout" toml:"idle_timeout"`
+	// ShutdownDelay is how long readiness fails before the listener closes;
+	// ShutdownTimeout bounds the wait for in-flight requests after that.
+	ShutdownDelay   Duration `yaml:"shutdown_delay" toml:"shutdown_delay"`
+	ShutdownTimeout Duration `yaml:"shutdown_timeout" toml:"shutdown_timeout"`
+}
+
+// LogConfig selects the log format and level.
+type LogConfig struct {
+	Format string `yaml:"format" toml:"format"`
+	Level  string `yaml:"level" toml:"level"`
+}
+
+// AuthConfig holds the bootstrap API keys and JWT validation settings.
+type AuthConfig struct {
+	APIKeys commaList   `yaml:"api_keys" toml:"api_keys"`
+	JWT     JWTSettings `yaml:"jwt" toml:"jwt"`
+}
+
+// JWTSettings is the file form of JWTConfig; JWT authentication is enabled
+// when JWKS is set.
+type JWTSettings struct {
+	JWKS            string    `yaml:"jwks" toml:"jwks"`
+	Issuer          string    `yaml:"issuer" toml:"issuer"`
+	Audience        string    `yaml:"audience" toml:"audience"`
+	ScopesClaim     string    `yaml:"scopes_claim" toml:"scopes_claim"`
+	TenantClaim     string    `yaml:"tenant_claim" toml:"tenant_claim"`
+	SystemSubjects  commaList `yaml:"system_subjects" toml:"system_subjects"`
+	GroupsClaim     string    `yaml:"groups_claim" toml:"groups_claim"`
+	Leeway          Duration  `yaml:"leeway" toml:"leeway"`
+	RefreshInterval Duration  `yaml:"refresh_interval" toml:"refresh_interval"`
+}
+
+// RateLimitConfig configures the RateLimiter, and PerIP and TrustedProxies
+// the IPLimiter in front of authentication.
+type RateLimitConfig struct {
+	Default        int         `yaml:"default" toml:"default"`
+	Scopes         scopeLimits `yaml:"scopes" toml:"scopes"`
+	ListCost       int         `yaml:"list_cost" toml:"list_cost"`
+	FailOpen       bool        `yaml:"fail_open" toml:"fail_open"`
+	PerIP          int         `yaml:"per_ip" toml:"per_ip"`
+	TrustedProxies commaList   `yaml:"trusted_proxies" toml:"trusted_proxies"`
+}
+
+// CacheConfig sizes the ItemCache; zero MaxEntries disables it. MaxAge
+// bounds how long a cached item can outlive a write whose invalidation was
+// lost. ServeStale serves expired items while Redis is unavailable.
+type CacheConfig struct {
+	MaxEntries int      `yaml:"max_entries" toml:"max_entries"`
+	MaxBytes   int      `yaml:"max_bytes" toml:"max_bytes"`
+	MaxAge     Duration `yaml:"max_age" toml:"max_age"`
+	ServeStale bool     `yaml:"serve_stale" toml:"serve_stale"`
+}
+
+// CompressionConfig configures the ItemCodec; zero Threshold stores every
+// item uncompressed.
+type CompressionConfig struct {
+	Threshold int `yaml:"threshold" toml:"threshold"`
+}
+
+// EncryptionConfig configures item data encryption. Keyring names the
+// keyring file; Fields lists, by item type, the dotted paths in the data
+// that are encrypted, "*" for all of it. A keyring without fields only
+// decrypts items encrypted before.
+type EncryptionConfig struct {
+	Keyring string     `yaml:"keyring" toml:"keyring"`
+	Fields  typeFields `yaml:"fields" toml:"fields"`
+}
+
+// WebhooksConfig configures webhook registration and delivery.
+// AllowPrivateNetworks accepts endpoints on loopback, link-local and private
+// addresses, which are refused by default.
+type WebhooksConfig struct {
+	AllowPrivateNetworks bool `yaml:"allow_private_networks" toml:"allow_private_networks"`
+}
+
+// TracingConfig selects the trace exporter passed to setupTracing.
+type TracingConfig struct {
+	Exporter string `yaml:"exporter" toml:"exporter"`
+}
+
+// defaultConfig returns the configuration used when nothing is set.
+func defaultConfig() *Config {
+	return &Config{
+		Redis: RedisConfig{
+			Mode:         "standalone",
+			DialTimeout:  Duration(5 * time.Second),
+			ReadTimeout:  Duration(3 * time.Second),
+			WriteTimeout: Duration(3 * time.Second),
+			Retries:      2,
+			RetryBackoff: Duration(50 * time.Millisecond),
+			Breaker:      RedisBreakerConfig{Failures: 5, Cooldown: Duration(5 * time.Second)},
+		},
+		HTTP: HTTPConfig{
+			Addr:            ":9090",
+			ReadTimeout:     Duration(5 * time.Second),
+			WriteTimeout:    Duration(10 * time.Second),
+			IdleTimeout:     Duration(120 * time.Second),
+			ShutdownDelay:   Duration(5 * time.Second),
+			ShutdownTimeout: Duration(5 * time.Second),
+		},
+		Log:       LogConfig{Format: "json", Level: "info"},
+		Auth:      AuthConfig{JWT: JWTSettings{ScopesClaim: "scope", TenantClaim: "tenant", GroupsClaim: "groups", Leeway: Duration(30 * time.Second), RefreshInterval: Duration(5 * time.Minute)}},
+		RateLimit: RateLimitConfig{Default: 600, ListCost: 10, FailOpen: true},
+		Cache:     CacheConfig{MaxBytes: 64 << 20, MaxAge: Duration(5 * time.Second)},
+		Tracing:   TracingConfig{Exporter: "none"},
+	}
+}
+
+// bind registers a flag for every setting on fs, pointing into c, and
+// returns the environment variable that sets each flag.
+func (c *Config) bind(fs *flag.FlagSet) map[string]string {
+	env := make(map[string]string)
+	str := func(p *string, name, envName, usage string) {
+		fs.StringVar(p, name, *p, usage)
+		env[name] = envName
+	}
+	integer := func(p *int, name, envName, usage string) {
+		fs.IntVar(p, name, *p, usage)
+		env[name] = envName
+	}
+	boolean := func(p *bool, name, envName, usage string) {
+		fs.BoolVar(p, name, *p, usage)
+		env[name] = envName
+	}
+	value := func(v flag.Value, name, envName, usage string) {
+		fs.Var(v, name, usage)
+		env[name] = envName
+	}
+	str(&c.Redis.Mode, "redis.mode", "REDIS_MODE", "standalone, sentinel or cluster")
+	str(&c.Redis.URL, "redis.url", "REDIS_URL", "redis:// or rediss:// URL with optional user, password and database")
+	str(&c.Redis.Addr, "redis.addr", "REDIS_ADDR", "Redis address, when no URL is given (default localhost:6379)")
+	value(&c.Redis.Addrs, "redis.addrs", "REDIS_ADDRS", "comma-separated sentinel or cluster node addresses")
+	str(&c.Redis.MasterName, "redis.master_name", "REDIS_MASTER_NAME", "name of the master monitored by Sentinel")
+	str(&c.Redis.SentinelUsername, "redis.sentinel_username", "REDIS_SENTINEL_USERNAME", "ACL user for the sentinels")
+	str(&c.Redis.SentinelPassword, "redis.sentinel_password", "REDIS_SENTINEL_PASSWORD", "password for the sentinels")
+	str(&c.Redis.SentinelPasswordFile, "redis.sentinel_password_file", "REDIS_SENTINEL_PASSWORD_FILE", "file holding the password for the sentinels")
+	str(&c.Redis.Username, "redis.username", "REDIS_USERNAME", "Redis ACL user")
+	str(&c.Redis.UsernameFile, "redis.username_file", "REDIS_USERNAME_FILE", "file holding the Redis ACL user")
+	str(&c.Redis.Password, "redis.password", "REDIS_PASSWORD", "Redis password")
+	str(&c.Redis.PasswordFile, "redis.password_file", "REDIS_PASSWORD_FILE", "file holding the Redis password")
+	integer(&c.Redis.DB, "redis.db", "REDIS_DB", "Redis database index")
+	boolean(&c.Redis.TLS.Enabled, "redis.tls.enabled", "REDIS_TLS", "connect to Redis over TLS")
+	str(&c.Redis.TLS.CAFile, "redis.tls.ca_file", "REDIS_TLS_CA_FILE", "PEM CA bundle verifying the Redis server (default: system roots)")
+	str(&c.Redis.TLS.CertFile, "redis.tls.cert_file", "REDIS_TLS_CERT_FILE", "PEM client certificate for mutual TLS")
+	str(&c.Redis.TLS.KeyFile, "redis.tls.key_file", "REDIS_TLS_KEY_FILE", "PEM client key for mutual TLS")
+	str(&c.Redis.TLS.ServerName, "redis.tls.server_name", "REDIS_TLS_SERVER_NAME", "server name to verify, when it differs from the host")
+	boolean(&c.Redis.TLS.InsecureSkipVerify, "redis.tls.insecure_skip_verify", "REDIS_TLS_INSECURE_SKIP_VERIFY", "skip verifying the Redis server certificate (testing only)")
+	integer(&c.Redis.PoolSize, "redis.pool_size", "REDIS_POOL_SIZE", "maximum connections in the pool, 0 for 10 per CPU")
+	integer(&c.Redis.MinIdleConns, "redis.min_idle_conns", "REDIS_MIN_IDLE_CONNS", "idle connections kept open")
+	value(&c.Redis.DialTimeout, "redis.dial_timeout", "REDIS_DIAL_TIMEOUT", "timeout for opening a connection")
+	value(&c.Redis.ReadTimeout, "redis.read_timeout", "REDIS_READ_TIMEOUT", "timeout for reading a reply")
+	value(&c.Redis.WriteTimeout, "redis.write_timeout", "REDIS_WRITE_TIMEOUT", "timeout for sending a command")
+	integer(&c.Redis.Retries, "redis.retries", "REDIS_RETRIES", "times a read is retried while Redis is unreachable")
+	value(&c.Redis.RetryBackoff, "redis.retry_backoff", "REDIS_RETRY_BACKOFF", "longest random wait before the first retry, doubling for each one")
+	integer(&c.Redis.Breaker.Failures, "redis.breaker.failures", "REDIS_BREAKER_FAILURES", "consecutive failures to reach Redis that open the circuit breaker, 0 to disable it")
+	value(&c.Redis.Breaker.Cooldown, "redis.breaker.cooldown", "REDIS_BREAKER_COOLDOWN", "how long the open circuit breaker fails requests before retrying Redis")
+	str(&c.HTTP.Addr, "http.addr", "HTTP_ADDR", "HTTP listen address")
+	value(&c.HTTP.ReadTimeout, "http.read_timeout", "HTTP_READ_TIMEOUT", "maximum duration for reading a request")
+	value(&c.HTTP.WriteTimeout, "http.write_timeout", "HTTP_WRITE_TIMEOUT", "maximum duration for writing a response")
+	value(&c.HTTP.IdleTimeout, "http.idle_timeout", "HTTP_IDLE_TIMEOUT", "how long idle keep-alive connections are kept")
+	value(&c.HTTP.ShutdownDelay, "http.shutdown_delay", "SHUTDOWN_DELAY", "how long readiness fails before the listener closes on shutdown")
+	value(&c.HTTP.ShutdownTimeout, "http.shutdown_timeout", "SHUTDOWN_TIMEOUT", "how long in-flight requests may take to finish on shutdown")
+	str(&c.Log.Format, "log.format", "LOG_FORMAT", "log format: json or text")
+	str(&c.Log.Level, "log.level", "LOG_LEVEL", "minimum log level: debug, info, warn or error")
+	value(&c.Auth.APIKeys, "auth.api_keys", "API_KEYS", "comma-separated bootstrap API keys with admin access")
+	str(&c.Auth.JWT.JWKS, "auth.jwt.jwks", "JWT_JWKS", "path or http(s) URL of a JWKS; enables JWT authentication")
+	str(&c.Auth.JWT.Issuer, "auth.jwt.issuer", "JWT_ISSUER", "required iss claim")
+	str(&c.Auth.JWT.Audience, "auth.jwt.audience", "JWT_AUDIENCE", "required aud claim")
+	str(&c.Auth.JWT.ScopesClaim, "auth.jwt.scopes_claim", "JWT_SCOPES_CLAIM", "claim holding scopes")
+	str(&c.Auth.JWT.TenantClaim, "auth.jwt.tenant_claim", "JWT_TENANT_CLAIM", "claim holding the caller's tenant")
+	value(&c.Auth.JWT.SystemSubjects, "auth.jwt.system_subjects", "JWT_SYSTEM_SUBJECTS", "comma-separated subjects whose tokens belong to the default tenant without a tenant claim")
+	str(&c.Auth.JWT.GroupsClaim, "auth.jwt.groups_claim", "JWT_GROUPS_CLAIM", "claim holding the caller's groups")
+	value(&c.Auth.JWT.Leeway, "auth.jwt.leeway", "JWT_LEEWAY", "clock skew tolerated when checking exp and nbf")
+	value(&c.Auth.JWT.RefreshInterval, "auth.jwt.refresh_interval", "JWT_REFRESH_INTERVAL", "how often the JWKS is reloaded, dropping keys removed from it")
+	integer(&c.RateLimit.Default, "rate_limit.default", "RATE_LIMIT", "requests per minute allowed to each caller, 0 for no limit")
+	value(&c.RateLimit.Scopes, "rate_limit.scopes", "RATE_LIMIT_SCOPES", "per-scope limits, e.g. read=1200,admin=0")
+	integer(&c.RateLimit.ListCost, "rate_limit.list_cost", "RATE_LIMIT_LIST_COST", "number of requests a listing counts as")
+	boolean(&c.RateLimit.FailOpen, "rate_limit.fail_open", "RATE_LIMIT_FAIL_OPEN", "let requests through unlimited while Redis cannot be reached, instead of failing them with 503")
+	integer(&c.RateLimit.PerIP, "rate_limit.per_ip", "RATE_LIMIT_PER_IP", "requests per minute allowed to each client address before authentication, on each replica, 0 for no limit")
+	value(&c.RateLimit.TrustedProxies, "rate_limit.trusted_proxies", "RATE_LIMIT_TRUSTED_PROXIES", "comma-separated addresses and CIDR ranges of proxies whose X-Forwarded-For or Forwarded headers name the client")
+	integer(&c.Cache.MaxEntries, "cache.max_entries", "CACHE_MAX_ENTRIES", "items kept in the local cache, 0 to disable it")
+	integer(&c.Cache.MaxBytes, "cache.max_bytes", "CACHE_MAX_BYTES", "total size of the item JSON kept in the local cache")
+	value(&c.Cache.MaxAge, "cache.max_age", "CACHE_MAX_AGE", "longest a cached item is served without rereading it")
+	boolean(&c.Cache.ServeStale, "cache.serve_stale", "CACHE_SERVE_STALE", "serve cached items past cache.max_age while Redis is unavailable")
+	integer(&c.Compression.Threshold, "compression.threshold", "COMPRESSION_THRESHOLD", "size in bytes of item JSON from which it is stored compressed, 0 to disable compression")
+	str(&c.Encryption.Keyring, "encryption.keyring", "ENCRYPTION_KEYRING", "JSON keyring file with the keys that encrypt item data")
+	value(&c.Encryption.Fields, "encryption.fields", "ENCRYPTION_FIELDS", "encrypted paths of item data by type, e.g. user=email,user=profile.location,payment=*")
+	boolean(&c.Webhooks.AllowPrivateNetworks, "webhooks.allow_private_networks", "WEBHOOKS_ALLOW_PRIVATE_NETWORKS", "accept webhook endpoints on loopback, link-local and private addresses")
+	str(&c.Tracing.Exporter, "tracing.exporter", "OTEL_TRACES_EXPORTER", "trace exporter: otlp, stdout or none")
+	return env
+}
+
+// loadConfig parses args with fs, which may already hold the command's own
+// flags, and returns the resulting configuration. The configuration file is
+// named by --config or GOCRUD_CONFIG; files ending in .toml are read as TOML,
+// anything else as YAML. Unknown settings and invalid values are errors.
+func loadConfig(fs *flag.FlagSet, args []string, getenv func(string) string) (*Config, error) {
+	// flags are parsed into a scratch copy first: they are needed to find the
+	// file, but must be applied after it and the environment
+	env := defaultConfig().bind(fs)
+	path := fs.String("config", getenv("GOCRUD_CONFIG"), "configuration file (YAML, or TOML with a .toml extension)")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	cfg := defaultConfig()
+	if *path != "" {
+		if err := cfg.loadFile(*path); err != nil {
+			return nil, err
+		}
+	}
+	target := flag.NewFlagSet("config", flag.ContinueOnError)
+	cfg.bind(target)
+	names := make([]string, 0, len(env))
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if v := getenv(env[name]); v != "" {
+			if err := target.Set(name, v); err != nil {
+				return nil, fmt.Errorf("invalid %s %q: %v", env[name], v, err)
+			}
+		}
+	}
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		if _, ok := env[f.Name]; ok && err == nil {
+			err = target.Set(f.Name, f.Value.String())
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// loadFile overlays the settings in the file at path onto c.
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if strings.EqualFold(filepath.Ext(path), ".toml") {
+		md, err := toml.Decode(string(data), c)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			return fmt.Errorf("%s: unknown setting %q", path, undecoded[0].String())
+		}
+		return nil
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil && err != io.EOF {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// Validate reports every invalid setting, naming each by its path in the file.
+func (c *Config) Validate() error {
+	var errs []error
+	invalid := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+	switch c.Redis.Mode {
+	case "standalone":
+		if c.Redis.URL != "" && c.Redis.Addr != "" {
+			invalid("redis.url and redis.addr are alternatives; set only one")
+		}
+		if len(c.Redis.Addrs) > 0 || c.Redis.MasterName != "" {
+			invalid("redis.addrs and redis.master_name apply only in sentinel and cluster mode")
+		}
+	case "sentinel", "cluster":
+		if c.Redis.URL != "" || c.Redis.Addr != "" {
+			invalid("redis.url and redis.addr apply only in standalone mode; list the nodes in redis.addrs")
+		}
+		if len(c.Redis.Addrs) == 0 {
+			invalid("redis.addrs is required in %s mode", c.Redis.Mode)
+		}
+		if c.Redis.Mode == "sentinel" && c.Redis.MasterName == "" {
+			invalid("redis.master_name is required in sentinel mode")
+		}
+		if c.Redis.Mode == "cluster" && c.Redis.DB != 0 {
+			invalid("redis.db must be 0 in cluster mode, got %d", c.Redis.DB)
+		}
+	default:
+		invalid("redis.mode must be standalone, sentinel or cluster, got %q", c.Redis.Mode)
+	}
+	if c.Redis.Mode != "sentinel" && (c.Redis.SentinelUsername != "" || c.Redis.SentinelPassword != "" || c.Redis.SentinelPasswordFile != "") {
+		invalid("redis.sentinel_username and redis.sentinel_password apply only in sentinel mode")
+	}
+	if c.Redis.SentinelPassword != "" && c.Redis.SentinelPasswordFile != "" {
+		invalid("redis.sentinel_password and redis.sentinel_password_file are alternatives; set only one")
+	}
+	if c.Redis.Username != "" && c.Redis.UsernameFile != "" {
+		invalid("redis.username and redis.username_file are alternatives; set only one")
+	}
+	if c.Redis.Password != "" && c.Redis.PasswordFile != "" {
+		invalid("redis.password and redis.password_file are alternatives; set only one")
+	}
+	if c.Redis.DB < 0 {
+		invalid("redis.db must not be negative, got %d", c.Redis.DB)
+	}
+	if (c.Redis.TLS.CertFile == "") != (c.Redis.TLS.KeyFile == "") {
+		invalid("redis.tls.cert_file and redis.tls.key_file must be set together")
+	}
+	if c.Redis.PoolSize < 0 || c.Redis.MinIdleConns < 0 {
+		invalid("redis.pool_size and redis.min_idle_conns must not be negative")
+	}
+	for _, d := range []struct {
+		name  string
+		value Duration
+	}{
+		{"redis.dial_timeout", c.Redis.DialTimeout},
+		{"redis.read_timeout", c.Redis.ReadTimeout},
+		{"redis.write_timeout", c.Redis.WriteTimeout},
+		{"redis.retry_backoff", c.Redis.RetryBackoff},
+	} {
+		if d.value < 0 {
+			invalid("%s must not be negative, got %s", d.name, d.value)
+		}
+	}
+	if c.Redis.Retries < 0 {
+		invalid("redis.retries must not be negative, got %d", c.Redis.Retries)
+	}
+	if c.Redis.Breaker.Failures < 0 {
+		invalid("redis.breaker.failures must not be negative, got %d", c.Redis.Breaker.Failures)
+	}
+	if c.Redis.Breaker.Failures > 0 && c.Redis.Breaker.Cooldown <= 0 {
+		invalid("redis.breaker.cooldown must be positive, got %s", c.Redis.Breaker.Cooldown)
+	}
+	if c.HTTP.Addr == "" {
+		invalid("http.addr is required")
+	}
+	for _, d := range []struct {
+		name  string
+		value Duration
+	}{
+		{"http.read_timeout", c.HTTP.ReadTimeout},
+		{"http.write_timeout", c.HTTP.WriteTimeout},
+		{"http.idle_timeout", c.HTTP.IdleTimeout},
+		{"http.shutdown_timeout", c.HTTP.ShutdownTimeout},
+	} {
+		if d.value <= 0 {
+			invalid("%s must be positive, got %s", d.name, d.value)
+		}
+	}
+	if c.HTTP.ShutdownDelay < 0 {
+		invalid("http.shutdown_delay must not be negative, got %s", c.HTTP.ShutdownDelay)
+	}
+	if f := strings.ToLower(c.Log.Format); f != "json" && f != "text" {
+		invalid("log.format must be json or text, got %q", c.Log.Format)
+	}
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(c.Log.Level)); err != nil {
+		invalid("log.level must be debug, info, warn or error, got %q", c.Log.Level)
+	}
+	if jwt := c.Auth.JWT; jwt.JWKS != "" {
+		if jwt.Issuer == "" {
+			invalid("auth.jwt.issuer is required when auth.jwt.jwks is set")
+		}
+		if jwt.Audience == "" {
+			invalid("auth.jwt.audience is required when auth.jwt.jwks is set")
+		}
+	}
+	if c.Auth.JWT.Leeway < 0 {
+		invalid("auth.jwt.leeway must not be negative, got %s", c.Auth.JWT.Leeway)
+	}
+	if c.Auth.JWT.RefreshInterval <= 0 {
+		invalid("auth.jwt.refresh_interval must be positive, got %s", c.Auth.JWT.RefreshInterval)
+	}
+	if c.RateLimit.Default < 0 {
+		invalid("rate_limit.default must not be negative, got %d", c.RateLimit.Default)
+	}
+	if c.RateLimit.PerIP < 0 {
+		invalid("rate_limit.per_ip must not be negative, got %d", c.RateLimit.PerIP)
+	}
+	if _, err := parseTrustedProxies(c.RateLimit.TrustedProxies); err != nil {
+		invalid("rate_limit.trusted_proxies: %v", err)
+	}
+	if c.RateLimit.ListCost < 1 {
+		invalid("rate_limit.list_cost must be at least 1, got %d", c.RateLimit.ListCost)
+	}
+	for _, scope := range c.RateLimit.Scopes.names() {
+		if n := c.RateLimit.Scopes[scope]; !validScope(scope) || n < 0 {
+			invalid("rate_limit.scopes: invalid limit %s=%d", scope, n)
+		}
+	}
+	if c.Cache.MaxEntries < 0 {
+		invalid("cache.max_entries must not be negative, got %d", c.Cache.MaxEntries)
+	}
+	if c.Cache.MaxEntries > 0 && (c.Cache.MaxBytes <= 0 || c.Cache.MaxAge <= 0) {
+		invalid("cache.max_bytes and cache.max_age must be positive when the cache is enabled")
+	}
+	if c.Compression.Threshold < 0 {
+		invalid("compression.threshold must not be negative, got %d", c.Compression.Threshold)
+	}
+	if len(c.Encryption.Fields) > 0 && c.Encryption.Keyring == "" {
+		invalid("encryption.keyring is required when encryption.fields is set")
+	}
+	for _, typ := range c.Encryption.Fields.types() {
+		paths := c.Encryption.Fields[typ]
+		for i, p := range paths {
+			if p != "*" && slices.Contains(strings.Split(p, "."), "") {
+				invalid("encryption.fields: invalid path %q for type %s", p, typ)
+			}
+			for _, q := range paths[:i] {
+				if pathsOverlap(p, q) {
+					invalid("encryption.fields: paths %s and %s of type %s overlap", q, p, typ)
+				}
+			}
+		}
+	}
+	switch c.Tracing.Exporter {
+	case "", "none", "otlp", "stdout":
+	default:
+		invalid("tracing.exporter must be otlp, stdout or none, got %q", c.Tracing.Exporter)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration:\n  %w", joinLines(errs))
+	}
+	return nil
+}
+
+// joinLines joins errs into one error, one per indented line.
+func joinLines(errs []error) error {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return errors.New(strings.Join(msgs, "\n  "))
+}
+
+// jwtConfig returns the settings for NewJWTValidator.
+func (s JWTSettings) jwtConfig() JWTConfig {
+	return JWTConfig{
+		JWKS:            s.JWKS,
+		Issuer:          s.Issuer,
+		Audience:        s.Audience,
+		ScopesClaim:     s.ScopesClaim,
+		TenantClaim:     s.TenantClaim,
+		SystemSubjects:  s.SystemSubjects,
+		GroupsClaim:     s.GroupsClaim,
+		Leeway:          time.Duration(s.Leeway),
+		RefreshInterval: time.Duration(s.RefreshInterval),
+	}
+}
+
+// itemCodec returns the ItemCodec for the compression and encryption
+// settings, reading the keyring file.
+func (c *Config) itemCodec() (*ItemCodec, error) {
+	codec := NewItemCodec(c.Compression.Threshold)
+	if c.Encryption.Keyring != "" {
+		keyring, err := LoadKeyring(c.Encryption.Keyring)
+		if err != nil {
+			return nil, err
+		}
+		codec.Keyring, codec.Encrypt = keyring, c.Encryption.Fields
+	}
+	return codec, nil
+}
+
+// redacted returns a copy of c that is safe to print.
+func (c *Config) redacted() *Config {
+	r := *c
+	if u, err := url.Parse(c.Redis.URL); err == nil && c.Redis.URL != "" {
+		r.Redis.URL = u.Redacted()
+	}
+	if c.Redis.Password != "" {
+		r.Redis.Password = "<redacted>"
+	}
+	if c.Redis.SentinelPassword != "" {
+		r.Redis.SentinelPassword = "<redacted>"
+	}
+	r.Auth.APIKeys = make(commaList, len(c.Auth.APIKeys))
+	for i := range r.Auth.APIKeys {
+		r.Auth.APIKeys[i] = "<redacted>"
+	}
+	return &r
+}
+
+// writeConfig writes c in format, "yaml" or "toml", for `gocrud config print`.
+func writeConfig(w io.Writer, c *Config, format string) error {
+	switch format {
+	case "yaml":
+		enc := yaml.NewEncoder(w)
+		enc.SetIndent(2)
+		if err := enc.Encode(c); err != nil {
+			return err
+		}
+		return enc.Close()
+	case "toml":
+		return toml.NewEncoder(w).Encode(c)
+	}
+	return fmt.Errorf("unknown format %q", format)
+}
+
+// Duration is a time.Duration written like "5s" in files, flags and env vars.
+type Duration time.Duration
+
+func (d Duration) String() string { return time.Duration(d).String() }
+
+// Set parses a flag or environment value.
+func (d *Duration) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// MarshalText and UnmarshalText use the same form in YAML and TOML files.
+func (d Duration) MarshalText() ([]byte, error) { return []byte(d.String()), nil }
+
+func (d *Duration) UnmarshalText(b []byte) error { return d.Set(string(b)) }
+
+// commaList is a list of strings written as "a,b,c" in flags and env vars.
+type commaList []string
+
+func (l *commaList) String() string { return strings.Join(*l, ",") }
+
+// Set replaces the list with the non-empty entries of s.
+func (l *commaList) Set(s string) error {
+	*l = nil
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
+
+// scopeLimits maps scopes to rate limits, written as "read=1200,admin=0" in
+// flags and env vars.
+type scopeLimits map[string]int
+
+func (m *scopeLimits) String() string {
+	parts := make([]string, 0, len(*m))
+	for _, scope := range m.names() {
+		parts = append(parts, fmt.Sprintf("%s=%d", scope, (*m)[scope]))
+	}
+	return strings.Join(parts, ",")
+}
+
+// Set replaces the limits with those parsed from s.
+func (m *scopeLimits) Set(s string) error {
+	limits, err := parseScopeLimits(s)
+	if err != nil {
+		return err
+	}
+	*m = limits
+	return nil
+}
+
+// names returns the scopes in m in sorted order.
+func (m scopeLimits) names() []string {
+	names := make([]string, 0, len(m))
+	for scope := range m {
+		names = append(names, scope)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// typeFields lists paths by item type, written as
+// "user=email,user=profile.location" in flags and env vars.
+type typeFields map[string][]string
+
+func (m *typeFields) String() string {
+	var parts []string
+	for _, typ := range m.types() {
+		for _, p := range (*m)[typ] {
+			parts = append(parts, typ+"="+p)
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// Set replaces the paths with those parsed from s.
+func (m *typeFields) Set(s string) error {
+	fields := make(typeFields)
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		typ, path, ok := strings.Cut(part, "=")
+		if !ok || typ == "" || path == "" {
+			return fmt.Errorf("invalid entry %q, want type=path", part)
+		}
+		fields[typ] = append(fields[typ], path)
+	}
+	*m = fields
+	return nil
+}
+
+// types returns the item types in m in sorted order.
+func (m typeFields) types() []string {
+	types := make([]string, 0, len(m))
+	for typ := range m {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// pathsOverlap reports whether one of two dotted paths lies within the other.
+func pathsOverlap(a, b string) bool {
+	return a == "*" || b == "*" || a == b || strings.HasPrefix(a, b+".") || strings.HasPrefix(b, a+".")
+}
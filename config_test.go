@@ -0,0 +1,105 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestLoadConfig checks that flags override env vars, which override the
+// file, which overrides the defaults.
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "gocrud.yaml")
+	os.WriteFile(path, []byte("http:\n  addr: ':8080'\n  read_timeout: 7s\nlog:\n  level: debug\nrate_limit:\n  default: 100\n  scopes: {read: 1200}\n"), 0o600)
+	env := map[string]string{"GOCRUD_CONFIG": path, "LOG_LEVEL": "warn", "RATE_LIMIT": "200", "API_KEYS": "k1, k2"}
+	getenv := func(k string) string { return env[k] }
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	cfg, err := loadConfig(fs, []string{"--rate_limit.default", "300"}, getenv)
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if cfg.HTTP.Addr != ":8080" || time.Duration(cfg.HTTP.ReadTimeout) != 7*time.Second {
+		t.Errorf("expected file settings, got addr %q and read timeout %s", cfg.HTTP.Addr, cfg.HTTP.ReadTimeout)
+	}
+	if time.Duration(cfg.HTTP.WriteTimeout) != 10*time.Second || time.Duration(cfg.Redis.ReadTimeout) != 3*time.Second {
+		t.Errorf("expected defaults for unset settings, got %+v", cfg)
+	}
+	if cfg.Log.Level != "warn" || len(cfg.Auth.APIKeys) != 2 || cfg.Auth.APIKeys[1] != "k2" {
+		t.Errorf("expected env settings over the file, got level %q and keys %v", cfg.Log.Level, cfg.Auth.APIKeys)
+	}
+	if cfg.RateLimit.Default != 300 || cfg.RateLimit.Scopes["read"] != 1200 {
+		t.Errorf("expected the flag over env and file, got %d, %v", cfg.RateLimit.Default, cfg.RateLimit.Scopes)
+	}
+
+	toml := filepath.Join(dir, "gocrud.toml")
+	os.WriteFile(toml, []byte("[http]\nshutdown_delay = \"1s\"\n[auth.jwt]\nleeway = \"1m\"\n"), 0o600)
+	cfg, err = loadConfig(flag.NewFlagSet("test", flag.ContinueOnError), []string{"--config", toml}, func(string) string { return "" })
+	if err != nil {
+		t.Fatalf("loadConfig with TOML: %v", err)
+	}
+	if time.Duration(cfg.HTTP.ShutdownDelay) != time.Second || time.Duration(cfg.Auth.JWT.Leeway) != time.Minute {
+		t.Errorf("expected TOML settings, got %+v", cfg.HTTP)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		os.WriteFile(path, []byte(content), 0o600)
+		return path
+	}
+	cases := []struct {
+		name string
+		args []string
+		env  map[string]string
+		want []string
+	}{
+		{"unknown yaml setting", []string{"--config", write("typo.yaml", "http:\n  adress: x\n")}, nil, []string{"adress"}},
+		{"unknown toml setting", []string{"--config", write("typo.toml", "[http]\nadress = \"x\"\n")}, nil, []string{`"http.adress"`}},
+		{"bad env value", nil, map[string]string{"SHUTDOWN_DELAY": "soon"}, []string{"SHUTDOWN_DELAY"}},
+		{"bad flag value", []string{"--rate_limit.scopes", "reed=1"}, nil, []string{"rate_limit.scopes"}},
+		{"breaker without cooldown", nil, map[string]string{"REDIS_RETRIES": "-1", "REDIS_BREAKER_COOLDOWN": "0s"}, []string{"redis.retries", "redis.breaker.cooldown must be positive"}},
+		{"cache without age", nil, map[string]string{"CACHE_MAX_ENTRIES": "100", "CACHE_MAX_AGE": "0s"}, []string{"cache.max_age must be positive"}},
+		{"encryption without keyring", nil, map[string]string{"ENCRYPTION_FIELDS": "user=email,user=email.domain,user=a..b"},
+			[]string{"encryption.keyring is required", "paths email and email.domain of type user overlap", `invalid path "a..b"`}},
+		{"bad encryption fields", []string{"--encryption.fields", "user"}, nil, []string{"encryption.fields"}},
+		{"negative compression threshold", []string{"--compression.threshold", "-1"}, nil, []string{"compression.threshold must not be negative"}},
+		{"every invalid setting", []string{"--log.format", "xml", "--auth.jwt.jwks", "keys.json", "--rate_limit.list_cost", "0"}, nil,
+			[]string{"log.format", "auth.jwt.issuer is required", "auth.jwt.audience is required", "rate_limit.list_cost"}},
+	}
+	for _, tc := range cases {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		fs.SetOutput(new(strings.Builder))
+		_, err := loadConfig(fs, tc.args, func(k string) string { return tc.env[k] })
+		if err == nil {
+			t.Errorf("%s: expected an error", tc.name)
+			continue
+		}
+		for _, want := range tc.want {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("%s: expected %q in %q", tc.name, want, err)
+			}
+		}
+	}
+}
+
+func TestConfigPrintRedacts(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Auth.APIKeys = commaList{"secret-key"}
+	var out strings.Builder
+	if err := writeConfig(&out, cfg.redacted(), "yaml"); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), "secret-key") || !strings.Contains(out.String(), "read_timeout: 5s") {
+		t.Fatalf("unexpected output:\n%s", out.String())
+	}
+	if cfg.Auth.APIKeys[0] != "secret-key" {
+		t.Fatal("redacted modified the original configuration")
+	}
+}
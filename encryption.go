@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// valueSealed is the header byte of an item value whose data is partly or
+// wholly encrypted. It is followed by the JSON of a sealedItem, and comes
+// before compression: a compressed value may hold a sealed one.
+const valueSealed byte = 0x02
+
+// sealedItem is a stored item with the values at Paths in its data
+// encrypted. Each value is replaced by a base64 string of a nonce and its
+// JSON encrypted with AES-GCM under a data key drawn for this write. The data
+// key is stored encrypted with the keyring key KeyID, so rotating keys only
+// means rewrapping it. Version selects the associated data the ciphertexts
+// are bound to; see fieldAD.
+type sealedItem struct {
+	Version int             `json:"v,omitempty"`
+	KeyID   string          `json:"kid"`
+	Key     []byte          `json:"key"`
+	Paths   []string        `json:"paths"`
+	Item    json.RawMessage `json:"item"`
+}
+
+// sealVersion is the sealedItem version written: 1 binds the ciphertexts to
+// the item's tenant as well as its ID. Version 0 values, which only bind the
+// ID, are still read, and rewritten by RewriteItems.
+const sealVersion = 1
+
+// sealedValue is a value other than an item, such as a change event, a
+// webhook delivery or a stored response, encrypted whole with the keyring key
+// KeyID. It follows the valueSealed header like a sealedItem.
+type sealedValue struct {
+	KeyID string `json:"kid"`
+	Data  []byte `json:"data"`
+}
+
+// Keyring holds the AES-256 keys that encrypt item data keys, by ID. New
+// values are encrypted with the Primary key; the others are kept to read
+// values written before a rotation.
+type Keyring struct {
+	Primary string
+	keys    map[string]cipher.AEAD
+}
+
+// keyringFile is the layout of a keyring file: the ID of the primary key and
+// every key by ID, each 32 random bytes in base64.
+type keyringFile struct {
+	Primary string            `json:"primary"`
+	Keys    map[string]string `json:"keys"`
+}
+
+// LoadKeyring reads the keyring file at path. Errors never include key material.
+func LoadKeyring(path string) (*Keyring, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f keyringFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("%s: invalid keyring: %w", path, err)
+	}
+	keys := make(map[string][]byte, len(f.Keys))
+	for id, s := range f.Keys {
+		key, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return nil, fmt.Errorf("%s: key %q is not valid base64", path, id)
+		}
+		keys[id] = key
+	}
+	k, err := NewKeyring(f.Primary, keys)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return k, nil
+}
+
+// NewKeyring creates a Keyring from 32-byte keys by ID.
+func NewKeyring(primary string, keys map[string][]byte) (*Keyring, error) {
+	k := &Keyring{Primary: primary, keys: make(map[string]cipher.AEAD, len(keys))}
+	for id, key := range keys {
+		if id == "" {
+			return nil, errors.New("keyring key IDs must not be empty")
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("key %q must be 32 bytes, got %d", id, len(key))
+		}
+		aead, err := newGCM(key)
+		if err != nil {
+			return nil, err
+		}
+		k.keys[id] = aead
+	}
+	if _, ok := k.keys[primary]; !ok {
+		return nil, fmt.Errorf("primary key %q is not in the keyring", primary)
+	}
+	return k, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts plaintext with aead, binding it to ad, and returns the nonce
+// followed by the ciphertext.
+func seal(aead cipher.AEAD, plaintext, ad []byte) []byte {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err) // crypto/rand never fails on supported platforms
+	}
+	return aead.Seal(nonce, nonce, plaintext, ad)
+}
+
+// open reverses seal.
+func open(aead cipher.AEAD, sealed, ad []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	n := aead.NonceSize()
+	return aead.Open(nil, sealed[:n], sealed[n:], ad)
+}
+
+// sealValue encrypts data with the primary key, bound to ad. A nil keyring
+// returns data as it is.
+func (k *Keyring) sealValue(data, ad []byte) ([]byte, error) {
+	if k == nil {
+		return data, nil
+	}
+	value, err := json.Marshal(sealedValue{KeyID: k.Primary, Data: seal(k.keys[k.Primary], data, ad)})
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{valueSealed}, value...), nil
+}
+
+// openValue reverses sealValue. Values that are not sealed, such as those
+// written before the keyring was configured, are returned as they are.
+func (k *Keyring) openValue(value, ad []byte) ([]byte, error) {
+	if len(value) == 0 || value[0] != valueSealed {
+		return value, nil
+	}
+	var s sealedValue
+	if err := json.Unmarshal(value[1:], &s); err != nil {
+		return nil, fmt.Errorf("reading encrypted value: %w", err)
+	}
+	if k == nil {
+		return nil, errors.New("value is encrypted and no keyring is configured")
+	}
+	kek, ok := k.keys[s.KeyID]
+	if !ok {
+		return nil, fmt.Errorf("value is encrypted with key %q, which is not in the keyring", s.KeyID)
+	}
+	return open(kek, s.Data, ad)
+}
+
+// sealPaths returns the paths configured for item's type that its data has,
+// in configuration order. The whole data is "*".
+func (c *ItemCodec) sealPaths(item *Item) []string {
+	if c == nil || c.Keyring == nil {
+		return nil
+	}
+	var paths []string
+	for _, p := range c.Encrypt[item.Type] {
+		if _, found, _ := replaceAt(item.Data, splitPath(p), func(v json.RawMessage) (json.RawMessage, error) { return v, nil }); found {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+// seal returns the value to store for item, in the tenant of ctx, before
+// compression: its JSON, or valueSealed and a sealedItem if its type has
+// encrypted paths.
+func (c *ItemCodec) seal(ctx context.Context, item *Item) ([]byte, error) {
+	paths := c.sealPaths(item)
+	if len(paths) == 0 {
+		return json.Marshal(item)
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	tenant := tenantFrom(ctx)
+	sealed := *item
+	for _, p := range paths {
+		sealed.Data, _, err = replaceAt(sealed.Data, splitPath(p), func(v json.RawMessage) (json.RawMessage, error) {
+			return json.Marshal(seal(aead, v, fieldAD(sealVersion, tenant, item.ID, p)))
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	data, err := json.Marshal(&sealed)
+	if err != nil {
+		return nil, err
+	}
+	kid := c.Keyring.Primary
+	value, err := json.Marshal(sealedItem{
+		Version: sealVersion,
+		KeyID:   kid,
+		Key:     seal(c.Keyring.keys[kid], key, fieldAD(sealVersion, tenant, item.ID, kid)),
+		Paths:   paths,
+		Item:    data,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{valueSealed}, value...), nil
+}
+
+// open returns the item JSON held in a sealed value of the tenant of ctx,
+// decrypted, and the ID of the key that encrypted it.
+func (c *ItemCodec) open(ctx context.Context, value []byte) ([]byte, *sealedItem, error) {
+	var s sealedItem
+	if err := json.Unmarshal(value[1:], &s); err != nil {
+		return nil, nil, fmt.Errorf("reading encrypted item: %w", err)
+	}
+	item, err := decodeItem(s.Item)
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading encrypted item: %w", err)
+	}
+	if c == nil || c.Keyring == nil {
+		return nil, nil, fmt.Errorf("item %s is encrypted and no keyring is configured", item.ID)
+	}
+	kek, ok := c.Keyring.keys[s.KeyID]
+	if !ok {
+		return nil, nil, fmt.Errorf("item %s is encrypted with key %q, which is not in the keyring", item.ID, s.KeyID)
+	}
+	tenant := tenantFrom(ctx)
+	key, err := open(kek, s.Key, fieldAD(s.Version, tenant, item.ID, s.KeyID))
+	if err != nil {
+		return nil, nil, fmt.Errorf("decrypting the data key of item %s: %w", item.ID, err)
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, p := range s.Paths {
+		var found bool
+		item.Data, found, err = replaceAt(item.Data, splitPath(p), func(v json.RawMessage) (json.RawMessage, error) {
+			var sealed []byte
+			if err := json.Unmarshal(v, &sealed); err != nil {
+				return nil, err
+			}
+			return open(aead, sealed, fieldAD(s.Version, tenant, item.ID, p))
+		})
+		if err == nil && !found {
+			err = errors.New("value missing")
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("decrypting %s of item %s: %w", p, item.ID, err)
+		}
+	}
+	data, err := json.Marshal(item)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, &s, nil
+}
+
+// fieldAD binds a ciphertext to the item it belongs to, so that it cannot
+// be moved to another item, tenant or path. Values of version 0 are not
+// bound to the tenant.
+func fieldAD(version int, tenant, itemID, name string) []byte {
+	if version == 0 {
+		return []byte(itemID + "\x00" + name)
+	}
+	return []byte(tenant + "\x00" + itemID + "\x00" + name)
+}
+
+// splitPath splits a dotted path below an item's data; "*" is the data itself.
+func splitPath(path string) []string {
+	if path == "*" {
+		return nil
+	}
+	return strings.Split(path, ".")
+}
+
+// replaceAt returns data with the value at path replaced by fn's result, and
+// whether path was found. Objects keep their key order; data is compacted
+// on the way to the value.
+func replaceAt(data json.RawMessage, path []string, fn func(json.RawMessage) (json.RawMessage, error)) (json.RawMessage, bool, error) {
+	if len(path) == 0 {
+		v, err := fn(data)
+		return v, err == nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return data, false, nil
+	}
+	var out bytes.Buffer
+	out.WriteByte('{')
+	found := false
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, false, err
+		}
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return nil, false, err
+		}
+		if key := tok.(string); key == path[0] && !found {
+			if value, found, err = replaceAt(value, path[1:], fn); err != nil {
+				return nil, false, err
+			}
+		}
+		if out.Len() > 1 {
+			out.WriteByte(',')
+		}
+		name, _ := json.Marshal(tok)
+		out.Write(name)
+		out.WriteByte(':')
+		if err := json.Compact(&out, value); err != nil {
+			return nil, false, err
+		}
+	}
+	out.WriteByte('}')
+	if !found {
+		return data, false, nil
+	}
+	return out.Bytes(), true, nil
+}
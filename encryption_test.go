@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testKeys returns n distinct 32-byte keys.
+func testKeys(n int) [][]byte {
+	keys := make([][]byte, n)
+	for i := range keys {
+		keys[i] = bytes.Repeat([]byte{byte(i + 1)}, 32)
+	}
+	return keys
+}
+
+func TestLoadKeyring(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString(testKeys(1)[0])
+	for _, tc := range []struct {
+		name, file, err string
+	}{
+		{"valid", `{"primary":"k1","keys":{"k1":"` + key + `","k0":"` + key + `"}}`, ""},
+		{"unknown primary", `{"primary":"k2","keys":{"k1":"` + key + `"}}`, `primary key "k2" is not in the keyring`},
+		{"short key", `{"primary":"k1","keys":{"k1":"c2hvcnQ="}}`, `key "k1" must be 32 bytes, got 5`},
+		{"bad base64", `{"primary":"k1","keys":{"k1":"not base64!"}}`, `key "k1" is not valid base64`},
+	} {
+		path := filepath.Join(t.TempDir(), "keyring.json")
+		os.WriteFile(path, []byte(tc.file), 0o600)
+		k, err := LoadKeyring(path)
+		switch {
+		case tc.err == "" && (err != nil || k.Primary != "k1" || len(k.keys) != 2):
+			t.Errorf("%s: got %+v, %v", tc.name, k, err)
+		case tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)):
+			t.Errorf("%s: expected %q, got %v", tc.name, tc.err, err)
+		case err != nil && strings.Contains(err.Error(), key):
+			t.Errorf("%s: the error shows the key: %v", tc.name, err)
+		}
+	}
+}
+
+func TestItemEncryption(t *testing.T) {
+	keys := testKeys(2)
+	k1, _ := NewKeyring("k1", map[string][]byte{"k1": keys[0]})
+	c := &ItemCodec{Keyring: k1, Encrypt: typeFields{"user": {"email", "profile.location", "phone"}, "secret": {"*"}}}
+	user := &Item{ID: "u1", Type: "user", Tags: []string{"customer"},
+		Data: json.RawMessage(`{"username":"john_doe","email":"john.doe@example.com","profile":{"location":"San Francisco, CA","bio":"x"}}`)}
+	plain, _ := json.Marshal(user)
+
+	value, err := c.encode(testCtx, user)
+	if err != nil || value[0] != valueSealed {
+		t.Fatalf("expected a sealed value, got %q, %v", value, err)
+	}
+	for _, secret := range []string{"john.doe@example.com", "San Francisco"} {
+		if bytes.Contains(value, []byte(secret)) {
+			t.Errorf("expected %q to be encrypted: %s", secret, value)
+		}
+	}
+	if !bytes.Contains(value, []byte(`john_doe`)) || !bytes.Contains(value, []byte(`"customer"`)) {
+		t.Errorf("expected the other fields and the tags in plaintext: %s", value)
+	}
+	data, info, err := c.decodeValue(testCtx, value)
+	if err != nil || !bytes.Equal(data, plain) {
+		t.Fatalf("decode: %s, %v", data, err)
+	}
+	if got := info.sealed.Paths; len(got) != 2 || got[0] != "email" || got[1] != "profile.location" {
+		t.Errorf("expected only the paths present to be encrypted, got %v", got)
+	}
+
+	// the ciphertexts are bound to their item
+	moved := bytes.Replace(value, []byte(`"id":"u1"`), []byte(`"id":"u2"`), 1)
+	if _, err := c.decode(testCtx, moved); err == nil {
+		t.Error("expected a value moved to another item not to decrypt")
+	}
+	if _, err := c.decode(withTenant(testCtx, "other"), value); err == nil {
+		t.Error("expected a value moved to another tenant not to decrypt")
+	}
+
+	secret := &Item{ID: "s1", Type: "secret", Data: json.RawMessage(`{"pin":1234}`)}
+	value, _ = c.encode(testCtx, secret)
+	if bytes.Contains(value, []byte("1234")) {
+		t.Errorf("expected the whole data to be encrypted: %s", value)
+	}
+	if data, err := c.decode(testCtx, value); err != nil || !strings.Contains(string(data), `"data":{"pin":1234}`) {
+		t.Errorf("decode: %s, %v", data, err)
+	}
+	note := &Item{ID: "n1", Type: "note", Data: json.RawMessage(`{"email":"a@b.c"}`)}
+	if value, _ := c.encode(testCtx, note); value[0] != '{' {
+		t.Errorf("expected other types to be stored plain, got %q", value)
+	}
+
+	c.Threshold = 10
+	value, _ = c.encode(testCtx, user)
+	if data, err := c.decode(testCtx, value); !isCompressed(value) || err != nil || !bytes.Equal(data, plain) {
+		t.Errorf("expected a compressed sealed value to round-trip, got %s, %v", data, err)
+	}
+
+	_, err = (*ItemCodec)(nil).decode(testCtx, value)
+	if err == nil || strings.Contains(err.Error(), "john.doe") {
+		t.Errorf("expected decoding without a keyring to fail without showing the data, got %v", err)
+	}
+}
+
+// TestKeyRotation reads items encrypted with a retired key, and checks that
+// reads and RewriteItems encrypt them again with the primary one.
+func TestKeyRotation(t *testing.T) {
+	keys := testKeys(2)
+	k1, _ := NewKeyring("k1", map[string][]byte{"k1": keys[0]})
+	k2, _ := NewKeyring("k2", map[string][]byte{"k1": keys[0], "k2": keys[1]})
+	fields := typeFields{"user": {"email"}}
+	old, rotated := NewRedisStore(redisClient), NewRedisStore(redisClient)
+	old.Codec = &ItemCodec{Keyring: k1, Encrypt: fields}
+	rotated.Codec = &ItemCodec{Keyring: k2, Encrypt: fields}
+
+	kid := func(id string) string {
+		t.Helper()
+		value, err := redisClient.Get(testCtx, tenantKey(testCtx, "item:%s", id)).Bytes()
+		if err != nil {
+			t.Fatalf("get %s: %v", id, err)
+		}
+		_, info, err := rotated.Codec.decodeValue(testCtx, value)
+		if err != nil || info.sealed == nil {
+			t.Fatalf("expected %s to be encrypted, got %v", id, err)
+		}
+		return info.sealed.KeyID
+	}
+	for _, id := range []string{"rot-1", "rot-2"} {
+		item := &Item{ID: id, Type: "user", Data: json.RawMessage(`{"email":"` + id + `@example.com"}`)}
+		if err := old.SaveItem(testCtx, item); err != nil {
+			t.Fatalf("save: %v", err)
+		}
+		defer rotated.DeleteItem(testCtx, id)
+	}
+
+	rotated.Modes = &ModeStore{}
+	rotated.Modes.current.Store(&ServiceMode{Mode: ModeReadOnly})
+	if _, err := rotated.GetItem(testCtx, "rot-1"); err != nil || kid("rot-1") != "k1" {
+		t.Fatalf("expected reads in read-only mode to leave the item alone, got %v", err)
+	}
+	rotated.Modes.current.Store(&ServiceMode{Mode: ModeNormal})
+
+	got, err := rotated.GetItem(testCtx, "rot-1")
+	if err != nil || string(got.Data) != `{"email":"rot-1@example.com"}` {
+		t.Fatalf("get: %+v, %v", got, err)
+	}
+	if kid("rot-1") != "k2" || kid("rot-2") != "k1" || rotated.Codec.rekeyed.Load() != 1 {
+		t.Fatal("expected the item read to be encrypted again with the primary key")
+	}
+	if _, err := old.GetItem(testCtx, "rot-1"); err == nil {
+		t.Error("expected a replica without the new key to fail to read the item")
+	}
+	if n, err := rotated.RewriteItems(testCtx); err != nil || n < 1 || kid("rot-2") != "k2" {
+		t.Fatalf("expected RewriteItems to encrypt the other item again, got %d, %v", n, err)
+	}
+
+	rotated.Codec.Encrypt = nil
+	if _, err := rotated.RewriteItems(testCtx); err != nil {
+		t.Fatalf("rewrite: %v", err)
+	}
+	if value, _ := redisClient.Get(testCtx, tenantKey(testCtx, "item:%s", "rot-2")).Bytes(); !bytes.Contains(value, []byte("rot-2@example.com")) {
+		t.Errorf("expected removing the type's fields to decrypt its items, got %q", value)
+	}
+}
+
+// TestLegacySealedItems reads an item sealed before values were bound to
+// their tenant, and checks that RewriteItems seals it again.
+func TestLegacySealedItems(t *testing.T) {
+	keys := testKeys(1)
+	k1, _ := NewKeyring("k1", map[string][]byte{"k1": keys[0]})
+	store := NewRedisStore(redisClient)
+	store.Codec = &ItemCodec{Keyring: k1, Encrypt: typeFields{"user": {"email"}}}
+
+	// the layout of a version 0 value, as written by earlier releases
+	dataKey := testKeys(1)[0]
+	aead, _ := newGCM(dataKey)
+	email, _ := json.Marshal(seal(aead, []byte(`"old@example.com"`), fieldAD(0, "", "legacy-1", "email")))
+	item, _ := json.Marshal(&Item{ID: "legacy-1", Type: "user", Data: json.RawMessage(`{"email":` + string(email) + `}`)})
+	value, _ := json.Marshal(sealedItem{KeyID: "k1", Key: seal(k1.keys["k1"], dataKey, fieldAD(0, "", "legacy-1", "k1")), Paths: []string{"email"}, Item: item})
+	key := tenantKey(testCtx, "item:%s", "legacy-1")
+	redisClient.Set(testCtx, key, append([]byte{valueSealed}, value...), 0)
+	defer redisClient.Del(testCtx, key)
+
+	got, err := store.GetItem(testCtx, "legacy-1")
+	if err != nil || string(got.Data) != `{"email":"old@example.com"}` {
+		t.Fatalf("expected the legacy item to be readable, got %+v, %v", got, err)
+	}
+	if n, err := store.RewriteItems(testCtx); err != nil || n < 1 {
+		t.Fatalf("rewrite: %d, %v", n, err)
+	}
+	stored, _ := redisClient.Get(testCtx, key).Bytes()
+	_, info, err := store.Codec.decodeValue(testCtx, stored)
+	if err != nil || info.sealed == nil || info.sealed.Version != sealVersion {
+		t.Fatalf("expected the item to be sealed again at version %d, got %+v, %v", sealVersion, info.sealed, err)
+	}
+}
+
+func TestAuditRedactsEncryptedPaths(t *testing.T) {
+	a := &AuditLog{Encrypted: typeFields{"user": {"email", "profile.location"}}}
+	before := &Item{Type: "user", Data: json.RawMessage(`{"email":"a@b.c","profile":{"location":"x","bio":"y"},"name":"n"}`)}
+	after := &Item{Type: "user", Data: json.RawMessage(`{"email":"d@e.f","profile":"hidden","name":"m"}`)}
+	ev := ChangeEvent{Before: before, Item: after}
+	changes := diffItems(before, after)
+	a.redact(ev, changes)
+	got := map[string]string{}
+	for _, c := range changes {
+		got[c.Path] = string(c.From) + " " + string(c.To)
+	}
+	want := map[string]string{
+		"data.email":   `"<encrypted>" "<encrypted>"`,
+		"data.profile": `{"bio":"y","location":"<encrypted>"} "hidden"`,
+		"data.name":    `"n" "m"`,
+	}
+	for path, w := range want {
+		if got[path] != w {
+			t.Errorf("%s: expected %s, got %s", path, w, got[path])
+		}
+	}
+
+	created := diffItems(nil, before)
+	a.redact(ChangeEvent{Item: before}, created)
+	if to := string(created[0].To); created[0].Path != "data" || to != `{"email":"<encrypted>","name":"n","profile":{"bio":"y","location":"<encrypted>"}}` {
+		t.Errorf("expected only the encrypted paths of a new item to be masked, got %s %s", created[0].Path, to)
+	}
+}
+
+// TestNoPlaintextInRedis writes an item with an encrypted path through every
+// store that copies item data into Redis, and checks that the value appears
+// in none of the raw values while each store still reads it back.
+func TestNoPlaintextInRedis(t *testing.T) {
+	const pii = "jane.roe@example.com"
+	k1, _ := NewKeyring("k1", map[string][]byte{"k1": testKeys(1)[0]})
+	ctx, cancel := context.WithCancel(withTenant(testCtx, "sealed"))
+	defer cancel()
+	item := &Item{ID: "pii-1", Type: "user", Data: json.RawMessage(`{"email":"` + pii + `"}`)}
+	ev := ChangeEvent{Event: EventItemUpdated, Tenant: "sealed", ItemID: item.ID, Item: item, Before: item, Time: time.Now().UTC()}
+
+	store := NewRedisStore(redisClient)
+	store.Codec = &ItemCodec{Keyring: k1, Encrypt: typeFields{"user": {"email"}}}
+	if err := store.SaveItem(ctx, item); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	defer store.DeleteItem(ctx, item.ID)
+
+	// pub/sub messages are not stored, so the channel is watched instead
+	raw := redisClient.Subscribe(ctx, eventsChannel)
+	defer raw.Close()
+	if _, err := raw.Receive(ctx); err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	broker := NewEventBroker(redisClient, newTestLogger())
+	broker.Keyring = k1
+	if err := broker.Start(ctx); err != nil {
+		t.Fatalf("start broker: %v", err)
+	}
+	events, stop := broker.Subscribe()
+	defer stop()
+	broker.ItemChanged(ctx, ev)
+	select {
+	case msg := <-raw.Channel():
+		if strings.Contains(msg.Payload, pii) {
+			t.Errorf("change event published in plaintext: %s", msg.Payload)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no change event published")
+	}
+	select {
+	case got := <-events:
+		if !bytes.Contains(got.Item.Data, []byte(pii)) {
+			t.Errorf("expected the broker to decrypt the event, got %s", got.Item.Data)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no change event received")
+	}
+
+	webhooks := NewWebhookStore(redisClient)
+	webhooks.Keyring = k1
+	dispatcher := NewWebhookDispatcher(webhooks, redisClient, newTestLogger())
+	dispatcher.BaseBackoff = time.Hour
+	del := &webhookDelivery{ID: "pii-delivery", Tenant: "sealed", WebhookID: "pii-hook", Event: ev, Attempt: 1}
+	dispatcher.retry(ctx, del, "endpoint responded 500")
+	defer redisClient.ZRemRangeByScore(testCtx, webhookRetryKey, strconv.FormatInt(time.Now().Add(30*time.Minute).UnixMilli(), 10), "+inf")
+	if err := webhooks.DeadLetter(ctx, del); err != nil {
+		t.Fatalf("dead-letter: %v", err)
+	}
+	defer redisClient.Del(testCtx, tenantKey(ctx, "webhook:%s:dead", del.WebhookID))
+	dead, err := webhooks.DeadLetters(ctx, del.WebhookID)
+	if err != nil || len(dead) != 1 || !bytes.Contains(dead[0].Event.Item.Data, []byte(pii)) {
+		t.Fatalf("expected the dead letter to be decrypted, got %+v, %v", dead, err)
+	}
+
+	idempotency := NewIdempotencyStore(redisClient)
+	idempotency.Keyring = k1
+	body, _ := json.Marshal(item)
+	if err := idempotency.Complete(ctx, "pii-key", &idempotencyRecord{Fingerprint: "f", Status: http.StatusCreated, Body: body}); err != nil {
+		t.Fatalf("complete: %v", err)
+	}
+	defer redisClient.Del(testCtx, idempotency.key(ctx, "pii-key"))
+	// the body is base64 in the record, where the search below cannot see it
+	if value, _ := redisClient.Get(testCtx, idempotency.key(ctx, "pii-key")).Bytes(); len(value) == 0 || value[0] != valueSealed {
+		t.Errorf("expected the stored response to be encrypted, got %q", value)
+	}
+	rec, claimed, err := idempotency.Begin(ctx, "pii-key", "f")
+	if err != nil || claimed || !bytes.Contains(rec.Body, []byte(pii)) {
+		t.Fatalf("expected the stored response to be decrypted, got %+v, %v, %v", rec, claimed, err)
+	}
+
+	keys, err := scanKeys(testCtx, redisClient, "*")
+	if err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+	for _, key := range keys {
+		var values []string
+		switch typ := redisClient.Type(testCtx, key).Val(); typ {
+		case "string":
+			values = []string{redisClient.Get(testCtx, key).Val()}
+		case "list":
+			values = redisClient.LRange(testCtx, key, 0, -1).Val()
+		case "set":
+			values = redisClient.SMembers(testCtx, key).Val()
+		case "zset":
+			values = redisClient.ZRange(testCtx, key, 0, -1).Val()
+		case "hash":
+			for k, v := range redisClient.HGetAll(testCtx, key).Val() {
+				values = append(values, k, v)
+			}
+		case "stream":
+			for _, msg := range redisClient.XRange(testCtx, key, "-", "+").Val() {
+				values = append(values, fmt.Sprint(msg.Values))
+			}
+		}
+		for _, v := range values {
+			if strings.Contains(v, pii) {
+				t.Errorf("%s holds the encrypted value in plaintext: %s", key, v)
+			}
+		}
+	}
+}
@@ -1,9 +1,60 @@
 package main
 
-import "errors"
+import (
+	"errors"
+	"time"
+)
 
 // ErrNotFound is returned when an item is not found in the store.
 var ErrNotFound = errors.New("item not found")
 
+// ErrPreconditionFailed is returned when a conditional write finds the item
+// changed since the version it was based on.
+var ErrPreconditionFailed = errors.New("item was modified")
+
 // ErrInvalidInput is returned when the input payload is invalid.
 var ErrInvalidInput = errors.New("invalid input")
+
+// ErrInvalidCredentials is returned when a presented API key or token is
+// unknown, revoked, expired or fails validation.
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// inputError carries a client-facing validation message and matches
+// ErrInvalidInput so callers can branch with errors.Is.
+type inputError struct {
+	msg string
+}
+
+func (e *inputError) Error() string { return e.msg }
+
+func (e *inputError) Is(target error) bool { return target == ErrInvalidInput }
+
+// ErrForbidden is returned when the caller lacks permission for an operation.
+var ErrForbidden = errors.New("forbidden")
+
+// forbiddenError carries the reason an operation was denied and matches ErrForbidden.
+type forbiddenError struct {
+	reason string
+}
+
+func (e *forbiddenError) Error() string { return e.reason }
+
+func (e *forbiddenError) Is(target error) bool { return target == ErrForbidden }
+
+// ErrUnavailable is returned when Redis cannot be reached or the circuit
+// breaker in front of it is open.
+var ErrUnavailable = errors.New("redis is unavailable")
+
+// unavailableError wraps the failure of a Redis command that could not reach
+// Redis, or that the open breaker rejected, and matches ErrUnavailable.
+type unavailableError struct {
+	err        error
+	retryAfter time.Duration // when to try again
+	rejected   bool          // the breaker failed the command without sending it
+}
+
+func (e *unavailableError) Error() string { return "redis is unavailable: " + e.err.Error() }
+
+func (e *unavailableError) Unwrap() error { return e.err }
+
+func (e *unavailableError) Is(target error) bool { return target == ErrUnavailable }
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Change event names published for item mutations.
+const (
+	EventItemCreated = "item.created"
+	EventItemUpdated = "item.updated"
+	EventItemDeleted = "item.deleted"
+)
+
+// eventsChannel is the Redis pub/sub channel carrying change events between replicas.
+const eventsChannel = "items:events"
+
+// ChangeEvent describes a single persisted mutation of an item.
+type ChangeEvent struct {
+	Event  string    `json:"event"`
+	Tenant string    `json:"tenant,omitempty"`
+	ItemID string    `json:"itemId"`
+	Item   *Item     `json:"item,omitempty"`   // state after the change, nil for deletes
+	Before *Item     `json:"before,omitempty"` // state before the change, nil for creates
+	Time   time.Time `json:"time"`
+}
+
+// Subject returns the item the event is about: the new state, or the old one for deletes.
+func (ev ChangeEvent) Subject() *Item {
+	if ev.Item != nil {
+		return ev.Item
+	}
+	return ev.Before
+}
+
+// ChangeListener is notified after an item mutation has been persisted.
+type ChangeListener interface {
+	ItemChanged(ctx context.Context, ev ChangeEvent)
+}
+
+// EventBroker publishes change events to Redis and fans the events received
+// from Redis out to local subscribers, so every replica sees every mutation.
+type EventBroker struct {
+	client redis.UniversalClient
+	logger *slog.Logger
+	// Keyring encrypts the events published, which carry item data; nil
+	// publishes them in plain JSON.
+	Keyring *Keyring
+
+	mu   sync.RWMutex
+	subs map[chan ChangeEvent]struct{}
+}
+
+// NewEventBroker creates an EventBroker; call Start to begin receiving events.
+func NewEventBroker(client redis.UniversalClient, logger *slog.Logger) *EventBroker {
+	return &EventBroker{client: client, logger: logger, subs: make(map[chan ChangeEvent]struct{})}
+}
+
+// ItemChanged publishes ev to all replicas.
+func (b *EventBroker) ItemChanged(ctx context.Context, ev ChangeEvent) {
+	data, err := json.Marshal(ev)
+	if err == nil {
+		data, err = b.Keyring.sealValue(data, []byte(eventsChannel))
+	}
+	if err != nil {
+		b.logger.ErrorContext(ctx, "error encoding change event", "error", err)
+		return
+	}
+	// the mutation is already committed, so publish even if the request is gone
+	if err := b.client.Publish(context.WithoutCancel(ctx), eventsChannel, data).Err(); err != nil {
+		b.logger.ErrorContext(ctx, "error publishing change event", "error", err)
+	}
+}
+
+// Start subscribes to the events channel and dispatches events until ctx is done.
+// It returns once the subscription is confirmed by Redis.
+func (b *EventBroker) Start(ctx context.Context) error {
+	ps := b.client.Subscribe(ctx, eventsChannel)
+	if _, err := ps.Receive(ctx); err != nil {
+		ps.Close()
+		return err
+	}
+	go func() {
+		defer ps.Close()
+		ch := ps.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg, ok := <-ch:
+				if !ok {
+					return
+				}
+				var ev ChangeEvent
+				data, err := b.Keyring.openValue([]byte(msg.Payload), []byte(eventsChannel))
+				if err == nil {
+					err = json.Unmarshal(data, &ev)
+				}
+				if err != nil {
+					b.logger.Error("error decoding change event", "error", err)
+					continue
+				}
+				b.dispatch(ev)
+			}
+		}
+	}()
+	return nil
+}
+
+// Subscribe returns a channel of change events and a function to stop receiving them.
+func (b *EventBroker) Subscribe() (<-chan ChangeEvent, func()) {
+	ch := make(chan ChangeEvent, 64)
+	b.mu.Lock()
+	b.subs[ch] = struct{}{}
+	b.mu.Unlock()
+	return ch, func() {
+		b.mu.Lock()
+		delete(b.subs, ch)
+		b.mu.Unlock()
+	}
+}
+
+// dispatch delivers ev to every subscriber, dropping it for subscribers that are not keeping up.
+func (b *EventBroker) dispatch(ev ChangeEvent) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for ch := range b.subs {
+		select {
+		case ch <- ev:
+		default:
+			b.logger.Warn("dropping event for slow subscriber", "event", ev.Event, "item_id", ev.ItemID)
+		}
+	}
+}
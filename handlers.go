@@ -1,28 +1,48 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/google/uuid"
 )
 
+// maxPageSize bounds the limit of a paginated GET /items.
+const maxPageSize = 1000
+
 // Handler handles HTTP requests for items.
 type Handler struct {
-	store  *RedisStore
-	logger *log.Logger
+	store     *RedisStore
+	logger    *slog.Logger
+	listeners []ChangeListener
 }
 
 // NewHandler creates a Handler with dependencies.
-func NewHandler(store *RedisStore, logger *log.Logger) *Handler {
+func NewHandler(store *RedisStore, logger *slog.Logger) *Handler {
 	return &Handler{store: store, logger: logger}
 }
 
+// AddListener registers l to be notified after every successful mutation.
+func (h *Handler) AddListener(l ChangeListener) {
+	h.listeners = append(h.listeners, l)
+}
+
+// notify delivers ev, stamped with the tenant of ctx, to all registered listeners.
+func (h *Handler) notify(ctx context.Context, ev ChangeEvent) {
+	ev.Tenant = tenantFrom(ctx)
+	for _, l := range h.listeners {
+		l.ItemChanged(ctx, ev)
+	}
+}
+
 // itemsHandler routes requests without ID: GET for list, POST for create.
 func (h *Handler) itemsHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
@@ -36,7 +56,7 @@ func (h *Handler) itemsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// itemHandler routes requests with ID: GET, PUT, DELETE.
+// itemHandler routes requests with ID: GET, PUT, PATCH, DELETE.
 func (h *Handler) itemHandler(w http.ResponseWriter, r *http.Request) {
 	id := strings.TrimPrefix(r.URL.Path, "/items/")
 	if id == "" {
@@ -48,10 +68,12 @@ func (h *Handler) itemHandler(w http.ResponseWriter, r *http.Request) {
 		h.handleGetItem(w, r, id)
 	case http.MethodPut:
 		h.handleUpdateItem(w, r, id)
+	case http.MethodPatch:
+		h.handlePatchItem(w, r, id)
 	case http.MethodDelete:
 		h.handleDeleteItem(w, r, id)
 	default:
-		w.Header().Set("Allow", "GET, PUT, DELETE")
+		w.Header().Set("Allow", "GET, PUT, PATCH, DELETE")
 		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
 	}
 }
@@ -69,56 +91,46 @@ func (h *Handler) handleCreateItem(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	if strings.TrimSpace(req.Type) == "" || len(req.Data) == 0 {
-		http.Error(w, "type and data are required", http.StatusBadRequest)
-		return
-	}
-	// validate JSON data
-	var js interface{}
-	if err := json.Unmarshal(req.Data, &js); err != nil {
-		http.Error(w, fmt.Sprintf("invalid JSON data: %v", err), http.StatusBadRequest)
-		return
-	}
-
-	now := time.Now().UTC()
-	item := &Item{
-		ID:           uuid.NewString(),
-		Type:         req.Type,
-		Tags:         req.Tags,
-		Data:         req.Data,
-		CreatedAt:    now,
-		LastModified: now,
-	}
 
-	if err := h.store.SaveItem(r.Context(), item); err != nil {
-		h.logger.Printf("error saving item: %v", err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	item, err := h.createItem(r.Context(), req)
+	if err != nil {
+		writeError(w, r, h.logger, err, "error saving item")
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Location", fmt.Sprintf("/items/%s", item.ID))
+	w.Header().Set("ETag", itemETag(item))
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(item)
 }
 
-// handleGetItem processes GET /items/{id}.
+// handleGetItem processes GET /items/{id}, answering 304 when If-None-Match
+// names the item's current version.
 func (h *Handler) handleGetItem(w http.ResponseWriter, r *http.Request, id string) {
 	item, err := h.store.GetItem(r.Context(), id)
 	if err != nil {
-		if err == ErrNotFound {
-			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
-		} else {
-			h.logger.Printf("error getting item: %v", err)
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-		}
+		writeError(w, r, h.logger, err, "error getting item")
+		return
+	}
+	if err := authorize(r.Context(), ScopeRead, item); err != nil {
+		writeError(w, r, h.logger, err, "error authorizing read")
+		return
+	}
+	if item.stale {
+		w.Header().Set("Warning", `110 - "Response is Stale"`)
+	}
+	w.Header().Set("ETag", itemETag(item))
+	if match := r.Header.Get("If-None-Match"); match != "" && etagMatches(match, item) {
+		w.WriteHeader(http.StatusNotModified)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(item)
 }
 
-// handleUpdateItem processes PUT /items/{id}.
+// handleUpdateItem processes PUT /items/{id}. With If-Match, the item is
+// only replaced if it is still at the version named.
 func (h *Handler) handleUpdateItem(w http.ResponseWriter, r *http.Request, id string) {
 	var req UpdateItemRequest
 	dec := json.NewDecoder(r.Body)
@@ -131,61 +143,72 @@ func (h *Handler) handleUpdateItem(w http.ResponseWriter, r *http.Request, id st
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	if strings.TrimSpace(req.Type) == "" || len(req.Data) == 0 {
-		http.Error(w, "type and data are required", http.StatusBadRequest)
+
+	item, err := h.updateItem(r.Context(), id, r.Header.Get("If-Match"), req)
+	if err != nil {
+		writeError(w, r, h.logger, err, "error updating item")
 		return
 	}
-	// validate JSON data
-	var js interface{}
-	if err := json.Unmarshal(req.Data, &js); err != nil {
-		http.Error(w, fmt.Sprintf("invalid JSON data: %v", err), http.StatusBadRequest)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", itemETag(item))
+	json.NewEncoder(w).Encode(item)
+}
+
+// handlePatchItem processes PATCH /items/{id}, honoring If-Match like PUT.
+func (h *Handler) handlePatchItem(w http.ResponseWriter, r *http.Request, id string) {
+	var req PatchItemRequest
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request payload: %v", err), http.StatusBadRequest)
 		return
 	}
-
-	item, err := h.store.GetItem(r.Context(), id)
-	if err != nil {
-		if err == ErrNotFound {
-			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
-		} else {
-			h.logger.Printf("error fetching item for update: %v", err)
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-		}
+	if err := ensureSingleJSON(dec); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	item.Type = req.Type
-	item.Tags = req.Tags
-	item.Data = req.Data
-	item.LastModified = time.Now().UTC()
-
-	if err := h.store.SaveItem(r.Context(), item); err != nil {
-		h.logger.Printf("error updating item: %v", err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	item, err := h.patchItem(r.Context(), id, r.Header.Get("If-Match"), req)
+	if err != nil {
+		writeError(w, r, h.logger, err, "error patching item")
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", itemETag(item))
 	json.NewEncoder(w).Encode(item)
 }
 
-// handleDeleteItem processes DELETE /items/{id}.
+// handleDeleteItem processes DELETE /items/{id}, honoring If-Match like PUT.
 func (h *Handler) handleDeleteItem(w http.ResponseWriter, r *http.Request, id string) {
-	err := h.store.DeleteItem(r.Context(), id)
-	if err != nil {
-		if err == ErrNotFound {
-			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
-		} else {
-			h.logger.Printf("error deleting item: %v", err)
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-		}
+	if err := h.deleteItem(r.Context(), id, r.Header.Get("If-Match")); err != nil {
+		writeError(w, r, h.logger, err, "error deleting item")
 		return
 	}
 	w.WriteHeader(http.StatusNoContent)
 }
 
-// handleListItems processes GET /items.
+// handleListItems processes GET /items. Items outside the caller's type and
+// tag limits, or private to others under their ACL, are left out of the result.
+// With ?limit=N the items are returned in pages of up to N, ordered by ID,
+// and a Link header with rel="next" points to the next page.
 func (h *Handler) handleListItems(w http.ResponseWriter, r *http.Request) {
-	typeFilter := r.URL.Query().Get("type")
+	if err := authorize(r.Context(), ScopeRead, nil); err != nil {
+		writeError(w, r, h.logger, err, "error authorizing list")
+		return
+	}
+	query := r.URL.Query()
+	typeFilter := query.Get("type")
+	limit := 0
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPageSize {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxPageSize), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
 
 	// Parse tag filters - support both comma-separated and multiple params
 	var tagFilters []string
@@ -206,16 +229,246 @@ func (h *Handler) handleListItems(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	items, err := h.store.ListItems(r.Context(), typeFilter, tagFilters)
+	items, next, err := h.store.ListPage(r.Context(), typeFilter, tagFilters, query.Get("cursor"), limit)
 	if err != nil {
-		h.logger.Printf("error listing items: %v", err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		writeError(w, r, h.logger, err, "error listing items")
 		return
 	}
+	if p := principalFrom(r.Context()); p != nil {
+		visible := items[:0]
+		for _, item := range items {
+			if p.CanAccess(item.Type, item.Tags) && p.canUse(ScopeRead, item) {
+				visible = append(visible, item)
+			}
+		}
+		items = visible
+	}
+	if next != "" {
+		query.Set("cursor", next)
+		w.Header().Set("Link", fmt.Sprintf(`</items?%s>; rel="next"`, query.Encode()))
+	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(items)
 }
 
+// createItem validates req, persists a new item and notifies listeners.
+func (h *Handler) createItem(ctx context.Context, req CreateItemRequest) (*Item, error) {
+	if err := validateItemPayload(req.Type, req.Data); err != nil {
+		return nil, err
+	}
+	if err := req.ACL.validate(); err != nil {
+		return nil, err
+	}
+	if err := authorize(ctx, ScopeWrite, &Item{Type: req.Type, Tags: req.Tags}); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	item := &Item{
+		ID:           uuid.NewString(),
+		Type:         req.Type,
+		Tags:         req.Tags,
+		Data:         req.Data,
+		ACL:          req.ACL,
+		CreatedAt:    now,
+		LastModified: now,
+	}
+	if p := principalFrom(ctx); p != nil {
+		item.Owner = p.ID
+	}
+	if err := h.store.SaveItem(ctx, item); err != nil {
+		return nil, err
+	}
+
+	h.notify(ctx, ChangeEvent{Event: EventItemCreated, ItemID: item.ID, Item: item, Time: now})
+	return item, nil
+}
+
+// updateItem validates req, replaces the item's contents and notifies listeners.
+func (h *Handler) updateItem(ctx context.Context, id, ifMatch string, req UpdateItemRequest) (*Item, error) {
+	if err := validateItemPayload(req.Type, req.Data); err != nil {
+		return nil, err
+	}
+	if err := req.ACL.validate(); err != nil {
+		return nil, err
+	}
+	if err := authorize(ctx, ScopeWrite, &Item{Type: req.Type, Tags: req.Tags}); err != nil {
+		return nil, err
+	}
+
+	return h.modifyItem(ctx, id, ifMatch, func(item *Item) error {
+		if err := checkACLChange(ctx, item, req.ACL); err != nil {
+			return err
+		}
+		item.Type = req.Type
+		item.Tags = req.Tags
+		item.Data = req.Data
+		if req.ACL != nil {
+			item.ACL = req.ACL
+		}
+		return nil
+	})
+}
+
+// patchItem validates req, applies it to the item and notifies listeners.
+func (h *Handler) patchItem(ctx context.Context, id, ifMatch string, req PatchItemRequest) (*Item, error) {
+	if req.Type != "" && strings.TrimSpace(req.Type) == "" {
+		return nil, &inputError{"type must not be blank"}
+	}
+	if err := req.ACL.validate(); err != nil {
+		return nil, err
+	}
+
+	return h.modifyItem(ctx, id, ifMatch, func(item *Item) error {
+		if err := checkACLChange(ctx, item, req.ACL); err != nil {
+			return err
+		}
+		if req.Type != "" {
+			item.Type = req.Type
+		}
+		if req.Tags != nil {
+			item.Tags = req.Tags
+		}
+		if len(req.Data) > 0 {
+			data, err := mergePatch(item.Data, req.Data)
+			if err != nil {
+				return &inputError{fmt.Sprintf("invalid JSON data: %v", err)}
+			}
+			item.Data = data
+		}
+		if req.ACL != nil {
+			item.ACL = req.ACL
+		}
+		return authorize(ctx, ScopeWrite, &Item{Type: item.Type, Tags: item.Tags})
+	})
+}
+
+// checkACLChange refuses to replace the ACL of item with acl unless the
+// caller owns the item or is an administrator.
+func checkACLChange(ctx context.Context, item *Item, acl *ItemACL) error {
+	if p := principalFrom(ctx); acl != nil && p != nil && !p.owns(item) && !p.Allows(ScopeAdmin) {
+		return &forbiddenError{"only the owner of an item can change its access control list"}
+	}
+	return nil
+}
+
+// maxWriteAttempts bounds how often modifyItem starts over when another
+// write changes the item between reading and saving it. A write only has to
+// start over after another one succeeded, so this many concurrent writers
+// all get through.
+const maxWriteAttempts = 10
+
+// modifyItem reads the item with id, lets change validate and apply the new
+// contents, and saves it if it has not been changed since it was read. With
+// ifMatch, the item must also be at the version named; otherwise a
+// concurrent change makes modifyItem start over with the newer item.
+func (h *Handler) modifyItem(ctx context.Context, id, ifMatch string, change func(item *Item) error) (*Item, error) {
+	for attempt := 1; ; attempt++ {
+		item, err := h.store.GetItem(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if err := authorize(ctx, ScopeWrite, item); err != nil {
+			return nil, err
+		}
+		if ifMatch != "" && !etagMatches(ifMatch, item) {
+			return nil, ErrPreconditionFailed
+		}
+		before := *item
+
+		if err := change(item); err != nil {
+			return nil, err
+		}
+		item.LastModified = time.Now().UTC()
+
+		err = h.store.SaveItemIf(ctx, item, before.LastModified)
+		if errors.Is(err, ErrPreconditionFailed) && ifMatch == "" && attempt < maxWriteAttempts {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		h.notify(ctx, ChangeEvent{Event: EventItemUpdated, ItemID: id, Item: item, Before: &before, Time: item.LastModified})
+		return item, nil
+	}
+}
+
+// deleteItem removes the item, if it is at the version named by ifMatch
+// when that is set, and notifies listeners.
+func (h *Handler) deleteItem(ctx context.Context, id, ifMatch string) error {
+	item, err := h.store.GetItem(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := authorize(ctx, ScopeDelete, item); err != nil {
+		return err
+	}
+	if ifMatch == "" {
+		err = h.store.DeleteItem(ctx, id)
+	} else if etagMatches(ifMatch, item) {
+		err = h.store.DeleteItemIf(ctx, id, item.LastModified)
+	} else {
+		err = ErrPreconditionFailed
+	}
+	if err != nil {
+		return err
+	}
+
+	h.notify(ctx, ChangeEvent{Event: EventItemDeleted, ItemID: id, Before: item, Time: time.Now().UTC()})
+	return nil
+}
+
+// itemETag is the entity tag of the current version of item.
+func itemETag(item *Item) string {
+	return `"` + strconv.FormatInt(item.LastModified.UnixNano(), 36) + `"`
+}
+
+// etagMatches reports whether an If-Match or If-None-Match header value
+// names the current version of item or is "*".
+func etagMatches(header string, item *Item) bool {
+	etag := itemETag(item)
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// validateItemPayload checks the fields shared by create and update payloads.
+func validateItemPayload(typ string, data json.RawMessage) error {
+	if strings.TrimSpace(typ) == "" || len(data) == 0 {
+		return &inputError{"type and data are required"}
+	}
+	var js interface{}
+	if err := json.Unmarshal(data, &js); err != nil {
+		return &inputError{fmt.Sprintf("invalid JSON data: %v", err)}
+	}
+	return nil
+}
+
+// writeError maps err to an HTTP response, logging unexpected failures to
+// logger with msg.
+func writeError(w http.ResponseWriter, r *http.Request, logger *slog.Logger, err error, msg string) {
+	switch {
+	case errors.Is(err, ErrInvalidInput):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, ErrForbidden):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, ErrNotFound):
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+	case errors.Is(err, ErrPreconditionFailed):
+		http.Error(w, err.Error(), http.StatusPreconditionFailed)
+	case isOutage(err):
+		writeUnavailable(w, err)
+	default:
+		logger.ErrorContext(r.Context(), msg, "error", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
+
 // ensureSingleJSON ensures only a single JSON object is in the request body.
 func ensureSingleJSON(dec *json.Decoder) error {
 	// Check for extra JSON tokens
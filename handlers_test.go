@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// TestConditionalWrites checks that items carry ETags, that If-Match makes
+// PUT, PATCH and DELETE fail with 412 once the item has changed, and that
+// concurrent unconditional patches are all applied.
+func TestConditionalWrites(t *testing.T) {
+	resp, b := send(t, testAPIKey, http.MethodPost, "/items", `{"type":"etag","tags":["a"],"data":{"n":1,"keep":true}}`)
+	var item Item
+	json.Unmarshal(b, &item)
+	defer call(t, testAPIKey, http.MethodDelete, "/items/"+item.ID, "")
+	etag := resp.Header.Get("ETag")
+	if etag == "" {
+		t.Fatal("expected POST /items to return an ETag")
+	}
+
+	get := func(header string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, testServerURL+"/items/"+item.ID, nil)
+		req.Header.Set("Authorization", "Bearer "+testAPIKey)
+		req.Header.Set("If-None-Match", header)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET: %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	if resp := get(etag); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("If-None-Match with the current ETag: expected 304, got %d", resp.StatusCode)
+	}
+	if resp := get(`"other"`); resp.StatusCode != http.StatusOK || resp.Header.Get("ETag") != etag {
+		t.Errorf("If-None-Match with another ETag: expected 200 with ETag %s, got %d %s", etag, resp.StatusCode, resp.Header.Get("ETag"))
+	}
+
+	conditional := func(method, ifMatch, body string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(method, testServerURL+"/items/"+item.ID, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+testAPIKey)
+		req.Header.Set("If-Match", ifMatch)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s: %v", method, err)
+		}
+		defer resp.Body.Close()
+		json.NewDecoder(resp.Body).Decode(&item)
+		return resp
+	}
+	resp = conditional(http.MethodPatch, etag, `{"tags":["b"],"data":{"n":2,"keep":null,"new":"x"}}`)
+	if resp.StatusCode != http.StatusOK || string(item.Data) != `{"n":2,"new":"x"}` || strings.Join(item.Tags, ",") != "b" || item.Type != "etag" {
+		t.Fatalf("PATCH with the current ETag: got %d %+v", resp.StatusCode, item)
+	}
+	patched := resp.Header.Get("ETag")
+	if patched == "" || patched == etag {
+		t.Fatalf("expected PATCH to return a new ETag, got %q", patched)
+	}
+	for _, method := range []string{http.MethodPut, http.MethodPatch, http.MethodDelete} {
+		if resp := conditional(method, etag, `{"type":"etag","data":{}}`); resp.StatusCode != http.StatusPreconditionFailed {
+			t.Errorf("%s with a stale ETag: expected 412, got %d", method, resp.StatusCode)
+		}
+	}
+	if resp := conditional(http.MethodPut, "*", `{"type":"etag","tags":["b"],"data":{"n":0}}`); resp.StatusCode != http.StatusOK {
+		t.Errorf("PUT with If-Match: *: expected 200, got %d", resp.StatusCode)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			call(t, testAPIKey, http.MethodPatch, "/items/"+item.ID, fmt.Sprintf(`{"data":{"p%d":true}}`, i))
+		}(i)
+	}
+	wg.Wait()
+	_, b = call(t, testAPIKey, http.MethodGet, "/items/"+item.ID, "")
+	json.Unmarshal(b, &item)
+	var data map[string]interface{}
+	json.Unmarshal(item.Data, &data)
+	if len(data) != 6 {
+		t.Errorf("expected every concurrent patch to be applied, got %s", item.Data)
+	}
+
+	if status, _ := call(t, testAPIKey, http.MethodPatch, "/items/"+item.ID, `{"type":"  "}`); status != http.StatusBadRequest {
+		t.Errorf("PATCH with a blank type: expected 400, got %d", status)
+	}
+	if status, _ := call(t, testAPIKey, http.MethodPatch, "/items/missing", `{"data":{}}`); status != http.StatusNotFound {
+		t.Errorf("PATCH of a missing item: expected 404, got %d", status)
+	}
+}
+
+// TestListPages checks that ?limit pages through a listing in ID order with
+// Link headers and that the pages add up to the full listing.
+func TestListPages(t *testing.T) {
+	var ids []string
+	for i := 0; i < 5; i++ {
+		_, b := call(t, testAPIKey, http.MethodPost, "/items", `{"type":"paged","data":{}}`)
+		var item Item
+		json.Unmarshal(b, &item)
+		ids = append(ids, item.ID)
+		defer call(t, testAPIKey, http.MethodDelete, "/items/"+item.ID, "")
+	}
+
+	var seen []string
+	path := "/items?type=paged&limit=2"
+	for pages := 0; path != ""; pages++ {
+		if pages > 3 {
+			t.Fatal("expected 3 pages")
+		}
+		resp, b := send(t, testAPIKey, http.MethodGet, path, "")
+		var items []Item
+		json.Unmarshal(b, &items)
+		if resp.StatusCode != http.StatusOK || len(items) == 0 || len(items) > 2 {
+			t.Fatalf("GET %s: %d %s", path, resp.StatusCode, b)
+		}
+		for _, item := range items {
+			seen = append(seen, item.ID)
+		}
+		path = ""
+		if link := resp.Header.Get("Link"); link != "" {
+			path = strings.TrimPrefix(strings.TrimSuffix(link, `>; rel="next"`), "<")
+		}
+	}
+	if len(seen) != len(ids) {
+		t.Fatalf("expected %d items across the pages, got %v", len(ids), seen)
+	}
+	for i := 1; i < len(seen); i++ {
+		if seen[i-1] >= seen[i] {
+			t.Errorf("expected pages in ID order, got %v", seen)
+		}
+	}
+	for _, limit := range []string{"0", "1001", "x"} {
+		if status, _ := call(t, testAPIKey, http.MethodGet, "/items?limit="+limit, ""); status != http.StatusBadRequest {
+			t.Errorf("limit=%s: expected 400, got %d", limit, status)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// version is the build version, set with -ldflags "-X main.version=…".
+var version = "dev"
+
+// Health serves the liveness, readiness and status endpoints.
+type Health struct {
+	client   redis.UniversalClient
+	started  time.Time
+	starting atomic.Bool
+	draining atomic.Bool
+
+	// Modes, when set, supplies the service mode reported by /status.
+	Modes *ModeStore
+}
+
+// NewHealth creates a Health reporting on client.
+func NewHealth(client redis.UniversalClient) *Health {
+	return &Health{client: client, started: time.Now()}
+}
+
+// Starting makes readiness fail until Started is called, while the server
+// waits for Redis to finish starting up.
+func (h *Health) Starting() {
+	h.starting.Store(true)
+}
+
+// Started marks the server as ready to serve once Redis is reachable.
+func (h *Health) Started() {
+	h.starting.Store(false)
+}
+
+// Drain makes readiness fail so load balancers stop routing new requests here
+// before the server shuts down.
+func (h *Health) Drain() {
+	h.draining.Store(true)
+}
+
+// RedisStatus describes the Redis connection and its pool. Credentials are
+// never included. In sentinel mode Addr lists the sentinels monitoring
+// MasterName; in cluster mode it lists the nodes the client started from and
+// the pool settings are per node.
+type RedisStatus struct {
+	OK         bool    `json:"ok"`
+	LatencyMs  float64 `json:"latencyMs"`
+	Error      string  `json:"error,omitempty"`
+	Mode       string  `json:"mode"`
+	Addr       string  `json:"addr"`
+	MasterName string  `json:"masterName,omitempty"`
+	DB         int     `json:"db"`
+	TLS        bool    `json:"tls"`
+	Pool       struct {
+		MaxConns     int    `json:"maxConns"`
+		MinIdleConns int    `json:"minIdleConns"`
+		TotalConns   uint32 `json:"totalConns"`
+		IdleConns    uint32 `json:"idleConns"`
+		StaleConns   uint32 `json:"staleConns"`
+		Hits         uint32 `json:"hits"`
+		Misses       uint32 `json:"misses"`
+		Timeouts     uint32 `json:"timeouts"`
+	} `json:"pool"`
+}
+
+// Status is the body of GET /status.
+type Status struct {
+	Version       string      `json:"version"`
+	GoVersion     string      `json:"goVersion"`
+	StartedAt     time.Time   `json:"startedAt"`
+	UptimeSeconds int64       `json:"uptimeSeconds"`
+	Mode          string      `json:"mode"`
+	Starting      bool        `json:"starting"`
+	Draining      bool        `json:"draining"`
+	Redis         RedisStatus `json:"redis"`
+}
+
+// ping checks Redis and reports its latency, connection settings and pool statistics.
+func (h *Health) ping(ctx context.Context) RedisStatus {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	start := time.Now()
+	err := h.client.Ping(ctx).Err()
+	st := RedisStatus{OK: err == nil, LatencyMs: float64(time.Since(start).Microseconds()) / 1000}
+	if err != nil {
+		st.Error = err.Error()
+	}
+	switch c := h.client.(type) {
+	case *redis.ClusterClient:
+		opts := c.Options()
+		st.Mode, st.Addr, st.TLS = "cluster", strings.Join(opts.Addrs, ","), opts.TLSConfig != nil
+		st.Pool.MaxConns, st.Pool.MinIdleConns = opts.PoolSize, opts.MinIdleConns
+	case *sentinelClient:
+		opts := c.Options()
+		st.Mode, st.Addr, st.DB, st.TLS = "sentinel", strings.Join(c.sentinels, ","), opts.DB, opts.TLSConfig != nil
+		st.MasterName = c.masterName
+		st.Pool.MaxConns, st.Pool.MinIdleConns = opts.PoolSize, opts.MinIdleConns
+	case *redis.Client:
+		opts := c.Options()
+		st.Mode, st.Addr, st.DB, st.TLS = "standalone", opts.Addr, opts.DB, opts.TLSConfig != nil
+		st.Pool.MaxConns, st.Pool.MinIdleConns = opts.PoolSize, opts.MinIdleConns
+	}
+	ps := h.client.PoolStats()
+	st.Pool.TotalConns, st.Pool.IdleConns, st.Pool.StaleConns = ps.TotalConns, ps.IdleConns, ps.StaleConns
+	st.Pool.Hits, st.Pool.Misses, st.Pool.Timeouts = ps.Hits, ps.Misses, ps.Timeouts
+	return st
+}
+
+// startupMiddleware answers 503 until h reports the server started, so that
+// no request reads or writes Redis before its schema version is checked.
+func startupMiddleware(h *Health) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if h.starting.Load() {
+				w.Header().Set("Retry-After", "1")
+				http.Error(w, "server is starting", http.StatusServiceUnavailable)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// handleLiveness processes GET /healthz: the process is up and serving.
+func (h *Health) handleLiveness(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// handleReadiness processes GET /readyz: the server has started, Redis is
+// reachable and the server is not draining for shutdown.
+func (h *Health) handleReadiness(w http.ResponseWriter, r *http.Request) {
+	if h.starting.Load() {
+		writeHealth(w, http.StatusServiceUnavailable, map[string]string{"status": "starting"})
+		return
+	}
+	if h.draining.Load() {
+		writeHealth(w, http.StatusServiceUnavailable, map[string]string{"status": "draining"})
+		return
+	}
+	if st := h.ping(r.Context()); !st.OK {
+		writeHealth(w, http.StatusServiceUnavailable, map[string]string{"status": "unavailable", "error": "redis: " + st.Error})
+		return
+	}
+	writeHealth(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// handleStatus processes GET /status with build, uptime and Redis details.
+func (h *Health) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	writeHealth(w, http.StatusOK, Status{
+		Version:       version,
+		GoVersion:     runtime.Version(),
+		StartedAt:     h.started.UTC(),
+		UptimeSeconds: int64(time.Since(h.started).Seconds()),
+		Mode:          h.Modes.Current().Mode,
+		Starting:      h.starting.Load(),
+		Draining:      h.draining.Load(),
+		Redis:         h.ping(r.Context()),
+	})
+}
+
+func writeHealth(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestHealthEndpoints checks that the probes need no credentials, that /status
+// does, and that readiness fails until the server has started and once it
+// starts draining.
+func TestHealthEndpoints(t *testing.T) {
+	for _, path := range []string{"/healthz", "/readyz"} {
+		resp, err := http.Get(testServerURL + path)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("GET %s: expected 200, got %d", path, resp.StatusCode)
+		}
+	}
+
+	resp, err := http.Get(testServerURL + "/status")
+	if err != nil {
+		t.Fatalf("GET /status: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("unauthenticated /status: expected 401, got %d", resp.StatusCode)
+	}
+	client := &http.Client{Transport: &authTransport{token: testAPIKey, base: http.DefaultTransport}}
+	resp, err = client.Get(testServerURL + "/status")
+	if err != nil {
+		t.Fatalf("GET /status: %v", err)
+	}
+	var st Status
+	json.NewDecoder(resp.Body).Decode(&st)
+	resp.Body.Close()
+	if st.Version != version || !st.Redis.OK || st.Redis.Addr == "" || st.Redis.Pool.TotalConns == 0 || st.Draining {
+		t.Errorf("unexpected status %+v", st)
+	}
+
+	h := NewHealth(redisClient)
+	h.Starting()
+	rec := httptest.NewRecorder()
+	h.handleReadiness(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("readiness while starting: expected 503, got %d", rec.Code)
+	}
+	h.Started()
+	h.Drain()
+	rec = httptest.NewRecorder()
+	h.handleReadiness(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("readiness while draining: expected 503, got %d", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	h.handleLiveness(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("liveness while draining: expected 200, got %d", rec.Code)
+	}
+}
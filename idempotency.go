@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+)
+
+// maxIdempotentBody bounds the request bodies read for fingerprinting.
+const maxIdempotentBody = 1 << 20
+
+// maxClaimAttempts bounds how often Begin retries when the record it found
+// expires before it can be read.
+const maxClaimAttempts = 3
+
+// idempotencyRecord is the state of one Idempotency-Key: pending while the
+// first request is in flight, then the response to replay.
+type idempotencyRecord struct {
+	Fingerprint string            `json:"fingerprint"`
+	Token       string            `json:"token,omitempty"`
+	Status      int               `json:"status,omitempty"`
+	Header      map[string]string `json:"header,omitempty"`
+	Body        []byte            `json:"body,omitempty"`
+}
+
+// IdempotencyStore keeps Idempotency-Keys and their responses in Redis,
+// separately for each caller.
+type IdempotencyStore struct {
+	client redis.UniversalClient
+	// TTL is how long a completed response is replayed.
+	TTL time.Duration
+	// LockTTL bounds how long a key stays pending if its request never
+	// completes, e.g. because the replica crashed. The claim is extended
+	// while its request is still running.
+	LockTTL time.Duration
+	// Keyring encrypts the stored responses, which carry item data; nil
+	// stores them in plain JSON.
+	Keyring *Keyring
+}
+
+// NewIdempotencyStore creates an IdempotencyStore that replays responses for 24 hours.
+func NewIdempotencyStore(client redis.UniversalClient) *IdempotencyStore {
+	return &IdempotencyStore{client: client, TTL: 24 * time.Hour, LockTTL: time.Minute}
+}
+
+func (s *IdempotencyStore) key(ctx context.Context, key string) string {
+	caller := ""
+	if p := principalFrom(ctx); p != nil {
+		caller = p.ID
+	}
+	return tenantKey(ctx, "idempotency:%s:%s", caller, key)
+}
+
+// Begin claims key for a request with fingerprint and returns the pending
+// claim and true. If the key was already claimed, it returns the existing
+// record and false instead.
+func (s *IdempotencyStore) Begin(ctx context.Context, key, fingerprint string) (*idempotencyRecord, bool, error) {
+	claim := &idempotencyRecord{Fingerprint: fingerprint, Token: uuid.NewString()}
+	data, err := json.Marshal(claim)
+	if err != nil {
+		return nil, false, err
+	}
+	for attempt := 0; attempt < maxClaimAttempts; attempt++ {
+		ok, err := s.client.SetNX(ctx, s.key(ctx, key), data, s.LockTTL).Result()
+		if err != nil {
+			return nil, false, err
+		}
+		if ok {
+			return claim, true, nil
+		}
+		raw, err := s.client.Get(ctx, s.key(ctx, key)).Bytes()
+		if err == redis.Nil {
+			// the pending claim expired in between; try again
+			continue
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		if raw, err = s.Keyring.openValue(raw, []byte(s.key(ctx, key))); err != nil {
+			return nil, false, err
+		}
+		var rec idempotencyRecord
+		if err := json.Unmarshal(raw, &rec); err != nil {
+			return nil, false, err
+		}
+		return &rec, false, nil
+	}
+	return nil, false, fmt.Errorf("idempotency key %q expired %d times while claiming it", key, maxClaimAttempts)
+}
+
+// Hold extends claim on key by LockTTL every LockTTL/3 until ctx is done, so
+// that a slow request keeps its key pending.
+func (s *IdempotencyStore) Hold(ctx context.Context, key string, claim *idempotencyRecord, logger *slog.Logger) {
+	data, err := json.Marshal(claim)
+	if err != nil {
+		return
+	}
+	ticker := time.NewTicker(s.LockTTL / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			held, err := holdLockScript.Run(ctx, s.client, []string{s.key(ctx, key)}, data, s.LockTTL.Milliseconds()).Int()
+			if err != nil && ctx.Err() == nil {
+				logger.WarnContext(ctx, "error extending idempotency key", "error", err)
+			}
+			if err == nil && held == 0 {
+				return
+			}
+		}
+	}
+}
+
+// Complete stores the response to replay for key, encrypted with Keyring.
+// Pending claims hold no response and stay plain, so that the scripts that
+// hold and release them can compare them.
+func (s *IdempotencyStore) Complete(ctx context.Context, key string, rec *idempotencyRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if data, err = s.Keyring.sealValue(data, []byte(s.key(ctx, key))); err != nil {
+		return err
+	}
+	return s.client.Set(ctx, s.key(ctx, key), data, s.TTL).Err()
+}
+
+// Release drops claim on key so the request can be retried. A key that has
+// since been claimed by another request is left alone.
+func (s *IdempotencyStore) Release(ctx context.Context, key string, claim *idempotencyRecord) error {
+	data, err := json.Marshal(claim)
+	if err != nil {
+		return err
+	}
+	return releaseLockScript.Run(ctx, s.client, []string{s.key(ctx, key)}, data).Err()
+}
+
+// idempotencyMiddleware makes POST requests carrying an Idempotency-Key header
+// safe to retry. The first request runs and its response is stored; retries
+// with the same body get that response again, with Idempotent-Replayed: true.
+// Reusing a key with a different body, or while the first request is still
+// running, fails with 409. Server errors are not stored, so they can be retried.
+func idempotencyMiddleware(store *IdempotencyStore, logger *slog.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := r.Header.Get("Idempotency-Key")
+			if r.Method != http.MethodPost || key == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if len(key) > 255 {
+				http.Error(w, "Idempotency-Key must be at most 255 characters", http.StatusBadRequest)
+				return
+			}
+			body, err := io.ReadAll(io.LimitReader(r.Body, maxIdempotentBody+1))
+			if err != nil {
+				http.Error(w, fmt.Sprintf("error reading request body: %v", err), http.StatusBadRequest)
+				return
+			}
+			if len(body) > maxIdempotentBody {
+				http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			sum := sha256.Sum256([]byte(r.Method + " " + r.URL.Path + "\n" + string(body)))
+			fingerprint := hex.EncodeToString(sum[:])
+
+			ctx := r.Context()
+			rec, claimed, err := store.Begin(ctx, key, fingerprint)
+			if isOutage(err) {
+				writeUnavailable(w, err)
+				return
+			}
+			if err != nil {
+				logger.ErrorContext(ctx, "error claiming idempotency key", "error", err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+			if !claimed {
+				switch {
+				case rec.Fingerprint != fingerprint:
+					http.Error(w, "Idempotency-Key was already used with a different request", http.StatusConflict)
+				case rec.Status == 0:
+					w.Header().Set("Retry-After", "1")
+					http.Error(w, "a request with this Idempotency-Key is still in progress", http.StatusConflict)
+				default:
+					for k, v := range rec.Header {
+						w.Header().Set(k, v)
+					}
+					w.Header().Set("Idempotent-Replayed", "true")
+					w.WriteHeader(rec.Status)
+					w.Write(rec.Body)
+				}
+				return
+			}
+
+			holdCtx, stopHold := context.WithCancel(ctx)
+			go store.Hold(holdCtx, key, rec, logger)
+			claim := rec
+			rw := &recordingWriter{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(rw, r)
+			stopHold()
+			ctx = context.WithoutCancel(ctx)
+			if rw.status >= 500 {
+				if err := store.Release(ctx, key, claim); err != nil {
+					logger.ErrorContext(ctx, "error releasing idempotency key", "error", err)
+				}
+				return
+			}
+			rec = &idempotencyRecord{Fingerprint: fingerprint, Status: rw.status, Header: map[string]string{}, Body: rw.body.Bytes()}
+			for _, h := range []string{"Content-Type", "Location", "ETag"} {
+				if v := w.Header().Get(h); v != "" {
+					rec.Header[h] = v
+				}
+			}
+			if err := store.Complete(ctx, key, rec); err != nil {
+				logger.ErrorContext(ctx, "error storing idempotent response", "error", err)
+			}
+		})
+	}
+}
+
+// recordingWriter passes a response through while keeping a copy of it.
+type recordingWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+// WriteHeader captures the status code and writes the header.
+func (rw *recordingWriter) WriteHeader(code int) {
+	if !rw.wroteHeader {
+		rw.status = code
+		rw.wroteHeader = true
+	}
+	rw.ResponseWriter.WriteHeader(code)
+}
+
+// Write copies b into the recording and writes it.
+func (rw *recordingWriter) Write(b []byte) (int, error) {
+	rw.wroteHeader = true
+	rw.body.Write(b)
+	return rw.ResponseWriter.Write(b)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestIdempotentCreate checks that retried POST /items requests with the same
+// Idempotency-Key replay the first response instead of creating duplicates.
+func TestIdempotentCreate(t *testing.T) {
+	post := func(key, body string) (*http.Response, []byte) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPost, testServerURL+"/items", bytes.NewReader([]byte(body)))
+		req.Header.Set("Authorization", "Bearer "+testAPIKey)
+		req.Header.Set("Idempotency-Key", key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("POST /items: %v", err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp, b
+	}
+	listItems := func(typ string) []Item {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, testServerURL+"/items?type="+typ, nil)
+		req.Header.Set("Authorization", "Bearer "+testAPIKey)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET /items: %v", err)
+		}
+		defer resp.Body.Close()
+		var items []Item
+		json.NewDecoder(resp.Body).Decode(&items)
+		return items
+	}
+
+	body := `{"type":"idem","data":{"n":1}}`
+	first, b1 := post("order-1", body)
+	if first.StatusCode != http.StatusCreated {
+		t.Fatalf("first POST: status %d %s", first.StatusCode, b1)
+	}
+	retry, b2 := post("order-1", body)
+	if retry.StatusCode != http.StatusCreated || !bytes.Equal(b1, b2) {
+		t.Errorf("retry should replay %d %s, got %d %s", first.StatusCode, b1, retry.StatusCode, b2)
+	}
+	if retry.Header.Get("Idempotent-Replayed") != "true" || retry.Header.Get("Location") != first.Header.Get("Location") {
+		t.Errorf("unexpected replay headers %v", retry.Header)
+	}
+	if resp, _ := post("order-1", `{"type":"idem","data":{"n":2}}`); resp.StatusCode != http.StatusConflict {
+		t.Errorf("reused key with different body: expected 409, got %d", resp.StatusCode)
+	}
+	if resp, _ := post("order-bad", `{"type":""}`); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("invalid body: expected 400, got %d", resp.StatusCode)
+	}
+	if resp, _ := post("order-bad", `{"type":""}`); resp.StatusCode != http.StatusBadRequest || resp.Header.Get("Idempotent-Replayed") != "true" {
+		t.Errorf("client errors should be replayed, got %d %v", resp.StatusCode, resp.Header)
+	}
+	if n := len(listItems("idem")); n != 1 {
+		t.Errorf("expected 1 item after retries, got %d", n)
+	}
+
+	var wg sync.WaitGroup
+	statuses := make(chan int, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, _ := post("order-2", `{"type":"idem-concurrent","data":{}}`)
+			statuses <- resp.StatusCode
+		}()
+	}
+	wg.Wait()
+	close(statuses)
+	for status := range statuses {
+		if status != http.StatusCreated && status != http.StatusConflict {
+			t.Errorf("concurrent duplicate: unexpected status %d", status)
+		}
+	}
+	if n := len(listItems("idem-concurrent")); n != 1 {
+		t.Errorf("expected 1 item from concurrent duplicates, got %d", n)
+	}
+
+	for _, item := range append(listItems("idem"), listItems("idem-concurrent")...) {
+		req, _ := http.NewRequest(http.MethodDelete, testServerURL+"/items/"+item.ID, nil)
+		req.Header.Set("Authorization", "Bearer "+testAPIKey)
+		if resp, err := http.DefaultClient.Do(req); err == nil {
+			resp.Body.Close()
+		}
+	}
+}
+
+// TestIdempotencyClaimHeld checks that a pending claim outlives LockTTL while
+// its request is running and that releasing it leaves other claims alone.
+func TestIdempotencyClaimHeld(t *testing.T) {
+	store := NewIdempotencyStore(redisClient)
+	store.LockTTL = 150 * time.Millisecond
+	ctx := testCtx
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	claim, ok, err := store.Begin(ctx, "slow", "fp")
+	if err != nil || !ok {
+		t.Fatalf("Begin: %v %v", ok, err)
+	}
+	holdCtx, stop := context.WithCancel(ctx)
+	go store.Hold(holdCtx, "slow", claim, logger)
+	time.Sleep(3 * store.LockTTL)
+	if rec, ok, err := store.Begin(ctx, "slow", "fp"); err != nil || ok || rec.Status != 0 {
+		t.Errorf("claim should still be pending while held, got %+v %v %v", rec, ok, err)
+	}
+	stop()
+
+	if err := store.Release(ctx, "slow", &idempotencyRecord{Fingerprint: "fp", Token: "other"}); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	if _, ok, _ := store.Begin(ctx, "slow", "fp"); ok {
+		t.Error("releasing another request's claim should not drop the key")
+	}
+	if err := store.Release(ctx, "slow", claim); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	if _, ok, _ := store.Begin(ctx, "slow", "fp"); !ok {
+		t.Error("key should be free after its claim was released")
+	}
+	redisClient.Del(ctx, store.key(ctx, "slow"))
+}
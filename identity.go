@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+type contextKey int
+
+const (
+	principalKey contextKey = iota
+	requestInfoKey
+	tenantIDKey
+)
+
+// Principal identifies the authenticated caller of a request.
+type Principal struct {
+	// ID is a stable, non-secret identifier safe to log and store.
+	ID string `json:"id"`
+	// Tenant is the namespace the caller works in; "" is the default tenant.
+	Tenant string `json:"tenant,omitempty"`
+	// Subject is the sub claim of a JWT caller.
+	Subject string `json:"subject,omitempty"`
+	// KeyID and Name describe the stored API key used, if any.
+	KeyID string `json:"keyId,omitempty"`
+	Name  string `json:"name,omitempty"`
+	// Groups are matched by "group:<name>" entries in item ACLs.
+	Groups []string `json:"groups,omitempty"`
+	// RateLimit, when set, is the caller's own limit in requests per minute.
+	RateLimit int `json:"rateLimit,omitempty"`
+	// Scopes lists the operations the caller may perform.
+	Scopes []string `json:"scopes"`
+	// Types and Tags, when set, limit the caller to items of those types
+	// and to items carrying at least one of those tags.
+	Types []string `json:"types,omitempty"`
+	Tags  []string `json:"tags,omitempty"`
+}
+
+// Permission scopes granted to API keys.
+const (
+	ScopeRead   = "read"
+	ScopeWrite  = "write"
+	ScopeDelete = "delete"
+	ScopeAdmin  = "admin"
+)
+
+// validScope reports whether s names a known scope.
+func validScope(s string) bool {
+	switch s {
+	case ScopeRead, ScopeWrite, ScopeDelete, ScopeAdmin:
+		return true
+	}
+	return false
+}
+
+// Allows reports whether the principal holds scope; admin implies every scope.
+func (p *Principal) Allows(scope string) bool {
+	for _, s := range p.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// CanAccess reports whether the principal's type and tag limits cover an item
+// of type typ carrying tags. Administrators are never limited.
+func (p *Principal) CanAccess(typ string, tags []string) bool {
+	if p.Allows(ScopeAdmin) {
+		return true
+	}
+	if len(p.Types) > 0 && !containsString(p.Types, typ) {
+		return false
+	}
+	if len(p.Tags) == 0 {
+		return true
+	}
+	for _, tag := range tags {
+		if containsString(p.Tags, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// systemPrincipal is the caller of operations the service performs on its
+// own behalf, in the default tenant; it holds every scope.
+var systemPrincipal = &Principal{ID: "system", Scopes: []string{ScopeAdmin}}
+
+// authorize checks that the caller in ctx holds scope and may access item
+// under its type and tag limits and the item's ACL. Requests without a
+// principal are refused: internal callers that must not be limited pass
+// systemPrincipal.
+func authorize(ctx context.Context, scope string, item *Item) error {
+	p := principalFrom(ctx)
+	if p == nil {
+		return &forbiddenError{"request has no authenticated caller"}
+	}
+	if !p.Allows(scope) {
+		return &forbiddenError{fmt.Sprintf("api key lacks the %q scope", scope)}
+	}
+	if item != nil && !p.CanAccess(item.Type, item.Tags) {
+		if len(p.Types) > 0 && !containsString(p.Types, item.Type) {
+			return &forbiddenError{fmt.Sprintf("api key is limited to item types %s", strings.Join(p.Types, ", "))}
+		}
+		return &forbiddenError{fmt.Sprintf("api key is limited to items tagged %s", strings.Join(p.Tags, ", "))}
+	}
+	if item != nil && !p.canUse(scope, item) {
+		return &forbiddenError{fmt.Sprintf("item %s is restricted by its access control list", item.ID)}
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// keyIdentity derives a principal ID from a raw API key without revealing it.
+func keyIdentity(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return "key:" + hex.EncodeToString(sum[:6])
+}
+
+// withPrincipal returns a copy of ctx carrying p.
+func withPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey, p)
+}
+
+// principalFrom returns the caller attached by authMiddleware, or nil.
+func principalFrom(ctx context.Context) *Principal {
+	p, _ := ctx.Value(principalKey).(*Principal)
+	return p
+}
+
+// actorFrom returns the caller's principal ID, or "anonymous".
+func actorFrom(ctx context.Context) string {
+	if p := principalFrom(ctx); p != nil {
+		return p.ID
+	}
+	return "anonymous"
+}
+
+// requestInfo holds per-request metadata set by requestIDMiddleware. It is
+// shared by pointer so that authMiddleware can record the caller for the
+// request log written further out.
+type requestInfo struct {
+	ID       string
+	Route    string
+	ClientIP string
+	Actor    string
+}
+
+// requestInfoFrom returns the metadata attached by requestIDMiddleware, or a zero value.
+func requestInfoFrom(ctx context.Context) requestInfo {
+	if info, ok := ctx.Value(requestInfoKey).(*requestInfo); ok {
+		return *info
+	}
+	return requestInfo{}
+}
+
+// clientIP returns the host part of the request's remote address.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -6,12 +6,13 @@ import (
 	"context"
 	"encoding/json"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/go-redis/redis/v8"
 )
@@ -35,15 +36,69 @@ func TestMain(m *testing.M) {
 	}
 
 	// start HTTP server using the real handlers
+	metrics := NewMetrics(redisClient)
+	redisClient.AddHook(redisTracingHook{})
 	store := NewRedisStore(redisClient)
+	store.Codec = NewItemCodec(256)
 	logger := newTestLogger()
 	handler := NewHandler(store, logger)
+	broker := NewEventBroker(redisClient, logger)
+	if err := broker.Start(testCtx); err != nil {
+		panic("failed to subscribe to change events: " + err.Error())
+	}
+	handler.AddListener(broker)
+	webhooks := NewWebhookStore(redisClient)
+	dispatcher := NewWebhookDispatcher(webhooks, redisClient, logger)
+	dispatcher.MaxAttempts = 3
+	dispatcher.BaseBackoff = 20 * time.Millisecond
+	dispatcher.PollInterval = 10 * time.Millisecond
+	dispatcher.AllowPrivateNetworks = true
+	dispatcher.Start(testCtx, 2)
+	handler.AddListener(dispatcher)
+	webhookHandler := NewWebhookHandler(webhooks, logger)
+	webhookHandler.AllowPrivateNetworks = true
+	audit := NewAuditLog(redisClient, logger)
+	handler.AddListener(audit)
+	idempotency := NewIdempotencyStore(redisClient)
 	mux := http.NewServeMux()
-	mux.HandleFunc("/items", handler.itemsHandler)
+	mux.Handle("/items", idempotencyMiddleware(idempotency, logger)(http.HandlerFunc(handler.itemsHandler)))
 	mux.HandleFunc("/items/", handler.itemHandler)
-	// wrap with API-key auth and logging middleware
-	validKeys := map[string]struct{}{testAPIKey: {}}
-	srv := httptest.NewServer(loggingMiddleware(logger)(authMiddleware(validKeys)(mux)))
+	mux.Handle("/batch", idempotencyMiddleware(idempotency, logger)(http.HandlerFunc(handler.batchHandler)))
+	modes := NewModeStore(redisClient, logger)
+	ws := NewWSHandler(handler, broker)
+	ws.Modes = modes
+	mux.Handle("/ws", ws)
+	mux.Handle("/mode", systemAdminOnly(http.HandlerFunc(modes.modeHandler)))
+	mux.Handle("/webhooks", adminOnly(http.HandlerFunc(webhookHandler.webhooksHandler)))
+	mux.Handle("/webhooks/", adminOnly(http.HandlerFunc(webhookHandler.webhookHandler)))
+	mux.Handle("/audit", adminOnly(http.HandlerFunc(audit.handleQuery)))
+	mux.Handle("/metrics", systemAdminOnly(metrics.Handler()))
+	keyStore := NewKeyStore(redisClient)
+	auth := NewAuthenticator(map[string]struct{}{testAPIKey: {}}, keyStore, logger)
+	tenants := NewTenantStore(redisClient)
+	auth.Tenants = tenants
+	ws.Auth = auth
+	if err := auth.Start(testCtx); err != nil {
+		panic("failed to subscribe to api key changes: " + err.Error())
+	}
+	keyHandler := NewKeyHandler(keyStore, tenants, auth, logger)
+	tenantHandler := NewTenantHandler(tenants, keyStore, auth, logger)
+	mux.Handle("/keys", adminOnly(http.HandlerFunc(keyHandler.keysHandler)))
+	mux.Handle("/keys/", adminOnly(http.HandlerFunc(keyHandler.keyHandler)))
+	mux.Handle("/tenants", systemAdminOnly(http.HandlerFunc(tenantHandler.tenantsHandler)))
+	mux.Handle("/tenants/", systemAdminOnly(http.HandlerFunc(tenantHandler.tenantHandler)))
+	limiter := NewRateLimiter(redisClient, logger)
+	ws.Limiter = limiter
+	health := NewHealth(redisClient)
+	health.Modes = modes
+	mux.Handle("/status", systemAdminOnly(http.HandlerFunc(health.handleStatus)))
+	root := http.NewServeMux()
+	root.HandleFunc("/healthz", health.handleLiveness)
+	root.HandleFunc("/readyz", health.handleReadiness)
+	root.HandleFunc("/openapi.json", handleOpenAPI)
+	root.Handle("/", authMiddleware(auth)(modeMiddleware(modes)(rateLimitMiddleware(limiter)(mux))))
+	// wrap with API-key auth, rate limiting, logging, metrics and tracing middleware
+	srv := httptest.NewServer(requestIDMiddleware(tracingMiddleware(metricsMiddleware(metrics)(loggingMiddleware(logger)(root)))))
 	defer srv.Close()
 	testServerURL = srv.URL
 
@@ -248,6 +303,41 @@ func TestCRUDIntegration(t *testing.T) {
 	}
 }
 
+// send makes a request with body to the test server as the caller
+// authenticated by token and returns the response along with its body.
+func send(t *testing.T, token, method, path, body string) (*http.Response, []byte) {
+	t.Helper()
+	req, _ := http.NewRequest(method, testServerURL+path, bytes.NewReader([]byte(body)))
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+	return resp, b
+}
+
+// call is send for tests that only need the status and body.
+func call(t *testing.T, token, method, path, body string) (int, []byte) {
+	t.Helper()
+	resp, b := send(t, token, method, path, body)
+	return resp.StatusCode, b
+}
+
+// newKey creates an API key with the POST /keys payload body as the caller
+// authenticated by token.
+func newKey(t *testing.T, token, body string) CreateKeyResponse {
+	t.Helper()
+	status, b := call(t, token, http.MethodPost, "/keys", body)
+	if status != http.StatusCreated {
+		t.Fatalf("POST /keys %s: status %d %s", body, status, b)
+	}
+	var created CreateKeyResponse
+	json.Unmarshal(b, &created)
+	return created
+}
+
 // authTransport injects the test API key into outgoing HTTP requests.
 type authTransport struct {
 	token string
@@ -260,6 +350,6 @@ func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 }
 
 // newTestLogger returns a logger that outputs to stdout for test visibility.
-func newTestLogger() *log.Logger {
-	return log.New(os.Stdout, "[TEST] ", log.LstdFlags)
+func newTestLogger() *slog.Logger {
+	return slog.New(contextHandler{slog.NewTextHandler(os.Stdout, nil)})
 }
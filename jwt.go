@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/sync/singleflight"
+)
+
+// jwksReloadInterval bounds how often an unknown key ID triggers a JWKS reload.
+const jwksReloadInterval = time.Minute
+
+// JWTConfig configures bearer JWT validation.
+type JWTConfig struct {
+	// JWKS is a path to a local JWKS file or an http(s) URL serving one.
+	JWKS     string
+	Issuer   string
+	Audience string
+	// ScopesClaim names the claim holding scopes, either a space-separated
+	// string or an array of strings. Defaults to "scope".
+	ScopesClaim string
+	// TenantClaim names the claim holding the caller's tenant. Defaults to
+	// "tenant". Tokens without it are rejected unless their subject is one of
+	// SystemSubjects, which belong to the default tenant and so administer
+	// every tenant when they hold the admin scope.
+	TenantClaim    string
+	SystemSubjects []string
+	// GroupsClaim names the claim holding the caller's groups for item ACLs,
+	// in the same forms as ScopesClaim. Defaults to "groups".
+	GroupsClaim string
+	// Leeway tolerates clock skew when checking exp and nbf.
+	Leeway time.Duration
+	// RefreshInterval is how often Start reloads the JWKS, so that keys
+	// removed from it stop being trusted. Defaults to five minutes.
+	RefreshInterval time.Duration
+}
+
+// JWTValidator verifies RS256, ES256 and EdDSA tokens against a JWKS and maps
+// their claims to a Principal.
+type JWTValidator struct {
+	cfg    JWTConfig
+	parser *jwt.Parser
+	http   *http.Client
+	loads  singleflight.Group
+
+	mu       sync.RWMutex
+	keys     map[string]crypto.PublicKey
+	loadedAt time.Time
+}
+
+// NewJWTValidator creates a JWTValidator and loads the JWKS once.
+func NewJWTValidator(ctx context.Context, cfg JWTConfig) (*JWTValidator, error) {
+	if cfg.JWKS == "" || cfg.Issuer == "" || cfg.Audience == "" {
+		return nil, errors.New("jwt validation needs a JWKS location, issuer and audience")
+	}
+	if cfg.ScopesClaim == "" {
+		cfg.ScopesClaim = "scope"
+	}
+	if cfg.TenantClaim == "" {
+		cfg.TenantClaim = "tenant"
+	}
+	if cfg.GroupsClaim == "" {
+		cfg.GroupsClaim = "groups"
+	}
+	if cfg.RefreshInterval <= 0 {
+		cfg.RefreshInterval = 5 * time.Minute
+	}
+	v := &JWTValidator{
+		cfg: cfg,
+		parser: jwt.NewParser(
+			jwt.WithValidMethods([]string{"RS256", "ES256", "EdDSA"}),
+			jwt.WithIssuer(cfg.Issuer),
+			jwt.WithAudience(cfg.Audience),
+			jwt.WithExpirationRequired(),
+			jwt.WithLeeway(cfg.Leeway),
+		),
+		http: &http.Client{Timeout: 10 * time.Second},
+	}
+	if err := v.load(ctx); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// Start reloads the JWKS every RefreshInterval until ctx is done, replacing
+// the whole key set. A failed reload keeps the previous set and is logged.
+func (v *JWTValidator) Start(ctx context.Context, logger *slog.Logger) {
+	go func() {
+		ticker := time.NewTicker(v.cfg.RefreshInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := v.reload(ctx); err != nil {
+					logger.WarnContext(ctx, "could not refresh the jwks; keeping the previous keys", "error", err)
+				}
+			}
+		}
+	}()
+}
+
+// Validate checks token's signature and registered claims and returns its principal.
+func (v *JWTValidator) Validate(ctx context.Context, token string) (*Principal, error) {
+	claims := jwt.MapClaims{}
+	_, err := v.parser.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		return v.key(ctx, kid, t.Method.Alg())
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCredentials, err)
+	}
+	sub, err := claims.GetSubject()
+	if err != nil || sub == "" {
+		return nil, fmt.Errorf("%w: token has no subject", ErrInvalidCredentials)
+	}
+
+	scopes := stringsClaim(claims[v.cfg.ScopesClaim])
+	known := scopes[:0]
+	for _, s := range scopes {
+		if validScope(s) {
+			known = append(known, s)
+		}
+	}
+	tenant, _ := claims[v.cfg.TenantClaim].(string)
+	if tenant == "" && !containsString(v.cfg.SystemSubjects, sub) {
+		return nil, fmt.Errorf("%w: token has no %s claim", ErrInvalidCredentials, v.cfg.TenantClaim)
+	}
+	groups := stringsClaim(claims[v.cfg.GroupsClaim])
+	return &Principal{ID: "jwt:" + sub, Subject: sub, Tenant: tenant, Groups: groups, Scopes: known}, nil
+}
+
+// stringsClaim reads a claim that is either a space-separated string or an array of strings.
+func stringsClaim(raw interface{}) []string {
+	var values []string
+	switch raw := raw.(type) {
+	case string:
+		values = strings.Fields(raw)
+	case []interface{}:
+		for _, s := range raw {
+			if str, ok := s.(string); ok {
+				values = append(values, str)
+			}
+		}
+	}
+	return values
+}
+
+// key returns the verification key for kid, reloading the JWKS once if it is
+// unknown, and checks that it suits alg.
+func (v *JWTValidator) key(ctx context.Context, kid, alg string) (crypto.PublicKey, error) {
+	v.mu.RLock()
+	key, ok := v.keys[kid]
+	stale := time.Since(v.loadedAt) > jwksReloadInterval
+	v.mu.RUnlock()
+	if !ok && stale {
+		if err := v.reload(ctx); err != nil {
+			return nil, err
+		}
+		v.mu.RLock()
+		key, ok = v.keys[kid]
+		v.mu.RUnlock()
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	switch key.(type) {
+	case *rsa.PublicKey:
+		ok = alg == "RS256"
+	case *ecdsa.PublicKey:
+		ok = alg == "ES256"
+	case ed25519.PublicKey:
+		ok = alg == "EdDSA"
+	}
+	if !ok {
+		return nil, fmt.Errorf("key %q cannot verify %s", kid, alg)
+	}
+	return key, nil
+}
+
+// reload calls load, sharing one load between concurrent callers. The load
+// is not cancelled with the request that started it, as others may wait on it.
+func (v *JWTValidator) reload(ctx context.Context) error {
+	_, err, _ := v.loads.Do("jwks", func() (interface{}, error) {
+		return nil, v.load(context.WithoutCancel(ctx))
+	})
+	return err
+}
+
+// load reads the JWKS from its file or URL and replaces the key set.
+func (v *JWTValidator) load(ctx context.Context) error {
+	var data []byte
+	var err error
+	if strings.HasPrefix(v.cfg.JWKS, "http://") || strings.HasPrefix(v.cfg.JWKS, "https://") {
+		data, err = v.fetch(ctx)
+	} else {
+		data, err = os.ReadFile(v.cfg.JWKS)
+	}
+	if err != nil {
+		return fmt.Errorf("loading jwks: %w", err)
+	}
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return fmt.Errorf("parsing jwks: %w", err)
+	}
+	v.mu.Lock()
+	v.keys = keys
+	v.loadedAt = time.Now()
+	v.mu.Unlock()
+	return nil
+}
+
+func (v *JWTValidator) fetch(ctx context.Context) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.cfg.JWKS, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := v.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s responded %s", v.cfg.JWKS, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+}
+
+// jwk is a single JSON Web Key; only the public members are read.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// parseJWKS decodes the RSA, P-256 and Ed25519 signing keys of a JWKS by key ID.
+func parseJWKS(data []byte) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", k.Kid, err)
+		}
+		if key != nil {
+			keys[k.Kid] = key
+		}
+	}
+	return keys, nil
+}
+
+// publicKey converts k to a crypto key, or returns nil for unsupported key types.
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	b64 := base64.RawURLEncoding.DecodeString
+	switch {
+	case k.Kty == "RSA":
+		n, err := b64(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := b64(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case k.Kty == "EC" && k.Crv == "P-256":
+		x, err := b64(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := b64(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("point is not on curve P-256")
+		}
+		return key, nil
+	case k.Kty == "OKP" && k.Crv == "Ed25519":
+		x, err := b64(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key length")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, nil
+}
+
+// looksLikeJWT reports whether token has the three dot-separated parts of a compact JWS.
+func looksLikeJWT(token string) bool {
+	return strings.Count(token, ".") == 2 && strings.HasPrefix(token, "eyJ")
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// TestJWTAuthentication signs tokens with RSA, EC and Ed25519 keys from a local
+// JWKS and checks validation of signatures and registered claims.
+func TestJWTAuthentication(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	b64 := base64.RawURLEncoding.EncodeToString
+	jwks := map[string]interface{}{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "rsa", "use": "sig", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+		{"kty": "EC", "kid": "ec", "crv": "P-256", "x": b64(ecKey.X.FillBytes(make([]byte, 32))), "y": b64(ecKey.Y.FillBytes(make([]byte, 32)))},
+		{"kty": "OKP", "kid": "ed", "crv": "Ed25519", "x": b64(edKey.Public().(ed25519.PublicKey))},
+	}}
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	data, _ := json.Marshal(jwks)
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("writing jwks: %v", err)
+	}
+
+	validator, err := NewJWTValidator(testCtx, JWTConfig{JWKS: path, Issuer: "https://issuer.test", Audience: "gocrud", SystemSubjects: []string{"svc-billing"}})
+	if err != nil {
+		t.Fatalf("NewJWTValidator: %v", err)
+	}
+	auth := NewAuthenticator(nil, nil, newTestLogger())
+	auth.JWT = validator
+	var seen *Principal
+	protected := authMiddleware(auth)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = principalFrom(r.Context())
+	}))
+
+	sign := func(method jwt.SigningMethod, kid string, key crypto.Signer, claims jwt.MapClaims) string {
+		tok := jwt.NewWithClaims(method, claims)
+		tok.Header["kid"] = kid
+		s, err := tok.SignedString(key)
+		if err != nil {
+			t.Fatalf("signing: %v", err)
+		}
+		return s
+	}
+	valid := func() jwt.MapClaims {
+		return jwt.MapClaims{
+			"iss":   "https://issuer.test",
+			"aud":   "gocrud",
+			"sub":   "svc-billing",
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"nbf":   time.Now().Add(-time.Minute).Unix(),
+			"scope": "read write unknown",
+		}
+	}
+	status := func(token string) int {
+		seen = nil
+		req := httptest.NewRequest(http.MethodGet, "/items", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		protected.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	for _, tc := range []struct {
+		name   string
+		method jwt.SigningMethod
+		kid    string
+		key    crypto.Signer
+	}{
+		{"RS256", jwt.SigningMethodRS256, "rsa", rsaKey},
+		{"ES256", jwt.SigningMethodES256, "ec", ecKey},
+		{"EdDSA", jwt.SigningMethodEdDSA, "ed", edKey},
+	} {
+		if got := status(sign(tc.method, tc.kid, tc.key, valid())); got != http.StatusOK {
+			t.Errorf("%s: expected 200, got %d", tc.name, got)
+			continue
+		}
+		if seen == nil || seen.ID != "jwt:svc-billing" || seen.Subject != "svc-billing" || len(seen.Scopes) != 2 || !seen.Allows(ScopeWrite) || seen.Allows(ScopeDelete) {
+			t.Errorf("%s: unexpected principal %+v", tc.name, seen)
+		}
+	}
+
+	mutate := func(k string, v interface{}) jwt.MapClaims {
+		c := valid()
+		c[k] = v
+		return c
+	}
+	for name, token := range map[string]string{
+		"wrong issuer":   sign(jwt.SigningMethodRS256, "rsa", rsaKey, mutate("iss", "https://evil.test")),
+		"wrong audience": sign(jwt.SigningMethodRS256, "rsa", rsaKey, mutate("aud", "other")),
+		"expired":        sign(jwt.SigningMethodRS256, "rsa", rsaKey, mutate("exp", time.Now().Add(-time.Hour).Unix())),
+		"not yet valid":  sign(jwt.SigningMethodRS256, "rsa", rsaKey, mutate("nbf", time.Now().Add(time.Hour).Unix())),
+		"unknown kid":    sign(jwt.SigningMethodRS256, "missing", rsaKey, valid()),
+		"alg mismatch":   sign(jwt.SigningMethodRS256, "ec", rsaKey, valid()),
+		"no subject":     sign(jwt.SigningMethodEdDSA, "ed", edKey, mutate("sub", "")),
+		"no tenant":      sign(jwt.SigningMethodEdDSA, "ed", edKey, mutate("sub", "svc-other")),
+	} {
+		if got := status(token); got != http.StatusUnauthorized {
+			t.Errorf("%s: expected 401, got %d", name, got)
+		}
+	}
+
+	// other subjects are admitted with a tenant claim only
+	other := mutate("sub", "svc-other")
+	other["tenant"] = "acme"
+	if got := status(sign(jwt.SigningMethodEdDSA, "ed", edKey, other)); got != http.StatusOK || seen.Tenant != "acme" {
+		t.Errorf("expected a token with a tenant claim to be accepted in its tenant, got %d", got)
+	}
+
+	// HS256 tokens are refused even when signed with the public key material
+	hs := jwt.NewWithClaims(jwt.SigningMethodHS256, valid())
+	hs.Header["kid"] = "rsa"
+	token, _ := hs.SignedString(rsaKey.N.Bytes())
+	if got := status(token); got != http.StatusUnauthorized {
+		t.Errorf("HS256: expected 401, got %d", got)
+	}
+}
+
+// TestJWKSRefresh checks that the periodic reload drops keys removed from the
+// JWKS and that concurrent reloads share one fetch.
+func TestJWKSRefresh(t *testing.T) {
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	b64 := base64.RawURLEncoding.EncodeToString
+	var mu sync.Mutex
+	fetches, keys := 0, []map[string]string{{"kty": "OKP", "kid": "ed", "crv": "Ed25519", "x": b64(edKey.Public().(ed25519.PublicKey))}}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetches++
+		set := map[string]interface{}{"keys": keys}
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		json.NewEncoder(w).Encode(set)
+	}))
+	defer srv.Close()
+
+	v, err := NewJWTValidator(testCtx, JWTConfig{JWKS: srv.URL, Issuer: "https://issuer.test", Audience: "gocrud", RefreshInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("NewJWTValidator: %v", err)
+	}
+	tok := jwt.NewWithClaims(jwt.SigningMethodEdDSA, jwt.MapClaims{"iss": "https://issuer.test", "aud": "gocrud", "sub": "s", "tenant": "acme", "exp": time.Now().Add(time.Hour).Unix()})
+	tok.Header["kid"] = "ed"
+	token, _ := tok.SignedString(edKey)
+	if _, err := v.Validate(testCtx, token); err != nil {
+		t.Fatalf("expected the token to validate, got %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v.reload(testCtx)
+		}()
+	}
+	wg.Wait()
+	mu.Lock()
+	if fetches > 3 {
+		t.Errorf("expected concurrent reloads to share fetches, got %d fetches", fetches)
+	}
+	keys = nil
+	mu.Unlock()
+	ctx, cancel := context.WithCancel(testCtx)
+	defer cancel()
+	v.Start(ctx, newTestLogger())
+	deadline := time.Now().Add(2 * time.Second)
+	for _, err = v.Validate(testCtx, token); err == nil && time.Now().Before(deadline); _, err = v.Validate(testCtx, token) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err == nil {
+		t.Error("expected a key removed from the jwks to be rejected after a refresh")
+	}
+}
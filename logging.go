@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// newLogger creates the service logger writing format ("json" or "text")
+// records at level ("debug", "info", "warn" or "error") or above to w.
+func newLogger(w io.Writer, format, level string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q", level)
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+	var h slog.Handler
+	switch strings.ToLower(format) {
+	case "json":
+		h = slog.NewJSONHandler(w, opts)
+	case "text":
+		h = slog.NewTextHandler(w, opts)
+	default:
+		return nil, fmt.Errorf("invalid log format %q", format)
+	}
+	return slog.New(contextHandler{h}), nil
+}
+
+// contextHandler adds the request ID, route, caller identity and trace ID
+// found in a record's context, so lines logged while serving a request can
+// be correlated with it.
+type contextHandler struct {
+	slog.Handler
+}
+
+// Handle adds the request attributes of ctx to rec and passes it on.
+func (h contextHandler) Handle(ctx context.Context, rec slog.Record) error {
+	if info := requestInfoFrom(ctx); info.ID != "" {
+		rec.AddAttrs(slog.String("request_id", info.ID), slog.String("route", info.Route))
+		if p := principalFrom(ctx); p != nil {
+			rec.AddAttrs(slog.String("actor", p.ID))
+		} else if info.Actor != "" {
+			rec.AddAttrs(slog.String("actor", info.Actor))
+		}
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		rec.AddAttrs(slog.String("trace_id", sc.TraceID().String()))
+	}
+	return h.Handler.Handle(ctx, rec)
+}
+
+// WithAttrs returns a contextHandler whose records also carry attrs.
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+// WithGroup returns a contextHandler that nests later attributes under name.
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// fatal logs msg with args at error level and exits.
+func fatal(logger *slog.Logger, msg string, args ...interface{}) {
+	logger.Error(msg, args...)
+	os.Exit(1)
+}
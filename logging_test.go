@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestRequestLogging checks that request logs and logs written by handlers are
+// JSON records carrying the request ID, route, caller and duration.
+func TestRequestLogging(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := newLogger(&buf, "json", "info")
+	if err != nil {
+		t.Fatalf("newLogger: %v", err)
+	}
+	if _, err := newLogger(&buf, "xml", "info"); err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+	if _, err := newLogger(&buf, "json", "loud"); err == nil {
+		t.Error("expected an error for an unknown level")
+	}
+
+	auth := NewAuthenticator(map[string]struct{}{"log-key": {}}, nil, logger)
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger.ErrorContext(r.Context(), "error getting item", "error", "boom")
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	srv := requestIDMiddleware(loggingMiddleware(logger)(authMiddleware(auth)(inner)))
+
+	req := httptest.NewRequest(http.MethodGet, "/items/0f8fad5b", nil)
+	req.Header.Set("Authorization", "Bearer log-key")
+	req.Header.Set("X-Request-ID", "req-123")
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, req)
+	if got := rec.Header().Get("X-Request-ID"); got != "req-123" {
+		t.Errorf("X-Request-ID: expected req-123, got %q", got)
+	}
+
+	var lines []map[string]interface{}
+	sc := bufio.NewScanner(&buf)
+	for sc.Scan() {
+		var line map[string]interface{}
+		if err := json.Unmarshal(sc.Bytes(), &line); err != nil {
+			t.Fatalf("log line is not JSON: %s", sc.Text())
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 log lines, got %d", len(lines))
+	}
+	for _, line := range lines {
+		if line["request_id"] != "req-123" || line["route"] != "/items/{id}" || line["actor"] != keyIdentity("log-key") {
+			t.Errorf("log line lacks request attributes: %v", line)
+		}
+	}
+	if lines[0]["level"] != "ERROR" || lines[0]["error"] != "boom" {
+		t.Errorf("unexpected handler log line %v", lines[0])
+	}
+	access := lines[1]
+	if access["msg"] != "request" || access["status"] != float64(500) || access["method"] != "GET" {
+		t.Errorf("unexpected request log line %v", access)
+	}
+	if _, ok := access["duration_ms"].(float64); !ok {
+		t.Errorf("request log line lacks duration_ms: %v", access)
+	}
+}
@@ -2,75 +2,286 @@ package main
 
 import (
 	"context"
-	"log"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
+	"syscall"
 	"time"
-
-	"github.com/go-redis/redis/v8"
 )
 
+const usage = `usage: gocrud [command] [flags]
+
+commands:
+  serve          run the HTTP server (the default)
+  migrate        apply pending data migrations
+  reindex        rebuild the type and tag indexes from the stored items
+  export         write a tenant's items as a JSON array
+  import         load items written by export
+  rewrite        rewrite stored items to match the compression and encryption settings
+                 (also available as compress, its name before encryption was added)
+  keys           create, list, rotate or revoke API keys
+  mode           show or switch the read-only and maintenance modes
+  config print   print the effective configuration
+
+Every command reads the configuration file named by --config or GOCRUD_CONFIG,
+then environment variables, then flags, each overriding the one before.
+Run "gocrud <command> -h" to list the flags.
+`
+
 func main() {
-	logger := log.New(os.Stdout, "go-crud ", log.LstdFlags|log.Lmicroseconds)
+	cmd, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
+	commands := map[string]func([]string) error{
+		"serve":   serve,
+		"migrate": migrateCommand,
+		"reindex": reindexCommand,
+		"export":  exportCommand,
+		"import":  importCommand,
+		"rewrite": rewriteCommand,
+		"keys":    keysCommand,
+		"mode":    modeCommand,
+		"config":  configCommand,
+		// compress is the name rewrite had before items could be encrypted
+		"compress": rewriteCommand,
+	}
+	run, ok := commands[cmd]
+	if !ok {
+		if cmd != "help" {
+			fmt.Fprintf(os.Stderr, "unknown command %q\n\n", cmd)
+		}
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err := run(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(0)
+		}
+		fmt.Fprintf(os.Stderr, "gocrud %s: %v\n", cmd, err)
+		os.Exit(1)
+	}
+}
+
+// serve runs the HTTP server until SIGINT or SIGTERM.
+func serve(args []string) error {
+	cfg, err := loadConfig(flag.NewFlagSet("gocrud serve", flag.ContinueOnError), args, os.Getenv)
+	if err != nil {
+		return err
+	}
+	logger, err := newLogger(os.Stdout, cfg.Log.Format, cfg.Log.Level)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(logger)
 	ctx := context.Background()
 
-	// allow overriding Redis address via REDIS_ADDR env var, default to localhost:6379
-	redisAddr := os.Getenv("REDIS_ADDR")
-	if redisAddr == "" {
-		redisAddr = "localhost:6379"
+	// the server starts even while Redis is down; commands fail fast with 503
+	// once redis.breaker.failures of them in a row could not reach it
+	redisClient, err := cfg.Redis.client()
+	if err != nil {
+		return err
 	}
-	redisClient := redis.NewClient(&redis.Options{Addr: redisAddr})
-	if err := redisClient.Ping(ctx).Err(); err != nil {
-		logger.Fatalf("could not connect to redis (%s): %v", redisAddr, err)
+	breaker := NewCircuitBreaker(logger)
+	breaker.Threshold, breaker.Cooldown = cfg.Redis.Breaker.Failures, time.Duration(cfg.Redis.Breaker.Cooldown)
+	redisClient.AddHook(breaker)
+
+	// Prometheus metrics, including Redis command latency, are served on /metrics
+	metrics := NewMetrics(redisClient)
+	metrics.Register(breaker)
+
+	// traces are exported to tracing.exporter (otlp or stdout) when set
+	shutdownTracing, err := setupTracing(ctx, cfg.Tracing.Exporter)
+	if err != nil {
+		fatal(logger, "could not set up tracing", "error", err)
 	}
+	redisClient.AddHook(redisTracingHook{})
 
+	// reads are retried redis.retries times while Redis is unreachable
 	store := NewRedisStore(redisClient)
+	store.Retries, store.RetryBackoff = cfg.Redis.Retries, time.Duration(cfg.Redis.RetryBackoff)
+	// GET /items/{id} is served from a local cache when cache.max_entries is set;
+	// writes on any replica invalidate it through Redis pub/sub
+	if cfg.Cache.MaxEntries > 0 {
+		store.Cache = NewItemCache(redisClient, logger, cfg.Cache.MaxEntries, cfg.Cache.MaxBytes, time.Duration(cfg.Cache.MaxAge))
+		store.StaleReads = cfg.Cache.ServeStale
+		metrics.Register(store.Cache)
+	}
+	// items of compression.threshold bytes or more are stored compressed, and
+	// the data paths in encryption.fields encrypted with the keyring's keys
+	store.Codec, err = cfg.itemCodec()
+	if err != nil {
+		return err
+	}
+	metrics.Register(store.Codec)
 	handler := NewHandler(store, logger)
 
+	// change events reach WebSocket clients on every replica through Redis
+	// pub/sub; with a keyring, events, queued webhook deliveries and stored
+	// idempotent responses are encrypted like item data
+	broker := NewEventBroker(redisClient, logger)
+	broker.Keyring = store.Codec.Keyring
+	handler.AddListener(broker)
+
+	// webhook endpoints must be public addresses unless
+	// webhooks.allow_private_networks is set
+	webhooks := NewWebhookStore(redisClient)
+	webhooks.Keyring = store.Codec.Keyring
+	dispatcher := NewWebhookDispatcher(webhooks, redisClient, logger)
+	dispatcher.AllowPrivateNetworks = cfg.Webhooks.AllowPrivateNetworks
+	handler.AddListener(dispatcher)
+	webhookHandler := NewWebhookHandler(webhooks, logger)
+	webhookHandler.AllowPrivateNetworks = cfg.Webhooks.AllowPrivateNetworks
+
+	audit := NewAuditLog(redisClient, logger)
+	audit.Encrypted = store.Codec.Encrypt
+	handler.AddListener(audit)
+
+	// POST /items and POST /batch with an Idempotency-Key header are safe to retry
+	idempotency := NewIdempotencyStore(redisClient)
+	idempotency.Keyring = store.Codec.Keyring
+
 	mux := http.NewServeMux()
-	mux.HandleFunc("/items", handler.itemsHandler)
+	mux.Handle("/items", idempotencyMiddleware(idempotency, logger)(http.HandlerFunc(handler.itemsHandler)))
 	mux.HandleFunc("/items/", handler.itemHandler)
+	mux.Handle("/batch", idempotencyMiddleware(idempotency, logger)(http.HandlerFunc(handler.batchHandler)))
+	// system administrators put the service in read-only or maintenance mode
+	// through /mode; every replica rereads it from Redis each second, and
+	// leaves stored items alone outside normal mode
+	modes := NewModeStore(redisClient, logger)
+	store.Modes = modes
+	ws := NewWSHandler(handler, broker)
+	ws.Modes = modes
+	mux.Handle("/ws", ws)
+	mux.Handle("/mode", systemAdminOnly(http.HandlerFunc(modes.modeHandler)))
+	mux.Handle("/webhooks", adminOnly(http.HandlerFunc(webhookHandler.webhooksHandler)))
+	mux.Handle("/webhooks/", adminOnly(http.HandlerFunc(webhookHandler.webhookHandler)))
+	mux.Handle("/audit", adminOnly(http.HandlerFunc(audit.handleQuery)))
+	mux.Handle("/metrics", systemAdminOnly(metrics.Handler()))
 
-	// Load API keys for authentication (comma-separated list in API_KEYS env var).
-	keysEnv := os.Getenv("API_KEYS")
-	if keysEnv == "" {
-		logger.Fatal("environment variable API_KEYS is required for authentication")
+	// Bootstrap API keys (auth.api_keys) act as administrators; all other keys
+	// are managed through /keys or `gocrud keys` and stored hashed in Redis.
+	bootstrapKeys := make(map[string]struct{})
+	for _, k := range cfg.Auth.APIKeys {
+		bootstrapKeys[k] = struct{}{}
 	}
-	validKeys := parseAPIKeys(keysEnv)
-	authMux := authMiddleware(validKeys)(mux)
-	loggedMux := loggingMiddleware(logger)(authMux)
-
-	// allow overriding HTTP listen address via HTTP_ADDR env var, default to :9090
-	httpAddr := os.Getenv("HTTP_ADDR")
-	if httpAddr == "" {
-		httpAddr = ":9090"
+	if len(bootstrapKeys) == 0 {
+		logger.Warn("no bootstrap API keys are configured: only keys stored in Redis will be accepted")
 	}
+	keyStore := NewKeyStore(redisClient)
+	auth := NewAuthenticator(bootstrapKeys, keyStore, logger)
+	// signed JWTs are accepted alongside API keys when a JWKS is configured
+	if cfg.Auth.JWT.JWKS != "" {
+		validator, err := NewJWTValidator(ctx, cfg.Auth.JWT.jwtConfig())
+		if err != nil {
+			fatal(logger, "could not configure jwt authentication", "error", err)
+		}
+		validator.Start(ctx, logger)
+		auth.JWT = validator
+	}
+	tenants := NewTenantStore(redisClient)
+	auth.Tenants = tenants
+	// open WebSocket sessions end once their key is revoked or expires
+	ws.Auth = auth
+	keyHandler := NewKeyHandler(keyStore, tenants, auth, logger)
+	tenantHandler := NewTenantHandler(tenants, keyStore, auth, logger)
+	mux.Handle("/keys", adminOnly(http.HandlerFunc(keyHandler.keysHandler)))
+	mux.Handle("/keys/", adminOnly(http.HandlerFunc(keyHandler.keyHandler)))
+	mux.Handle("/tenants", systemAdminOnly(http.HandlerFunc(tenantHandler.tenantsHandler)))
+	mux.Handle("/tenants/", systemAdminOnly(http.HandlerFunc(tenantHandler.tenantHandler)))
+
+	// requests are rate limited per caller; a default of 0 disables the limit
+	limiter := NewRateLimiter(redisClient, logger)
+	limiter.Default = cfg.RateLimit.Default
+	limiter.ListCost = cfg.RateLimit.ListCost
+	limiter.Scopes = cfg.RateLimit.Scopes
+	limiter.FailOpen = cfg.RateLimit.FailOpen
+	ws.Limiter = limiter
+	// client addresses are limited in process before authentication, so
+	// floods of invalid tokens never reach the key store
+	ipLimiter := NewIPLimiter(cfg.RateLimit.PerIP)
+	ipLimiter.TrustedProxies, _ = parseTrustedProxies(cfg.RateLimit.TrustedProxies)
+
+	// probes and the API description are served without authentication;
+	// everything else requires it, and fails with 503 until Redis is ready
+	health := NewHealth(redisClient)
+	health.Modes = modes
+	health.Starting()
+	mux.Handle("/status", systemAdminOnly(http.HandlerFunc(health.handleStatus)))
+	root := http.NewServeMux()
+	root.HandleFunc("/healthz", health.handleLiveness)
+	root.HandleFunc("/readyz", health.handleReadiness)
+	root.HandleFunc("/openapi.json", handleOpenAPI)
+	root.Handle("/", startupMiddleware(health)(ipRateLimitMiddleware(ipLimiter)(authMiddleware(auth)(modeMiddleware(modes)(rateLimitMiddleware(limiter)(mux))))))
+	loggedMux := requestIDMiddleware(tracingMiddleware(metricsMiddleware(metrics)(loggingMiddleware(logger)(root))))
+
 	server := &http.Server{
-		Addr:         httpAddr,
+		Addr:         cfg.HTTP.Addr,
 		Handler:      loggedMux,
-		ReadTimeout:  5 * time.Second,
-		WriteTimeout: 10 * time.Second,
-		IdleTimeout:  120 * time.Second,
+		ReadTimeout:  time.Duration(cfg.HTTP.ReadTimeout),
+		WriteTimeout: time.Duration(cfg.HTTP.WriteTimeout),
+		IdleTimeout:  time.Duration(cfg.HTTP.IdleTimeout),
 	}
 
+	// readiness fails until Redis has answered, the schema is current and
+	// the subscriptions are in place
 	go func() {
-		logger.Printf("server is listening on %s", server.Addr)
+		steps := []struct {
+			name string
+			run  func() error
+		}{
+			{"checking the schema version", func() error { return checkSchema(ctx, redisClient) }},
+			{"subscribing to change events", func() error { return broker.Start(ctx) }},
+			{"subscribing to cache invalidations", func() error { return store.Cache.Start(ctx) }},
+			{"subscribing to api key changes", func() error { return auth.Start(ctx) }},
+			{"reading the service mode", func() error { return modes.Start(ctx) }},
+		}
+		for _, step := range steps {
+			if err := waitForRedis(ctx, logger, step.name, step.run); err != nil {
+				fatal(logger, "could not start: "+step.name, "error", err)
+			}
+		}
+		dispatcher.Start(ctx, 4)
+		health.Started()
+		logger.Info("redis is ready", "redis", redisEndpoint(redisClient))
+		// items stored before compression or encryption was enabled, or
+		// encrypted with an old key, are rewritten in the background
+		if cfg.Compression.Threshold > 0 || cfg.Encryption.Keyring != "" {
+			rewriteItems(ctx, store, logger)
+		}
+	}()
+
+	go func() {
+		logger.Info("server is listening", "addr", server.Addr)
 		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			logger.Fatalf("could not listen: %v", err)
+			fatal(logger, "could not listen", "error", err)
 		}
 	}()
 
 	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, os.Interrupt)
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
 	<-quit
-	logger.Println("server is shutting down")
+	logger.Info("server is shutting down")
 
-	ctxShutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	// fail readiness first and give load balancers time to notice before
+	// the listener closes
+	health.Drain()
+	time.Sleep(time.Duration(cfg.HTTP.ShutdownDelay))
+
+	ctxShutdown, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.HTTP.ShutdownTimeout))
 	defer cancel()
 	if err := server.Shutdown(ctxShutdown); err != nil {
-		logger.Fatalf("server forced to shutdown: %v", err)
+		fatal(logger, "server forced to shutdown", "error", err)
+	}
+	if err := shutdownTracing(ctxShutdown); err != nil {
+		logger.Error("error flushing traces", "error", err)
 	}
 
-	logger.Println("server stopped")
+	logger.Info("server stopped")
+	return nil
 }
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// routeRoots and routeSubresources are the path segments kept verbatim in
+// route labels; IDs become "{id}" and anything else is reported as "other".
+var (
+	routeRoots        = map[string]bool{"items": true, "batch": true, "ws": true, "webhooks": true, "audit": true, "keys": true, "tenants": true, "mode": true, "metrics": true, "healthz": true, "readyz": true, "status": true, "openapi.json": true}
+	routeSubresources = map[string]bool{"rotate": true, "deliveries": true, "dead-letters": true}
+)
+
+// itemCountInterval is how often the gocrud_items counts are recomputed.
+const itemCountInterval = time.Minute
+
+// maxItemTypeLabels bounds the item types reported per tenant: callers name
+// types freely, so beyond the largest ones they are summed as "other".
+const maxItemTypeLabels = 50
+
+// Metrics collects the Prometheus metrics served on /metrics.
+type Metrics struct {
+	registry      *prometheus.Registry
+	requests      *prometheus.CounterVec
+	duration      *prometheus.HistogramVec
+	inFlight      prometheus.Gauge
+	authFailures  *prometheus.CounterVec
+	redisDuration *prometheus.HistogramVec
+	redisErrors   *prometheus.CounterVec
+}
+
+// NewMetrics creates the metrics and instruments client's commands. Item
+// counts are read from client when /metrics is scraped, at most once per
+// itemCountInterval.
+func NewMetrics(client redis.UniversalClient) *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gocrud_http_requests_total",
+			Help: "HTTP requests by route template, method and status.",
+		}, []string{"route", "method", "status"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "gocrud_http_request_duration_seconds",
+			Help:    "HTTP request latency by route template, method and status.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"route", "method", "status"}),
+		inFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "gocrud_http_requests_in_flight",
+			Help: "HTTP requests currently being served.",
+		}),
+		authFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gocrud_auth_failures_total",
+			Help: "Rejected requests by reason: missing_token, invalid_token or forbidden.",
+		}, []string{"reason"}),
+		redisDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "gocrud_redis_command_duration_seconds",
+			Help:    "Redis command latency by command; pipelines are reported as \"pipeline\".",
+			Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+		}, []string{"command"}),
+		redisErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gocrud_redis_command_errors_total",
+			Help: "Failed Redis commands by command, not counting missing keys.",
+		}, []string{"command"}),
+	}
+	m.registry.MustRegister(
+		m.requests, m.duration, m.inFlight, m.authFailures, m.redisDuration, m.redisErrors,
+		&itemCountCollector{client: client, interval: itemCountInterval, desc: prometheus.NewDesc(
+			"gocrud_items", "Stored items by tenant and type.", []string{"tenant", "type"}, nil)},
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	client.AddHook(redisMetricsHook{m})
+	return m
+}
+
+// Register adds the metrics reported by c.
+func (m *Metrics) Register(c prometheus.Collector) {
+	m.registry.MustRegister(c)
+}
+
+// Handler serves the metrics in the Prometheus text format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// metricsMiddleware records the count, latency and status of every request,
+// labelled by route template so item IDs don't become label values.
+func metricsMiddleware(m *Metrics) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			m.inFlight.Inc()
+			defer m.inFlight.Dec()
+			start := time.Now()
+			rw := &responseWriter{w, http.StatusOK}
+			next.ServeHTTP(rw, r)
+
+			status := strconv.Itoa(rw.statusCode)
+			route, method := routeTemplate(r.URL.Path), methodLabel(r.Method)
+			m.requests.WithLabelValues(route, method, status).Inc()
+			m.duration.WithLabelValues(route, method, status).Observe(time.Since(start).Seconds())
+			switch rw.statusCode {
+			case http.StatusUnauthorized:
+				if strings.Contains(w.Header().Get("WWW-Authenticate"), "invalid_token") {
+					m.authFailures.WithLabelValues("invalid_token").Inc()
+				} else {
+					m.authFailures.WithLabelValues("missing_token").Inc()
+				}
+			case http.StatusForbidden:
+				m.authFailures.WithLabelValues("forbidden").Inc()
+			}
+		})
+	}
+}
+
+// routeTemplate maps a request path to the route it was served by,
+// e.g. "/items/1b9d…" to "/items/{id}".
+func routeTemplate(path string) string {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if !routeRoots[parts[0]] || len(parts) > 3 || (len(parts) == 3 && !routeSubresources[parts[2]]) {
+		return "other"
+	}
+	if len(parts) > 1 {
+		parts[1] = "{id}"
+	}
+	return "/" + strings.Join(parts, "/")
+}
+
+// methodLabel returns method if it is a standard HTTP method and "other"
+// otherwise, so that clients cannot create series with made-up methods.
+func methodLabel(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodOptions:
+		return method
+	}
+	return "other"
+}
+
+// redisMetricsHook times Redis commands and counts their failures.
+type redisMetricsHook struct {
+	m *Metrics
+}
+
+type redisStartKey struct{}
+
+func (h redisMetricsHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	return context.WithValue(ctx, redisStartKey{}, time.Now()), nil
+}
+
+func (h redisMetricsHook) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	h.observe(ctx, cmd.Name(), cmd.Err())
+	return nil
+}
+
+func (h redisMetricsHook) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	return context.WithValue(ctx, redisStartKey{}, time.Now()), nil
+}
+
+func (h redisMetricsHook) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	var err error
+	for _, cmd := range cmds {
+		if cmd.Err() != nil && cmd.Err() != redis.Nil {
+			err = cmd.Err()
+			break
+		}
+	}
+	h.observe(ctx, "pipeline", err)
+	return nil
+}
+
+func (h redisMetricsHook) observe(ctx context.Context, command string, err error) {
+	if start, ok := ctx.Value(redisStartKey{}).(time.Time); ok {
+		h.m.redisDuration.WithLabelValues(command).Observe(time.Since(start).Seconds())
+	}
+	if err != nil && err != redis.Nil {
+		h.m.redisErrors.WithLabelValues(command).Inc()
+	}
+}
+
+// itemCountCollector reports the size of every tenant's per-type item index.
+// Counting scans the keyspace, so the counts are cached for interval and
+// scrapes in between report the last ones.
+type itemCountCollector struct {
+	client   redis.UniversalClient
+	desc     *prometheus.Desc
+	interval time.Duration
+
+	mu        sync.Mutex
+	counted   time.Time
+	counts    []itemCount
+	countsErr error
+}
+
+// itemCount is the size of one tenant's index of one item type.
+type itemCount struct {
+	tenant, typ string
+	n           int64
+}
+
+func (c *itemCountCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *itemCountCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	if time.Since(c.counted) >= c.interval {
+		c.counts, c.countsErr = c.count()
+		c.counted = time.Now()
+	}
+	counts, err := c.counts, c.countsErr
+	c.mu.Unlock()
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(c.desc, err)
+		return
+	}
+	for _, ic := range counts {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(ic.n), ic.tenant, ic.typ)
+	}
+}
+
+// count reads the size of every per-type item index, keeping the
+// maxItemTypeLabels largest types of each tenant and summing the rest.
+func (c *itemCountCollector) count() ([]itemCount, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	keys, err := scanKeys(ctx, c.client, "*items:type:*")
+	if err != nil {
+		return nil, err
+	}
+	var counts []itemCount
+	for _, key := range keys {
+		tenant, rest, ok := splitTenantKey(key)
+		if !ok {
+			continue
+		}
+		typ, ok := strings.CutPrefix(rest, "items:type:")
+		if !ok {
+			continue
+		}
+		n, err := c.client.SCard(ctx, key).Result()
+		if err != nil {
+			return nil, err
+		}
+		counts = append(counts, itemCount{tenant: tenant, typ: typ, n: n})
+	}
+	return capItemTypes(counts, maxItemTypeLabels), nil
+}
+
+// capItemTypes returns counts with the types of each tenant beyond the max
+// largest ones summed into one "other" count.
+func capItemTypes(counts []itemCount, max int) []itemCount {
+	sort.Slice(counts, func(i, j int) bool { return counts[i].n > counts[j].n })
+	var capped []itemCount
+	kept := map[string]int{}
+	other := map[string]*itemCount{}
+	for _, ic := range counts {
+		// a type named "other" is summed with the rest so the labels stay unique
+		if kept[ic.tenant] < max && ic.typ != "other" {
+			capped = append(capped, ic)
+			kept[ic.tenant]++
+		} else if o := other[ic.tenant]; o != nil {
+			o.n += ic.n
+		} else {
+			other[ic.tenant] = &itemCount{tenant: ic.tenant, typ: "other", n: ic.n}
+		}
+	}
+	for _, o := range other {
+		capped = append(capped, *o)
+	}
+	return capped
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// TestMetrics checks that /metrics reports requests by route template, auth
+// failures, Redis commands and item counts.
+func TestMetrics(t *testing.T) {
+	client := &http.Client{Transport: &authTransport{token: testAPIKey, base: http.DefaultTransport}}
+	resp, err := client.Post(testServerURL+"/items", "application/json", bytes.NewReader([]byte(`{"type":"metered","data":{}}`)))
+	if err != nil {
+		t.Fatalf("POST /items: %v", err)
+	}
+	var item Item
+	json.NewDecoder(resp.Body).Decode(&item)
+	resp.Body.Close()
+	defer func() {
+		req, _ := http.NewRequest(http.MethodDelete, testServerURL+"/items/"+item.ID, nil)
+		if resp, err := client.Do(req); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	if resp, err := client.Get(testServerURL + "/items/" + item.ID); err == nil {
+		resp.Body.Close()
+	}
+	if resp, err := http.Get(testServerURL + "/items"); err == nil {
+		resp.Body.Close()
+	}
+
+	if resp, err := http.Get(testServerURL + "/metrics"); err != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("unauthenticated scrape: expected 401, got %v %v", resp, err)
+	}
+	resp, err = client.Get(testServerURL + "/metrics")
+	if err != nil {
+		t.Fatalf("GET /metrics: %v", err)
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+	body := string(b)
+	for _, want := range []string{
+		`gocrud_http_requests_total{method="GET",route="/items/{id}",status="200"}`,
+		`gocrud_http_request_duration_seconds_bucket{method="POST",route="/items",status="201"`,
+		`gocrud_auth_failures_total{reason="missing_token"}`,
+		`gocrud_redis_command_duration_seconds_count{command="pipeline"}`,
+		`gocrud_items{tenant="",type="metered"} 1`,
+		`gocrud_http_requests_in_flight 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics missing %s", want)
+		}
+	}
+	if strings.Contains(body, item.ID) {
+		t.Error("metrics contain a raw item ID")
+	}
+}
+
+func TestRouteTemplate(t *testing.T) {
+	cases := map[string]string{
+		"/items":                           "/items",
+		"/items/":                          "/items",
+		"/items/0f8fad5b":                  "/items/{id}",
+		"/keys/abc123/rotate":              "/keys/{id}/rotate",
+		"/webhooks/abc/dead-letters":       "/webhooks/{id}/dead-letters",
+		"/items/abc/anything":              "other",
+		"/wp-admin/setup.php":              "other",
+		"/webhooks/abc/deliveries/extra/x": "other",
+	}
+	for path, want := range cases {
+		if got := routeTemplate(path); got != want {
+			t.Errorf("routeTemplate(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
+
+// TestItemCountCache checks that item counts are recomputed only once per
+// interval rather than on every scrape.
+func TestItemCountCache(t *testing.T) {
+	c := &itemCountCollector{client: redisClient, interval: time.Hour, desc: prometheus.NewDesc(
+		"gocrud_items", "Stored items by tenant and type.", []string{"tenant", "type"}, nil)}
+	key := tenantKey(testCtx, "items:type:%s", "counted")
+	defer redisClient.Del(testCtx, key)
+	redisClient.SAdd(testCtx, key, "a")
+
+	count := func() float64 {
+		t.Helper()
+		reg := prometheus.NewRegistry()
+		reg.MustRegister(c)
+		families, err := reg.Gather()
+		if err != nil {
+			t.Fatalf("Gather: %v", err)
+		}
+		for _, f := range families {
+			for _, m := range f.GetMetric() {
+				for _, l := range m.GetLabel() {
+					if l.GetName() == "type" && l.GetValue() == "counted" {
+						return m.GetGauge().GetValue()
+					}
+				}
+			}
+		}
+		return 0
+	}
+	if n := count(); n != 1 {
+		t.Fatalf("expected 1 item, got %v", n)
+	}
+	redisClient.SAdd(testCtx, key, "b")
+	if n := count(); n != 1 {
+		t.Errorf("expected the cached count 1 within the interval, got %v", n)
+	}
+	c.counted = time.Time{}
+	if n := count(); n != 2 {
+		t.Errorf("expected 2 items after the interval, got %v", n)
+	}
+}
+
+// TestMetricLabelsBounded checks that request methods and item types cannot
+// add series without bound.
+func TestMetricLabelsBounded(t *testing.T) {
+	if got := methodLabel("PATCH"); got != "PATCH" {
+		t.Errorf("methodLabel(PATCH) = %q", got)
+	}
+	if got := methodLabel("FROBNICATE"); got != "other" {
+		t.Errorf("methodLabel(FROBNICATE) = %q, want other", got)
+	}
+
+	counts := []itemCount{
+		{"", "a", 5}, {"", "b", 4}, {"", "other", 1}, {"", "c", 2}, {"", "d", 1},
+		{"acme", "a", 1},
+	}
+	got := map[string]int64{}
+	for _, ic := range capItemTypes(counts, 2) {
+		got[ic.tenant+"/"+ic.typ] = ic.n
+	}
+	want := map[string]int64{"/a": 5, "/b": 4, "/other": 4, "acme/a": 1}
+	if len(got) != len(want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	for k, n := range want {
+		if got[k] != n {
+			t.Errorf("%s: expected %d, got %d", k, n, got[k])
+		}
+	}
+}
@@ -1,24 +1,53 @@
 package main
 
 import (
-	"log"
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
 	"strings"
 	"time"
+
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
-// loggingMiddleware logs HTTP requests with method, path, status, and duration.
-func loggingMiddleware(logger *log.Logger) func(http.Handler) http.Handler {
+// loggingMiddleware logs HTTP requests with method, path, status and duration;
+// the logger adds the request ID, route and caller from the context.
+func loggingMiddleware(logger *slog.Logger) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			start := time.Now()
 			rw := &responseWriter{w, http.StatusOK}
 			next.ServeHTTP(rw, r)
-			logger.Printf("%s %s %d %s", r.Method, r.URL.Path, rw.statusCode, time.Since(start))
+			logger.InfoContext(r.Context(), "request",
+				"method", r.Method,
+				"path", r.URL.Path,
+				"status", rw.statusCode,
+				"duration_ms", float64(time.Since(start).Microseconds())/1000)
 		})
 	}
 }
 
+// requestIDMiddleware honors an incoming X-Request-ID header or generates one,
+// echoes it on the response and records it with the client IP in the context.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if id == "" || len(id) > 128 {
+			id = uuid.NewString()
+		}
+		w.Header().Set("X-Request-ID", id)
+		info := &requestInfo{ID: id, Route: routeTemplate(r.URL.Path), ClientIP: clientIP(r)}
+		ctx := context.WithValue(r.Context(), requestInfoKey, info)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
 // responseWriter wraps http.ResponseWriter to capture status code.
 type responseWriter struct {
 	http.ResponseWriter
@@ -31,35 +60,88 @@ func (rw *responseWriter) WriteHeader(code int) {
 	rw.ResponseWriter.WriteHeader(code)
 }
 
+// Hijack lets WebSocket upgrades take over the underlying connection.
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := rw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer does not support hijacking")
+	}
+	conn, buf, err := hj.Hijack()
+	if err == nil {
+		rw.statusCode = http.StatusSwitchingProtocols
+	}
+	return conn, buf, err
+}
+
 // authMiddleware enforces API-key authentication via Bearer tokens.
-func authMiddleware(validKeys map[string]struct{}) func(http.Handler) http.Handler {
+func authMiddleware(auth *Authenticator) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			authHeader := r.Header.Get("Authorization")
-			const prefix = "Bearer "
-			if !strings.HasPrefix(authHeader, prefix) {
+			token, ok := bearerToken(r)
+			if !ok {
 				w.Header().Set("WWW-Authenticate", `Bearer realm="gocrud"`)
 				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
 				return
 			}
-			token := strings.TrimSpace(strings.TrimPrefix(authHeader, prefix))
-			if _, ok := validKeys[token]; !ok {
+			p, err := auth.Authenticate(r.Context(), token)
+			if errors.Is(err, ErrInvalidCredentials) {
 				w.Header().Set("WWW-Authenticate", `Bearer realm="gocrud", error="invalid_token"`)
 				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
 				return
 			}
-			next.ServeHTTP(w, r)
+			if isOutage(err) {
+				writeUnavailable(w, err)
+				return
+			}
+			if err != nil {
+				auth.logger.ErrorContext(r.Context(), "error authenticating request", "error", err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+			trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("enduser.id", p.ID))
+			if info, ok := r.Context().Value(requestInfoKey).(*requestInfo); ok {
+				info.Actor = p.ID
+			}
+			ctx := withTenant(withPrincipal(r.Context(), p), p.Tenant)
+			next.ServeHTTP(w, r.WithContext(ctx))
 		})
 	}
 }
 
-// parseAPIKeys parses a comma-separated list of API keys into a set.
-func parseAPIKeys(s string) map[string]struct{} {
-	keys := make(map[string]struct{})
-	for _, k := range strings.Split(s, ",") {
-		if v := strings.TrimSpace(k); v != "" {
-			keys[v] = struct{}{}
+// adminOnly rejects callers that are not administrators with 403.
+func adminOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p := principalFrom(r.Context()); p == nil || !p.Allows(ScopeAdmin) {
+			http.Error(w, `api key lacks the "admin" scope`, http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// systemAdminOnly admits only administrators of the default tenant, who manage tenants.
+func systemAdminOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p := principalFrom(r.Context()); p == nil || !p.Allows(ScopeAdmin) || p.Tenant != "" {
+			http.Error(w, "system administrator access required", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// bearerToken extracts the API key from the Authorization header. Browsers cannot
+// set headers on WebSocket handshakes, so upgrade requests may pass it in the
+// access_token query parameter instead.
+func bearerToken(r *http.Request) (string, bool) {
+	const prefix = "Bearer "
+	if authHeader := r.Header.Get("Authorization"); strings.HasPrefix(authHeader, prefix) {
+		return strings.TrimSpace(strings.TrimPrefix(authHeader, prefix)), true
+	}
+	if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		if token := r.URL.Query().Get("access_token"); token != "" {
+			return token, true
 		}
 	}
-	return keys
+	return "", false
 }
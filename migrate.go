@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+)
+
+// schemaVersionKey holds the version of the newest migration applied to the
+// data in Redis; schemaLockKey keeps two migrate runs from overlapping.
+const (
+	schemaVersionKey = "schema:version"
+	schemaLockKey    = "schema:lock"
+)
+
+// migration upgrades the data in Redis to version.
+type migration struct {
+	version     int
+	description string
+	apply       func(ctx context.Context, client redis.UniversalClient) error
+}
+
+// migrations lists the data migrations in version order; new ones are
+// appended.
+var migrations = []migration{
+	{version: 1, description: "move tenant keys under hash-tagged prefixes", apply: migrateHashTags},
+	{version: 2, description: "index audit entries by item and actor", apply: migrateAuditIndexes},
+}
+
+// checkSchema fails when the data in Redis is older than the migrations this
+// build relies on. An empty database is marked as current instead, so a new
+// deployment needs no migrate run.
+func checkSchema(ctx context.Context, client redis.UniversalClient) error {
+	latest := migrations[len(migrations)-1].version
+	current, err := client.Get(ctx, schemaVersionKey).Int()
+	if err == redis.Nil {
+		n, err := client.DBSize(ctx).Result()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return client.SetNX(ctx, schemaVersionKey, latest, 0).Err()
+		}
+	} else if err != nil {
+		return err
+	}
+	if current < latest {
+		return fmt.Errorf("the data in redis is at schema version %d and this build needs version %d: run `gocrud migrate` first", current, latest)
+	}
+	return nil
+}
+
+// applyMigrations runs the migrations in list that are newer than the stored
+// schema version, in order, recording each version as it completes. It
+// returns the resulting schema version.
+func applyMigrations(ctx context.Context, client redis.UniversalClient, list []migration, logger *slog.Logger) (int, error) {
+	token := uuid.NewString()
+	ok, err := client.SetNX(ctx, schemaLockKey, token, 10*time.Minute).Result()
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, errors.New("another migration is running")
+	}
+	// a migration outlasting the lock must not release the next run's
+	defer releaseLockScript.Run(context.Background(), client, []string{schemaLockKey}, token)
+
+	current, err := client.Get(ctx, schemaVersionKey).Int()
+	if err != nil && err != redis.Nil {
+		return 0, err
+	}
+	for _, m := range list {
+		if m.version <= current {
+			continue
+		}
+		logger.InfoContext(ctx, "applying migration", "version", m.version, "description", m.description)
+		if err := m.apply(ctx, client); err != nil {
+			return current, fmt.Errorf("migration %d (%s): %w", m.version, m.description, err)
+		}
+		if err := client.Set(ctx, schemaVersionKey, m.version, 0).Err(); err != nil {
+			return current, err
+		}
+		current = m.version
+	}
+	return current, nil
+}
+
+// legacyDefaultKeys and legacyDefaultPrefixes match the keys of the default
+// tenant before version 1, when they had no prefix. Other tenants' keys
+// started with "t:<id>:".
+var (
+	legacyDefaultKeys     = map[string]bool{"items": true, "webhooks": true, auditStreamKey: true}
+	legacyDefaultPrefixes = []string{"item:", "items:type:", "items:tag:", "webhook:", "idempotency:", "ratelimit:"}
+)
+
+// hashTaggedKey returns the name a tenant key written before version 1 has
+// now, and false for keys that are not tenant keys or were already moved.
+func hashTaggedKey(key string) (string, bool) {
+	if rest, ok := strings.CutPrefix(key, "t:"); ok {
+		tenant, rest, ok := strings.Cut(rest, ":")
+		if !ok || strings.HasPrefix(tenant, "{") {
+			return "", false
+		}
+		return tenantPrefix(tenant) + rest, true
+	}
+	if legacyDefaultKeys[key] {
+		return tenantPrefix("") + key, true
+	}
+	for _, p := range legacyDefaultPrefixes {
+		if strings.HasPrefix(key, p) {
+			return tenantPrefix("") + key, true
+		}
+	}
+	return "", false
+}
+
+// migrateHashTags renames every tenant key to its hash-tagged name, keeping
+// expiries. The old layout was never used with Redis Cluster, where a rename
+// across slots would fail, so it runs before switching to cluster mode.
+func migrateHashTags(ctx context.Context, client redis.UniversalClient) error {
+	keys, err := scanKeys(ctx, client, "*")
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		to, ok := hashTaggedKey(key)
+		if !ok {
+			continue
+		}
+		if err := client.Rename(ctx, key, to).Err(); err != nil && err.Error() != "ERR no such key" {
+			return fmt.Errorf("renaming %s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// migrateAuditIndexes adds the audit entries written before version 2 to the
+// streams of their item and actor, keeping their IDs. Entries already
+// indexed are skipped, so an interrupted run can be repeated.
+func migrateAuditIndexes(ctx context.Context, client redis.UniversalClient) error {
+	streams, err := scanKeys(ctx, client, "*}:"+auditStreamKey)
+	if err != nil {
+		return err
+	}
+	for _, stream := range streams {
+		tenant, _, ok := splitTenantKey(stream)
+		if !ok {
+			continue
+		}
+		tctx := withTenant(ctx, tenant)
+		start := "-"
+		for {
+			msgs, err := client.XRangeN(ctx, stream, start, "+", 500).Result()
+			if err != nil {
+				return err
+			}
+			for _, msg := range msgs {
+				raw, _ := msg.Values["entry"].(string)
+				var entry AuditEntry
+				if err := json.Unmarshal([]byte(raw), &entry); err != nil {
+					return fmt.Errorf("%s %s: %w", stream, msg.ID, err)
+				}
+				if err := appendAuditScript.Run(ctx, client, auditKeys(tctx, &entry), raw, msg.ID).Err(); err != nil {
+					return err
+				}
+			}
+			if len(msgs) < 500 {
+				break
+			}
+			start = "(" + msgs[len(msgs)-1].ID
+		}
+	}
+	return nil
+}
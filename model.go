@@ -11,8 +11,13 @@ type Item struct {
 	Type         string          `json:"type"`
 	Tags         []string        `json:"tags"`
 	Data         json.RawMessage `json:"data"`
+	Owner        string          `json:"owner,omitempty"`
+	ACL          *ItemACL        `json:"acl,omitempty"`
 	CreatedAt    time.Time       `json:"createdAt"`
 	LastModified time.Time       `json:"lastModified"`
+
+	// stale is set on an item served from the cache because Redis was unavailable.
+	stale bool
 }
 
 // CreateItemRequest is the payload for creating a new item.
@@ -20,11 +25,86 @@ type CreateItemRequest struct {
 	Type string          `json:"type"`
 	Tags []string        `json:"tags"`
 	Data json.RawMessage `json:"data"`
+	ACL  *ItemACL        `json:"acl,omitempty"`
 }
 
 // UpdateItemRequest is the payload for updating an existing item.
+// ACL is left unchanged when omitted; only the owner may change it.
 type UpdateItemRequest struct {
 	Type string          `json:"type"`
 	Tags []string        `json:"tags"`
 	Data json.RawMessage `json:"data"`
+	ACL  *ItemACL        `json:"acl,omitempty"`
+}
+
+// PatchItemRequest is the payload for changing part of an item. Type and ACL
+// are left unchanged when omitted, and Tags when omitted or null. Data is a
+// JSON merge patch (RFC 7386) applied to the item's data.
+type PatchItemRequest struct {
+	Type string          `json:"type,omitempty"`
+	Tags []string        `json:"tags"`
+	Data json.RawMessage `json:"data,omitempty"`
+	ACL  *ItemACL        `json:"acl,omitempty"`
+}
+
+// BatchRequest is the payload of POST /batch.
+type BatchRequest struct {
+	Operations []BatchOperation `json:"operations"`
+}
+
+// BatchOperation is one write of a batch. Op is "create", "update", "patch"
+// or "delete"; the other fields are those of the single-item request, with
+// ID naming the item and IfMatch standing in for the If-Match header.
+type BatchOperation struct {
+	Op      string          `json:"op"`
+	ID      string          `json:"id,omitempty"`
+	IfMatch string          `json:"ifMatch,omitempty"`
+	Type    string          `json:"type,omitempty"`
+	Tags    []string        `json:"tags"`
+	Data    json.RawMessage `json:"data,omitempty"`
+	ACL     *ItemACL        `json:"acl,omitempty"`
+}
+
+// BatchResult is the outcome of one operation of a batch: the status the
+// single-item request would have answered with, and the item written or the
+// reason the operation failed.
+type BatchResult struct {
+	Status int    `json:"status"`
+	Item   *Item  `json:"item,omitempty"`
+	ETag   string `json:"etag,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// BatchResponse lists the results of a batch in the order of its operations.
+type BatchResponse struct {
+	Results []BatchResult `json:"results"`
+}
+
+// ItemFilter selects items by type and tags; empty fields match everything.
+type ItemFilter struct {
+	Type string   `json:"type,omitempty"`
+	Tags []string `json:"tags,omitempty"`
+}
+
+// Matches reports whether item has the filter's type and carries all of its tags.
+func (f ItemFilter) Matches(item *Item) bool {
+	if item == nil {
+		return false
+	}
+	if f.Type != "" && item.Type != f.Type {
+		return false
+	}
+	for _, want := range f.Tags {
+		found := false
+		for _, tag := range item.Tags {
+			if tag == want {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
 }
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// serviceModeKey holds the ServiceMode shared by every replica.
+const serviceModeKey = "service:mode"
+
+// Service modes. In read-only mode requests that change data are refused;
+// in maintenance mode every request is, except from administrators.
+const (
+	ModeNormal      = "normal"
+	ModeReadOnly    = "read-only"
+	ModeMaintenance = "maintenance"
+)
+
+// ServiceMode is the body of GET and PUT /mode. Message is shown to the
+// callers whose requests are refused.
+type ServiceMode struct {
+	Mode      string    `json:"mode"`
+	Message   string    `json:"message,omitempty"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	UpdatedBy string    `json:"updatedBy,omitempty"`
+}
+
+// validate checks a requested mode.
+func (m *ServiceMode) validate() error {
+	switch m.Mode {
+	case ModeNormal, ModeReadOnly, ModeMaintenance:
+	default:
+		return &inputError{fmt.Sprintf("mode must be %s, %s or %s", ModeNormal, ModeReadOnly, ModeMaintenance)}
+	}
+	if len(m.Message) > 1000 {
+		return &inputError{"message must be at most 1000 characters"}
+	}
+	return nil
+}
+
+// modeProblem is the RFC 9457 problem details body of a request refused by
+// the service mode.
+type modeProblem struct {
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail"`
+	Mode   string `json:"mode"`
+}
+
+// ModeStore keeps the service mode in Redis so that every replica sees it.
+// Each replica rereads it every Refresh and checks requests against the copy.
+type ModeStore struct {
+	client redis.UniversalClient
+	logger *slog.Logger
+	// Refresh is how often the mode is reread from Redis.
+	Refresh time.Duration
+
+	current atomic.Pointer[ServiceMode]
+}
+
+// NewModeStore creates a ModeStore rereading the mode every second.
+func NewModeStore(client redis.UniversalClient, logger *slog.Logger) *ModeStore {
+	return &ModeStore{client: client, logger: logger, Refresh: time.Second}
+}
+
+// Start reads the mode and keeps rereading it until ctx is done. It returns
+// once the mode has been read.
+func (s *ModeStore) Start(ctx context.Context) error {
+	m, err := s.GetMode(ctx)
+	if err != nil {
+		return err
+	}
+	s.current.Store(m)
+	go func() {
+		ticker := time.NewTicker(s.Refresh)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			m, err := s.GetMode(ctx)
+			if err != nil {
+				// keep the last mode read; the open breaker has logged the outage already
+				if ctx.Err() == nil && !isRejected(err) {
+					s.logger.Error("error reading the service mode", "error", err)
+				}
+				continue
+			}
+			if prev := s.current.Swap(m); prev.Mode != m.Mode {
+				s.logger.Warn("service mode changed", "mode", m.Mode, "updated_by", m.UpdatedBy)
+			}
+		}
+	}()
+	return nil
+}
+
+// GetMode reads the mode from Redis; it is normal if it was never set.
+func (s *ModeStore) GetMode(ctx context.Context) (*ServiceMode, error) {
+	data, err := s.client.Get(ctx, serviceModeKey).Bytes()
+	if err == redis.Nil {
+		return &ServiceMode{Mode: ModeNormal}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var m ServiceMode
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// SetMode stores m. This replica applies it at once, the others within Refresh.
+func (s *ModeStore) SetMode(ctx context.Context, m *ServiceMode) error {
+	if err := m.validate(); err != nil {
+		return err
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if err := s.client.Set(ctx, serviceModeKey, data, 0).Err(); err != nil {
+		return err
+	}
+	s.current.Store(m)
+	return nil
+}
+
+// Current returns the mode this replica enforces. A nil *ModeStore, or one
+// that has not started, is always in normal mode.
+func (s *ModeStore) Current() *ServiceMode {
+	if s == nil {
+		return &ServiceMode{Mode: ModeNormal}
+	}
+	if m := s.current.Load(); m != nil {
+		return m
+	}
+	return &ServiceMode{Mode: ModeNormal}
+}
+
+// refusal returns the problem to answer a request from p with, or nil if the
+// current mode allows it; write tells whether the request changes data.
+func (s *ModeStore) refusal(p *Principal, write bool) *modeProblem {
+	m := s.Current()
+	switch {
+	case m.Mode == ModeMaintenance && (p == nil || !p.Allows(ScopeAdmin)):
+		detail := m.Message
+		if detail == "" {
+			detail = "The service is down for maintenance. Please try again later."
+		}
+		return &modeProblem{Title: "Service is under maintenance", Status: http.StatusServiceUnavailable, Detail: detail, Mode: m.Mode}
+	case m.Mode == ModeReadOnly && write:
+		detail := m.Message
+		if detail == "" {
+			detail = "The service is read-only for maintenance: data can be read but not changed."
+		}
+		return &modeProblem{Title: "Service is read-only", Status: http.StatusServiceUnavailable, Detail: detail, Mode: m.Mode}
+	}
+	return nil
+}
+
+// modeMiddleware refuses the requests that the current service mode does not
+// allow. Requests to /mode itself always pass, so an administrator can leave
+// read-only mode.
+func modeMiddleware(modes *ModeStore) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			write := r.Method != http.MethodGet && r.Method != http.MethodHead && r.Method != http.MethodOptions
+			if r.URL.Path != "/mode" {
+				if problem := modes.refusal(principalFrom(r.Context()), write); problem != nil {
+					w.Header().Set("Content-Type", "application/problem+json")
+					w.WriteHeader(problem.Status)
+					json.NewEncoder(w).Encode(problem)
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// modeHandler processes GET and PUT /mode.
+func (s *ModeStore) modeHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		m, err := s.GetMode(r.Context())
+		if err != nil {
+			writeError(w, r, s.logger, err, "error reading the service mode")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(m)
+	case http.MethodPut:
+		var m ServiceMode
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&m); err != nil {
+			http.Error(w, fmt.Sprintf("invalid request payload: %v", err), http.StatusBadRequest)
+			return
+		}
+		if err := ensureSingleJSON(dec); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		m.UpdatedAt, m.UpdatedBy = time.Now().UTC(), ""
+		if p := principalFrom(r.Context()); p != nil {
+			m.UpdatedBy = p.ID
+		}
+		if err := s.SetMode(r.Context(), &m); err != nil {
+			writeError(w, r, s.logger, err, "error setting the service mode")
+			return
+		}
+		s.logger.WarnContext(r.Context(), "service mode changed", "mode", m.Mode, "updated_by", m.UpdatedBy)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&m)
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
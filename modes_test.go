@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"gocrud/client"
+)
+
+// TestServiceModes switches the test server to read-only and maintenance
+// mode and checks which requests still get through.
+func TestServiceModes(t *testing.T) {
+	writer := newKey(t, testAPIKey, `{"name":"mode-writer","scopes":["read","write"]}`).Secret
+	defer call(t, testAPIKey, http.MethodPut, "/mode", `{"mode":"normal"}`)
+
+	if got, _ := call(t, testAPIKey, http.MethodPut, "/mode", `{"mode":"readonly"}`); got != http.StatusBadRequest {
+		t.Errorf("unknown mode: expected 400, got %d", got)
+	}
+	if got, body := call(t, writer, http.MethodPut, "/mode", `{"mode":"read-only"}`); got != http.StatusForbidden {
+		t.Errorf("mode change without admin scope: got %d %q", got, body)
+	}
+	if got, body := call(t, testAPIKey, http.MethodPut, "/mode", `{"mode":"read-only"}`); got != http.StatusOK || !strings.Contains(string(body), `"updatedBy":"key:`) {
+		t.Fatalf("entering read-only mode: got %d %q", got, body)
+	}
+	resp, body := send(t, writer, http.MethodPost, "/items", `{"type":"note","data":{}}`)
+	var problem modeProblem
+	json.Unmarshal(body, &problem)
+	if got := resp.StatusCode; got != http.StatusServiceUnavailable || problem.Mode != ModeReadOnly || problem.Status != got || problem.Detail == "" {
+		t.Errorf("write in read-only mode: got %d %q", got, body)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/problem+json" {
+		t.Errorf("write in read-only mode: expected a problem body, got %s", ct)
+	}
+	if got, _ := call(t, testAPIKey, http.MethodPost, "/items", `{"type":"note","data":{}}`); got != http.StatusServiceUnavailable {
+		t.Errorf("admin write in read-only mode: expected 503, got %d", got)
+	}
+	if got, _ := call(t, writer, http.MethodGet, "/items/missing", ""); got != http.StatusNotFound {
+		t.Errorf("read in read-only mode: expected 404, got %d", got)
+	}
+	c := client.New(testServerURL, writer)
+	c.MinBackoff, c.MaxBackoff = time.Second, time.Second
+	start := time.Now()
+	_, err := c.Create(testCtx, client.CreateItemRequest{Type: "note", Data: json.RawMessage(`{}`)})
+	if !errors.Is(err, client.ErrReadOnly) || time.Since(start) >= time.Second {
+		t.Errorf("expected the client to report ErrReadOnly without retrying, got %v", err)
+	}
+
+	if got, _ := call(t, testAPIKey, http.MethodPut, "/mode", `{"mode":"maintenance","message":"Back at 14:00 UTC"}`); got != http.StatusOK {
+		t.Fatalf("entering maintenance mode: got %d", got)
+	}
+	resp, body = send(t, writer, http.MethodGet, "/items/missing", "")
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Content-Type") != "application/problem+json" || !strings.Contains(string(body), "Back at 14:00 UTC") {
+		t.Errorf("read in maintenance mode: got %d %s %q", resp.StatusCode, resp.Header.Get("Content-Type"), body)
+	}
+	if got, _ := call(t, testAPIKey, http.MethodGet, "/items/missing", ""); got != http.StatusNotFound {
+		t.Errorf("admin read in maintenance mode: expected 404, got %d", got)
+	}
+	var st Status
+	_, body = call(t, testAPIKey, http.MethodGet, "/status", "")
+	json.Unmarshal(body, &st)
+	if st.Mode != ModeMaintenance {
+		t.Errorf("expected /status to report maintenance mode, got %q", st.Mode)
+	}
+
+	if got, _ := call(t, testAPIKey, http.MethodPut, "/mode", `{"mode":"normal"}`); got != http.StatusOK {
+		t.Fatalf("leaving maintenance mode: got %d", got)
+	}
+	if got, _ := call(t, writer, http.MethodGet, "/items/missing", ""); got != http.StatusNotFound {
+		t.Errorf("read after maintenance: expected 404, got %d", got)
+	}
+}
+
+// TestModeRefresh checks that a replica picks up a mode set by another.
+func TestModeRefresh(t *testing.T) {
+	ctx, cancel := context.WithCancel(testCtx)
+	defer cancel()
+	a, b := NewModeStore(redisClient, newTestLogger()), NewModeStore(redisClient, newTestLogger())
+	b.Refresh = 10 * time.Millisecond
+	if err := b.Start(ctx); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	defer a.SetMode(testCtx, &ServiceMode{Mode: ModeNormal})
+	if err := a.SetMode(testCtx, &ServiceMode{Mode: ModeReadOnly}); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for b.refusal(nil, true) == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("the other replica did not switch to read-only mode")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if b.refusal(nil, false) != nil {
+		t.Error("expected reads to be allowed in read-only mode")
+	}
+}
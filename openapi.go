@@ -0,0 +1,23 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// openAPISpec is the OpenAPI 3.1 description of the API. openapi_test.go
+// checks it against the registered routes and the request and item types.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// handleOpenAPI processes GET /openapi.json.
+func handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPISpec)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+type openAPIDoc struct {
+	OpenAPI    string                            `json:"openapi"`
+	Paths      map[string]map[string]interface{} `json:"paths"`
+	Components struct {
+		Schemas map[string]struct {
+			Properties map[string]interface{} `json:"properties"`
+		} `json:"schemas"`
+		SecuritySchemes map[string]interface{} `json:"securitySchemes"`
+	} `json:"components"`
+}
+
+func loadOpenAPI(t *testing.T) *openAPIDoc {
+	t.Helper()
+	resp, err := http.Get(testServerURL + "/openapi.json")
+	if err != nil {
+		t.Fatalf("GET /openapi.json: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /openapi.json: expected 200 without credentials, got %d", resp.StatusCode)
+	}
+	var doc openAPIDoc
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		t.Fatalf("decoding /openapi.json: %v", err)
+	}
+	if doc.OpenAPI != "3.1.0" || doc.Components.SecuritySchemes["bearerAuth"] == nil {
+		t.Fatalf("unexpected document header: openapi %q, security schemes %v", doc.OpenAPI, doc.Components.SecuritySchemes)
+	}
+	return &doc
+}
+
+// registeredRoutes returns the patterns main.go registers on its muxes.
+func registeredRoutes(t *testing.T) []string {
+	t.Helper()
+	f, err := parser.ParseFile(token.NewFileSet(), "main.go", nil, 0)
+	if err != nil {
+		t.Fatalf("parsing main.go: %v", err)
+	}
+	var routes []string
+	ast.Inspect(f, func(n ast.Node) bool {
+		call, ok := n.(*ast.CallExpr)
+		if !ok || len(call.Args) != 2 {
+			return true
+		}
+		sel, ok := call.Fun.(*ast.SelectorExpr)
+		if !ok || (sel.Sel.Name != "Handle" && sel.Sel.Name != "HandleFunc") {
+			return true
+		}
+		if lit, ok := call.Args[0].(*ast.BasicLit); ok && lit.Kind == token.STRING {
+			pattern, _ := strconv.Unquote(lit.Value)
+			routes = append(routes, pattern)
+		}
+		return true
+	})
+	if len(routes) == 0 {
+		t.Fatal("found no routes in main.go")
+	}
+	return routes
+}
+
+// TestOpenAPIRoutes fails when a route served by main.go is missing from the spec.
+func TestOpenAPIRoutes(t *testing.T) {
+	doc := loadOpenAPI(t)
+	for _, pattern := range registeredRoutes(t) {
+		path := pattern
+		switch {
+		case pattern == "/":
+			continue // everything behind authentication
+		case strings.HasSuffix(pattern, "/"):
+			path = pattern + "{id}"
+		}
+		if _, ok := doc.Paths[path]; !ok {
+			t.Errorf("route %s is not in openapi.json (expected path %s)", pattern, path)
+		}
+	}
+	for sub := range routeSubresources {
+		found := false
+		for path := range doc.Paths {
+			found = found || strings.HasSuffix(path, "/{id}/"+sub)
+		}
+		if !found {
+			t.Errorf("subresource %q is not in openapi.json", sub)
+		}
+	}
+	for path := range doc.Paths {
+		if routeTemplate(path) != path {
+			t.Errorf("openapi.json path %s does not match a served route", path)
+		}
+	}
+}
+
+// TestOpenAPISchemas fails when the spec's schemas drift from the Go types.
+func TestOpenAPISchemas(t *testing.T) {
+	doc := loadOpenAPI(t)
+	for name, v := range map[string]interface{}{
+		"Item":                 Item{},
+		"CreateItemRequest":    CreateItemRequest{},
+		"UpdateItemRequest":    UpdateItemRequest{},
+		"PatchItemRequest":     PatchItemRequest{},
+		"BatchRequest":         BatchRequest{},
+		"BatchOperation":       BatchOperation{},
+		"BatchResult":          BatchResult{},
+		"BatchResponse":        BatchResponse{},
+		"ItemACL":              ItemACL{},
+		"Webhook":              Webhook{},
+		"CreateWebhookRequest": CreateWebhookRequest{},
+		"DeliveryRecord":       DeliveryRecord{},
+		"AuditEntry":           AuditEntry{},
+		"CreateKeyRequest":     CreateKeyRequest{},
+		"Tenant":               Tenant{},
+		"CreateTenantRequest":  CreateTenantRequest{},
+		"Status":               Status{},
+	} {
+		schema, ok := doc.Components.Schemas[name]
+		if !ok {
+			t.Errorf("schema %s is missing", name)
+			continue
+		}
+		var want, got []string
+		typ := reflect.TypeOf(v)
+		for i := 0; i < typ.NumField(); i++ {
+			if !typ.Field(i).IsExported() {
+				continue
+			}
+			tag, _, _ := strings.Cut(typ.Field(i).Tag.Get("json"), ",")
+			want = append(want, tag)
+		}
+		for prop := range schema.Properties {
+			got = append(got, prop)
+		}
+		sort.Strings(want)
+		sort.Strings(got)
+		if !reflect.DeepEqual(want, got) {
+			t.Errorf("schema %s has properties %v, type has %v", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// mergePatch applies the JSON merge patch (RFC 7386) patch to the document
+// target: objects are merged member by member, null removes a member and
+// any other value replaces the one in target.
+func mergePatch(target, patch json.RawMessage) (json.RawMessage, error) {
+	var doc, p interface{}
+	if len(target) > 0 {
+		if err := decodeNumbers(target, &doc); err != nil {
+			return nil, err
+		}
+	}
+	if err := decodeNumbers(patch, &p); err != nil {
+		return nil, err
+	}
+	return json.Marshal(mergeValue(doc, p))
+}
+
+func mergeValue(doc, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	d, ok := doc.(map[string]interface{})
+	if !ok {
+		d = map[string]interface{}{}
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(d, k)
+		} else {
+			d[k] = mergeValue(d[k], v)
+		}
+	}
+	return d
+}
+
+// decodeNumbers unmarshals data into v, keeping numbers as json.Number so
+// that they are written back unchanged.
+func decodeNumbers(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	return ensureSingleJSON(dec)
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestMergePatch(t *testing.T) {
+	for _, c := range []struct{ target, patch, want string }{
+		{`{"a":1,"b":{"c":2,"d":3}}`, `{"b":{"c":null,"e":4}}`, `{"a":1,"b":{"d":3,"e":4}}`},
+		{`{"a":1}`, `{"a":null}`, `{}`},
+		{`{"a":[1,2]}`, `{"a":[3]}`, `{"a":[3]}`},
+		{`{"a":1}`, `[1]`, `[1]`},
+		{`[1]`, `{"a":1}`, `{"a":1}`},
+		{`{"n":12345678901234567890}`, `{"m":0.1}`, `{"m":0.1,"n":12345678901234567890}`},
+	} {
+		got, err := mergePatch(json.RawMessage(c.target), json.RawMessage(c.patch))
+		if err != nil || string(got) != c.want {
+			t.Errorf("mergePatch(%s, %s) = %s, %v; want %s", c.target, c.patch, got, err, c.want)
+		}
+	}
+	if _, err := mergePatch(json.RawMessage(`{}`), json.RawMessage(`{"a":`)); err == nil {
+		t.Error("expected an invalid patch to fail")
+	}
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// tokenBucketScript atomically refills a caller's bucket for the time elapsed
+// since its last request and takes cost tokens if enough are left. It returns
+// whether the request is allowed and the tokens remaining afterwards.
+var tokenBucketScript = redis.NewScript(`
+local capacity = tonumber(ARGV[1])
+local rate = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local cost = tonumber(ARGV[4])
+local state = redis.call("HMGET", KEYS[1], "tokens", "ts")
+local tokens = tonumber(state[1]) or capacity
+local ts = tonumber(state[2]) or now
+if now > ts then
+  tokens = math.min(capacity, tokens + (now - ts) * rate)
+  ts = now
+end
+local allowed = 0
+if tokens >= cost then
+  tokens = tokens - cost
+  allowed = 1
+end
+redis.call("HSET", KEYS[1], "tokens", tostring(tokens), "ts", tostring(ts))
+redis.call("PEXPIRE", KEYS[1], math.ceil(capacity / rate) + 1000)
+return {allowed, tostring(tokens)}
+`)
+
+// RateLimiter limits each caller to a number of requests per minute with a
+// token bucket kept in Redis, so the limit holds across replicas. A caller may
+// spend its whole minute's allowance in a burst.
+type RateLimiter struct {
+	client redis.UniversalClient
+	logger *slog.Logger
+
+	// Default is the requests per minute of callers without a more specific limit.
+	// Zero disables rate limiting for them.
+	Default int
+	// Scopes overrides Default for callers holding a scope; callers with several
+	// get the largest of their limits, and zero means unlimited.
+	Scopes map[string]int
+	// ListCost is the number of requests a GET /items listing or a POST
+	// /batch counts as.
+	ListCost int
+	// FailOpen lets requests through unlimited when the bucket cannot be
+	// read from Redis; otherwise they fail with 503.
+	FailOpen bool
+}
+
+// NewRateLimiter creates a RateLimiter allowing 600 requests per minute and
+// failing open.
+func NewRateLimiter(client redis.UniversalClient, logger *slog.Logger) *RateLimiter {
+	return &RateLimiter{client: client, logger: logger, Default: 600, ListCost: 10, FailOpen: true}
+}
+
+// rateLimitResult is the state of a caller's bucket after a request.
+type rateLimitResult struct {
+	Allowed    bool
+	Limit      int
+	Remaining  float64
+	RetryAfter time.Duration // until the request's cost is available again
+	Reset      time.Duration // until the bucket is full
+}
+
+// limitFor returns the requests per minute allowed to p, or 0 for no limit.
+// A limit set on the caller's API key takes precedence.
+func (l *RateLimiter) limitFor(p *Principal) int {
+	if p.RateLimit > 0 {
+		return p.RateLimit
+	}
+	limit, scoped := 0, false
+	for _, scope := range p.Scopes {
+		if n, ok := l.Scopes[scope]; ok {
+			if n == 0 {
+				return 0
+			}
+			scoped = true
+			if n > limit {
+				limit = n
+			}
+		}
+	}
+	if !scoped {
+		limit = l.Default
+	}
+	return limit
+}
+
+// Take spends cost tokens from the bucket of the caller identified by id.
+func (l *RateLimiter) Take(ctx context.Context, id string, limit, cost int) (*rateLimitResult, error) {
+	if cost > limit {
+		cost = limit
+	}
+	rate := float64(limit) / float64(time.Minute.Milliseconds()) // tokens per millisecond
+	res, err := tokenBucketScript.Run(ctx, l.client, []string{tenantKey(ctx, "ratelimit:%s", id)},
+		limit, rate, time.Now().UnixMilli(), cost).Slice()
+	if err != nil {
+		return nil, err
+	}
+	if len(res) != 2 {
+		return nil, fmt.Errorf("unexpected rate limit script result %v", res)
+	}
+	allowed, _ := res[0].(int64)
+	remainingStr, _ := res[1].(string)
+	remaining, err := strconv.ParseFloat(remainingStr, 64)
+	if err != nil {
+		return nil, fmt.Errorf("unexpected rate limit script result %v", res)
+	}
+	msUntil := func(tokens float64) time.Duration {
+		if tokens <= 0 {
+			return 0
+		}
+		return time.Duration(math.Ceil(tokens/rate)) * time.Millisecond
+	}
+	return &rateLimitResult{
+		Allowed:    allowed == 1,
+		Limit:      limit,
+		Remaining:  remaining,
+		RetryAfter: msUntil(float64(cost) - remaining),
+		Reset:      msUntil(float64(limit) - remaining),
+	}, nil
+}
+
+// cost returns how many requests r counts as.
+func (l *RateLimiter) cost(r *http.Request) int {
+	if ((r.Method == http.MethodGet && r.URL.Path == "/items") || r.URL.Path == "/batch") && l.ListCost > 1 {
+		return l.ListCost
+	}
+	return 1
+}
+
+// rateLimitMiddleware applies the caller's rate limit, setting RateLimit-*
+// headers on every response and rejecting requests over the limit with 429.
+// If Redis cannot be reached, requests are let through when l.FailOpen is
+// set and fail with 503 otherwise.
+func rateLimitMiddleware(l *RateLimiter) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p := principalFrom(r.Context())
+			if p == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			limit := l.limitFor(p)
+			if limit <= 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			res, err := l.Take(r.Context(), p.ID, limit, l.cost(r))
+			if err != nil {
+				if !isOutage(err) {
+					l.logger.ErrorContext(r.Context(), "error applying rate limit", "error", err)
+				}
+				switch {
+				case l.FailOpen:
+					next.ServeHTTP(w, r)
+				case isOutage(err):
+					writeUnavailable(w, err)
+				default:
+					http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				}
+				return
+			}
+			h := w.Header()
+			h.Set("RateLimit-Policy", fmt.Sprintf("%d;w=60", res.Limit))
+			h.Set("RateLimit-Limit", strconv.Itoa(res.Limit))
+			h.Set("RateLimit-Remaining", strconv.Itoa(int(res.Remaining)))
+			h.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(res.Reset)))
+			if !res.Allowed {
+				h.Set("Retry-After", strconv.Itoa(ceilSeconds(res.RetryAfter)))
+				http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// IPLimiter limits the requests of each client IP address before they are
+// authenticated, so that floods of invalid tokens are turned away without a
+// key lookup. Its token buckets are kept in process memory: the check costs
+// no Redis command and holds while Redis is down, and each replica applies
+// the limit on its own.
+type IPLimiter struct {
+	// PerMinute is the requests per minute allowed to each address, in bursts
+	// of up to a minute's worth. Zero disables the limit.
+	PerMinute int
+	// TrustedProxies lists the load balancers and proxies whose
+	// X-Forwarded-For or Forwarded headers name the client. Without them
+	// every request is limited by its connection's address.
+	TrustedProxies []netip.Prefix
+
+	mu      sync.Mutex
+	lru     *list.List // of *ipBucket, most recently used first
+	buckets map[string]*list.Element
+}
+
+// ipBuckets is the number of addresses tracked; the least recently seen are
+// dropped beyond it.
+const ipBuckets = 10000
+
+type ipBucket struct {
+	addr   string
+	tokens float64
+	ts     time.Time
+}
+
+// NewIPLimiter creates an IPLimiter allowing perMinute requests to each address.
+func NewIPLimiter(perMinute int) *IPLimiter {
+	return &IPLimiter{PerMinute: perMinute, lru: list.New(), buckets: make(map[string]*list.Element)}
+}
+
+// Allow takes a token from the bucket of ip, and returns whether one was
+// left and otherwise how long until there is.
+func (l *IPLimiter) Allow(ip string, now time.Time) (bool, time.Duration) {
+	capacity := float64(l.PerMinute)
+	rate := capacity / float64(time.Minute) // tokens per nanosecond
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// buckets unused for a minute are full, the same as none
+	for el := l.lru.Back(); el != nil && now.Sub(el.Value.(*ipBucket).ts) >= time.Minute; el = l.lru.Back() {
+		delete(l.buckets, l.lru.Remove(el).(*ipBucket).addr)
+	}
+	var b *ipBucket
+	if el, ok := l.buckets[ip]; ok {
+		l.lru.MoveToFront(el)
+		b = el.Value.(*ipBucket)
+	} else {
+		b = &ipBucket{addr: ip, tokens: capacity, ts: now}
+		l.buckets[ip] = l.lru.PushFront(b)
+		if l.lru.Len() > ipBuckets {
+			delete(l.buckets, l.lru.Remove(l.lru.Back()).(*ipBucket).addr)
+		}
+	}
+	if now.After(b.ts) {
+		b.tokens = math.Min(capacity, b.tokens+float64(now.Sub(b.ts))*rate)
+		b.ts = now
+	}
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / rate)
+	}
+	b.tokens--
+	return true, 0
+}
+
+// clientAddr returns the address r is limited by: that of its connection,
+// unless it comes from a trusted proxy. The forwarding headers are then read
+// from the last hop back, and the first address that is not a trusted proxy
+// is the client's.
+func (l *IPLimiter) clientAddr(r *http.Request) string {
+	addr := clientIP(r)
+	if !l.trusted(addr) {
+		return addr
+	}
+	hops := forwardedFor(r.Header)
+	for i := len(hops) - 1; i >= 0; i-- {
+		if !l.trusted(hops[i]) {
+			return hops[i]
+		}
+	}
+	if len(hops) > 0 {
+		return hops[0]
+	}
+	return addr
+}
+
+// trusted reports whether addr is one of l's trusted proxies.
+func (l *IPLimiter) trusted(addr string) bool {
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return false
+	}
+	ip = ip.Unmap()
+	for _, p := range l.TrustedProxies {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedFor returns the addresses listed by the X-Forwarded-For headers of
+// a request, or else by the for parameters of its Forwarded headers, client
+// first.
+func forwardedFor(h http.Header) []string {
+	var hops []string
+	for _, v := range h.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(v, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	if len(hops) > 0 {
+		return hops
+	}
+	for _, v := range h.Values("Forwarded") {
+		for _, elem := range strings.Split(v, ",") {
+			for _, pair := range strings.Split(elem, ";") {
+				name, value, _ := strings.Cut(strings.TrimSpace(pair), "=")
+				if !strings.EqualFold(name, "for") {
+					continue
+				}
+				// quoted IPv6 addresses are bracketed and may carry a port
+				value = strings.Trim(value, `"`)
+				if host, _, err := net.SplitHostPort(value); err == nil {
+					value = host
+				}
+				hops = append(hops, strings.Trim(value, "[]"))
+			}
+		}
+	}
+	return hops
+}
+
+// parseTrustedProxies parses addresses and CIDR ranges of trusted proxies.
+func parseTrustedProxies(list []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(list))
+	for _, s := range list {
+		if ip, err := netip.ParseAddr(s); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(ip.Unmap(), ip.Unmap().BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q", s)
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes, nil
+}
+
+// ipRateLimitMiddleware rejects requests from addresses over l's limit with
+// 429 before they reach authentication.
+func ipRateLimitMiddleware(l *IPLimiter) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if l == nil || l.PerMinute <= 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if ok, wait := l.Allow(l.clientAddr(r), time.Now()); !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(max(1, ceilSeconds(wait))))
+				http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// ceilSeconds rounds d up to whole seconds.
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// parseScopeLimits parses per-scope limits written as "read=1200,admin=0".
+func parseScopeLimits(s string) (map[string]int, error) {
+	limits := make(map[string]int)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		scope, value, ok := strings.Cut(part, "=")
+		n, err := strconv.Atoi(strings.TrimSpace(value))
+		if !ok || err != nil || n < 0 || !validScope(strings.TrimSpace(scope)) {
+			return nil, fmt.Errorf("invalid scope limit %q", part)
+		}
+		limits[strings.TrimSpace(scope)] = n
+	}
+	return limits, nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// TestRateLimiting checks that a key's requests are limited with RateLimit
+// headers, that listings cost more, and that exhausted keys get 429 with Retry-After.
+func TestRateLimiting(t *testing.T) {
+	limited := newKey(t, testAPIKey, `{"name":"limited","scopes":["read"],"rateLimit":3}`).Secret
+	for i := 0; i < 3; i++ {
+		resp, _ := send(t, limited, http.MethodGet, "/items/missing", "")
+		if resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("request %d: expected 404, got %d", i+1, resp.StatusCode)
+		}
+		if got := resp.Header.Get("RateLimit-Limit"); got != "3" {
+			t.Errorf("RateLimit-Limit: expected 3, got %q", got)
+		}
+		if got := resp.Header.Get("RateLimit-Remaining"); got != strconv.Itoa(2-i) {
+			t.Errorf("request %d: RateLimit-Remaining: expected %d, got %q", i+1, 2-i, got)
+		}
+	}
+	resp, _ := send(t, limited, http.MethodGet, "/items/missing", "")
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 once the limit is spent, got %d", resp.StatusCode)
+	}
+	if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err != nil || secs < 1 || secs > 20 {
+		t.Errorf("Retry-After: expected about 20 seconds, got %q", resp.Header.Get("Retry-After"))
+	}
+
+	lister := newKey(t, testAPIKey, `{"name":"lister","scopes":["read"],"rateLimit":25}`).Secret
+	for i := 0; i < 2; i++ {
+		if status, _ := call(t, lister, http.MethodGet, "/items", ""); status != http.StatusOK {
+			t.Fatalf("list %d: expected 200, got %d", i+1, status)
+		}
+	}
+	if status, _ := call(t, lister, http.MethodGet, "/items", ""); status != http.StatusTooManyRequests {
+		t.Errorf("third list should exceed the limit, got %d", status)
+	}
+	if status, _ := call(t, lister, http.MethodGet, "/items/missing", ""); status != http.StatusNotFound {
+		t.Errorf("single-item read within the remaining allowance: expected 404, got %d", status)
+	}
+
+	resp, _ = send(t, testAPIKey, http.MethodGet, "/items/missing", "")
+	if got := resp.Header.Get("RateLimit-Limit"); got != "600" {
+		t.Errorf("bootstrap key should get the default limit, got %q", got)
+	}
+}
+
+func TestRateLimitFor(t *testing.T) {
+	scopes, err := parseScopeLimits("read=1200, admin=0")
+	if err != nil {
+		t.Fatalf("parseScopeLimits: %v", err)
+	}
+	if _, err := parseScopeLimits("root=5"); err == nil {
+		t.Error("expected error for unknown scope")
+	}
+	l := &RateLimiter{Default: 600, Scopes: scopes}
+	cases := []struct {
+		p    *Principal
+		want int
+	}{
+		{&Principal{Scopes: []string{ScopeWrite}}, 600},
+		{&Principal{Scopes: []string{ScopeRead, ScopeWrite}}, 1200},
+		{&Principal{Scopes: []string{ScopeAdmin}}, 0},
+		{&Principal{Scopes: []string{ScopeAdmin}, RateLimit: 30}, 30},
+	}
+	for _, c := range cases {
+		if got := l.limitFor(c.p); got != c.want {
+			t.Errorf("limitFor(%+v) = %d, want %d", c.p, got, c.want)
+		}
+	}
+}
+
+func TestIPLimiter(t *testing.T) {
+	l := NewIPLimiter(2)
+	now := time.Now()
+	for i, want := range []bool{true, true, false} {
+		if ok, _ := l.Allow("10.0.0.1", now); ok != want {
+			t.Errorf("request %d: expected allowed %v", i+1, want)
+		}
+	}
+	if ok, _ := l.Allow("10.0.0.2", now); !ok {
+		t.Error("expected another address to have its own bucket")
+	}
+	if ok, wait := l.Allow("10.0.0.1", now.Add(10*time.Second)); ok || wait != 20*time.Second {
+		t.Errorf("expected to wait 20s for a token, got %v, %s", ok, wait)
+	}
+	if ok, _ := l.Allow("10.0.0.1", now.Add(30*time.Second)); !ok {
+		t.Error("expected the bucket to refill")
+	}
+
+	// idle buckets are dropped, and the least recently seen beyond ipBuckets
+	if ok, _ := l.Allow("10.0.0.3", now.Add(2*time.Minute)); !ok || len(l.buckets) != 1 {
+		t.Errorf("expected only the new bucket to be left, got %d", len(l.buckets))
+	}
+	for i := 0; i <= ipBuckets; i++ {
+		l.Allow(strconv.Itoa(i), now.Add(2*time.Minute))
+	}
+	if _, ok := l.buckets["10.0.0.3"]; ok || len(l.buckets) != ipBuckets {
+		t.Errorf("expected %d buckets without the oldest, got %d", ipBuckets, len(l.buckets))
+	}
+
+	// the limit applies before authentication
+	h := ipRateLimitMiddleware(NewIPLimiter(1))(authMiddleware(NewAuthenticator(nil, nil, newTestLogger()))(http.NotFoundHandler()))
+	for _, want := range []int{http.StatusUnauthorized, http.StatusTooManyRequests} {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/items", nil)
+		req.Header.Set("Authorization", "Bearer invalid")
+		h.ServeHTTP(rec, req)
+		if rec.Code != want {
+			t.Errorf("expected %d, got %d", want, rec.Code)
+		}
+	}
+}
+
+func TestIPLimiterTrustedProxies(t *testing.T) {
+	l := NewIPLimiter(1)
+	var err error
+	if l.TrustedProxies, err = parseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseTrustedProxies([]string{"10.0.0.0/33"}); err == nil {
+		t.Error("expected an invalid range to be refused")
+	}
+	for _, c := range []struct {
+		remote string
+		header http.Header
+		want   string
+	}{
+		{"203.0.113.1:1234", http.Header{"X-Forwarded-For": {"198.51.100.1"}}, "203.0.113.1"},
+		{"10.1.2.3:1234", nil, "10.1.2.3"},
+		{"10.1.2.3:1234", http.Header{"X-Forwarded-For": {"198.51.100.1, 198.51.100.2, 192.168.1.1"}}, "198.51.100.2"},
+		{"[::ffff:192.168.1.1]:1234", http.Header{"X-Forwarded-For": {"198.51.100.1", "10.0.0.2"}}, "198.51.100.1"},
+		{"10.1.2.3:1234", http.Header{"Forwarded": {`for=198.51.100.1;proto=https, for="[2001:db8::1]:4711"`}}, "2001:db8::1"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/items", nil)
+		req.RemoteAddr = c.remote
+		for name, values := range c.header {
+			req.Header[name] = values
+		}
+		if got := l.clientAddr(req); got != c.want {
+			t.Errorf("clientAddr(%s, %v) = %s, want %s", c.remote, c.header, got, c.want)
+		}
+	}
+}
+
+// TestRateLimitFailClosed checks that requests fail with 503 while Redis is
+// unreachable when the limiter does not fail open.
+func TestRateLimitFailClosed(t *testing.T) {
+	client := redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1})
+	defer client.Close()
+	l := NewRateLimiter(client, newTestLogger())
+	h := rateLimitMiddleware(l)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for failOpen, want := range map[bool]int{true: http.StatusOK, false: http.StatusServiceUnavailable} {
+		l.FailOpen = failOpen
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/items/x", nil)
+		h.ServeHTTP(rec, req.WithContext(withPrincipal(req.Context(), &Principal{ID: "key:x", Scopes: []string{ScopeRead}})))
+		if rec.Code != want {
+			t.Errorf("fail open %v: expected %d, got %d", failOpen, want, rec.Code)
+		}
+	}
+}
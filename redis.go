@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// connectRedis opens a client for the configured Redis server, Sentinel
+// master or cluster and checks that it answers.
+func connectRedis(ctx context.Context, cfg *Config) (redis.UniversalClient, error) {
+	client, err := cfg.Redis.client()
+	if err != nil {
+		return nil, err
+	}
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("could not connect to redis (%s): %w", redisEndpoint(client), err)
+	}
+	return client, nil
+}
+
+// sentinelClient is a client for the master that Sentinel reports. It keeps
+// the master name and sentinel addresses, which go-redis does not expose, so
+// that /status can show them.
+type sentinelClient struct {
+	*redis.Client
+	masterName string
+	sentinels  []string
+}
+
+// client creates the go-redis client for c.Mode without connecting.
+func (c RedisConfig) client() (redis.UniversalClient, error) {
+	opts, err := c.options()
+	if err != nil {
+		return nil, err
+	}
+	if c.Mode == "standalone" || c.Mode == "" {
+		return redis.NewClient(opts), nil
+	}
+	u := &redis.UniversalOptions{
+		Addrs:        c.Addrs,
+		MasterName:   c.MasterName,
+		Username:     opts.Username,
+		Password:     opts.Password,
+		DB:           opts.DB,
+		TLSConfig:    opts.TLSConfig,
+		PoolSize:     opts.PoolSize,
+		MinIdleConns: opts.MinIdleConns,
+		DialTimeout:  opts.DialTimeout,
+		ReadTimeout:  opts.ReadTimeout,
+		WriteTimeout: opts.WriteTimeout,
+		MaxRetries:   opts.MaxRetries,
+	}
+	if c.Mode == "cluster" {
+		return redis.NewClusterClient(u.Cluster()), nil
+	}
+	u.SentinelUsername, u.SentinelPassword = c.SentinelUsername, c.SentinelPassword
+	if c.SentinelPasswordFile != "" {
+		if u.SentinelPassword, err = readSecretFile(c.SentinelPasswordFile); err != nil {
+			return nil, fmt.Errorf("reading redis.sentinel_password_file: %w", err)
+		}
+	}
+	return &sentinelClient{Client: redis.NewFailoverClient(u.Failover()), masterName: c.MasterName, sentinels: c.Addrs}, nil
+}
+
+// redisEndpoint describes where client connects, for logs and errors.
+func redisEndpoint(client redis.UniversalClient) string {
+	switch c := client.(type) {
+	case *redis.ClusterClient:
+		return "cluster " + strings.Join(c.Options().Addrs, ",")
+	case *sentinelClient:
+		return fmt.Sprintf("master %s via sentinels %s", c.masterName, strings.Join(c.sentinels, ","))
+	case *redis.Client:
+		return c.Options().Addr
+	}
+	return "unknown"
+}
+
+// holdLockScript extends the expiry of KEYS[1] to ARGV[2] milliseconds, and
+// releaseLockScript deletes it, but only while it still holds ARGV[1]: the
+// caller's own claim or lock token, not one taken since it expired.
+var (
+	holdLockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+  return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0
+`)
+	releaseLockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+  return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+)
+
+// scanKeys returns the keys matching pattern. On a cluster it scans every
+// master, since SCAN only covers the node it runs on.
+func scanKeys(ctx context.Context, client redis.UniversalClient, pattern string) ([]string, error) {
+	cluster, ok := client.(*redis.ClusterClient)
+	if !ok {
+		return scanNode(ctx, client, pattern)
+	}
+	var mu sync.Mutex
+	var keys []string
+	err := cluster.ForEachMaster(ctx, func(ctx context.Context, node *redis.Client) error {
+		found, err := scanNode(ctx, node, pattern)
+		mu.Lock()
+		keys = append(keys, found...)
+		mu.Unlock()
+		return err
+	})
+	return keys, err
+}
+
+func scanNode(ctx context.Context, client redis.Cmdable, pattern string) ([]string, error) {
+	var keys []string
+	iter := client.Scan(ctx, 0, pattern, 500).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	return keys, iter.Err()
+}
+
+// options translates c into go-redis options for a single server. The URL,
+// when given, supplies the address, credentials, database and TLS; the other
+// settings override it. In sentinel and cluster mode only the credentials,
+// database, TLS, pool and timeouts are used.
+// Credential and certificate files are read here, so rotated secrets are
+// picked up on restart.
+func (c RedisConfig) options() (*redis.Options, error) {
+	opts := &redis.Options{Addr: "localhost:6379"}
+	if c.URL != "" {
+		var err error
+		if opts, err = redis.ParseURL(c.URL); err != nil {
+			return nil, fmt.Errorf("invalid redis.url: %w", err)
+		}
+	} else if c.Addr != "" {
+		opts.Addr = c.Addr
+	}
+
+	if c.Username != "" {
+		opts.Username = c.Username
+	}
+	if c.UsernameFile != "" {
+		v, err := readSecretFile(c.UsernameFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading redis.username_file: %w", err)
+		}
+		opts.Username = v
+	}
+	if c.Password != "" {
+		opts.Password = c.Password
+	}
+	if c.PasswordFile != "" {
+		v, err := readSecretFile(c.PasswordFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading redis.password_file: %w", err)
+		}
+		opts.Password = v
+	}
+	if c.DB != 0 {
+		opts.DB = c.DB
+	}
+
+	if c.TLS.Enabled || c.TLS.CAFile != "" || c.TLS.CertFile != "" || opts.TLSConfig != nil {
+		tlsConfig, err := c.TLS.config(opts.TLSConfig)
+		if err != nil {
+			return nil, err
+		}
+		opts.TLSConfig = tlsConfig
+	}
+
+	opts.PoolSize = c.PoolSize
+	opts.MinIdleConns = c.MinIdleConns
+	opts.DialTimeout = time.Duration(c.DialTimeout)
+	opts.ReadTimeout = time.Duration(c.ReadTimeout)
+	opts.WriteTimeout = time.Duration(c.WriteTimeout)
+	// go-redis would retry writes too; RedisStore retries only reads
+	opts.MaxRetries = -1
+	return opts, nil
+}
+
+// config builds the TLS configuration for Redis, starting from base when a
+// rediss:// URL already created one. Without a server name each connection
+// verifies the host it dials, which is what sentinel and cluster mode need.
+func (c RedisTLSConfig) config(base *tls.Config) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if base != nil {
+		cfg = base.Clone()
+	}
+	if c.ServerName != "" {
+		cfg.ServerName = c.ServerName
+	}
+	cfg.InsecureSkipVerify = cfg.InsecureSkipVerify || c.InsecureSkipVerify
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading redis.tls.ca_file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("redis.tls.ca_file contains no PEM certificates")
+		}
+		cfg.RootCAs = pool
+	}
+	if c.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading redis.tls.cert_file and key_file: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// readSecretFile returns the contents of a credentials file without its trailing newline.
+func readSecretFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
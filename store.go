@@ -3,159 +3,414 @@ package main
 import (
 	"context"
 	"encoding/json"
-	"fmt"
+	"sort"
+	"time"
 
 	"github.com/go-redis/redis/v8"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // RedisStore provides item persistence in Redis.
 type RedisStore struct {
-	client *redis.Client
+	client redis.UniversalClient
+
+	// Cache, when set, serves GetItem from memory. SaveItem and DeleteItem
+	// invalidate it on every replica.
+	Cache *ItemCache
+	// StaleReads lets GetItem fall back to an expired cache entry while
+	// Redis is unavailable.
+	StaleReads bool
+	// Retries is how many times reads are retried while Redis is unreachable,
+	// after a random wait of up to RetryBackoff that doubles each time. Writes
+	// are not retried: they read the item first, so a partly applied write
+	// could not be replayed safely.
+	Retries      int
+	RetryBackoff time.Duration
+	// Codec, when set, compresses large items. Compressed items are read
+	// whether it is set or not.
+	Codec *ItemCodec
+	// Modes, when set, stops reads from encrypting items again, and
+	// RewriteItems from running, unless the service is in normal mode.
+	Modes *ModeStore
 }
 
-// NewRedisStore creates a new RedisStore.
-func NewRedisStore(client *redis.Client) *RedisStore {
-	return &RedisStore{client: client}
+// NewRedisStore creates a new RedisStore retrying reads twice.
+func NewRedisStore(client redis.UniversalClient) *RedisStore {
+	return &RedisStore{client: client, Retries: 2, RetryBackoff: 50 * time.Millisecond}
 }
 
 // SaveItem stores a new or updated item in Redis.
-func (s *RedisStore) SaveItem(ctx context.Context, item *Item) error {
-	key := fmt.Sprintf("item:%s", item.ID)
+func (s *RedisStore) SaveItem(ctx context.Context, item *Item) (err error) {
+	ctx, span := tracer.Start(ctx, "RedisStore.SaveItem", trace.WithAttributes(
+		attribute.String("item.id", item.ID), attribute.String("item.type", item.Type)))
+	defer func() { endSpan(span, err) }()
+
+	key := tenantKey(ctx, "item:%s", item.ID)
 
 	// For updates, we need to clean up old indexes first
-	oldItem, err := s.GetItem(ctx, item.ID)
+	oldItem, _, err := s.readItem(ctx, key)
 	if err != nil && err != ErrNotFound {
 		return err
 	}
 
-	data, err := json.Marshal(item)
+	value, err := s.Codec.encode(ctx, item)
 	if err != nil {
 		return err
 	}
 
 	pipe := s.client.Pipeline()
-	pipe.Set(ctx, key, data, 0)
-	pipe.SAdd(ctx, "items", item.ID)
+	queueSave(ctx, pipe, key, value, oldItem, item)
+	return s.execWrite(ctx, pipe, key)
+}
+
+// SaveItemIf replaces the stored item with item only if the stored one was
+// last modified at version. It fails with ErrPreconditionFailed if the item
+// has changed since, and with ErrNotFound if it is gone.
+func (s *RedisStore) SaveItemIf(ctx context.Context, item *Item, version time.Time) (err error) {
+	ctx, span := tracer.Start(ctx, "RedisStore.SaveItemIf", trace.WithAttributes(
+		attribute.String("item.id", item.ID), attribute.String("item.type", item.Type)))
+	defer func() { endSpan(span, err) }()
+
+	value, err := s.Codec.encode(ctx, item)
+	if err != nil {
+		return err
+	}
+	return s.writeIf(ctx, item.ID, version, func(pipe redis.Pipeliner, key string, old *Item) {
+		queueSave(ctx, pipe, key, value, old, item)
+	})
+}
+
+// queueSave queues the commands storing value as item at key and moving it
+// from the indexes of old, if it existed, to its own.
+func queueSave(ctx context.Context, pipe redis.Pipeliner, key string, value []byte, old, item *Item) {
+	pipe.Set(ctx, key, value, 0)
+	pipe.SAdd(ctx, tenantKey(ctx, "items"), item.ID)
 
 	// Clean up old indexes if this is an update
-	if oldItem != nil {
+	if old != nil {
 		// Remove from old type index if type changed
-		if oldItem.Type != item.Type {
-			pipe.SRem(ctx, fmt.Sprintf("items:type:%s", oldItem.Type), item.ID)
+		if old.Type != item.Type {
+			pipe.SRem(ctx, tenantKey(ctx, "items:type:%s", old.Type), item.ID)
 		}
 		// Remove from old tag indexes
-		for _, oldTag := range oldItem.Tags {
-			pipe.SRem(ctx, fmt.Sprintf("items:tag:%s", oldTag), item.ID)
+		for _, oldTag := range old.Tags {
+			pipe.SRem(ctx, tenantKey(ctx, "items:tag:%s", oldTag), item.ID)
 		}
 	}
 
 	// Add to new indexes
-	pipe.SAdd(ctx, fmt.Sprintf("items:type:%s", item.Type), item.ID)
+	pipe.SAdd(ctx, tenantKey(ctx, "items:type:%s", item.Type), item.ID)
 	for _, tag := range item.Tags {
-		pipe.SAdd(ctx, fmt.Sprintf("items:tag:%s", tag), item.ID)
+		pipe.SAdd(ctx, tenantKey(ctx, "items:tag:%s", tag), item.ID)
 	}
+}
 
-	_, err = pipe.Exec(ctx)
+// writeIf runs the write queued by queue in a transaction that only commits
+// if the item with id is still at version. The stored item is watched while
+// it is read, so a concurrent write in between fails the transaction.
+func (s *RedisStore) writeIf(ctx context.Context, id string, version time.Time, queue func(pipe redis.Pipeliner, key string, old *Item)) error {
+	key := tenantKey(ctx, "item:%s", id)
+	err := s.client.Watch(ctx, func(tx *redis.Tx) error {
+		value, err := tx.Get(ctx, key).Bytes()
+		if err == redis.Nil {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		data, err := s.Codec.decode(ctx, value)
+		if err != nil {
+			return err
+		}
+		old, err := decodeItem(data)
+		if err != nil {
+			return err
+		}
+		if !old.LastModified.Equal(version) {
+			return ErrPreconditionFailed
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			queue(pipe, key, old)
+			s.Cache.publish(ctx, pipe, key)
+			return nil
+		})
+		return err
+	}, key)
+	if err == redis.TxFailedErr {
+		err = ErrPreconditionFailed
+	}
+	// the version compared against may have come from a stale cache entry
+	s.Cache.invalidate(key)
+	return err
+}
+
+// execWrite runs the pipeline of a write to the item at key and evicts the
+// item from the cache of every replica.
+func (s *RedisStore) execWrite(ctx context.Context, pipe redis.Pipeliner, key string) error {
+	s.Cache.publish(ctx, pipe, key)
+	_, err := pipe.Exec(ctx)
+	s.Cache.invalidate(key)
 	return err
 }
 
 // GetItem retrieves an item by ID.
-func (s *RedisStore) GetItem(ctx context.Context, id string) (*Item, error) {
-	key := fmt.Sprintf("item:%s", id)
-	data, err := s.client.Get(ctx, key).Result()
+func (s *RedisStore) GetItem(ctx context.Context, id string) (_ *Item, err error) {
+	ctx, span := tracer.Start(ctx, "RedisStore.GetItem", trace.WithAttributes(attribute.String("item.id", id)))
+	defer func() { endSpan(span, err) }()
+
+	key := tenantKey(ctx, "item:%s", id)
+	if data, ok := s.Cache.get(key); ok {
+		span.SetAttributes(attribute.String("cache", "hit"))
+		return decodeItem(data)
+	}
+	token := s.Cache.startFill(key)
+	var item *Item
+	var data []byte
+	err = retryRedis(ctx, s.Retries, s.RetryBackoff, func() (err error) {
+		item, data, err = s.readItem(ctx, key)
+		return err
+	})
+	s.Cache.put(key, data, token)
 	if err != nil {
-		if err == redis.Nil {
-			return nil, ErrNotFound
+		if s.StaleReads && isOutage(err) {
+			if data, ok := s.Cache.getStale(key); ok {
+				span.SetAttributes(attribute.String("cache", "stale"))
+				if item, err = decodeItem(data); err == nil {
+					item.stale = true
+				}
+				return item, err
+			}
 		}
 		return nil, err
 	}
+	span.SetAttributes(attribute.String("item.type", item.Type))
+	return item, nil
+}
+
+func decodeItem(data []byte) (*Item, error) {
 	var item Item
-	if err := json.Unmarshal([]byte(data), &item); err != nil {
+	if err := json.Unmarshal(data, &item); err != nil {
 		return nil, err
 	}
 	return &item, nil
 }
 
+// readItem reads and decodes the item at key, bypassing the cache. It also
+// returns the item JSON, decompressed and decrypted. An item encrypted with
+// a key other than the primary one is encrypted again on the way.
+func (s *RedisStore) readItem(ctx context.Context, key string) (*Item, []byte, error) {
+	value, err := s.client.Get(ctx, key).Bytes()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, nil, ErrNotFound
+		}
+		return nil, nil, err
+	}
+	data, info, err := s.Codec.decodeValue(ctx, value)
+	if err != nil {
+		return nil, nil, err
+	}
+	item, err := decodeItem(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	if s.Codec.rekey(info) && s.Modes.Current().Mode == ModeNormal {
+		// best effort: the next read tries again, and RewriteItems catches the rest
+		if ok, _ := s.replaceValue(ctx, key, value, item); ok {
+			s.Codec.rekeyed.Add(1)
+		}
+	}
+	return item, data, nil
+}
+
 // DeleteItem removes an item by ID.
-func (s *RedisStore) DeleteItem(ctx context.Context, id string) error {
+func (s *RedisStore) DeleteItem(ctx context.Context, id string) (err error) {
+	ctx, span := tracer.Start(ctx, "RedisStore.DeleteItem", trace.WithAttributes(attribute.String("item.id", id)))
+	defer func() { endSpan(span, err) }()
+
 	// First get the item to know its type and tags for cleanup
-	item, err := s.GetItem(ctx, id)
+	key := tenantKey(ctx, "item:%s", id)
+	item, _, err := s.readItem(ctx, key)
 	if err != nil {
 		return err // This will return ErrNotFound if item doesn't exist
 	}
+	span.SetAttributes(attribute.String("item.type", item.Type))
 
-	key := fmt.Sprintf("item:%s", id)
 	pipe := s.client.Pipeline()
+	queueDelete(ctx, pipe, key, item)
+	return s.execWrite(ctx, pipe, key)
+}
+
+// DeleteItemIf removes the item with id only if it was last modified at
+// version, failing like SaveItemIf otherwise.
+func (s *RedisStore) DeleteItemIf(ctx context.Context, id string, version time.Time) (err error) {
+	ctx, span := tracer.Start(ctx, "RedisStore.DeleteItemIf", trace.WithAttributes(attribute.String("item.id", id)))
+	defer func() { endSpan(span, err) }()
+
+	return s.writeIf(ctx, id, version, func(pipe redis.Pipeliner, key string, old *Item) {
+		queueDelete(ctx, pipe, key, old)
+	})
+}
+
+// queueDelete queues the commands removing item at key and its index entries.
+func queueDelete(ctx context.Context, pipe redis.Pipeliner, key string, item *Item) {
 	pipe.Del(ctx, key)
-	pipe.SRem(ctx, "items", id)
-	pipe.SRem(ctx, fmt.Sprintf("items:type:%s", item.Type), id)
+	pipe.SRem(ctx, tenantKey(ctx, "items"), item.ID)
+	pipe.SRem(ctx, tenantKey(ctx, "items:type:%s", item.Type), item.ID)
 
 	// Remove from all tag indexes
 	for _, tag := range item.Tags {
-		pipe.SRem(ctx, fmt.Sprintf("items:tag:%s", tag), id)
+		pipe.SRem(ctx, tenantKey(ctx, "items:tag:%s", tag), item.ID)
 	}
-
-	_, err = pipe.Exec(ctx)
-	return err
 }
 
 // ListItems returns all items in the store, optionally filtered by type and/or tags.
 func (s *RedisStore) ListItems(ctx context.Context, typeFilter string, tagFilters []string) ([]*Item, error) {
+	items, _, err := s.ListPage(ctx, typeFilter, tagFilters, "", 0)
+	return items, err
+}
+
+// ListPage returns items filtered like ListItems in order of their IDs: up
+// to limit of them, all if limit is 0, whose IDs sort after the cursor after.
+// next is the cursor of the following page, or "" if this one is the last.
+func (s *RedisStore) ListPage(ctx context.Context, typeFilter string, tagFilters []string, after string, limit int) (_ []*Item, next string, err error) {
+	ctx, span := tracer.Start(ctx, "RedisStore.ListItems", trace.WithAttributes(
+		attribute.String("item.type", typeFilter), attribute.StringSlice("item.tags", tagFilters)))
+	defer func() { endSpan(span, err) }()
+
 	var setKeys []string
 
 	// Build list of sets to intersect
 	if typeFilter != "" {
-		setKeys = append(setKeys, fmt.Sprintf("items:type:%s", typeFilter))
+		setKeys = append(setKeys, tenantKey(ctx, "items:type:%s", typeFilter))
 	}
 
 	for _, tag := range tagFilters {
-		setKeys = append(setKeys, fmt.Sprintf("items:tag:%s", tag))
+		setKeys = append(setKeys, tenantKey(ctx, "items:tag:%s", tag))
 	}
 
 	var ids []string
-	var err error
-
-	if len(setKeys) == 0 {
-		// No filters, return all items
-		ids, err = s.client.SMembers(ctx, "items").Result()
-	} else if len(setKeys) == 1 {
-		// Single filter
-		ids, err = s.client.SMembers(ctx, setKeys[0]).Result()
-	} else {
-		// Multiple filters - use intersection
-		ids, err = s.client.SInter(ctx, setKeys...).Result()
-	}
-
+	err = retryRedis(ctx, s.Retries, s.RetryBackoff, func() (err error) {
+		if len(setKeys) == 0 {
+			// No filters, return all items
+			ids, err = s.client.SMembers(ctx, tenantKey(ctx, "items")).Result()
+		} else if len(setKeys) == 1 {
+			// Single filter
+			ids, err = s.client.SMembers(ctx, setKeys[0]).Result()
+		} else {
+			// Multiple filters - use intersection
+			ids, err = s.client.SInter(ctx, setKeys...).Result()
+		}
+		return err
+	})
 	if err != nil {
-		return nil, err
+		return nil, "", err
+	}
+	sort.Strings(ids)
+	if after != "" {
+		ids = ids[sort.SearchStrings(ids, after+"\x00"):]
+	}
+	if limit > 0 && len(ids) > limit {
+		ids = ids[:limit]
+		next = ids[limit-1]
 	}
 	if len(ids) == 0 {
-		return []*Item{}, nil
+		return []*Item{}, "", nil
 	}
 
-	pipe := s.client.Pipeline()
 	cmds := make([]*redis.StringCmd, len(ids))
-	for i, id := range ids {
-		key := fmt.Sprintf("item:%s", id)
-		cmds[i] = pipe.Get(ctx, key)
-	}
-	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
-		return nil, err
+	err = retryRedis(ctx, s.Retries, s.RetryBackoff, func() error {
+		pipe := s.client.Pipeline()
+		for i, id := range ids {
+			key := tenantKey(ctx, "item:%s", id)
+			cmds[i] = pipe.Get(ctx, key)
+		}
+		if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
 	}
 	items := make([]*Item, 0, len(ids))
 	for _, cmd := range cmds {
-		data, err := cmd.Result()
+		value, err := cmd.Bytes()
 		if err != nil {
 			if err == redis.Nil {
 				continue
 			}
-			return nil, err
+			return nil, "", err
+		}
+		data, err := s.Codec.decode(ctx, value)
+		if err != nil {
+			return nil, "", err
+		}
+		item, err := decodeItem(data)
+		if err != nil {
+			return nil, "", err
+		}
+		items = append(items, item)
+	}
+	span.SetAttributes(attribute.Int("item.count", len(items)))
+	return items, next, nil
+}
+
+// Reindex rebuilds the items set and the type and tag indexes of the tenant
+// in ctx from the stored items and returns the number of items indexed.
+// Items written while it runs may be missing from the new indexes, so it is
+// meant for maintenance windows.
+func (s *RedisStore) Reindex(ctx context.Context) (_ int, err error) {
+	ctx, span := tracer.Start(ctx, "RedisStore.Reindex")
+	defer func() { endSpan(span, err) }()
+
+	stale := []string{tenantKey(ctx, "items")}
+	for _, pattern := range []string{"items:type:*", "items:tag:*"} {
+		keys, err := scanKeys(ctx, s.client, tenantKey(ctx, pattern))
+		if err != nil {
+			return 0, err
 		}
-		var item Item
-		if err := json.Unmarshal([]byte(data), &item); err != nil {
-			return nil, err
+		stale = append(stale, keys...)
+	}
+	itemKeys, err := scanKeys(ctx, s.client, tenantKey(ctx, "item:*"))
+	if err != nil {
+		return 0, err
+	}
+
+	pipe := s.client.TxPipeline()
+	pipe.Del(ctx, stale...)
+	count := 0
+	for start := 0; start < len(itemKeys); start += 500 {
+		batch := itemKeys[start:min(start+500, len(itemKeys))]
+		values, err := s.client.MGet(ctx, batch...).Result()
+		if err != nil {
+			return 0, err
 		}
-		items = append(items, &item)
+		for _, v := range values {
+			value, ok := v.(string)
+			if !ok {
+				continue // deleted since the scan
+			}
+			data, err := s.Codec.decode(ctx, []byte(value))
+			if err != nil {
+				return 0, err
+			}
+			item, err := decodeItem(data)
+			if err != nil {
+				return 0, err
+			}
+			pipe.SAdd(ctx, tenantKey(ctx, "items"), item.ID)
+			pipe.SAdd(ctx, tenantKey(ctx, "items:type:%s", item.Type), item.ID)
+			for _, tag := range item.Tags {
+				pipe.SAdd(ctx, tenantKey(ctx, "items:tag:%s", tag), item.ID)
+			}
+			count++
+		}
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, err
 	}
-	return items, nil
+	span.SetAttributes(attribute.Int("item.count", count))
+	return count, nil
 }
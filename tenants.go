@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// tenantIDPattern restricts tenant IDs to values that are safe inside Redis keys.
+var tenantIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+// Tenant is an isolated namespace of items, webhooks and audit entries.
+// The default tenant has the empty ID and always exists.
+type Tenant struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// CreateTenantRequest is the payload for creating a tenant.
+type CreateTenantRequest struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// withTenant returns a copy of ctx scoped to tenant.
+func withTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantIDKey, tenant)
+}
+
+// tenantFrom returns the tenant ctx is scoped to; "" is the default tenant.
+func tenantFrom(ctx context.Context) string {
+	t, _ := ctx.Value(tenantIDKey).(string)
+	return t
+}
+
+// tenantPrefix is the prefix of every key of tenant. The tenant ID is a
+// Redis Cluster hash tag, so all of a tenant's keys live in one slot and
+// multi-key commands such as SINTER work on them in cluster mode.
+func tenantPrefix(tenant string) string {
+	if tenant == "" {
+		return "{default}:"
+	}
+	return "t:{" + tenant + "}:"
+}
+
+// splitTenantKey returns the tenant a key formatted by tenantKey belongs to
+// and the key within the tenant.
+func splitTenantKey(key string) (tenant, rest string, ok bool) {
+	if rest, ok := strings.CutPrefix(key, tenantPrefix("")); ok {
+		return "", rest, true
+	}
+	if s, ok := strings.CutPrefix(key, "t:{"); ok {
+		return strings.Cut(s, "}:")
+	}
+	return "", "", false
+}
+
+// tenantKey formats a Redis key within the tenant of ctx.
+func tenantKey(ctx context.Context, format string, args ...interface{}) string {
+	return tenantPrefix(tenantFrom(ctx)) + fmt.Sprintf(format, args...)
+}
+
+// TenantStore persists the tenant registry in Redis.
+type TenantStore struct {
+	client redis.UniversalClient
+}
+
+// NewTenantStore creates a new TenantStore.
+func NewTenantStore(client redis.UniversalClient) *TenantStore {
+	return &TenantStore{client: client}
+}
+
+// CreateTenant registers a tenant, failing with ErrInvalidInput if the ID is taken.
+func (s *TenantStore) CreateTenant(ctx context.Context, t *Tenant) error {
+	data, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	ok, err := s.client.SetNX(ctx, fmt.Sprintf("tenant:%s", t.ID), data, 0).Result()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return &inputError{fmt.Sprintf("tenant %q already exists", t.ID)}
+	}
+	return s.client.SAdd(ctx, "tenants", t.ID).Err()
+}
+
+// GetTenant retrieves a tenant by ID.
+func (s *TenantStore) GetTenant(ctx context.Context, id string) (*Tenant, error) {
+	data, err := s.client.Get(ctx, fmt.Sprintf("tenant:%s", id)).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	var t Tenant
+	if err := json.Unmarshal([]byte(data), &t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// Exists reports whether id names a registered tenant or the default tenant.
+func (s *TenantStore) Exists(ctx context.Context, id string) (bool, error) {
+	if id == "" {
+		return true, nil
+	}
+	return s.client.SIsMember(ctx, "tenants", id).Result()
+}
+
+// ListTenants returns all registered tenants.
+func (s *TenantStore) ListTenants(ctx context.Context) ([]*Tenant, error) {
+	ids, err := s.client.SMembers(ctx, "tenants").Result()
+	if err != nil {
+		return nil, err
+	}
+	tenants := make([]*Tenant, 0, len(ids))
+	for _, id := range ids {
+		t, err := s.GetTenant(ctx, id)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		tenants = append(tenants, t)
+	}
+	return tenants, nil
+}
+
+// DeleteTenant unregisters a tenant and deletes every key in its namespace.
+func (s *TenantStore) DeleteTenant(ctx context.Context, id string) error {
+	removed, err := s.client.SRem(ctx, "tenants", id).Result()
+	if err != nil {
+		return err
+	}
+	if removed == 0 {
+		return ErrNotFound
+	}
+	if err := s.client.Del(ctx, fmt.Sprintf("tenant:%s", id)).Err(); err != nil {
+		return err
+	}
+	keys, err := scanKeys(ctx, s.client, tenantPrefix(id)+"*")
+	if err != nil {
+		return err
+	}
+	for start := 0; start < len(keys); start += 500 {
+		if err := s.client.Del(ctx, keys[start:min(start+500, len(keys))]...).Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TenantHandler serves the endpoints for managing tenants.
+type TenantHandler struct {
+	store  *TenantStore
+	keys   *KeyStore
+	auth   *Authenticator
+	logger *slog.Logger
+}
+
+// NewTenantHandler creates a TenantHandler; deleting a tenant revokes its API keys.
+func NewTenantHandler(store *TenantStore, keys *KeyStore, auth *Authenticator, logger *slog.Logger) *TenantHandler {
+	return &TenantHandler{store: store, keys: keys, auth: auth, logger: logger}
+}
+
+// tenantsHandler routes requests without ID: GET for list, POST for create.
+func (h *TenantHandler) tenantsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		h.handleListTenants(w, r)
+	case http.MethodPost:
+		h.handleCreateTenant(w, r)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// tenantHandler routes requests with ID: GET, DELETE.
+func (h *TenantHandler) tenantHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/tenants/")
+	if id == "" {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		h.handleGetTenant(w, r, id)
+	case http.MethodDelete:
+		h.handleDeleteTenant(w, r, id)
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// handleCreateTenant processes POST /tenants.
+func (h *TenantHandler) handleCreateTenant(w http.ResponseWriter, r *http.Request) {
+	var req CreateTenantRequest
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request payload: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := ensureSingleJSON(dec); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !tenantIDPattern.MatchString(req.ID) {
+		http.Error(w, "id must be 1-63 lowercase letters, digits or dashes", http.StatusBadRequest)
+		return
+	}
+
+	t := &Tenant{ID: req.ID, Name: req.Name, CreatedAt: time.Now().UTC()}
+	if err := h.store.CreateTenant(r.Context(), t); err != nil {
+		writeError(w, r, h.logger, err, "error creating tenant")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", fmt.Sprintf("/tenants/%s", t.ID))
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(t)
+}
+
+// handleGetTenant processes GET /tenants/{id}.
+func (h *TenantHandler) handleGetTenant(w http.ResponseWriter, r *http.Request, id string) {
+	t, err := h.store.GetTenant(r.Context(), id)
+	if err != nil {
+		writeError(w, r, h.logger, err, "error getting tenant")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t)
+}
+
+// handleListTenants processes GET /tenants.
+func (h *TenantHandler) handleListTenants(w http.ResponseWriter, r *http.Request) {
+	tenants, err := h.store.ListTenants(r.Context())
+	if err != nil {
+		writeError(w, r, h.logger, err, "error listing tenants")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tenants)
+}
+
+// handleDeleteTenant processes DELETE /tenants/{id}. The tenant's keys are
+// revoked, and dropped from every replica's cache, before its data is
+// deleted, so that no caller of the tenant can write while it goes.
+func (h *TenantHandler) handleDeleteTenant(w http.ResponseWriter, r *http.Request, id string) {
+	if _, err := h.store.GetTenant(r.Context(), id); err != nil {
+		writeError(w, r, h.logger, err, "error getting tenant")
+		return
+	}
+	keys, err := h.keys.ListKeys(r.Context())
+	if err != nil {
+		writeError(w, r, h.logger, err, "error listing keys of tenant")
+		return
+	}
+	for _, key := range keys {
+		if key.Tenant != id || key.RevokedAt != nil {
+			continue
+		}
+		if err := h.keys.RevokeKey(r.Context(), key.ID); err != nil {
+			writeError(w, r, h.logger, err, "error revoking key of tenant")
+			return
+		}
+		h.auth.Invalidate(key.ID)
+	}
+	if err := h.store.DeleteTenant(r.Context(), id); err != nil {
+		writeError(w, r, h.logger, err, "error deleting tenant")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
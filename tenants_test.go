@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+// TestTenantIsolation creates two tenants and checks that their items, keys and
+// listings are isolated, and that deleting a tenant removes its data and keys.
+func TestTenantIsolation(t *testing.T) {
+	for _, id := range []string{"acme", "globex"} {
+		if status, b := call(t, testAPIKey, http.MethodPost, "/tenants", `{"id":"`+id+`","name":"`+id+`"}`); status != http.StatusCreated {
+			t.Fatalf("POST /tenants %s: status %d %s", id, status, b)
+		}
+	}
+	defer call(t, testAPIKey, http.MethodDelete, "/tenants/globex", "")
+	if status, _ := call(t, testAPIKey, http.MethodPost, "/tenants", `{"id":"acme"}`); status != http.StatusBadRequest {
+		t.Errorf("duplicate tenant: expected 400, got %d", status)
+	}
+	if status, _ := call(t, testAPIKey, http.MethodPost, "/keys", `{"name":"x","tenant":"nope","scopes":["read"]}`); status != http.StatusBadRequest {
+		t.Errorf("key for unknown tenant: expected 400, got %d", status)
+	}
+
+	acmeAdmin := newKey(t, testAPIKey, `{"name":"acme-admin","tenant":"acme","scopes":["admin"]}`).Secret
+	globexAdmin := newKey(t, testAPIKey, `{"name":"globex-admin","tenant":"globex","scopes":["admin"]}`).Secret
+	acmeReader := newKey(t, acmeAdmin, `{"name":"acme-reader","scopes":["read"]}`).Secret
+
+	if status, _ := call(t, acmeAdmin, http.MethodGet, "/tenants", ""); status != http.StatusForbidden {
+		t.Errorf("tenant admin listing tenants: expected 403, got %d", status)
+	}
+	if status, _ := call(t, acmeAdmin, http.MethodGet, "/metrics", ""); status != http.StatusForbidden {
+		t.Errorf("tenant admin scraping every tenant's metrics: expected 403, got %d", status)
+	}
+	if status, _ := call(t, acmeAdmin, http.MethodGet, "/status", ""); status != http.StatusForbidden {
+		t.Errorf("tenant admin reading the Redis details: expected 403, got %d", status)
+	}
+	if status, _ := call(t, acmeAdmin, http.MethodPost, "/keys", `{"name":"x","tenant":"globex","scopes":["read"]}`); status != http.StatusForbidden {
+		t.Errorf("tenant admin creating key elsewhere: expected 403, got %d", status)
+	}
+	_, b := call(t, acmeAdmin, http.MethodGet, "/keys", "")
+	var keys []APIKey
+	json.Unmarshal(b, &keys)
+	if len(keys) != 2 {
+		t.Errorf("acme admin should see its 2 keys, got %d", len(keys))
+	}
+
+	_, b = call(t, acmeAdmin, http.MethodPost, "/items", `{"type":"shared","data":{"owner":"acme"}}`)
+	var acmeItem Item
+	json.Unmarshal(b, &acmeItem)
+	call(t, globexAdmin, http.MethodPost, "/items", `{"type":"shared","data":{"owner":"globex"}}`)
+
+	_, b = call(t, acmeReader, http.MethodGet, "/items?type=shared", "")
+	var listed []Item
+	json.Unmarshal(b, &listed)
+	if len(listed) != 1 || listed[0].ID != acmeItem.ID {
+		t.Errorf("acme should list only its item, got %+v", listed)
+	}
+	if status, _ := call(t, globexAdmin, http.MethodGet, "/items/"+acmeItem.ID, ""); status != http.StatusNotFound {
+		t.Errorf("cross-tenant read: expected 404, got %d", status)
+	}
+	if status, _ := call(t, globexAdmin, http.MethodDelete, "/items/"+acmeItem.ID, ""); status != http.StatusNotFound {
+		t.Errorf("cross-tenant delete: expected 404, got %d", status)
+	}
+	if status, b := call(t, testAPIKey, http.MethodGet, "/items?type=shared", ""); status != http.StatusOK || string(bytes.TrimSpace(b)) != "[]" {
+		t.Errorf("default tenant should not see tenant items, got %d %s", status, b)
+	}
+
+	_, b = call(t, acmeAdmin, http.MethodGet, "/audit?itemId="+acmeItem.ID, "")
+	var entries []AuditEntry
+	json.Unmarshal(b, &entries)
+	if len(entries) != 1 {
+		t.Errorf("acme audit: expected 1 entry, got %d", len(entries))
+	}
+	_, b = call(t, globexAdmin, http.MethodGet, "/audit?itemId="+acmeItem.ID, "")
+	entries = nil
+	json.Unmarshal(b, &entries)
+	if len(entries) != 0 {
+		t.Errorf("globex should not see acme audit entries, got %d", len(entries))
+	}
+
+	if status, _ := call(t, testAPIKey, http.MethodDelete, "/tenants/acme", ""); status != http.StatusNoContent {
+		t.Fatalf("DELETE /tenants/acme: status %d", status)
+	}
+	if status, _ := call(t, acmeReader, http.MethodGet, "/items", ""); status != http.StatusUnauthorized {
+		t.Errorf("key of deleted tenant: expected 401, got %d", status)
+	}
+	if n, err := redisClient.Keys(testCtx, tenantPrefix("acme")+"*").Result(); err != nil || len(n) != 0 {
+		t.Errorf("expected acme keys to be removed, got %v (%v)", n, err)
+	}
+}
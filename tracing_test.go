@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// TestTracing checks that requests continue an incoming traceparent and that
+// store operations and Redis commands are recorded as child spans.
+func TestTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	client := &http.Client{Transport: &authTransport{token: testAPIKey, base: http.DefaultTransport}}
+	resp, err := client.Post(testServerURL+"/items", "application/json", bytes.NewReader([]byte(`{"type":"traced","data":{}}`)))
+	if err != nil {
+		t.Fatalf("POST /items: %v", err)
+	}
+	var item Item
+	json.NewDecoder(resp.Body).Decode(&item)
+	resp.Body.Close()
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req, _ := http.NewRequest(http.MethodGet, testServerURL+"/items/"+item.ID, nil)
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatalf("GET /items/%s: %v", item.ID, err)
+	}
+	resp.Body.Close()
+	req, _ = http.NewRequest(http.MethodDelete, testServerURL+"/items/"+item.ID, nil)
+	if resp, err := client.Do(req); err == nil {
+		resp.Body.Close()
+	}
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, s := range recorder.Ended() {
+		if s.SpanContext().TraceID().String() == traceID {
+			spans[s.Name()] = s
+		}
+	}
+	server, ok := spans["GET /items/{id}"]
+	if !ok {
+		t.Fatalf("no server span in the incoming trace; got %v", spans)
+	}
+	if server.Parent().SpanID().String() != "00f067aa0ba902b7" {
+		t.Errorf("server span parent = %s, want the traceparent span", server.Parent().SpanID())
+	}
+	get, ok := spans["RedisStore.GetItem"]
+	if !ok {
+		t.Fatalf("no RedisStore.GetItem span in the incoming trace")
+	}
+	if get.Parent().SpanID() != server.SpanContext().SpanID() {
+		t.Error("RedisStore.GetItem should be a child of the server span")
+	}
+	attrs := map[string]string{}
+	for _, kv := range get.Attributes() {
+		attrs[string(kv.Key)] = kv.Value.Emit()
+	}
+	if attrs["item.id"] != item.ID || attrs["item.type"] != "traced" {
+		t.Errorf("unexpected GetItem attributes %v", attrs)
+	}
+	if cmd, ok := spans["redis get"]; !ok || cmd.Parent().SpanID() != get.SpanContext().SpanID() {
+		t.Error("expected a redis get span under RedisStore.GetItem")
+	}
+}
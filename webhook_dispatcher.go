@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+)
+
+// Redis keys shared by every replica's dispatcher. Each worker moves the
+// deliveries it takes from the queue to a list of its own until they are
+// sent, so the processing lists share the queue's cluster slot.
+const (
+	webhookQueueKey      = "webhooks:queue"                 // list of deliveries ready to send
+	webhookRetryKey      = "webhooks:retry"                 // sorted set of deliveries scored by next attempt time
+	webhookProcessingKey = "{webhooks:queue}:processing:%s" // list of the deliveries a worker is sending
+	webhookWorkersKey    = "webhooks:workers"               // sorted set of worker IDs scored by last heartbeat
+)
+
+// webhookDelivery is a queued notification of one event to one webhook.
+type webhookDelivery struct {
+	ID        string      `json:"id"`
+	Tenant    string      `json:"tenant,omitempty"`
+	WebhookID string      `json:"webhookId"`
+	Event     ChangeEvent `json:"event"`
+	Attempt   int         `json:"attempt"`
+	LastError string      `json:"lastError,omitempty"`
+}
+
+// webhookPayload is the JSON body POSTed to webhook endpoints.
+type webhookPayload struct {
+	DeliveryID string `json:"deliveryId"`
+	WebhookID  string `json:"webhookId"`
+	ChangeEvent
+}
+
+// WebhookDispatcher queues a delivery for every webhook interested in a change
+// and sends them from background workers, retrying failures with exponential
+// backoff until MaxAttempts is reached and the delivery is dead-lettered.
+type WebhookDispatcher struct {
+	store  *WebhookStore
+	client redis.UniversalClient
+	http   *http.Client
+	logger *slog.Logger
+
+	MaxAttempts  int
+	BaseBackoff  time.Duration
+	MaxBackoff   time.Duration
+	PollInterval time.Duration
+	// StaleAfter is how long a worker may go without a heartbeat before the
+	// deliveries it was sending are queued again, e.g. after a crash. It must
+	// exceed the longest delivery attempt.
+	StaleAfter time.Duration
+	// AllowPrivateNetworks lets deliveries connect to loopback, link-local and
+	// private addresses; see WebhookHandler.
+	AllowPrivateNetworks bool
+}
+
+// NewWebhookDispatcher creates a WebhookDispatcher with default retry settings.
+func NewWebhookDispatcher(store *WebhookStore, client redis.UniversalClient, logger *slog.Logger) *WebhookDispatcher {
+	d := &WebhookDispatcher{
+		store:        store,
+		client:       client,
+		logger:       logger,
+		MaxAttempts:  8,
+		BaseBackoff:  time.Second,
+		MaxBackoff:   10 * time.Minute,
+		PollInterval: 500 * time.Millisecond,
+		StaleAfter:   time.Minute,
+	}
+	// the address is checked as the connection is made, after DNS
+	// resolution, so that a name cannot be pointed at a private address
+	// once the webhook is registered; deliveries bypass HTTP proxies, whose
+	// address the check would see instead
+	dialer := &net.Dialer{Timeout: 5 * time.Second, Control: d.checkDial}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	d.http = &http.Client{Timeout: 10 * time.Second, Transport: transport}
+	return d
+}
+
+// checkDial refuses connections to addresses deliveries must not reach.
+func (d *WebhookDispatcher) checkDial(network, address string, _ syscall.RawConn) error {
+	if d.AllowPrivateNetworks {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !publicAddr(ip) {
+		return fmt.Errorf("webhook address %s is not public", host)
+	}
+	return nil
+}
+
+// ItemChanged queues a delivery of ev for each matching webhook of its tenant.
+func (d *WebhookDispatcher) ItemChanged(ctx context.Context, ev ChangeEvent) {
+	ctx = withTenant(context.WithoutCancel(ctx), ev.Tenant)
+	hooks, err := d.store.ListWebhooks(ctx)
+	if err != nil {
+		d.logger.ErrorContext(ctx, "error listing webhooks", "event", ev.Event, "error", err)
+		return
+	}
+	for _, wh := range hooks {
+		if !wh.Wants(ev) {
+			continue
+		}
+		if err := d.enqueue(ctx, &webhookDelivery{ID: uuid.NewString(), Tenant: ev.Tenant, WebhookID: wh.ID, Event: ev}); err != nil {
+			d.logger.ErrorContext(ctx, "error queueing webhook delivery", "webhook_id", wh.ID, "error", err)
+		}
+	}
+}
+
+// Start runs n delivery workers until ctx is done.
+func (d *WebhookDispatcher) Start(ctx context.Context, n int) {
+	for i := 0; i < n; i++ {
+		go d.work(ctx)
+	}
+}
+
+// work sends deliveries until ctx is done. A delivery stays on the worker's
+// processing list until it has been sent, retried or dead-lettered; the
+// worker's heartbeat stops when it dies, and another worker then queues the
+// deliveries left on the list again.
+func (d *WebhookDispatcher) work(ctx context.Context) {
+	id := uuid.NewString()
+	processing := fmt.Sprintf(webhookProcessingKey, id)
+	var beat time.Time
+	for ctx.Err() == nil {
+		if time.Since(beat) >= d.StaleAfter/4 {
+			if err := d.heartbeat(ctx, id); err != nil {
+				if ctx.Err() == nil {
+					if !isRejected(err) {
+						d.logger.Error("error recording webhook worker heartbeat", "error", err)
+					}
+					time.Sleep(d.PollInterval)
+				}
+				continue
+			}
+			beat = time.Now()
+		}
+		// the open circuit breaker has logged the outage already
+		if err := d.promoteDue(ctx); err != nil && ctx.Err() == nil && !isRejected(err) {
+			d.logger.Error("error promoting webhook retries", "error", err)
+		}
+		data, err := d.client.RPopLPush(ctx, webhookQueueKey, processing).Result()
+		if err == redis.Nil {
+			select {
+			case <-ctx.Done():
+			case <-time.After(d.PollInterval):
+			}
+			continue
+		}
+		if err != nil {
+			if ctx.Err() == nil {
+				if !isRejected(err) {
+					d.logger.Error("error reading webhook queue", "error", err)
+				}
+				time.Sleep(d.PollInterval)
+			}
+			continue
+		}
+		if del, err := d.store.decodeDelivery([]byte(data)); err != nil {
+			d.logger.Warn("dropping malformed webhook delivery", "error", err)
+		} else {
+			d.deliver(ctx, del)
+		}
+		if err := d.client.LRem(ctx, processing, 1, data).Err(); err != nil && ctx.Err() == nil {
+			d.logger.Error("error completing webhook delivery", "error", err)
+		}
+	}
+}
+
+// heartbeat records that the worker with id is alive, then queues again the
+// deliveries of workers that have not been for StaleAfter.
+func (d *WebhookDispatcher) heartbeat(ctx context.Context, id string) error {
+	now := time.Now()
+	if err := d.client.ZAdd(ctx, webhookWorkersKey, &redis.Z{Score: float64(now.UnixMilli()), Member: id}).Err(); err != nil {
+		return err
+	}
+	stale, err := d.client.ZRangeByScore(ctx, webhookWorkersKey, &redis.ZRangeBy{
+		Min: "-inf",
+		Max: "(" + strconv.FormatInt(now.Add(-d.StaleAfter).UnixMilli(), 10),
+	}).Result()
+	if err != nil {
+		return err
+	}
+	for _, worker := range stale {
+		if err := d.requeue(ctx, worker); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// requeue moves the deliveries a stale worker was sending back onto the
+// queue, then forgets the worker. Each delivery is moved atomically, so
+// workers reaping the same one concurrently never duplicate it.
+func (d *WebhookDispatcher) requeue(ctx context.Context, worker string) error {
+	processing := fmt.Sprintf(webhookProcessingKey, worker)
+	for {
+		_, err := d.client.RPopLPush(ctx, processing, webhookQueueKey).Result()
+		if err == redis.Nil {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		d.logger.Warn("queueing again a webhook delivery of a stopped worker", "worker", worker)
+	}
+	return d.client.ZRem(ctx, webhookWorkersKey, worker).Err()
+}
+
+// promoteDue moves retries whose backoff has elapsed back onto the queue.
+// ZREM succeeds on only one replica, so each retry is promoted exactly once.
+func (d *WebhookDispatcher) promoteDue(ctx context.Context) error {
+	due, err := d.client.ZRangeByScore(ctx, webhookRetryKey, &redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(time.Now().UnixMilli(), 10),
+	}).Result()
+	if err != nil {
+		return err
+	}
+	for _, data := range due {
+		removed, err := d.client.ZRem(ctx, webhookRetryKey, data).Result()
+		if err != nil {
+			return err
+		}
+		if removed == 1 {
+			if err := d.client.LPush(ctx, webhookQueueKey, data).Err(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// deliver makes one attempt and logs it, then schedules a retry or dead-letters on failure.
+func (d *WebhookDispatcher) deliver(ctx context.Context, del *webhookDelivery) {
+	ctx = withTenant(ctx, del.Tenant)
+	wh, err := d.store.GetWebhook(ctx, del.WebhookID)
+	if err == ErrNotFound {
+		return // webhook was removed while the delivery was queued
+	}
+	if err != nil {
+		d.logger.Error("error loading webhook", "webhook_id", del.WebhookID, "error", err)
+		d.retry(ctx, del, err.Error())
+		return
+	}
+
+	del.Attempt++
+	start := time.Now()
+	status, sendErr := d.send(ctx, wh, del)
+	rec := DeliveryRecord{
+		DeliveryID: del.ID,
+		Event:      del.Event.Event,
+		ItemID:     del.Event.ItemID,
+		Attempt:    del.Attempt,
+		StatusCode: status,
+		DurationMs: time.Since(start).Milliseconds(),
+		Time:       start.UTC(),
+	}
+	if sendErr != nil {
+		rec.Error = sendErr.Error()
+	}
+	if err := d.store.LogDelivery(ctx, wh.ID, rec); err != nil {
+		d.logger.Error("error logging webhook delivery", "delivery_id", del.ID, "error", err)
+	}
+	if sendErr != nil {
+		d.retry(ctx, del, sendErr.Error())
+	}
+}
+
+// send POSTs the signed payload and returns the response status.
+func (d *WebhookDispatcher) send(ctx context.Context, wh *Webhook, del *webhookDelivery) (int, error) {
+	body, err := json.Marshal(webhookPayload{DeliveryID: del.ID, WebhookID: wh.ID, ChangeEvent: del.Event})
+	if err != nil {
+		return 0, err
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, wh.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "gocrud-webhooks")
+	req.Header.Set("X-Gocrud-Event", del.Event.Event)
+	req.Header.Set("X-Gocrud-Delivery", del.ID)
+	req.Header.Set("X-Gocrud-Timestamp", ts)
+	req.Header.Set("X-Gocrud-Signature", "sha256="+signWebhook(wh.Secret, ts, body))
+
+	resp, err := d.http.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("endpoint responded %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// retry schedules the next attempt, or dead-letters del once MaxAttempts is reached.
+func (d *WebhookDispatcher) retry(ctx context.Context, del *webhookDelivery, reason string) {
+	del.LastError = reason
+	if del.Attempt >= d.MaxAttempts {
+		if err := d.store.DeadLetter(ctx, del); err != nil {
+			d.logger.Error("error dead-lettering webhook delivery", "delivery_id", del.ID, "error", err)
+		}
+		return
+	}
+	data, err := d.store.encodeDelivery(del)
+	if err != nil {
+		d.logger.Error("error encoding webhook delivery", "delivery_id", del.ID, "error", err)
+		return
+	}
+	next := time.Now().Add(d.backoff(del.Attempt))
+	if err := d.client.ZAdd(ctx, webhookRetryKey, &redis.Z{Score: float64(next.UnixMilli()), Member: data}).Err(); err != nil {
+		d.logger.Error("error scheduling webhook retry", "delivery_id", del.ID, "error", err)
+	}
+}
+
+// backoff returns the delay before the attempt following attempt n.
+func (d *WebhookDispatcher) backoff(n int) time.Duration {
+	delay := d.BaseBackoff
+	for i := 1; i < n && delay < d.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > d.MaxBackoff {
+		delay = d.MaxBackoff
+	}
+	return delay
+}
+
+func (d *WebhookDispatcher) enqueue(ctx context.Context, del *webhookDelivery) error {
+	data, err := d.store.encodeDelivery(del)
+	if err != nil {
+		return err
+	}
+	return d.client.LPush(ctx, webhookQueueKey, data).Err()
+}
+
+// signWebhook computes the hex HMAC-SHA256 of "<timestamp>.<body>" with secret.
+// Receivers recompute it from the X-Gocrud-Timestamp header and the raw body.
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+)
+
+// webhookLogSize bounds the delivery log and dead-letter list kept per webhook.
+const webhookLogSize = 100
+
+// Webhook is an external endpoint notified about item changes.
+type Webhook struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Type      string    `json:"type,omitempty"`
+	Tags      []string  `json:"tags,omitempty"`
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// CreateWebhookRequest is the payload for registering a webhook.
+// Events defaults to all item events and Secret is generated when empty.
+type CreateWebhookRequest struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+	Type   string   `json:"type"`
+	Tags   []string `json:"tags"`
+	Secret string   `json:"secret"`
+}
+
+// Wants reports whether the webhook subscribes to ev.
+func (wh *Webhook) Wants(ev ChangeEvent) bool {
+	if len(wh.Events) > 0 {
+		found := false
+		for _, e := range wh.Events {
+			if e == ev.Event {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	f := ItemFilter{Type: wh.Type, Tags: wh.Tags}
+	return f.Matches(ev.Item) || f.Matches(ev.Before)
+}
+
+// DeliveryRecord is one attempt to deliver an event to a webhook.
+type DeliveryRecord struct {
+	DeliveryID string    `json:"deliveryId"`
+	Event      string    `json:"event"`
+	ItemID     string    `json:"itemId"`
+	Attempt    int       `json:"attempt"`
+	StatusCode int       `json:"statusCode,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	DurationMs int64     `json:"durationMs"`
+	Time       time.Time `json:"time"`
+}
+
+// WebhookStore persists webhooks, their delivery logs and dead letters in Redis.
+type WebhookStore struct {
+	client redis.UniversalClient
+	// Keyring encrypts queued and dead-lettered deliveries, whose events
+	// carry item data; nil stores them in plain JSON.
+	Keyring *Keyring
+}
+
+// NewWebhookStore creates a new WebhookStore.
+func NewWebhookStore(client redis.UniversalClient) *WebhookStore {
+	return &WebhookStore{client: client}
+}
+
+// SaveWebhook stores a webhook.
+func (s *WebhookStore) SaveWebhook(ctx context.Context, wh *Webhook) error {
+	data, err := json.Marshal(wh)
+	if err != nil {
+		return err
+	}
+	pipe := s.client.Pipeline()
+	pipe.Set(ctx, tenantKey(ctx, "webhook:%s", wh.ID), data, 0)
+	pipe.SAdd(ctx, tenantKey(ctx, "webhooks"), wh.ID)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// GetWebhook retrieves a webhook by ID.
+func (s *WebhookStore) GetWebhook(ctx context.Context, id string) (*Webhook, error) {
+	data, err := s.client.Get(ctx, tenantKey(ctx, "webhook:%s", id)).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	var wh Webhook
+	if err := json.Unmarshal([]byte(data), &wh); err != nil {
+		return nil, err
+	}
+	return &wh, nil
+}
+
+// DeleteWebhook removes a webhook together with its delivery log and dead letters.
+func (s *WebhookStore) DeleteWebhook(ctx context.Context, id string) error {
+	removed, err := s.client.SRem(ctx, tenantKey(ctx, "webhooks"), id).Result()
+	if err != nil {
+		return err
+	}
+	if removed == 0 {
+		return ErrNotFound
+	}
+	return s.client.Del(ctx,
+		tenantKey(ctx, "webhook:%s", id),
+		tenantKey(ctx, "webhook:%s:deliveries", id),
+		tenantKey(ctx, "webhook:%s:dead", id),
+	).Err()
+}
+
+// ListWebhooks returns all registered webhooks.
+func (s *WebhookStore) ListWebhooks(ctx context.Context) ([]*Webhook, error) {
+	ids, err := s.client.SMembers(ctx, tenantKey(ctx, "webhooks")).Result()
+	if err != nil {
+		return nil, err
+	}
+	hooks := make([]*Webhook, 0, len(ids))
+	for _, id := range ids {
+		wh, err := s.GetWebhook(ctx, id)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, wh)
+	}
+	return hooks, nil
+}
+
+// LogDelivery prepends rec to the webhook's bounded delivery log.
+func (s *WebhookStore) LogDelivery(ctx context.Context, webhookID string, rec DeliveryRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return s.pushBounded(ctx, tenantKey(ctx, "webhook:%s:deliveries", webhookID), data)
+}
+
+// Deliveries returns the most recent delivery attempts, newest first.
+func (s *WebhookStore) Deliveries(ctx context.Context, webhookID string) ([]DeliveryRecord, error) {
+	var recs []DeliveryRecord
+	err := s.readList(ctx, tenantKey(ctx, "webhook:%s:deliveries", webhookID), func(data []byte) error {
+		var rec DeliveryRecord
+		if err := json.Unmarshal(data, &rec); err != nil {
+			return err
+		}
+		recs = append(recs, rec)
+		return nil
+	})
+	return recs, err
+}
+
+// DeadLetter records a delivery that exhausted its retries.
+func (s *WebhookStore) DeadLetter(ctx context.Context, d *webhookDelivery) error {
+	data, err := s.encodeDelivery(d)
+	if err != nil {
+		return err
+	}
+	return s.pushBounded(ctx, tenantKey(ctx, "webhook:%s:dead", d.WebhookID), data)
+}
+
+// DeadLetters returns the deliveries that exhausted their retries, newest first.
+func (s *WebhookStore) DeadLetters(ctx context.Context, webhookID string) ([]*webhookDelivery, error) {
+	var dead []*webhookDelivery
+	err := s.readList(ctx, tenantKey(ctx, "webhook:%s:dead", webhookID), func(data []byte) error {
+		d, err := s.decodeDelivery(data)
+		if err != nil {
+			return err
+		}
+		dead = append(dead, d)
+		return nil
+	})
+	return dead, err
+}
+
+// encodeDelivery returns the value stored for d in the queue, the retry set
+// and the dead letters. The same value moves between them, so it is bound to
+// the queue rather than to the key holding it.
+func (s *WebhookStore) encodeDelivery(d *webhookDelivery) ([]byte, error) {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return nil, err
+	}
+	return s.Keyring.sealValue(data, []byte(webhookQueueKey))
+}
+
+// decodeDelivery reverses encodeDelivery.
+func (s *WebhookStore) decodeDelivery(value []byte) (*webhookDelivery, error) {
+	data, err := s.Keyring.openValue(value, []byte(webhookQueueKey))
+	if err != nil {
+		return nil, err
+	}
+	var d webhookDelivery
+	if err := json.Unmarshal(data, &d); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+func (s *WebhookStore) pushBounded(ctx context.Context, key string, data []byte) error {
+	pipe := s.client.Pipeline()
+	pipe.LPush(ctx, key, data)
+	pipe.LTrim(ctx, key, 0, webhookLogSize-1)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (s *WebhookStore) readList(ctx context.Context, key string, fn func([]byte) error) error {
+	entries, err := s.client.LRange(ctx, key, 0, -1).Result()
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := fn([]byte(e)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WebhookHandler handles HTTP requests for webhook registrations.
+type WebhookHandler struct {
+	store  *WebhookStore
+	logger *slog.Logger
+
+	// AllowPrivateNetworks accepts endpoints on loopback, link-local and
+	// private addresses, for deployments whose receivers run next to the
+	// service. Otherwise any tenant admin could make the server send requests
+	// into its own network.
+	AllowPrivateNetworks bool
+}
+
+// NewWebhookHandler creates a WebhookHandler with dependencies.
+func NewWebhookHandler(store *WebhookStore, logger *slog.Logger) *WebhookHandler {
+	return &WebhookHandler{store: store, logger: logger}
+}
+
+// webhooksHandler routes requests without ID: GET for list, POST for create.
+func (h *WebhookHandler) webhooksHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		h.handleListWebhooks(w, r)
+	case http.MethodPost:
+		h.handleCreateWebhook(w, r)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// webhookHandler routes /webhooks/{id}, /webhooks/{id}/deliveries and /webhooks/{id}/dead-letters.
+func (h *WebhookHandler) webhookHandler(w http.ResponseWriter, r *http.Request) {
+	id, sub, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/webhooks/"), "/")
+	if id == "" {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	switch {
+	case sub == "" && r.Method == http.MethodGet:
+		h.handleGetWebhook(w, r, id)
+	case sub == "" && r.Method == http.MethodDelete:
+		h.handleDeleteWebhook(w, r, id)
+	case sub == "":
+		w.Header().Set("Allow", "GET, DELETE")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	case sub != "deliveries" && sub != "dead-letters":
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+	case r.Method != http.MethodGet:
+		w.Header().Set("Allow", "GET")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	default:
+		h.handleWebhookLog(w, r, id, sub)
+	}
+}
+
+// handleCreateWebhook processes POST /webhooks. The secret is only ever returned here.
+func (h *WebhookHandler) handleCreateWebhook(w http.ResponseWriter, r *http.Request) {
+	var req CreateWebhookRequest
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request payload: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := ensureSingleJSON(dec); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateWebhookRequest(r.Context(), req, h.AllowPrivateNetworks); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	secret := req.Secret
+	if secret == "" {
+		buf := make([]byte, 32)
+		if _, err := rand.Read(buf); err != nil {
+			h.logger.ErrorContext(r.Context(), "error generating webhook secret", "error", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		secret = "whsec_" + hex.EncodeToString(buf)
+	}
+	wh := &Webhook{
+		ID:        uuid.NewString(),
+		URL:       req.URL,
+		Events:    req.Events,
+		Type:      req.Type,
+		Tags:      req.Tags,
+		Secret:    secret,
+		CreatedAt: time.Now().UTC(),
+	}
+	if err := h.store.SaveWebhook(r.Context(), wh); err != nil {
+		writeError(w, r, h.logger, err, "error saving webhook")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", fmt.Sprintf("/webhooks/%s", wh.ID))
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(wh)
+}
+
+// handleGetWebhook processes GET /webhooks/{id}.
+func (h *WebhookHandler) handleGetWebhook(w http.ResponseWriter, r *http.Request, id string) {
+	wh, err := h.store.GetWebhook(r.Context(), id)
+	if err != nil {
+		writeError(w, r, h.logger, err, "error getting webhook")
+		return
+	}
+	wh.Secret = ""
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(wh)
+}
+
+// handleDeleteWebhook processes DELETE /webhooks/{id}.
+func (h *WebhookHandler) handleDeleteWebhook(w http.ResponseWriter, r *http.Request, id string) {
+	if err := h.store.DeleteWebhook(r.Context(), id); err != nil {
+		writeError(w, r, h.logger, err, "error deleting webhook")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleListWebhooks processes GET /webhooks.
+func (h *WebhookHandler) handleListWebhooks(w http.ResponseWriter, r *http.Request) {
+	hooks, err := h.store.ListWebhooks(r.Context())
+	if err != nil {
+		writeError(w, r, h.logger, err, "error listing webhooks")
+		return
+	}
+	for _, wh := range hooks {
+		wh.Secret = ""
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(hooks)
+}
+
+// handleWebhookLog processes GET /webhooks/{id}/deliveries and GET /webhooks/{id}/dead-letters.
+func (h *WebhookHandler) handleWebhookLog(w http.ResponseWriter, r *http.Request, id, sub string) {
+	if _, err := h.store.GetWebhook(r.Context(), id); err != nil {
+		writeError(w, r, h.logger, err, "error getting webhook")
+		return
+	}
+	var out interface{}
+	var err error
+	if sub == "deliveries" {
+		var recs []DeliveryRecord
+		recs, err = h.store.Deliveries(r.Context(), id)
+		if recs == nil {
+			recs = []DeliveryRecord{}
+		}
+		out = recs
+	} else {
+		var dead []*webhookDelivery
+		dead, err = h.store.DeadLetters(r.Context(), id)
+		if dead == nil {
+			dead = []*webhookDelivery{}
+		}
+		out = dead
+	}
+	if err != nil {
+		writeError(w, r, h.logger, err, "error reading webhook "+sub)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// validateWebhookRequest checks the endpoint URL and event names. Unless
+// allowPrivate is set, every address the URL's host resolves to must be
+// public; the dispatcher checks again when it connects, in case the name
+// resolves elsewhere by then.
+func validateWebhookRequest(ctx context.Context, req CreateWebhookRequest, allowPrivate bool) error {
+	u, err := url.Parse(req.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return &inputError{"url must be an absolute http or https URL"}
+	}
+	if !allowPrivate {
+		if err := checkWebhookHost(ctx, u.Hostname()); err != nil {
+			return err
+		}
+	}
+	for _, e := range req.Events {
+		switch e {
+		case EventItemCreated, EventItemUpdated, EventItemDeleted:
+		default:
+			return &inputError{fmt.Sprintf("unknown event type: %q", e)}
+		}
+	}
+	return nil
+}
+
+// checkWebhookHost resolves host and rejects it unless all its addresses are public.
+func checkWebhookHost(ctx context.Context, host string) error {
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return &inputError{fmt.Sprintf("url host %q cannot be resolved", host)}
+		}
+		for _, a := range addrs {
+			ips = append(ips, a.IP)
+		}
+	}
+	for _, ip := range ips {
+		if !publicAddr(ip) {
+			return &inputError{"url must not point to a loopback, link-local, private or unspecified address"}
+		}
+	}
+	return nil
+}
+
+// publicAddr reports whether webhooks may be delivered to ip.
+func publicAddr(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsPrivate() || ip.IsUnspecified())
+}
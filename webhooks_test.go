@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// TestWebhookIntegration registers httptest receivers and checks signed delivery,
+// filtering, retries, the delivery log and dead-lettering.
+func TestWebhookIntegration(t *testing.T) {
+	client := &http.Client{Transport: &authTransport{token: testAPIKey, base: http.DefaultTransport}}
+
+	var mu sync.Mutex
+	var received []webhookPayload
+	var flaky int
+	okSecret := "flaky-secret"
+	flakyRecv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		want := "sha256=" + signWebhook(okSecret, r.Header.Get("X-Gocrud-Timestamp"), body)
+		if r.Header.Get("X-Gocrud-Signature") != want {
+			t.Errorf("bad signature %q", r.Header.Get("X-Gocrud-Signature"))
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		flaky++
+		if flaky == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var p webhookPayload
+		json.Unmarshal(body, &p)
+		received = append(received, p)
+	}))
+	defer flakyRecv.Close()
+	deadRecv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer deadRecv.Close()
+
+	register := func(body string) Webhook {
+		t.Helper()
+		resp, err := client.Post(testServerURL+"/webhooks", "application/json", bytes.NewReader([]byte(body)))
+		if err != nil {
+			t.Fatalf("POST /webhooks: %v", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusCreated {
+			b, _ := io.ReadAll(resp.Body)
+			t.Fatalf("POST /webhooks status %d: %s", resp.StatusCode, b)
+		}
+		var wh Webhook
+		json.NewDecoder(resp.Body).Decode(&wh)
+		return wh
+	}
+
+	// invalid registrations are rejected
+	resp, _ := client.Post(testServerURL+"/webhooks", "application/json", bytes.NewReader([]byte(`{"url":"ftp://x"}`)))
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400 for bad url, got %d", resp.StatusCode)
+	}
+	resp.Body.Close()
+
+	okHook := register(`{"url":"` + flakyRecv.URL + `","events":["item.created"],"type":"whtest","secret":"` + okSecret + `"}`)
+	deadHook := register(`{"url":"` + deadRecv.URL + `","type":"whtest"}`)
+	if deadHook.Secret == "" {
+		t.Errorf("expected generated secret in create response")
+	}
+
+	// the secret is not exposed after creation
+	resp, _ = client.Get(testServerURL + "/webhooks/" + okHook.ID)
+	var fetched Webhook
+	json.NewDecoder(resp.Body).Decode(&fetched)
+	resp.Body.Close()
+	if fetched.Secret != "" || fetched.URL != flakyRecv.URL {
+		t.Errorf("unexpected fetched webhook: %+v", fetched)
+	}
+
+	var itemIDs []string
+	for _, body := range []string{
+		`{"type":"other","data":{"n":1}}`,
+		`{"type":"whtest","tags":["x"],"data":{"n":2}}`,
+	} {
+		resp, err := client.Post(testServerURL+"/items", "application/json", bytes.NewReader([]byte(body)))
+		if err != nil {
+			t.Fatalf("POST /items: %v", err)
+		}
+		var it Item
+		json.NewDecoder(resp.Body).Decode(&it)
+		resp.Body.Close()
+		itemIDs = append(itemIDs, it.ID)
+	}
+	defer func() {
+		for _, id := range itemIDs {
+			req, _ := http.NewRequest(http.MethodDelete, testServerURL+"/items/"+id, nil)
+			if resp, err := client.Do(req); err == nil {
+				resp.Body.Close()
+			}
+		}
+	}()
+
+	getJSON := func(path string, v interface{}) {
+		t.Helper()
+		resp, err := client.Get(testServerURL + path)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		defer resp.Body.Close()
+		json.NewDecoder(resp.Body).Decode(v)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	var dead []webhookDelivery
+	for time.Now().Before(deadline) {
+		mu.Lock()
+		n := len(received)
+		mu.Unlock()
+		getJSON("/webhooks/"+deadHook.ID+"/dead-letters", &dead)
+		if n > 0 && len(dead) > 0 {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	mu.Lock()
+	if len(received) != 1 || received[0].ItemID != itemIDs[1] || received[0].Event != EventItemCreated {
+		t.Errorf("unexpected deliveries to flaky receiver: %+v", received)
+	}
+	mu.Unlock()
+
+	var log []DeliveryRecord
+	getJSON("/webhooks/"+okHook.ID+"/deliveries", &log)
+	if len(log) != 2 || log[0].StatusCode != http.StatusOK || log[0].Attempt != 2 || log[1].StatusCode != http.StatusInternalServerError {
+		t.Errorf("unexpected delivery log: %+v", log)
+	}
+
+	if len(dead) != 1 || dead[0].Attempt != 3 || dead[0].Event.ItemID != itemIDs[1] {
+		t.Errorf("unexpected dead letters: %+v", dead)
+	}
+
+	for _, id := range []string{okHook.ID, deadHook.ID} {
+		req, _ := http.NewRequest(http.MethodDelete, testServerURL+"/webhooks/"+id, nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("DELETE /webhooks/%s: %v", id, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNoContent {
+			t.Errorf("DELETE /webhooks/%s status %d", id, resp.StatusCode)
+		}
+	}
+}
+
+// TestWebhookPrivateAddresses checks that endpoints on internal addresses are
+// refused at registration and when a delivery connects.
+func TestWebhookPrivateAddresses(t *testing.T) {
+	for url, ok := range map[string]bool{
+		"http://127.0.0.1:6379/":            false,
+		"http://localhost/hook":             false,
+		"http://169.254.169.254/latest":     false,
+		"http://10.1.2.3/hook":              false,
+		"http://192.168.0.10/hook":          false,
+		"http://[::1]:8080/hook":            false,
+		"http://[::ffff:127.0.0.1]/hook":    false,
+		"http://0.0.0.0/hook":               false,
+		"https://93.184.215.14/hook":        true,
+		"https://[2606:4700::6810:84e5]/hk": true,
+	} {
+		err := validateWebhookRequest(testCtx, CreateWebhookRequest{URL: url}, false)
+		if (err == nil) != ok {
+			t.Errorf("%s: expected allowed %v, got %v", url, ok, err)
+		}
+		if err := validateWebhookRequest(testCtx, CreateWebhookRequest{URL: url}, true); err != nil {
+			t.Errorf("%s: expected private networks to be allowed, got %v", url, err)
+		}
+	}
+
+	recv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("expected the delivery not to connect")
+	}))
+	defer recv.Close()
+	d := NewWebhookDispatcher(nil, redisClient, newTestLogger())
+	del := &webhookDelivery{ID: "d1", Event: ChangeEvent{Event: EventItemCreated}}
+	if _, err := d.send(testCtx, &Webhook{ID: "w1", URL: recv.URL}, del); err == nil || !strings.Contains(err.Error(), "is not public") {
+		t.Errorf("expected the connection to a loopback address to be refused, got %v", err)
+	}
+}
+
+// TestWebhookStaleWorker checks that the deliveries a worker was sending when
+// it stopped are queued again and sent by the running workers.
+func TestWebhookStaleWorker(t *testing.T) {
+	got := make(chan string, 1)
+	recv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got <- r.Header.Get("X-Gocrud-Delivery")
+	}))
+	defer recv.Close()
+	store := NewWebhookStore(redisClient)
+	wh := &Webhook{ID: "stale-worker", URL: recv.URL, Secret: "s", CreatedAt: time.Now().UTC()}
+	if err := store.SaveWebhook(testCtx, wh); err != nil {
+		t.Fatalf("save webhook: %v", err)
+	}
+	defer store.DeleteWebhook(testCtx, wh.ID)
+
+	data, err := store.encodeDelivery(&webhookDelivery{ID: "orphaned", WebhookID: wh.ID, Event: ChangeEvent{Event: EventItemCreated, ItemID: "x"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	processing := fmt.Sprintf(webhookProcessingKey, "crashed")
+	redisClient.LPush(testCtx, processing, data)
+	redisClient.ZAdd(testCtx, webhookWorkersKey, &redis.Z{Score: float64(time.Now().Add(-time.Hour).UnixMilli()), Member: "crashed"})
+
+	d := NewWebhookDispatcher(store, redisClient, newTestLogger())
+	if err := d.heartbeat(testCtx, "reaper"); err != nil {
+		t.Fatalf("heartbeat: %v", err)
+	}
+	defer redisClient.ZRem(testCtx, webhookWorkersKey, "reaper")
+	select {
+	case id := <-got:
+		if id != "orphaned" {
+			t.Errorf("expected the orphaned delivery, got %q", id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the orphaned delivery was not sent")
+	}
+	if n, _ := redisClient.Exists(testCtx, processing).Result(); n != 0 {
+		t.Error("expected the stale worker's list to be emptied")
+	}
+	if _, err := redisClient.ZScore(testCtx, webhookWorkersKey, "crashed").Result(); err != redis.Nil {
+		t.Errorf("expected the stale worker to be forgotten, got %v", err)
+	}
+}
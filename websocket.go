@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	wsWriteWait  = 10 * time.Second
+	wsPongWait   = 60 * time.Second
+	wsPingPeriod = wsPongWait * 9 / 10
+	wsMaxMessage = 1 << 20
+	// wsAuthPeriod is how often an idle session's credentials are checked again
+	wsAuthPeriod = 10 * time.Second
+)
+
+// wsMessage is a command sent by a WebSocket client.
+//
+//	{"op":"subscribe","subscription":"s1","type":"product","tags":["sale"]}
+//	{"op":"unsubscribe","subscription":"s1"}
+//	{"op":"create","ref":"r1","type":"task","tags":["work"],"data":{...}}
+//	{"op":"update","ref":"r2","id":"<item id>","type":"task","data":{...}}
+//	{"op":"delete","ref":"r3","id":"<item id>"}
+type wsMessage struct {
+	Op           string          `json:"op"`
+	Ref          string          `json:"ref,omitempty"`
+	Subscription string          `json:"subscription,omitempty"`
+	ID           string          `json:"id,omitempty"`
+	Type         string          `json:"type,omitempty"`
+	Tags         []string        `json:"tags,omitempty"`
+	Data         json.RawMessage `json:"data,omitempty"`
+}
+
+// wsReply is sent to a WebSocket client: "event" for subscribed changes,
+// "result" for a successful command and "error" for a failed one.
+type wsReply struct {
+	Op           string `json:"op"`
+	Ref          string `json:"ref,omitempty"`
+	Subscription string `json:"subscription,omitempty"`
+	Event        string `json:"event,omitempty"`
+	Status       int    `json:"status,omitempty"`
+	Item         *Item  `json:"item,omitempty"`
+	Error        string `json:"error,omitempty"`
+	RetryAfter   int    `json:"retryAfter,omitempty"` // seconds, with status 429
+}
+
+// WSHandler serves the /ws endpoint.
+type WSHandler struct {
+	handler  *Handler
+	broker   *EventBroker
+	upgrader websocket.Upgrader
+	// Modes, when set, refuses commands as modeMiddleware refuses requests.
+	Modes *ModeStore
+	// Limiter, when set, charges each command to the caller's rate limit
+	// as rateLimitMiddleware charges requests.
+	Limiter *RateLimiter
+	// Auth, when set, checks the session's token again before each command
+	// and every wsAuthPeriod, closing the session once it is revoked or expired.
+	Auth *Authenticator
+}
+
+// NewWSHandler creates a WSHandler that runs commands through h and streams events from broker.
+func NewWSHandler(h *Handler, broker *EventBroker) *WSHandler {
+	return &WSHandler{
+		handler: h,
+		broker:  broker,
+		upgrader: websocket.Upgrader{
+			// clients authenticate with an API key rather than ambient cookies,
+			// so cross-origin browser connections are safe to accept
+			CheckOrigin: func(r *http.Request) bool { return true },
+		},
+	}
+}
+
+// wsSession holds the state of one WebSocket connection.
+type wsSession struct {
+	token     string
+	mu        sync.Mutex
+	principal *Principal
+	subs      map[string]ItemFilter
+	closeCode int
+	closeText string
+	out       chan wsReply
+}
+
+// ServeHTTP upgrades the connection and runs the session until either side closes it.
+func (s *WSHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return // Upgrade has already replied with an HTTP error
+	}
+	defer conn.Close()
+
+	events, unsubscribe := s.broker.Subscribe()
+	defer unsubscribe()
+
+	token, _ := bearerToken(r)
+	sess := &wsSession{
+		token:     token,
+		principal: principalFrom(r.Context()),
+		subs:      make(map[string]ItemFilter),
+		closeCode: websocket.CloseNormalClosure,
+		out:       make(chan wsReply, 16),
+	}
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.writeLoop(ctx, conn, sess, events)
+	}()
+
+	conn.SetReadLimit(wsMaxMessage)
+	conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			break
+		}
+		msg, err := decodeWSMessage(data)
+		if err != nil {
+			sess.send(ctx, wsError("", http.StatusBadRequest, "invalid message: "+err.Error()))
+			continue
+		}
+		p, err := s.authenticate(ctx, sess)
+		if errors.Is(err, ErrInvalidCredentials) {
+			sess.revoke()
+			break
+		}
+		if err != nil {
+			sess.send(ctx, s.commandError(ctx, msg, err, "error authenticating websocket command"))
+			continue
+		}
+		cmdCtx := withTenant(withPrincipal(ctx, p), p.Tenant)
+		if reply := s.limit(cmdCtx, p, msg); reply != nil {
+			sess.send(ctx, *reply)
+			continue
+		}
+		sess.send(ctx, s.handle(cmdCtx, sess, msg))
+	}
+	cancel()
+	<-done
+}
+
+// decodeWSMessage parses one client message, rejecting unknown fields and
+// trailing data as the REST handlers do.
+func decodeWSMessage(data []byte) (wsMessage, error) {
+	var msg wsMessage
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&msg); err != nil {
+		return wsMessage{}, err
+	}
+	if err := ensureSingleJSON(dec); err != nil {
+		return wsMessage{}, err
+	}
+	return msg, nil
+}
+
+// authenticate checks the session's token again and returns its current
+// principal, so that changes to the key's scopes apply to open sessions.
+// Without an Authenticator the principal of the handshake is kept.
+func (s *WSHandler) authenticate(ctx context.Context, sess *wsSession) (*Principal, error) {
+	if s.Auth == nil || sess.token == "" {
+		sess.mu.Lock()
+		defer sess.mu.Unlock()
+		return sess.principal, nil
+	}
+	p, err := s.Auth.Authenticate(ctx, sess.token)
+	if err != nil {
+		return nil, err
+	}
+	sess.mu.Lock()
+	sess.principal = p
+	sess.mu.Unlock()
+	return p, nil
+}
+
+// limit charges msg to the caller's rate limit and returns the error reply
+// when it is refused, or nil to run the command.
+func (s *WSHandler) limit(ctx context.Context, p *Principal, msg wsMessage) *wsReply {
+	l := s.Limiter
+	if l == nil {
+		return nil
+	}
+	limit := l.limitFor(p)
+	if limit <= 0 {
+		return nil
+	}
+	res, err := l.Take(ctx, p.ID, limit, 1)
+	if err != nil {
+		if !isOutage(err) {
+			l.logger.ErrorContext(ctx, "error applying rate limit", "error", err)
+		}
+		var reply wsReply
+		switch {
+		case l.FailOpen:
+			return nil
+		case isOutage(err):
+			reply = wsError(msg.Ref, http.StatusServiceUnavailable, ErrUnavailable.Error())
+		default:
+			reply = wsError(msg.Ref, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		}
+		return &reply
+	}
+	if !res.Allowed {
+		reply := wsError(msg.Ref, http.StatusTooManyRequests, "rate limit exceeded")
+		reply.RetryAfter = max(1, ceilSeconds(res.RetryAfter))
+		return &reply
+	}
+	return nil
+}
+
+// handle executes a single client command and returns the reply for it.
+func (s *WSHandler) handle(ctx context.Context, sess *wsSession, msg wsMessage) wsReply {
+	write := msg.Op == "create" || msg.Op == "update" || msg.Op == "delete"
+	if problem := s.Modes.refusal(principalFrom(ctx), write); problem != nil {
+		return wsError(msg.Ref, problem.Status, problem.Detail)
+	}
+	switch msg.Op {
+	case "subscribe":
+		if msg.Subscription == "" {
+			return wsError(msg.Ref, http.StatusBadRequest, "subscription is required")
+		}
+		if err := authorize(ctx, ScopeRead, nil); err != nil {
+			return s.commandError(ctx, msg, err, "error authorizing subscribe")
+		}
+		sess.mu.Lock()
+		sess.subs[msg.Subscription] = ItemFilter{Type: msg.Type, Tags: msg.Tags}
+		sess.mu.Unlock()
+		return wsReply{Op: "result", Ref: msg.Ref, Subscription: msg.Subscription, Status: http.StatusOK}
+	case "unsubscribe":
+		sess.mu.Lock()
+		delete(sess.subs, msg.Subscription)
+		sess.mu.Unlock()
+		return wsReply{Op: "result", Ref: msg.Ref, Subscription: msg.Subscription, Status: http.StatusOK}
+	case "create":
+		item, err := s.handler.createItem(ctx, CreateItemRequest{Type: msg.Type, Tags: msg.Tags, Data: msg.Data})
+		if err != nil {
+			return s.commandError(ctx, msg, err, "error saving item")
+		}
+		return wsReply{Op: "result", Ref: msg.Ref, Status: http.StatusCreated, Item: item}
+	case "update":
+		if msg.ID == "" {
+			return wsError(msg.Ref, http.StatusBadRequest, "id is required")
+		}
+		item, err := s.handler.updateItem(ctx, msg.ID, "", UpdateItemRequest{Type: msg.Type, Tags: msg.Tags, Data: msg.Data})
+		if err != nil {
+			return s.commandError(ctx, msg, err, "error updating item")
+		}
+		return wsReply{Op: "result", Ref: msg.Ref, Status: http.StatusOK, Item: item}
+	case "delete":
+		if msg.ID == "" {
+			return wsError(msg.Ref, http.StatusBadRequest, "id is required")
+		}
+		if err := s.handler.deleteItem(ctx, msg.ID, ""); err != nil {
+			return s.commandError(ctx, msg, err, "error deleting item")
+		}
+		return wsReply{Op: "result", Ref: msg.Ref, Status: http.StatusNoContent}
+	default:
+		return wsError(msg.Ref, http.StatusBadRequest, "unknown op: "+msg.Op)
+	}
+}
+
+// commandError maps a failed command to an error reply, mirroring Handler.writeError.
+func (s *WSHandler) commandError(ctx context.Context, msg wsMessage, err error, logMsg string) wsReply {
+	switch {
+	case errors.Is(err, ErrInvalidInput):
+		return wsError(msg.Ref, http.StatusBadRequest, err.Error())
+	case errors.Is(err, ErrForbidden):
+		return wsError(msg.Ref, http.StatusForbidden, err.Error())
+	case errors.Is(err, ErrNotFound):
+		return wsError(msg.Ref, http.StatusNotFound, http.StatusText(http.StatusNotFound))
+	case errors.Is(err, ErrPreconditionFailed):
+		return wsError(msg.Ref, http.StatusPreconditionFailed, err.Error())
+	case isOutage(err):
+		return wsError(msg.Ref, http.StatusServiceUnavailable, ErrUnavailable.Error())
+	default:
+		s.handler.logger.ErrorContext(ctx, logMsg, "error", err)
+		return wsError(msg.Ref, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+	}
+}
+
+// writeLoop is the connection's only writer: it sends replies, matching events and pings.
+// It also checks the session's credentials every wsAuthPeriod, so that a
+// revoked key stops receiving events even when it sends no commands.
+func (s *WSHandler) writeLoop(ctx context.Context, conn *websocket.Conn, sess *wsSession, events <-chan ChangeEvent) {
+	ticker := time.NewTicker(wsPingPeriod)
+	defer ticker.Stop()
+	authTicker := time.NewTicker(wsAuthPeriod)
+	defer authTicker.Stop()
+	for {
+		var err error
+		select {
+		case <-ctx.Done():
+			sess.mu.Lock()
+			code, text := sess.closeCode, sess.closeText
+			sess.mu.Unlock()
+			conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(code, text))
+			return
+		case <-authTicker.C:
+			// outages keep the last known principal; only rejected credentials end the session
+			if _, err := s.authenticate(ctx, sess); errors.Is(err, ErrInvalidCredentials) {
+				sess.revoke()
+				conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+				conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, wsRevokedText))
+				// unblock the reader so ServeHTTP can return
+				conn.Close()
+				return
+			}
+		case reply := <-sess.out:
+			conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			err = conn.WriteJSON(reply)
+		case ev := <-events:
+			for _, reply := range sess.matching(ev) {
+				conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+				if err = conn.WriteJSON(reply); err != nil {
+					break
+				}
+			}
+		case <-ticker.C:
+			conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			err = conn.WriteMessage(websocket.PingMessage, nil)
+		}
+		if err != nil {
+			// unblock the reader so ServeHTTP can return
+			conn.Close()
+			return
+		}
+	}
+}
+
+// matching returns one event reply per subscription that ev's item matches,
+// before or after the change, so subscribers also see items leaving their filter.
+// Items the caller may not read, because of their tenant, the caller's type and
+// tag limits or the item's ACL, are never sent.
+func (sess *wsSession) matching(ev ChangeEvent) []wsReply {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	if p := sess.principal; p == nil || p.Tenant != ev.Tenant || authorize(withPrincipal(context.Background(), p), ScopeRead, ev.Subject()) != nil {
+		return nil
+	}
+	var replies []wsReply
+	for id, f := range sess.subs {
+		if f.Matches(ev.Item) || f.Matches(ev.Before) {
+			replies = append(replies, wsReply{Op: "event", Subscription: id, Event: ev.Event, Item: ev.Subject()})
+		}
+	}
+	return replies
+}
+
+// wsRevokedText is the close reason sent when a session's credentials are no longer valid.
+const wsRevokedText = "credentials revoked or expired"
+
+// revoke records that the session ends because its credentials were
+// rejected, and stops it from receiving further events.
+func (sess *wsSession) revoke() {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	sess.principal = nil
+	sess.closeCode = websocket.ClosePolicyViolation
+	sess.closeText = wsRevokedText
+}
+
+// send queues reply for the writer unless the session is shutting down.
+func (sess *wsSession) send(ctx context.Context, reply wsReply) {
+	select {
+	case sess.out <- reply:
+	case <-ctx.Done():
+	}
+}
+
+func wsError(ref string, status int, msg string) wsReply {
+	return wsReply{Op: "error", Ref: ref, Status: status, Error: msg}
+}
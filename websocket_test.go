@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// TestWebSocketIntegration subscribes over /ws, mutates items over REST and WebSocket,
+// and checks that commands are validated and events are delivered.
+func TestWebSocketIntegration(t *testing.T) {
+	wsURL := "ws" + strings.TrimPrefix(testServerURL, "http") + "/ws"
+
+	// the handshake must be authenticated
+	if _, resp, err := websocket.DefaultDialer.Dial(wsURL, nil); err == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without API key, got err=%v resp=%v", err, resp)
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL+"?access_token="+testAPIKey, nil)
+	if err != nil {
+		t.Fatalf("dial /ws: %v", err)
+	}
+	defer conn.Close()
+
+	read := func() wsReply {
+		t.Helper()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var reply wsReply
+		if err := conn.ReadJSON(&reply); err != nil {
+			t.Fatalf("read reply: %v", err)
+		}
+		return reply
+	}
+
+	if err := conn.WriteJSON(wsMessage{Op: "subscribe", Subscription: "notes", Type: "wsnote"}); err != nil {
+		t.Fatalf("write subscribe: %v", err)
+	}
+	if reply := read(); reply.Op != "result" || reply.Subscription != "notes" {
+		t.Fatalf("unexpected subscribe reply: %+v", reply)
+	}
+
+	// CREATE over REST is delivered as an event
+	client := &http.Client{Transport: &authTransport{token: testAPIKey, base: http.DefaultTransport}}
+	resp, err := client.Post(testServerURL+"/items", "application/json",
+		bytes.NewReader([]byte(`{"type":"wsnote","tags":["a"],"data":{"text":"hello"}}`)))
+	if err != nil {
+		t.Fatalf("POST /items: %v", err)
+	}
+	resp.Body.Close()
+	ev := read()
+	if ev.Op != "event" || ev.Event != EventItemCreated || ev.Item == nil || ev.Item.Type != "wsnote" {
+		t.Fatalf("unexpected event: %+v", ev)
+	}
+	restID := ev.Item.ID
+
+	// unknown fields are rejected as by the REST handlers
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"op":"subscribe","subscription":"x","typo":"wsnote"}`))
+	if reply := read(); reply.Op != "error" || reply.Status != http.StatusBadRequest || !strings.Contains(reply.Error, "typo") {
+		t.Fatalf("expected unknown field error, got %+v", reply)
+	}
+
+	// invalid commands get the same validation as REST
+	conn.WriteJSON(wsMessage{Op: "create", Ref: "bad", Type: "wsnote"})
+	if reply := read(); reply.Op != "error" || reply.Ref != "bad" || reply.Status != http.StatusBadRequest {
+		t.Fatalf("expected validation error, got %+v", reply)
+	}
+
+	// UPDATE over WebSocket returns a result and an event, in either order
+	conn.WriteJSON(wsMessage{Op: "update", Ref: "upd", ID: restID, Type: "wsnote", Data: []byte(`{"text":"bye"}`)})
+	var gotResult, gotEvent bool
+	for i := 0; i < 2; i++ {
+		reply := read()
+		switch {
+		case reply.Op == "result" && reply.Ref == "upd":
+			gotResult = reply.Status == http.StatusOK && reply.Item != nil && bytes.Contains(reply.Item.Data, []byte("bye"))
+		case reply.Op == "event" && reply.Event == EventItemUpdated:
+			gotEvent = reply.Item != nil && reply.Item.ID == restID
+		}
+	}
+	if !gotResult || !gotEvent {
+		t.Fatalf("expected update result and event, got result=%v event=%v", gotResult, gotEvent)
+	}
+
+	// DELETE of an unknown item is a 404
+	conn.WriteJSON(wsMessage{Op: "delete", Ref: "missing", ID: "does-not-exist"})
+	if reply := read(); reply.Op != "error" || reply.Status != http.StatusNotFound {
+		t.Fatalf("expected 404, got %+v", reply)
+	}
+
+	// after unsubscribing, deletes no longer produce events
+	conn.WriteJSON(wsMessage{Op: "unsubscribe", Subscription: "notes"})
+	read()
+	conn.WriteJSON(wsMessage{Op: "delete", Ref: "del", ID: restID})
+	if reply := read(); reply.Op != "result" || reply.Status != http.StatusNoContent {
+		t.Fatalf("unexpected delete reply: %+v", reply)
+	}
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	var extra wsReply
+	if err := conn.ReadJSON(&extra); err == nil {
+		t.Fatalf("unexpected message after unsubscribe: %+v", extra)
+	}
+}
+
+// TestWebSocketKeyLimits checks that commands are charged to the key's rate
+// limit and that revoking the key closes its open sessions.
+func TestWebSocketKeyLimits(t *testing.T) {
+	wsURL := "ws" + strings.TrimPrefix(testServerURL, "http") + "/ws"
+	// the handshake takes one of the three requests
+	key := newKey(t, testAPIKey, `{"name":"ws-limited","scopes":["read"],"rateLimit":3}`)
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL+"?access_token="+key.Secret, nil)
+	if err != nil {
+		t.Fatalf("dial /ws: %v", err)
+	}
+	defer conn.Close()
+	read := func() (wsReply, error) {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var reply wsReply
+		err := conn.ReadJSON(&reply)
+		return reply, err
+	}
+
+	for i := 0; i < 2; i++ {
+		conn.WriteJSON(wsMessage{Op: "subscribe", Subscription: "s"})
+		if reply, err := read(); err != nil || reply.Op != "result" {
+			t.Fatalf("subscribe %d: got %+v, %v", i, reply, err)
+		}
+	}
+	conn.WriteJSON(wsMessage{Op: "subscribe", Ref: "over", Subscription: "s"})
+	if reply, err := read(); err != nil || reply.Status != http.StatusTooManyRequests || reply.Ref != "over" || reply.RetryAfter < 1 {
+		t.Fatalf("expected 429 with retryAfter, got %+v, %v", reply, err)
+	}
+
+	if status, b := call(t, testAPIKey, http.MethodDelete, "/keys/"+key.ID, ""); status != http.StatusNoContent {
+		t.Fatalf("revoke: status %d %s", status, b)
+	}
+	conn.WriteJSON(wsMessage{Op: "subscribe", Subscription: "s"})
+	_, err = read()
+	if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Fatalf("expected the session of the revoked key to close with 1008, got %v", err)
+	}
+}